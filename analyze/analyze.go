@@ -0,0 +1,428 @@
+package analyze
+
+import (
+	"os"
+	"fmt"
+	"syscall"
+	"strings"
+	"net/url"
+	"net/http"
+	"io/ioutil"
+	"encoding/json"
+	"path/filepath"
+
+	"github.com/seveirbian/gear/pkg"
+	"github.com/seveirbian/gear/types"
+	"github.com/sirupsen/logrus"
+)
+
+var (
+	logger = logrus.WithField("gear", "analyze")
+
+	// upper bounds of the buckets of the size histogram, files not smaller
+	// than the last one are in an unbounded bucket
+	bucketBounds = []int64{1 << 10, 4 << 10, 16 << 10, 64 << 10, 256 << 10, 1 << 20, 4 << 20, 16 << 20, 64 << 20}
+)
+
+const (
+	// a tar entry is a 512 bytes header and the content in 512 bytes blocks
+	tarBlockSize = 512
+
+	// length of a CID in an index image, like sha256:<hex>
+	cidLength = len("sha256:") + 64
+)
+
+// Analyzer collects the files of a set of images, plain images or gear
+// images, and reports how well they dedup and load lazily
+type Analyzer struct {
+	// objects already in storage are found in StoragePath, like the storage
+	// dir of a manager or a files dir of gear build, or by querying the
+	// manager at ManagerIp:ManagerPort
+	StoragePath string
+	ManagerIp   string
+	ManagerPort string
+
+	images []*image
+}
+
+// image is the content of an analyzed image
+type image struct {
+	report ImageReport
+	// objects the regular files are stored as, sizes by cid
+	objects map[string]int64
+	// packed files are in storage as a member of the pack object, by cid
+	packs map[string]string
+}
+
+type inode struct {
+	dev uint64
+	ino uint64
+}
+
+// Report is the report of an image set
+type Report struct {
+	// Storage is what objects were looked up in, empty if they were not
+	Storage string        `json:"storage,omitempty"`
+	Images  []ImageReport `json:"images"`
+	// UniqueBytes is the size of the distinct objects of all the images
+	UniqueBytes int64     `json:"unique_bytes"`
+	StoredBytes int64     `json:"stored_bytes"`
+}
+
+// ImageReport is the report of an image, objects are the whole regular files
+// of plain images and the objects gear stored them as for gear images
+type ImageReport struct {
+	Image string `json:"image"`
+	Gear  bool   `json:"gear"`
+
+	Files    int `json:"files"`
+	Dirs     int `json:"dirs"`
+	Symlinks int `json:"symlinks"`
+	Others   int `json:"others"`
+	// Bytes is the size of the regular files, hardlinks are counted once
+	Bytes     int64    `json:"bytes"`
+	Histogram []Bucket `json:"histogram"`
+
+	// InlineBytes are kept in the index image instead of objects
+	InlineBytes int64 `json:"inline_bytes"`
+	ObjectBytes int64 `json:"object_bytes"`
+	Objects     int   `json:"objects"`
+	// UniqueBytes is the size of the distinct objects of the image
+	UniqueBytes int64 `json:"unique_bytes"`
+	// StoredBytes of the distinct objects are already in storage
+	StoredBytes int64 `json:"stored_bytes"`
+	// SharedBytes of the distinct objects are also in other images of the set
+	SharedBytes int64 `json:"shared_bytes"`
+
+	// IndexBytes is the uncompressed size of the index image, estimated for
+	// plain images as if they were built without packs, chunks and inlining
+	IndexBytes int64 `json:"index_bytes"`
+
+	// StartupFiles and StartupBytes are the regular files in RecordFiles of
+	// -gearmd images, which were accessed at startup
+	Profiled     bool  `json:"profiled"`
+	StartupFiles int   `json:"startup_files,omitempty"`
+	StartupBytes int64 `json:"startup_bytes,omitempty"`
+}
+
+// Bucket counts the regular files smaller than Below, and not smaller than
+// the bound of the previous bucket. The last bucket has no bound.
+type Bucket struct {
+	Below int64 `json:"below,omitempty"`
+	Files int   `json:"files"`
+	Bytes int64 `json:"bytes"`
+}
+
+// AddRootfs analyzes the image whose merged rootfs is at rootfs, images with
+// /.gear/manifest.json are gear images
+func (a *Analyzer) AddRootfs(name, rootfs string) error {
+	img := &image{
+		report:  ImageReport{Image: name},
+		objects: map[string]int64{},
+		packs:   map[string]string{},
+	}
+	for _, bound := range bucketBounds {
+		img.report.Histogram = append(img.report.Histogram, Bucket{Below: bound})
+	}
+	img.report.Histogram = append(img.report.Histogram, Bucket{})
+
+	manifest, err := pkg.ReadManifest(rootfs)
+	switch {
+	case err == pkg.ErrNotGearImage:
+		err = img.addPlainFiles(rootfs)
+	case err == nil && manifest.Version == 0:
+		err = fmt.Errorf("%s is built by older gear without a manifest", name)
+	case err == nil:
+		img.report.Gear = true
+		err = img.addGearFiles(rootfs, manifest)
+	}
+	if err != nil {
+		return err
+	}
+
+	a.images = append(a.images, img)
+
+	return nil
+}
+
+// addPlainFiles hashes the regular files of a plain image, the index image
+// is estimated from the manifest gear build would write
+func (img *image) addPlainFiles(rootfs string) error {
+	files := []types.ManifestFile{}
+	// 硬链接的普通文件只计算一次
+	inodes := map[inode]bool{}
+
+	err := filepath.Walk(rootfs, func(path string, f os.FileInfo, err error) error {
+		if f == nil {
+			return err
+		}
+		name, err := filepath.Rel(rootfs, path)
+		if err != nil || name == "." {
+			return err
+		}
+
+		file := types.ManifestFile{Path: name, Size: f.Size()}
+		img.report.IndexBytes += tarBlockSize
+
+		switch {
+		case f.IsDir():
+			img.report.Dirs++
+		case f.Mode()&os.ModeSymlink != 0:
+			img.report.Symlinks++
+		case f.Mode().IsRegular():
+			if st, ok := f.Sys().(*syscall.Stat_t); ok && st.Nlink > 1 {
+				key := inode{dev: uint64(st.Dev), ino: st.Ino}
+				if inodes[key] {
+					img.report.Files++
+					break
+				}
+				inodes[key] = true
+			}
+
+			file.CID, err = hashFile(path)
+			if err != nil {
+				return err
+			}
+			img.addFile(f.Size())
+			img.addObject(file.CID, f.Size())
+			img.report.IndexBytes += blocks(int64(cidLength))
+		default:
+			img.report.Others++
+		}
+		files = append(files, file)
+
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+
+	manifest, err := json.MarshalIndent(types.Manifest{Version: pkg.ManifestVersion, Files: files}, "", "  ")
+	if err != nil {
+		return err
+	}
+	img.report.IndexBytes += tarBlockSize + blocks(int64(len(manifest)))
+
+	return nil
+}
+
+// addGearFiles reads the files of a gear image from its manifest and the
+// startup profile from RecordFiles, the index image is the rootfs itself
+func (img *image) addGearFiles(rootfs string, manifest *types.Manifest) error {
+	sizes := map[string]int64{}
+
+	for _, file := range manifest.Files {
+		switch file.Mode & syscall.S_IFMT {
+		case syscall.S_IFDIR:
+			img.report.Dirs++
+			continue
+		case syscall.S_IFLNK:
+			img.report.Symlinks++
+			continue
+		case syscall.S_IFREG:
+		default:
+			img.report.Others++
+			continue
+		}
+
+		if file.Link != "" {
+			img.report.Files++
+			continue
+		}
+
+		img.addFile(file.Size)
+		sizes[file.Path] = file.Size
+
+		switch {
+		case file.Inline:
+			img.report.InlineBytes += file.Size
+		case file.Entry != nil && file.Entry.Pack != nil:
+			img.addObject(file.Entry.Pack.CID, file.Entry.Size)
+			img.packs[file.Entry.Pack.CID] = file.Entry.Pack.Pack
+		case file.Entry != nil:
+			for _, chunk := range file.Entry.Chunks {
+				img.addObject(chunk.CID, chunk.Size)
+			}
+		case file.CID != "":
+			img.addObject(file.CID, file.Size)
+		}
+	}
+
+	err := filepath.Walk(rootfs, func(path string, f os.FileInfo, err error) error {
+		if f == nil {
+			return err
+		}
+		if path == rootfs {
+			return nil
+		}
+		img.report.IndexBytes += tarBlockSize
+		if f.Mode().IsRegular() {
+			img.report.IndexBytes += blocks(f.Size())
+		}
+
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+
+	content, err := ioutil.ReadFile(filepath.Join(rootfs, pkg.RecordFilesName))
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+
+	img.report.Profiled = true
+	for _, path := range pkg.ProfilePaths(pkg.ParseRecordFiles(content)) {
+		size, ok := sizes[strings.TrimPrefix(path, "/")]
+		if ok {
+			img.report.StartupFiles++
+			img.report.StartupBytes += size
+		}
+	}
+
+	return nil
+}
+
+func (img *image) addFile(size int64) {
+	img.report.Files++
+	img.report.Bytes += size
+
+	for i := range img.report.Histogram {
+		bucket := &img.report.Histogram[i]
+		if bucket.Below == 0 || size < bucket.Below {
+			bucket.Files++
+			bucket.Bytes += size
+			return
+		}
+	}
+}
+
+func (img *image) addObject(cid string, size int64) {
+	img.report.ObjectBytes += size
+	if _, ok := img.objects[cid]; !ok {
+		img.objects[cid] = size
+		img.report.Objects++
+		img.report.UniqueBytes += size
+	}
+}
+
+// Report reports the images added, objects are looked up in storage if it
+// is set
+func (a *Analyzer) Report() (*Report, error) {
+	report := &Report{Images: []ImageReport{}}
+	switch {
+	case a.StoragePath != "":
+		report.Storage = a.StoragePath
+	case a.ManagerIp != "":
+		report.Storage = a.ManagerIp + ":" + a.ManagerPort
+	}
+
+	// 每个对象属于几个镜像，打包的文件在存储中是pack对象
+	owners := map[string]int{}
+	storedAs := map[string]string{}
+	for _, img := range a.images {
+		for cid := range img.objects {
+			owners[cid]++
+			storedAs[cid] = cid
+		}
+		for cid, pack := range img.packs {
+			storedAs[cid] = pack
+		}
+	}
+
+	stored := map[string]bool{}
+	objects := map[string]bool{}
+	for cid, object := range storedAs {
+		if report.Storage == "" {
+			break
+		}
+		ok, queried := objects[object]
+		if !queried {
+			var err error
+			ok, err = a.inStorage(object)
+			if err != nil {
+				logger.Warnf("Fail to query %s for %v", object, err)
+				return nil, err
+			}
+			objects[object] = ok
+		}
+		stored[cid] = ok
+	}
+
+	counted := map[string]bool{}
+	for _, img := range a.images {
+		for cid, size := range img.objects {
+			if owners[cid] > 1 {
+				img.report.SharedBytes += size
+			}
+			if stored[cid] {
+				img.report.StoredBytes += size
+			}
+
+			if counted[cid] {
+				continue
+			}
+			counted[cid] = true
+			report.UniqueBytes += size
+			if stored[cid] {
+				report.StoredBytes += size
+			}
+		}
+		report.Images = append(report.Images, img.report)
+	}
+
+	return report, nil
+}
+
+// inStorage reports whether the object is in storage
+func (a *Analyzer) inStorage(cid string) (bool, error) {
+	if !pkg.ValidCID(cid) {
+		return false, fmt.Errorf("Invalid cid %s", cid)
+	}
+
+	if a.StoragePath != "" {
+		_, err := os.Lstat(filepath.Join(a.StoragePath, cid))
+		if os.IsNotExist(err) {
+			return false, nil
+		}
+		return err == nil, err
+	}
+
+	resp, err := http.PostForm("http://"+a.ManagerIp+":"+a.ManagerPort+"/query/"+cid, url.Values{})
+	if err != nil {
+		return false, err
+	}
+	defer resp.Body.Close()
+
+	switch resp.StatusCode {
+	case http.StatusOK:
+		return true, nil
+	case http.StatusNotFound:
+		return false, nil
+	default:
+		return false, fmt.Errorf("Unexpected status %s", resp.Status)
+	}
+}
+
+func hashFile(path string) (string, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+
+	d, err := pkg.CIDAlgorithm.FromReader(f)
+	if err != nil {
+		return "", err
+	}
+
+	return d.String(), nil
+}
+
+// blocks is the size of content in a tar file
+func blocks(size int64) int64 {
+	return (size + tarBlockSize - 1) / tarBlockSize * tarBlockSize
+}
@@ -0,0 +1,87 @@
+package analyze
+
+import (
+	"io"
+	"fmt"
+	"text/tabwriter"
+)
+
+// WriteText writes the report as tables
+func (r *Report) WriteText(w io.Writer) error {
+	tw := tabwriter.NewWriter(w, 0, 8, 2, ' ', 0)
+
+	fmt.Fprintln(tw, "IMAGE\tKIND\tFILES\tSIZE\tUNIQUE\tDEDUP\tSTORED\tSHARED\tINDEX\tSTARTUP")
+	for _, img := range r.Images {
+		kind := "plain"
+		if img.Gear {
+			kind = "gear"
+		}
+		stored := "-"
+		if r.Storage != "" {
+			stored = percent(img.StoredBytes, img.UniqueBytes)
+		}
+		startup := "-"
+		if img.Profiled {
+			startup = fmt.Sprintf("%s (%d files)", percent(img.StartupBytes, img.Bytes), img.StartupFiles)
+		}
+
+		fmt.Fprintf(tw, "%s\t%s\t%d\t%s\t%s\t%s\t%s\t%s\t%s\t%s\n",
+			img.Image, kind, img.Files, humanSize(img.Bytes), humanSize(img.UniqueBytes),
+			percent(img.ObjectBytes-img.UniqueBytes, img.ObjectBytes), stored,
+			percent(img.SharedBytes, img.UniqueBytes), humanSize(img.IndexBytes), startup)
+	}
+	err := tw.Flush()
+	if err != nil {
+		return err
+	}
+
+	for _, img := range r.Images {
+		fmt.Fprintf(w, "\n%s: %d dirs, %d symlinks, %d others, %s inline\n", img.Image, img.Dirs, img.Symlinks, img.Others, humanSize(img.InlineBytes))
+		tw := tabwriter.NewWriter(w, 0, 8, 2, ' ', tabwriter.AlignRight)
+		lower := int64(0)
+		for _, bucket := range img.Histogram {
+			if bucket.Files > 0 {
+				bound := ">=" + humanSize(lower)
+				if bucket.Below > 0 {
+					bound = "<" + humanSize(bucket.Below)
+				}
+				fmt.Fprintf(tw, "  %s\t%d files\t%s\t\n", bound, bucket.Files, humanSize(bucket.Bytes))
+			}
+			lower = bucket.Below
+		}
+		err := tw.Flush()
+		if err != nil {
+			return err
+		}
+	}
+
+	stored := ""
+	if r.Storage != "" {
+		stored = fmt.Sprintf(", %s already in %s", percent(r.StoredBytes, r.UniqueBytes), r.Storage)
+	}
+	_, err = fmt.Fprintf(w, "\n%d images, %s of distinct objects%s\n", len(r.Images), humanSize(r.UniqueBytes), stored)
+
+	return err
+}
+
+func percent(part, whole int64) string {
+	if whole == 0 {
+		return "-"
+	}
+	return fmt.Sprintf("%.1f%%", float64(part)*100/float64(whole))
+}
+
+func humanSize(size int64) string {
+	units := []string{"B", "KiB", "MiB", "GiB", "TiB"}
+	value := float64(size)
+	unit := 0
+	for value >= 1024 && unit < len(units)-1 {
+		value /= 1024
+		unit++
+	}
+	if unit == 0 {
+		return fmt.Sprintf("%d%s", size, units[0])
+	}
+
+	return fmt.Sprintf("%.1f%s", value, units[unit])
+}
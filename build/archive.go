@@ -0,0 +1,577 @@
+package build
+
+import (
+	"os"
+	"io"
+	"fmt"
+	"bufio"
+	"errors"
+	"strings"
+	"strconv"
+	"io/ioutil"
+	"archive/tar"
+	"encoding/json"
+	"path/filepath"
+
+	gzip "github.com/klauspost/pgzip"
+	"github.com/klauspost/compress/zstd"
+	"github.com/docker/docker/api/types"
+	"github.com/docker/docker/api/types/container"
+	dockerArchive "github.com/docker/docker/pkg/archive"
+	digest "github.com/opencontainers/go-digest"
+	specs "github.com/opencontainers/image-spec/specs-go/v1"
+	"github.com/seveirbian/gear/registry"
+	"golang.org/x/net/context"
+)
+
+const (
+	// image is read from a running docker daemon using overlay2
+	SourceDaemon = "daemon"
+	// image is read from a tarball created by docker save
+	SourceArchive = "docker-archive"
+	// image is read from an oci image layout dir
+	SourceOCILayout = "oci-layout"
+	// image is pulled from a registry using the distribution v2 api
+	SourceRegistry = "registry"
+)
+
+const (
+	mediaTypeDockerManifest     = "application/vnd.docker.distribution.manifest.v2+json"
+	mediaTypeDockerManifestList = "application/vnd.docker.distribution.manifest.list.v2+json"
+)
+
+// archiveManifest is an entry of manifest.json in a docker-archive tarball
+type archiveManifest struct {
+	Config   string
+	RepoTags []string
+	Layers   []string
+}
+
+// imageConfig is the config json of a docker or oci image. Configs read
+// from an image keep their raw json, which is written back as is except the
+// rootfs, so that fields not in imageConfig, like history, are carried over.
+type imageConfig struct {
+	Architecture string            `json:"architecture"`
+	Variant      string            `json:"variant,omitempty"`
+	Os           string            `json:"os"`
+	OsVersion    string            `json:"os.version,omitempty"`
+	Created      string            `json:"created,omitempty"`
+	Author       string            `json:"author,omitempty"`
+	Config       *container.Config `json:"config"`
+	RootFS       struct {
+		Type    string   `json:"type"`
+		DiffIDs []string `json:"diff_ids"`
+	} `json:"rootfs"`
+
+	raw map[string]json.RawMessage
+}
+
+// plainImageConfig is imageConfig marshaled without its raw json
+type plainImageConfig imageConfig
+
+func (c imageConfig) MarshalJSON() ([]byte, error) {
+	if c.raw == nil {
+		return json.Marshal(plainImageConfig(c))
+	}
+
+	rootfs, err := json.Marshal(c.RootFS)
+	if err != nil {
+		return nil, err
+	}
+	raw := map[string]json.RawMessage{}
+	for key, value := range c.raw {
+		raw[key] = value
+	}
+	raw["rootfs"] = rootfs
+
+	return json.Marshal(raw)
+}
+
+// InitBuilderFromArchive inits a builder which reads the image from a
+// docker-archive tarball (docker save) instead of docker daemon. image
+// selects the image in the tarball, if it is "", the first one is used.
+func InitBuilderFromArchive(archivePath, image, suffix string) (_ *Builder, retErr error) {
+	b := &Builder{
+		Source:     SourceArchive,
+		SourcePath: archivePath,
+		Ctx:        context.Background(),
+	}
+
+	// 1. 读取tarball的文件列表和manifest.json，不解压tarball
+	archive, err := indexArchive(archivePath)
+	if err != nil {
+		logger.Warnf("Fail to read archive for %v", err)
+		return nil, err
+	}
+	b.archive = archive
+	// 出错时删除解压出来的文件
+	defer func() {
+		if retErr != nil && archive.dir != "" {
+			os.RemoveAll(archive.dir)
+		}
+	}()
+
+	var manifests []archiveManifest
+	err = json.Unmarshal(archive.manifest, &manifests)
+	if err != nil {
+		logger.Warnf("Fail to parse manifest.json for %v", err)
+		return nil, err
+	}
+	if len(manifests) == 0 {
+		return nil, errors.New("No image in archive...")
+	}
+
+	// 2. 选择镜像
+	manifest := manifests[0]
+	if image != "" {
+		dImageName, dImageTag := parseImage(image)
+		found := false
+		for _, m := range manifests {
+			if exist(m.RepoTags, dImageName+":"+dImageTag) {
+				manifest = m
+				found = true
+				break
+			}
+		}
+		if !found {
+			return nil, fmt.Errorf("No image %s in archive", image)
+		}
+	} else {
+		if len(manifest.RepoTags) == 0 {
+			return nil, errors.New("No image name in archive, please provide one...")
+		}
+		image = manifest.RepoTags[0]
+	}
+
+	// 3. 压缩的tarball只解压选中镜像的配置和层，读取镜像配置
+	err = archive.extract(append([]string{manifest.Config}, manifest.Layers...))
+	if err != nil {
+		logger.Warnf("Fail to extract archive for %v", err)
+		return nil, err
+	}
+	data, err := archive.readFile(manifest.Config)
+	if err != nil {
+		logger.Warnf("Fail to read image config for %v", err)
+		return nil, err
+	}
+	config, err := parseImageConfig(data)
+	if err != nil {
+		logger.Warnf("Fail to read image config for %v", err)
+		return nil, err
+	}
+
+	b.DLayers = manifest.Layers
+
+	b.DImageName, b.DImageTag = parseImage(image)
+	b.GImageName = b.DImageName + suffix
+	b.GImageTag = b.DImageTag
+	b.DImageInfo = config.imageInspect(strings.TrimSuffix(filepath.Base(manifest.Config), ".json"), image)
+	b.config = config
+
+	err = b.initPaths()
+	if err != nil {
+		return nil, err
+	}
+
+	return b, nil
+}
+
+// InitBuilderFromOCILayout inits a builder which reads the image from an
+// oci image layout dir. image selects the image by its
+// org.opencontainers.image.ref.name annotation, if it is "", the first one
+// is used.
+func InitBuilderFromOCILayout(layoutPath, image, suffix string) (*Builder, error) {
+	return initBuilderFromOCILayout(layoutPath, image, suffix, nil)
+}
+
+// ociLayoutImage returns the descriptor of the image in the oci image layout
+// dir and its name, see InitBuilderFromOCILayout
+func ociLayoutImage(layoutPath, image string) (specs.Descriptor, string, error) {
+	// 1. 读取index.json
+	var index specs.Index
+	err := readJSON(filepath.Join(layoutPath, "index.json"), &index)
+	if err != nil {
+		logger.Warnf("Fail to read index.json for %v", err)
+		return specs.Descriptor{}, "", err
+	}
+	if len(index.Manifests) == 0 {
+		return specs.Descriptor{}, "", errors.New("No image in oci layout...")
+	}
+
+	// 2. 选择镜像
+	desc := index.Manifests[0]
+	if image != "" {
+		_, dImageTag := parseImage(image)
+		found := false
+		for _, m := range index.Manifests {
+			ref := m.Annotations[specs.AnnotationRefName]
+			if ref == image || ref == dImageTag {
+				desc = m
+				found = true
+				break
+			}
+		}
+		if !found {
+			return specs.Descriptor{}, "", fmt.Errorf("No image %s in oci layout", image)
+		}
+	} else {
+		ref := desc.Annotations[specs.AnnotationRefName]
+		// 只有tag的ref name不能作为镜像名
+		if !strings.ContainsAny(ref, "/:") {
+			return specs.Descriptor{}, "", errors.New("No image name in oci layout, please provide one...")
+		}
+		image = ref
+	}
+
+	return desc, image, nil
+}
+
+// ociLayoutFetcher reads blobs of the oci image layout dir
+func ociLayoutFetcher(layoutPath string) func(specs.Descriptor) ([]byte, error) {
+	return func(desc specs.Descriptor) ([]byte, error) {
+		return ioutil.ReadFile(registry.BlobPath(layoutPath, desc.Digest))
+	}
+}
+
+func initBuilderFromOCILayout(layoutPath, image, suffix string, platform *specs.Platform) (*Builder, error) {
+	b := &Builder{
+		Source:     SourceOCILayout,
+		SourcePath: layoutPath,
+		Platform:   platform,
+		Ctx:        context.Background(),
+	}
+
+	desc, image, err := ociLayoutImage(layoutPath, image)
+	if err != nil {
+		return nil, err
+	}
+
+	// 3. 如果是多架构镜像，选择目标平台
+	manifest, err := resolveManifest(desc, b.platform(), ociLayoutFetcher(layoutPath))
+	if err != nil {
+		return nil, err
+	}
+
+	// 4. 读取镜像配置
+	config, err := readImageConfig(registry.BlobPath(layoutPath, manifest.Config.Digest))
+	if err != nil {
+		return nil, err
+	}
+
+	for _, layer := range manifest.Layers {
+		b.DLayers = append(b.DLayers, registry.BlobPath(layoutPath, layer.Digest))
+	}
+
+	b.DImageName, b.DImageTag = parseImage(image)
+	b.GImageName = b.DImageName + suffix
+	b.GImageTag = b.DImageTag
+	b.DImageInfo = config.imageInspect(manifest.Config.Digest.String(), image)
+	b.config = config
+
+	err = b.initPaths()
+	if err != nil {
+		return nil, err
+	}
+
+	return b, nil
+}
+
+// resolveManifest reads the image manifest desc points to with fetch,
+// descending into image indexes by choosing the image of platform
+func resolveManifest(desc specs.Descriptor, platform specs.Platform, fetch func(specs.Descriptor) ([]byte, error)) (*specs.Manifest, error) {
+	for {
+		data, err := fetch(desc)
+		if err != nil {
+			logger.Warnf("Fail to fetch %s for %v", desc.Digest, err)
+			return nil, err
+		}
+
+		switch desc.MediaType {
+		case specs.MediaTypeImageIndex, mediaTypeDockerManifestList:
+			var index specs.Index
+			err := json.Unmarshal(data, &index)
+			if err != nil {
+				logger.Warnf("Fail to parse image index for %v", err)
+				return nil, err
+			}
+
+			found := false
+			for _, m := range index.Manifests {
+				if matchPlatform(m.Platform, platform) {
+					desc = m
+					found = true
+					break
+				}
+			}
+			if !found {
+				return nil, fmt.Errorf("No image for platform %s", PlatformString(platform))
+			}
+		case specs.MediaTypeImageManifest, mediaTypeDockerManifest, "":
+			var manifest specs.Manifest
+			err := json.Unmarshal(data, &manifest)
+			if err != nil {
+				logger.Warnf("Fail to parse image manifest for %v", err)
+				return nil, err
+			}
+			return &manifest, nil
+		default:
+			return nil, fmt.Errorf("Unsupported media type: %s", desc.MediaType)
+		}
+	}
+}
+
+func (b *Builder) applyLayers() (string, func(), error) {
+	// 在构建目录中创建rootfs目录，按顺序将每一层解压到其中
+	rootfs := filepath.Join(b.GearBuildPath, b.GImageName+":"+b.GImageTag, "rootfs")
+	if b.Platform != nil {
+		rootfs = filepath.Join(rootfs, platformDir(*b.Platform))
+	}
+	err := os.RemoveAll(rootfs)
+	if err != nil {
+		logger.Warnf("Fail to remove old rootfs for %v", err)
+		return "", nil, err
+	}
+	err = os.MkdirAll(rootfs, 0755)
+	if err != nil {
+		logger.Warnf("Fail to create rootfs for %v", err)
+		return "", nil, err
+	}
+
+	// 保留层时每一层还要原样解压到单独的目录中
+	layersPath := rootfs + "-layers"
+	err = os.RemoveAll(layersPath)
+	if err != nil {
+		logger.Warnf("Fail to remove old layer dirs for %v", err)
+		return "", nil, err
+	}
+	b.layerDirs = nil
+	if b.KeepLayers {
+		for i := range b.DLayers {
+			b.layerDirs = append(b.layerDirs, filepath.Join(layersPath, strconv.Itoa(i)))
+		}
+	}
+
+	b.layerOf = map[string]int{}
+	for i, layer := range b.DLayers {
+		err := b.applyLayer(rootfs, layer, i)
+		if err != nil {
+			logger.Warnf("Fail to apply layer %s for %v", layer, err)
+			os.RemoveAll(rootfs)
+			os.RemoveAll(layersPath)
+			return "", nil, err
+		}
+	}
+
+	return rootfs, func() {
+		err := os.RemoveAll(rootfs)
+		if err != nil {
+			logger.Warnf("Fail to remove rootfs for %v", err)
+		}
+		os.RemoveAll(layersPath)
+		// 删除从docker-archive解压出来的文件
+		if b.archive != nil && b.archive.dir != "" {
+			os.RemoveAll(b.archive.dir)
+		}
+	}, nil
+}
+
+// applyLayer applies the index-th layer blob, which may be compressed with
+// gzip or zstd, into rootfs, whiteout files are handled. The regular files in
+// the layer are recorded in b.layerOf, and the layer is also extracted as is
+// into b.layerDirs[index] if b.layerDirs is set.
+func (b *Builder) applyLayer(rootfs, layer string, index int) error {
+	f, err := b.openLayer(layer)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	rc, err := decompressStream(f)
+	if err != nil {
+		return err
+	}
+	defer rc.Close()
+
+	// 解压的同时读取层中的文件列表
+	readers := []func(io.Reader) error{
+		func(r io.Reader) error { return b.scanLayer(r, index) },
+	}
+	if b.layerDirs != nil {
+		readers = append(readers, func(r io.Reader) error { return extractLayer(r, b.layerDirs[index]) })
+	}
+
+	pws := []*io.PipeWriter{}
+	writers := []io.Writer{}
+	results := make(chan error, len(readers))
+	for _, read := range readers {
+		pr, pw := io.Pipe()
+		go func(read func(io.Reader) error) {
+			results <- read(pr)
+		}(read)
+		pws = append(pws, pw)
+		writers = append(writers, pw)
+	}
+
+	tee := io.TeeReader(rc, io.MultiWriter(writers...))
+	_, err = dockerArchive.ApplyUncompressedLayer(rootfs, tee, &dockerArchive.TarOptions{})
+	if err == nil {
+		_, err = io.Copy(ioutil.Discard, tee)
+	}
+	for _, pw := range pws {
+		pw.CloseWithError(err)
+	}
+
+	var readErr error
+	for range readers {
+		if e := <-results; readErr == nil {
+			readErr = e
+		}
+	}
+	if err != nil {
+		return err
+	}
+
+	return readErr
+}
+
+// scanLayer records the regular files in the layer tar read from r, r is
+// always read to the end
+func (b *Builder) scanLayer(r io.Reader, index int) error {
+	defer io.Copy(ioutil.Discard, r)
+
+	tr := tar.NewReader(r)
+	for {
+		hd, err := tr.Next()
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+
+		switch hd.Typeflag {
+		case tar.TypeReg, tar.TypeRegA, tar.TypeLink:
+			b.layerOf[filepath.Clean(strings.TrimPrefix(hd.Name, "/"))] = index
+		}
+	}
+}
+
+// openLayer opens a layer in b.DLayers, which is a file path, the digest of
+// the layer blob for images in a registry, or the name of the layer in the
+// tarball for images in a docker-archive
+func (b *Builder) openLayer(layer string) (io.ReadCloser, error) {
+	if b.Source == SourceRegistry {
+		fmt.Println("Pulling layer", layer)
+		return b.registry.GetBlob(b.sourceRepo, digest.Digest(layer))
+	}
+	if b.Source == SourceArchive {
+		return b.archive.open(layer)
+	}
+
+	return os.Open(layer)
+}
+
+// decompressStream detects the compression of r by its magic number
+func decompressStream(r io.Reader) (io.ReadCloser, error) {
+	br := bufio.NewReader(r)
+	magic, _ := br.Peek(4)
+
+	switch {
+	case isGzip(magic):
+		return gzip.NewReader(br)
+	case isZstd(magic):
+		zr, err := zstd.NewReader(br)
+		if err != nil {
+			return nil, err
+		}
+		return zstdReadCloser{zr}, nil
+	}
+
+	return ioutil.NopCloser(br), nil
+}
+
+func isGzip(magic []byte) bool {
+	return len(magic) >= 2 && magic[0] == 0x1f && magic[1] == 0x8b
+}
+
+func isZstd(magic []byte) bool {
+	return len(magic) == 4 && magic[0] == 0x28 && magic[1] == 0xb5 && magic[2] == 0x2f && magic[3] == 0xfd
+}
+
+type zstdReadCloser struct {
+	*zstd.Decoder
+}
+
+func (z zstdReadCloser) Close() error {
+	z.Decoder.Close()
+	return nil
+}
+
+func readImageConfig(path string) (*imageConfig, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		logger.Warnf("Fail to read image config for %v", err)
+		return nil, err
+	}
+
+	config, err := parseImageConfig(data)
+	if err != nil {
+		logger.Warnf("Fail to read image config for %v", err)
+		return nil, err
+	}
+
+	return config, nil
+}
+
+// parseImageConfig parses the config json, keeping the raw json
+func parseImageConfig(data []byte) (*imageConfig, error) {
+	var config imageConfig
+	err := json.Unmarshal(data, (*plainImageConfig)(&config))
+	if err != nil {
+		return nil, err
+	}
+	err = json.Unmarshal(data, &config.raw)
+	if err != nil {
+		return nil, err
+	}
+	if config.Config == nil {
+		config.Config = &container.Config{}
+	}
+
+	return &config, nil
+}
+
+// imageInspect fills the part of docker inspect info used by builder
+func (c *imageConfig) imageInspect(id, image string) types.ImageInspect {
+	return types.ImageInspect{
+		ID:           id,
+		RepoTags:     []string{image},
+		Created:      c.Created,
+		Author:       c.Author,
+		Config:       c.Config,
+		Architecture: c.Architecture,
+		Os:           c.Os,
+		RootFS: types.RootFS{
+			Type:   c.RootFS.Type,
+			Layers: c.RootFS.DiffIDs,
+		},
+	}
+}
+
+func readJSON(path string, v interface{}) error {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return err
+	}
+
+	return json.Unmarshal(data, v)
+}
+
+func exist(set []string, element string) bool {
+	for _, ele := range set {
+		if ele == element {
+			return true
+		}
+	}
+	return false
+}
@@ -2,19 +2,21 @@ package build
 
 import (
 	"fmt"
-	"io"
 	"os"
+	"errors"
 	// "bytes"
+	"sync"
+	"time"
 	"strings"
-	"io/ioutil"
 	// "crypto/md5"
 	"archive/tar"
-	"encoding/json"
 	"path/filepath"
 
-	gzip "github.com/klauspost/pgzip"
 	"github.com/docker/docker/api/types"
+	gtypes "github.com/seveirbian/gear/types"
+	specs "github.com/opencontainers/image-spec/specs-go/v1"
 	"github.com/seveirbian/gear/pkg"
+	"github.com/seveirbian/gear/registry"
 	"github.com/docker/docker/client"
 	"github.com/docker/docker/daemon/graphdriver/overlay2"
 	// "github.com/seveirbian/gear/graphdriver"
@@ -26,19 +28,6 @@ var (
 	logger = logrus.WithField("gear", "build")
 )
 
-type DockerFile struct {
-	FROM       string
-	ENV        []string
-	RUN        []string
-	LABEL      map[string]string
-	EXPOSE     map[string]struct{} // "80/tcp":{}
-	ENTRYPOINT []string
-	VOLUME     map[string]struct{}
-	WORKDIR    string
-	USER       string
-	CMD        []string
-}
-
 type Builder struct {
 	DImageName string
 	DImageTag  string
@@ -47,6 +36,35 @@ type Builder struct {
 
 	DImageInfo types.ImageInspect //docker image infomation got by docker inspect
 
+	// where the source image is read from, SourceDaemon, SourceArchive,
+	// SourceOCILayout or SourceRegistry
+	Source     string
+	SourcePath string
+	// layer blobs of the source image from bottom to top, file paths,
+	// digests or names in the docker-archive, only used when the image is
+	// not read from docker daemon
+	DLayers []string
+	// docker-archive the image is read from
+	archive *archiveIndex
+	// config of the source image read from an archive, a layout or a
+	// registry, nil for images of docker daemon
+	config *imageConfig
+	// registry and repository the image is pulled from
+	registry   *registry.Registry
+	sourceRepo string
+	// Platform of a multi-arch source image to build, nil means the platform
+	// of this machine
+	Platform *specs.Platform
+	// index of the top layer each regular file comes from, and the caches of
+	// the layers
+	layerOf     map[string]int
+	layerCaches []*layerCache
+	cacheMu     sync.Mutex
+	// dirs each source layer is extracted to as is, with its whiteout files,
+	// and the index layers written from them
+	layerDirs   []string
+	indexLayers []string
+
 	GImageName string
 	GImageTag  string
 
@@ -59,7 +77,42 @@ type Builder struct {
 	IrregularFilesPath string
 
 	IrregularFiles map[string]os.FileInfo
-	Dockerfile     DockerFile
+
+	// regular files not smaller than ChunkThreshold are stored as content
+	// defined chunks, 0 disables chunking
+	ChunkThreshold int64
+	// number of workers storing regular files, 0 means the number of cpus
+	Jobs int
+	// memory the workers may use in bytes, 0 means DefaultMemoryLimit
+	MemoryLimit int64
+	// regular files smaller than PackThreshold are stored in pack objects of
+	// at most 1MB, larger files are not packed, 0 disables packing
+	PackThreshold int64
+	// Compression of objects, one of pkg.CompressionNone, CompressionGzip,
+	// CompressionZstd, CompressionSeekable and CompressionAuto, empty means
+	// pkg.DefaultCompression
+	Compression string
+	// Reproducible builds write the same index image for the same source
+	// image on any host at any time
+	Reproducible bool
+	// SourceDateEpoch is the latest mtime in reproducible builds, zero means
+	// the creation time of the source image
+	SourceDateEpoch time.Time
+	// StartupConfigFiles are added to the startup files found from the
+	// entrypoint if the image has them, nil means DefaultStartupConfigFiles
+	StartupConfigFiles []string
+	// NoStartupAnalysis disables writing /.gear/startup
+	NoStartupAnalysis bool
+	// regular files smaller than InlineThreshold or matching InlineInclude
+	// keep their content in the index image, unless they match
+	// InlineExclude, 0 means only InlineInclude
+	InlineThreshold int64
+	InlineInclude   []string
+	InlineExclude   []string
+	// KeepLayers writes an index layer for each layer of the source image
+	// below the layer of the manifest, so that the index layers of a base
+	// image are the same blobs in every gear image built on it
+	KeepLayers bool
 }
 
 func InitBuilder(image, suffix string) (*Builder, error) {
@@ -85,14 +138,43 @@ func InitBuilder(image, suffix string) (*Builder, error) {
 		return nil, err
 	}
 
-	// 5. init build path
+	// 5. get Dimage's lower layer paths and upper layer path
+	var dOverlayID string
+	dOverlayID = imageInfo.GraphDriver.Data["UpperDir"]
+	// dOverlayID = strings.Split(dOverlayID, "/var/lib/docker/overlay2/")[1]
+	dOverlayID = strings.Split(dOverlayID, "/var/lib/docker/overlay2/")[1]
+	dOverlayID = strings.Split(dOverlayID, "/diff")[0]
+
+	b := &Builder{
+		DImageName: dImageName,
+		DImageTag:  dImageTag,
+		DOverlayID: dOverlayID,
+		DImageInfo: imageInfo,
+		Source:     SourceDaemon,
+		GImageName: gImageName,
+		GImageTag:  gImageTag,
+		Ctx:        ctx,
+		Client:     cli,
+	}
+
+	// 6. init build path
+	err = b.initPaths()
+	if err != nil {
+		return nil, err
+	}
+
+	return b, nil
+}
+
+// initPaths creates the dirs used to build b.GImageName:b.GImageTag
+func (b *Builder) initPaths() error {
 	gearPath := "/var/lib/gear/"
-	_, err = os.Stat(gearPath)
+	_, err := os.Stat(gearPath)
 	if err != nil {
 		err = os.MkdirAll(gearPath, os.ModePerm)
 		if err != nil {
 			logger.Warn("Fail to create gearPath...")
-			return nil, err
+			return err
 		}
 	}
 	gearBuildPath := filepath.Join(gearPath, "build")
@@ -101,49 +183,38 @@ func InitBuilder(image, suffix string) (*Builder, error) {
 		err = os.MkdirAll(gearBuildPath, os.ModePerm)
 		if err != nil {
 			logger.Warn("Fail to create gearBuildPath...")
-			return nil, err
+			return err
 		}
 	}
-	regularFilesPath := filepath.Join(gearBuildPath, gImageName + ":" + gImageTag, "files")
+	regularFilesPath := filepath.Join(gearBuildPath, b.GImageName + ":" + b.GImageTag, "files")
 	_, err = os.Stat(regularFilesPath)
 	if err != nil {
 		err = os.MkdirAll(regularFilesPath, os.ModePerm)
 		if err != nil {
 			logger.Warn("Fail to create regularFilesPath...")
-			return nil, err
+			return err
 		}
 	}
-	irregularFilesPath := filepath.Join(gearBuildPath, gImageName + ":" + gImageTag, "build")
+	irregularFilesPath := filepath.Join(gearBuildPath, b.GImageName + ":" + b.GImageTag, "build")
+	if b.Platform != nil {
+		// 多架构镜像的每个平台有自己的index image，普通文件共用files目录
+		irregularFilesPath = filepath.Join(irregularFilesPath, platformDir(*b.Platform))
+	}
 	_, err = os.Stat(irregularFilesPath)
 	if err != nil {
 		err = os.MkdirAll(irregularFilesPath, os.ModePerm)
 		if err != nil {
 			logger.Warn("Fail to create irregularFilesPath...")
-			return nil, err
+			return err
 		}
 	}
 
-	// 6. get Dimage's lower layer paths and upper layer path
-	var dOverlayID string
-	dOverlayID = imageInfo.GraphDriver.Data["UpperDir"]
-	// dOverlayID = strings.Split(dOverlayID, "/var/lib/docker/overlay2/")[1]
-	dOverlayID = strings.Split(dOverlayID, "/var/lib/docker/overlay2/")[1]
-	dOverlayID = strings.Split(dOverlayID, "/diff")[0]
+	b.GearPath = gearPath
+	b.GearBuildPath = gearBuildPath
+	b.RegularFilesPath = regularFilesPath
+	b.IrregularFilesPath = irregularFilesPath
 
-	return &Builder{
-		DImageName:         dImageName,
-		DImageTag:          dImageTag,
-		DOverlayID:         dOverlayID,
-		DImageInfo:         imageInfo,
-		GImageName:         gImageName,
-		GImageTag:          gImageTag,
-		Ctx:                ctx,
-		Client:             cli,
-		GearPath:           gearPath,
-		GearBuildPath:      gearBuildPath,
-		RegularFilesPath:   regularFilesPath,
-		IrregularFilesPath: irregularFilesPath,
-	}, nil
+	return nil
 }
 
 func parseImage(image string) (imageName string, imageTag string) {
@@ -192,41 +263,81 @@ func (b *Builder) Build(recordedFiles, recordedFileNames []string) error {
 		return err
 	}
 
-	// 2. create dockerfile and put it in GearBuildPath/imageID/build/
-	fmt.Println("Creating Dockerfile...")
-	err = b.createDocekrfile()
+	// 2. create the gear index image as an oci image layout in GearBuildPath/imageID/build/oci
+	fmt.Println("Creating gear image...")
+	err = b.createGearImage()
 	if err != nil {
-		logger.Warn("Fail to create gear dockerfile...")
+		logger.Warn("Fail to create gear index image...")
 		return err
 	}
 
-	// 3. build gear image by using docker build cmd
-	fmt.Println("Building gear image...")
-	err = b.buildGearImage()
+	// 没有docker daemon时，只生成files目录和镜像
+	if b.Client == nil {
+		fmt.Println("Gear image is written to", b.IrregularFilesPath)
+		return nil
+	}
+
+	// 3. load gear image into docker daemon
+	fmt.Println("Loading gear image...")
+	err = b.loadGearImage()
 	if err != nil {
-		logger.Warnf("Fail to build gear index image...")
+		logger.Warnf("Fail to load gear index image...")
 		return err
 	}
 
 	return nil
 }
 
-func (b *Builder) tarAndCopy(recordedFiles, recordedFileNames []string) error {
-	// 1. mount lower layer paths and upper layer path using overlayfs
+// mountRootfs returns a dir holding the merged view of the source image's
+// layers and a func to release it after use
+func (b *Builder) mountRootfs() (string, func(), error) {
+	if b.Source != SourceDaemon {
+		return b.applyLayers()
+	}
+
+	// mount lower layer paths and upper layer path using overlayfs
 	driver, err := overlay2.Init("/var/lib/docker/overlay2", []string{}, nil, nil)
 	if err != nil {
 		logger.WithField("err", err).Warn("Fail to create overlay2 driver...")
-		return err
+		return "", nil, err
 	}
 
 	mountPath, err := driver.Get(b.DOverlayID, "")
 	if err != nil {
 		logger.WithField("err", err).Warn("Fail to mount overlayfs...")
+		return "", nil, err
+	}
+
+	return mountPath.Path(), func() { driver.Put(b.DOverlayID) }, nil
+}
+
+// WithRootfs calls fn with a dir holding the merged view of the source
+// image's layers, which is released after fn returns
+func (b *Builder) WithRootfs(fn func(rootfs string) error) error {
+	rootfs, release, err := b.mountRootfs()
+	if err != nil {
+		logger.WithField("err", err).Warn("Fail to get rootfs of image...")
 		return err
 	}
-	defer driver.Put(b.DOverlayID)
+	defer release()
+
+	return fn(rootfs)
+}
+
+func (b *Builder) tarAndCopy(recordedFiles, recordedFileNames []string) error {
+	// 源镜像层只在自己解压镜像层时才能得到
+	if b.KeepLayers && b.Source == SourceDaemon {
+		return errors.New("Keeping layers needs an image read from a docker-archive, an oci layout or a registry")
+	}
 
-	mergedPath := mountPath.Path()
+	// 1. mount lower layer paths and upper layer path using overlayfs, or
+	// apply the layers of an image archive into a scratch dir
+	mergedPath, release, err := b.mountRootfs()
+	if err != nil {
+		logger.WithField("err", err).Warn("Fail to get rootfs of image...")
+		return err
+	}
+	defer release()
 
 	// 2. tar irregular files into /var/lib/gear/build/imageID/build/tmp.tar and
 	// copy regular files to /var/lib/gear/build/imageID/common/
@@ -240,151 +351,62 @@ func (b *Builder) tarAndCopy(recordedFiles, recordedFileNames []string) error {
 	tw := tar.NewWriter(tmpFile)
 	defer tw.Close()
 
-	// 判断是否已经创建了软链接
-	_, err = os.Lstat(filepath.Join(mergedPath, "gear-image"))
-	if err == nil {
-		err := os.Remove(filepath.Join(mergedPath, "gear-image"))
-		if err != nil {
-			logger.Warnf("Fail to remove gear-image symlink for %v", err)
+	// 静态分析镜像启动时读取的文件
+	startupNames := b.startupFiles(mergedPath)
+
+	b.loadLayerCaches()
+	b.removeIndexLayers()
+
+	// 3. 每个源镜像层写入一个索引层，tmp.tar中只有清单，或者所有文件写入tmp.tar
+	var manifestFiles []gtypes.ManifestFile
+	if b.KeepLayers {
+		manifestFiles, err = b.writeIndexLayers(mergedPath)
+	} else {
+		// 小文件打包成pack对象，没有访问记录时启动文件排在最前面
+		packOrder := recordedFileNames
+		if packOrder == nil {
+			packOrder = startupNames
 		}
+		manifestFiles, err = b.writeIndex(tw, mergedPath, packOrder, nil)
 	}
-	err = os.Symlink(b.GImageName+":"+b.GImageTag, filepath.Join(mergedPath, "gear-image"))
 	if err != nil {
-		fmt.Println(err)
-		logger.Warn("Fail to create gear-image file...")
 		return err
 	}
 
-	err = filepath.Walk(mergedPath, func(path string, f os.FileInfo, err error) error {
-		// fail to get file info
-		if f == nil {
-			return err
-		}
-
-		var target string
-
-		// get file's relative path
-		var finalPath string
-		pathSlice := strings.SplitAfter(path, mergedPath)
-		if pathSlice[1] == "" {
-			return nil
-		}
-		for i := 1; i < len(pathSlice); i++ {
-			finalPath += pathSlice[i]
-		}
-		finalPath = strings.TrimPrefix(finalPath, string(filepath.Separator))
-
-		// current file is a regular file
-		if f.Mode().IsRegular() {
-			src, err := os.Open(path)
-			if err != nil {
-				logger.Warnf("Fail to open file for %v", err)
-				return err
-			}
-			defer src.Close()
-
-			hashValue := []byte(pkg.HashAFileInMD5(path))
-
-			_, err = os.Lstat(filepath.Join(b.RegularFilesPath, string(hashValue)))
-			if err != nil {
-				// 创建压缩的普通文件
-				dst, err := os.Create(filepath.Join(b.RegularFilesPath, string(hashValue)))
-				if err != nil {
-					logger.WithField("err", err).Warnf("Fail to create file: %s\n", filepath.Join(b.RegularFilesPath, string(hashValue)))
-					return err
-				}
-				defer dst.Close()
-
-				gw := gzip.NewWriter(dst)
-				defer gw.Close()
-
-				srcContent, err := ioutil.ReadAll(src)
-				if err != nil {
-					logger.Warnf("Fail to read file all for %v", err)
-				}
-
-				_, err = gw.Write(srcContent)
-				if err != nil {
-					logger.Warnf("Fail to write gzip file for %v", err)
-				}
-
-				// 修改文件属性
-				err = os.Chmod(filepath.Join(b.RegularFilesPath, string(hashValue)), f.Mode().Perm())
-				if err != nil {
-					logger.Warnf("Fail to chmod for %v", err)
-				}
-			}
-
-
-			// 将普通文件的内容替换成哈希值
-			hd, err := tar.FileInfoHeader(f, target)
-			if err != nil {
-				logger.Warn("Fail to get file head...")
-				return err
-			}
-
-			hd.Name = finalPath
-
-			hd.Size = int64(len(hashValue))
-
-			// write file header info
-			err = tw.WriteHeader(hd)
-			if err != nil {
-				logger.WithField("err", err).Warn("Fail to write header info")
-				return err
-			}
-
-			_, err = tw.Write(hashValue)
-			if err != nil {
-				logger.WithField("err", err).Warn("Fail to write content...")
-				return err
-			}
-
-			return nil
-		}
-
-		// current file is a symlink
-		if f.Mode()&os.ModeSymlink != 0 {
-			target, err = os.Readlink(path)
-			if err != nil {
-				logger.Warn("Fail to read symlink target...")
-				return err
-			}
-		}
+	// 4. 写入/.gear/manifest.json，记录镜像的格式和每个文件的存储位置
+	err = b.writeManifest(tw, manifestFiles)
+	if err != nil {
+		logger.Warnf("Fail to write gear manifest for %v", err)
+		return err
+	}
 
-		hd, err := tar.FileInfoHeader(f, target)
+	// 5. 写入/.gear/startup，格式与RecordFiles相同
+	startupFiles, startupFileNames := recordedCIDs(startupNames, manifestFiles)
+	if len(startupFiles) > 0 {
+		err = writeGearFile(tw, pkg.StartupFilesPath, []byte(pkg.FormatRecordFiles(startupFileNames, startupFiles)))
 		if err != nil {
-			logger.Warn("Fail to get file head...")
+			logger.Warnf("Fail to write startup files for %v", err)
 			return err
 		}
+	}
 
-		hd.Name = finalPath
-
-		// write file header info
-		err = tw.WriteHeader(hd)
-		if err != nil {
-			logger.WithField("err", err).Warn("Fail to write header info")
-			return err
-		}
-
-		return nil
-	})
-
+	err = b.saveLayerCaches()
 	if err != nil {
-		logger.Warn("Fail to walk layers of image...")
-		return err
+		logger.Warnf("Fail to save layer caches for %v", err)
 	}
 
-	if recordedFiles != nil && recordedFileNames != nil {
+	// 只有文件名的访问记录(gear build --profile)，从本次构建的结果中查找cid
+	if recordedFiles == nil && recordedFileNames != nil {
+		recordedFiles, recordedFileNames = recordedCIDs(recordedFileNames, manifestFiles)
+	}
+
+	if len(recordedFiles) > 0 && len(recordedFileNames) > 0 {
 		content := ""
 
 		if len(recordedFiles) != len(recordedFileNames) {
 			logger.Warnf("Something went error that len(recordedFiles) != len(recordedFileNames)")
 		} else {
-			for i := 0; i < len(recordedFiles) - 1; i++ {
-				content = content+recordedFileNames[i]+" "+recordedFiles[i]+"\n"
-			}
-			content = content+recordedFileNames[len(recordedFiles)-1]+" "+recordedFiles[len(recordedFiles)-1]
+			content = pkg.FormatRecordFiles(recordedFileNames, recordedFiles)
 		}
 
 		_, err := os.Create(filepath.Join(mergedPath, "RecordFiles"))
@@ -405,6 +427,7 @@ func (b *Builder) tarAndCopy(recordedFiles, recordedFileNames []string) error {
 		hd.Name = "/RecordFiles"
 
 		hd.Size = int64(len(content))
+		b.normalizeHeader(hd)
 
 		// write file header info
 		err = tw.WriteHeader(hd)
@@ -428,222 +451,3 @@ func (b *Builder) tarAndCopy(recordedFiles, recordedFileNames []string) error {
 
 	return nil
 }
-
-func (b *Builder) createDocekrfile() error {
-	// 1. fill b.Dockerfile struct
-	b.Dockerfile.FROM = "scratch"
-	b.Dockerfile.ENV = b.DImageInfo.Config.Env
-	b.Dockerfile.LABEL = b.DImageInfo.Config.Labels
-	b.Dockerfile.VOLUME = b.DImageInfo.Config.Volumes
-	b.Dockerfile.WORKDIR = b.DImageInfo.Config.WorkingDir
-	b.Dockerfile.USER = b.DImageInfo.Config.User
-
-	b.Dockerfile.EXPOSE = map[string]struct{}{}
-	exposedPorts := b.DImageInfo.Config.ExposedPorts
-	for key, value := range exposedPorts {
-		b.Dockerfile.EXPOSE[string(key)] = value
-	}
-
-	entryPoints := b.DImageInfo.Config.Entrypoint
-	for _, value := range entryPoints {
-		b.Dockerfile.ENTRYPOINT = append(b.Dockerfile.ENTRYPOINT, string(value))
-	}
-
-	cmds := b.DImageInfo.Config.Cmd
-	for _, value := range cmds {
-		b.Dockerfile.CMD = append(b.Dockerfile.CMD, string(value))
-	}
-
-	// 2. transform b.Dockerfile to []bytes
-	var dockerfile string
-
-	dockerfile = dockerfile + "FROM "
-	dockerfile = dockerfile + b.Dockerfile.FROM
-	dockerfile = dockerfile + "\n"
-
-	for _, env := range b.Dockerfile.ENV {
-		dockerfile = dockerfile + "ENV "
-		envSlices := strings.Split(env, "=")
-		dockerfile = dockerfile + envSlices[0] + " "
-		dockerfile = dockerfile + "\"" + envSlices[1] + "\""
-		dockerfile = dockerfile + "\n"
-	}
-
-	for key, value := range b.Dockerfile.LABEL {
-		dockerfile = dockerfile + "LABEL "
-		dockerfile = dockerfile + key + "=\"" + value + "\""
-		dockerfile = dockerfile + "\n"
-	}
-
-	for key, _ := range b.Dockerfile.VOLUME {
-		dockerfile = dockerfile + "VOLUME "
-		dockerfile = dockerfile + key
-		dockerfile = dockerfile + "\n"
-	}
-
-	if b.Dockerfile.WORKDIR != "" {
-		dockerfile = dockerfile + "WORKDIR "
-		dockerfile = dockerfile + b.Dockerfile.WORKDIR
-		dockerfile = dockerfile + "\n"
-	}
-
-	for key, _ := range b.Dockerfile.EXPOSE {
-		dockerfile = dockerfile + "EXPOSE "
-		dockerfile = dockerfile + strings.Split(key, "/")[0]
-		dockerfile = dockerfile + "\n"
-	}
-
-	if len(b.Dockerfile.ENTRYPOINT) != 0 {
-		dockerfile = dockerfile + "ENTRYPOINT ["
-		for _, entry := range b.Dockerfile.ENTRYPOINT {
-			dockerfile = dockerfile + "\"" + entry + "\", "
-		}
-		dockerfile = strings.TrimSuffix(dockerfile, ", ")
-		dockerfile = dockerfile + "]\n"
-	}
-
-	dockerfile = dockerfile + "ADD "
-	dockerfile = dockerfile + "tmp.tar /"
-	dockerfile = dockerfile + "\n"
-
-	if b.Dockerfile.USER != "" {
-		dockerfile = dockerfile + "USER "
-		dockerfile = dockerfile + b.Dockerfile.USER
-		dockerfile = dockerfile + "\n"
-	}
-
-	if len(b.Dockerfile.CMD) != 0 {
-		dockerfile = dockerfile + "CMD ["
-		for _, cmd := range b.Dockerfile.CMD {
-			dockerfile = dockerfile + "\"" + cmd + "\", "
-		}
-		dockerfile = strings.TrimSuffix(dockerfile, ", ")
-		dockerfile = dockerfile + "]\n"
-	}
-
-	// 3. write to dockerfile in gearBuildPath
-	f, err := os.Create(filepath.Join(b.IrregularFilesPath, "Dockerfile"))
-	if err != nil {
-		logger.Warn("Fail to create Dockerfile...")
-		return err
-	}
-	defer f.Close()
-
-	_, err = f.Write([]byte(dockerfile))
-	if err != nil {
-		logger.Warn("Fail to write to Dockerfile...")
-		return err
-	}
-
-	return nil
-}
-
-func (b *Builder) buildGearImage() error {
-	// 1. create a tarball which contains everything including Dockerfile
-	var files = []string{
-		filepath.Join(b.IrregularFilesPath, "tmp.tar"),
-		filepath.Join(b.IrregularFilesPath, "Dockerfile"),
-	}
-
-	var buildTarPath = filepath.Join(b.IrregularFilesPath, "build.tar")
-	err := archive(files, buildTarPath)
-	if err != nil {
-		logger.Warn("Fail to create build.tar...")
-		return err
-	}
-
-	// 2. open build.tar
-	buildTar, err := os.Open(buildTarPath)
-	if err != nil {
-		logger.Warn("Fail to open build.tar...")
-		return err
-	}
-
-	// 3. init image build options
-	opts := types.ImageBuildOptions{
-		NoCache: true, 
-		Context: buildTar,
-		Tags:    []string{b.GImageName + ":" + b.GImageTag},
-	}
-
-	// 4. start to build
-	buildResp, err := b.Client.ImageBuild(b.Ctx, buildTar, opts)
-	if err != nil {
-		logger.WithField("err", err).Warn("Fail to build...")
-		return err
-	}
-	defer buildResp.Body.Close()
-
-	// following two raws are important, cannot be removed
-	type Message struct {
-		Stream string
-	}
-	decoder := json.NewDecoder(buildResp.Body)
-	for decoder.More() {
-		var m Message
-		err := decoder.Decode(&m)
-		if err != nil {
-			logger.WithField("err", err).Warn("Fail decode build response...")
-			return err
-		}
-		fmt.Print(m.Stream)
-	}
-
-	return nil
-}
-
-func archive(files []string, archivePath string) error {
-	// 1. create a file, which will store the tar data
-	tarFile, err := os.Create(archivePath)
-	if err != nil {
-		logger.WithField("err", err).Warn("Fail to create archive target file...")
-		return err
-	}
-	defer tarFile.Close()
-
-	// 2. create a tar writer on tarFile
-	tw := tar.NewWriter(tarFile)
-	defer tw.Close()
-
-	for _, file := range files {
-		fInfo, err := os.Lstat(file)
-		if err != nil {
-			logger.WithField("err", err).Warn("Fail to get file's info...")
-			return err
-		}
-
-		mode := fInfo.Mode()
-		var target string
-
-		// if this file is a regular file
-		if mode.IsRegular() {
-			// get file header info
-			hd, err := tar.FileInfoHeader(fInfo, target)
-			if err != nil {
-				logger.WithField("err", err).Warn("Fail to get file header...")
-				return err
-			}
-			// write file header info
-			err = tw.WriteHeader(hd)
-			if err != nil {
-				logger.WithField("err", err).Warn("Fail to write file header...")
-				return err
-			}
-			// open file
-			f, err := os.Open(file)
-			if err != nil {
-				logger.WithField("err", err).Warn("Fail to open file...")
-				return err
-			}
-			defer f.Close()
-			// copy to tar file
-			_, err = io.Copy(tw, f)
-			if err != nil {
-				logger.WithField("err", err).Warn("Fail to write tar file...")
-				return err
-			}
-		}
-	}
-
-	return nil
-}
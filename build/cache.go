@@ -0,0 +1,180 @@
+package build
+
+import (
+	"os"
+	"strconv"
+	"io/ioutil"
+	"encoding/json"
+	"path/filepath"
+
+	digest "github.com/opencontainers/go-digest"
+	"github.com/seveirbian/gear/pkg"
+)
+
+// layerCache maps the regular files a source layer introduces to their
+// entries in tmp.tar, the objects of the entries are kept in dir/files. It
+// lets a new tag skip hashing and storing the files of unchanged layers.
+type layerCache struct {
+	dir string
+	// the cache was loaded from dir, otherwise it is filled by this build
+	loaded bool
+
+	Files map[string]cachedFile `json:"files"`
+}
+
+type cachedFile struct {
+	Size  int64  `json:"size"`
+	Entry string `json:"entry"`
+}
+
+// indexName is the name of the cache index, which depends on the options
+// that change the entries
+func (b *Builder) indexName() string {
+	return "index-" + strconv.FormatInt(b.ChunkThreshold, 10) + ".json"
+}
+
+// loadLayerCaches loads the cache of each source layer by its diff id, only
+// images whose layers are applied by the builder are supported
+func (b *Builder) loadLayerCaches() {
+	b.layerCaches = nil
+	if b.Source == SourceDaemon || len(b.DImageInfo.RootFS.Layers) != len(b.DLayers) {
+		return
+	}
+
+	for _, diffID := range b.DImageInfo.RootFS.Layers {
+		d, err := digest.Parse(diffID)
+		if err != nil {
+			b.layerCaches = nil
+			return
+		}
+
+		cache := &layerCache{
+			dir:   filepath.Join(b.GearBuildPath, "layers", d.Algorithm().String()+"-"+d.Hex()),
+			Files: map[string]cachedFile{},
+		}
+		err = readJSON(filepath.Join(cache.dir, b.indexName()), cache)
+		if err == nil {
+			cache.loaded = true
+		}
+		b.layerCaches = append(b.layerCaches, cache)
+	}
+}
+
+// layerCacheOf returns the cache of the layer the regular file comes from
+func (b *Builder) layerCacheOf(item *buildItem) *layerCache {
+	if item.cache != nil {
+		return item.cache
+	}
+	if b.layerCaches == nil {
+		return nil
+	}
+	index, ok := b.layerOf[item.name]
+	if !ok || index >= len(b.layerCaches) {
+		return nil
+	}
+
+	return b.layerCaches[index]
+}
+
+// cachedEntry returns the cached entry of the regular file and links its
+// objects into b.RegularFilesPath
+func (b *Builder) cachedEntry(item *buildItem) ([]byte, bool) {
+	cache := b.layerCacheOf(item)
+	if cache == nil || !cache.loaded {
+		return nil, false
+	}
+
+	file, ok := cache.Files[item.name]
+	if !ok || file.Size != item.info.Size() {
+		return nil, false
+	}
+
+	entry := []byte(file.Entry)
+	for _, cid := range entryCIDs(entry) {
+		err := os.Link(filepath.Join(cache.dir, "files", cid), filepath.Join(b.RegularFilesPath, cid))
+		if err != nil && !os.IsExist(err) {
+			return nil, false
+		}
+	}
+
+	return entry, true
+}
+
+// recordEntry records the entry of the regular file in the cache of its
+// layer, if the cache is not loaded
+func (b *Builder) recordEntry(item *buildItem, entry []byte) {
+	cache := b.layerCacheOf(item)
+	if cache == nil || cache.loaded {
+		return
+	}
+
+	b.cacheMu.Lock()
+	cache.Files[item.name] = cachedFile{
+		Size:  item.info.Size(),
+		Entry: string(entry),
+	}
+	b.cacheMu.Unlock()
+}
+
+// saveLayerCaches saves the caches filled by this build
+func (b *Builder) saveLayerCaches() error {
+	for _, cache := range b.layerCaches {
+		if cache.loaded {
+			continue
+		}
+
+		err := os.MkdirAll(filepath.Join(cache.dir, "files"), os.ModePerm)
+		if err != nil {
+			return err
+		}
+
+		for _, file := range cache.Files {
+			for _, cid := range entryCIDs([]byte(file.Entry)) {
+				err := os.Link(filepath.Join(b.RegularFilesPath, cid), filepath.Join(cache.dir, "files", cid))
+				if err != nil && !os.IsExist(err) {
+					return err
+				}
+			}
+		}
+
+		// 先写入临时文件再重命名，并行的构建不会读到不完整的索引
+		tmp, err := ioutil.TempFile(cache.dir, ".index-")
+		if err != nil {
+			return err
+		}
+		err = json.NewEncoder(tmp).Encode(cache)
+		tmp.Close()
+		if err != nil {
+			os.Remove(tmp.Name())
+			return err
+		}
+		err = os.Rename(tmp.Name(), filepath.Join(cache.dir, b.indexName()))
+		if err != nil {
+			os.Remove(tmp.Name())
+			return err
+		}
+	}
+
+	return nil
+}
+
+// entryCIDs returns the CIDs of the objects an entry in tmp.tar refers to
+func entryCIDs(entry []byte) []string {
+	index, ok, err := pkg.ParseIndexEntry(entry)
+	if err != nil {
+		return nil
+	}
+	if !ok {
+		return []string{string(entry)}
+	}
+
+	cids := []string{}
+	for _, chunk := range index.Chunks {
+		cids = append(cids, chunk.CID)
+	}
+	if index.Pack != nil {
+		cids = append(cids, index.Pack.Pack)
+	}
+
+	return cids
+}
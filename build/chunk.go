@@ -0,0 +1,139 @@
+package build
+
+import (
+	"os"
+	"io"
+	"encoding/json"
+
+	"github.com/seveirbian/gear/pkg"
+	"github.com/seveirbian/gear/types"
+)
+
+const (
+	// FastCDC chunk size limits, chunks are about avgChunkSize long
+	minChunkSize = 128 * 1024
+	avgChunkSize = 512 * 1024
+	maxChunkSize = 2 * 1024 * 1024
+)
+
+var (
+	// before avgChunkSize a cut point needs more zero bits, after it fewer,
+	// which normalizes chunk sizes around avgChunkSize
+	maskS = topBits(21)
+	maskL = topBits(17)
+
+	gearTable = newGearTable()
+)
+
+func topBits(n uint) uint64 {
+	return ((uint64(1) << n) - 1) << (64 - n)
+}
+
+// newGearTable fills the table of the gear rolling hash with splitmix64, so
+// that chunk boundaries are the same across builds and machines
+func newGearTable() [256]uint64 {
+	var table [256]uint64
+	var seed uint64 = 0x6765617263646321
+	for i := range table {
+		seed += 0x9e3779b97f4a7c15
+		z := seed
+		z = (z ^ (z >> 30)) * 0xbf58476d1ce4e5b9
+		z = (z ^ (z >> 27)) * 0x94d049bb133111eb
+		table[i] = z ^ (z >> 31)
+	}
+	return table
+}
+
+// cutPoint returns the length of the first chunk of data
+func cutPoint(data []byte) int {
+	n := len(data)
+	if n <= minChunkSize {
+		return n
+	}
+	if n > maxChunkSize {
+		n = maxChunkSize
+	}
+	normal := avgChunkSize
+	if n < normal {
+		normal = n
+	}
+
+	var fp uint64
+	i := minChunkSize
+	for ; i < normal; i++ {
+		fp = (fp << 1) + gearTable[data[i]]
+		if fp&maskS == 0 {
+			return i
+		}
+	}
+	for ; i < n; i++ {
+		fp = (fp << 1) + gearTable[data[i]]
+		if fp&maskL == 0 {
+			return i
+		}
+	}
+	return n
+}
+
+// chunkFile splits the file at path into content defined chunks, each chunk
+// is passed to fn in order
+func chunkFile(path string, fn func(chunk []byte) error) error {
+	f, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	buf := make([]byte, 2*maxChunkSize)
+	start, end := 0, 0
+	eof := false
+	for {
+		// 保证缓冲区中至少有maxChunkSize的数据
+		if !eof && end-start < maxChunkSize {
+			copy(buf, buf[start:end])
+			end -= start
+			start = 0
+			n, err := io.ReadFull(f, buf[end:])
+			end += n
+			if err == io.EOF || err == io.ErrUnexpectedEOF {
+				eof = true
+			} else if err != nil {
+				return err
+			}
+		}
+		if start == end {
+			return nil
+		}
+
+		n := cutPoint(buf[start:end])
+		err := fn(buf[start : start+n])
+		if err != nil {
+			return err
+		}
+		start += n
+	}
+}
+
+// chunkAndCopy stores the file at path as chunk objects in
+// b.RegularFilesPath and returns the index entry of the file
+func (b *Builder) chunkAndCopy(path string) ([]byte, error) {
+	entry := types.IndexEntry{Algorithm: pkg.CIDAlgorithm.String()}
+
+	err := chunkFile(path, func(chunk []byte) error {
+		cid := pkg.HashBytes(chunk)
+
+		entry.Chunks = append(entry.Chunks, types.Chunk{
+			CID:    cid,
+			Offset: entry.Size,
+			Size:   int64(len(chunk)),
+		})
+		entry.Size += int64(len(chunk))
+
+		return b.writeObject(cid, chunk, 0644)
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return json.Marshal(entry)
+}
@@ -0,0 +1,105 @@
+package build
+
+import (
+	"os"
+	"bytes"
+	"testing"
+	"io/ioutil"
+	"math/rand"
+	"path/filepath"
+
+	"github.com/seveirbian/gear/pkg"
+)
+
+// chunksOf returns the chunks of content cut by chunkFile
+func chunksOf(t *testing.T, content []byte) [][]byte {
+	dir, err := ioutil.TempDir("", "gear-chunk-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	path := filepath.Join(dir, "file")
+	err = ioutil.WriteFile(path, content, 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	chunks := [][]byte{}
+	err = chunkFile(path, func(chunk []byte) error {
+		chunks = append(chunks, append([]byte{}, chunk...))
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return chunks
+}
+
+func randomContent(seed int64, size int) []byte {
+	content := make([]byte, size)
+	rand.New(rand.NewSource(seed)).Read(content)
+	return content
+}
+
+func TestChunkSizes(t *testing.T) {
+	text := bytes.Repeat([]byte("gear builds images whose files are fetched on demand\n"), 200000)
+	tests := []struct {
+		name    string
+		content []byte
+	}{
+		{"empty", nil},
+		{"smaller than min", randomContent(1, minChunkSize-1)},
+		{"min", randomContent(2, minChunkSize)},
+		{"between min and max", randomContent(3, minChunkSize+maxChunkSize/2)},
+		{"random", randomContent(4, 20<<20)},
+		// 没有切分点的内容按maxChunkSize切分
+		{"zeros", make([]byte, 9<<20+123)},
+		{"text", text},
+	}
+
+	for _, test := range tests {
+		chunks := chunksOf(t, test.content)
+		if !bytes.Equal(bytes.Join(chunks, nil), test.content) {
+			t.Fatalf("%s: chunks do not make up the content", test.name)
+		}
+		for i, chunk := range chunks {
+			if len(chunk) > maxChunkSize {
+				t.Fatalf("%s: chunk %d has %d bytes, more than max", test.name, i, len(chunk))
+			}
+			// 只有最后一个块可以小于minChunkSize
+			if i < len(chunks)-1 && len(chunk) < minChunkSize {
+				t.Fatalf("%s: chunk %d has %d bytes, less than min", test.name, i, len(chunk))
+			}
+			if len(chunk) == 0 {
+				t.Fatalf("%s: chunk %d is empty", test.name, i)
+			}
+		}
+	}
+}
+
+func TestCutPointsAreStable(t *testing.T) {
+	content := randomContent(5, 32<<20)
+	before := chunksOf(t, content)
+
+	// 在文件前部插入内容后，插入点之后的块很快与原来的块相同
+	for _, at := range []int{0, 100, 3 << 20} {
+		edited := append(append(append([]byte{}, content[:at]...), []byte("inserted bytes")...), content[at:]...)
+		after := chunksOf(t, edited)
+
+		cids := map[string]bool{}
+		for _, chunk := range before {
+			cids[pkg.HashBytes(chunk)] = true
+		}
+		changed := 0
+		for _, chunk := range after {
+			if !cids[pkg.HashBytes(chunk)] {
+				changed++
+			}
+		}
+		if changed > 2 {
+			t.Fatalf("Insertion at %d changes %d of %d chunks", at, changed, len(after))
+		}
+	}
+}
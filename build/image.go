@@ -0,0 +1,314 @@
+package build
+
+import (
+	"os"
+	"io"
+	"fmt"
+	"io/ioutil"
+	"encoding/json"
+	"path/filepath"
+
+	gzip "github.com/klauspost/pgzip"
+	dockerArchive "github.com/docker/docker/pkg/archive"
+	"github.com/docker/docker/pkg/jsonmessage"
+	digest "github.com/opencontainers/go-digest"
+	imagespec "github.com/opencontainers/image-spec/specs-go"
+	specs "github.com/opencontainers/image-spec/specs-go/v1"
+	"github.com/seveirbian/gear/registry"
+)
+
+// ociManifest is specs.Manifest with the mediaType field, which some
+// registries require
+type ociManifest struct {
+	specs.Manifest
+	MediaType string `json:"mediaType,omitempty"`
+}
+
+// layoutPath is the oci image layout dir of the gear image
+func (b *Builder) layoutPath() string {
+	return filepath.Join(b.IrregularFilesPath, "oci")
+}
+
+// createGearImage writes the gear index image into IrregularFilesPath/oci as
+// an oci image layout, the config is copied from the source image and the
+// layers are the index layers, if any, and tmp.tar on top. The layout also
+// has a manifest.json so that its tarball image.tar can be loaded by docker
+// load.
+func (b *Builder) createGearImage() error {
+	// 镜像配置原样复制源镜像的配置，docker daemon中的镜像只有inspect信息
+	config := imageConfig{
+		Architecture: b.DImageInfo.Architecture,
+		Os:           b.DImageInfo.Os,
+		OsVersion:    b.DImageInfo.OsVersion,
+		Created:      b.DImageInfo.Created,
+		Author:       b.DImageInfo.Author,
+		Config:       b.DImageInfo.Config,
+	}
+	if b.config != nil {
+		config = *b.config
+	}
+
+	tarPaths := append(append([]string{}, b.indexLayers...), filepath.Join(b.IrregularFilesPath, "tmp.tar"))
+	err := writeImageLayout(b.layoutPath(), tarPaths, config, b.GImageName+":"+b.GImageTag, b.platform())
+	if err != nil {
+		return err
+	}
+
+	// 打包成image.tar
+	err = tarLayout(b.layoutPath(), filepath.Join(b.IrregularFilesPath, "image.tar"))
+	if err != nil {
+		logger.Warnf("Fail to write image.tar for %v", err)
+		return err
+	}
+
+	return nil
+}
+
+// writeImageLayout writes an oci image layout of an image named image into
+// layoutPath, the layers are the tar files at tarPaths from bottom to top and
+// the rootfs of config is replaced by them
+func writeImageLayout(layoutPath string, tarPaths []string, config imageConfig, image string, platform specs.Platform) error {
+	err := os.RemoveAll(layoutPath)
+	if err != nil {
+		logger.Warnf("Fail to remove old oci layout for %v", err)
+		return err
+	}
+	err = os.MkdirAll(filepath.Join(layoutPath, "blobs", string(digest.SHA256)), os.ModePerm)
+	if err != nil {
+		logger.Warnf("Fail to create oci layout for %v", err)
+		return err
+	}
+
+	// 1. 压缩tar文件作为镜像层
+	layers := []specs.Descriptor{}
+	diffIDs := []string{}
+	for _, tarPath := range tarPaths {
+		layer, diffID, err := writeLayerBlob(layoutPath, tarPath)
+		if err != nil {
+			logger.Warnf("Fail to write layer blob for %v", err)
+			return err
+		}
+		layers = append(layers, layer)
+		diffIDs = append(diffIDs, diffID.String())
+	}
+
+	// 2. 镜像配置
+	config.RootFS.Type = "layers"
+	config.RootFS.DiffIDs = diffIDs
+
+	configDesc, err := writeJSONBlob(layoutPath, specs.MediaTypeImageConfig, config)
+	if err != nil {
+		logger.Warnf("Fail to write config blob for %v", err)
+		return err
+	}
+
+	// 3. manifest
+	manifest := ociManifest{
+		Manifest: specs.Manifest{
+			Versioned: imagespec.Versioned{SchemaVersion: 2},
+			Config:    configDesc,
+			Layers:    layers,
+		},
+		MediaType: specs.MediaTypeImageManifest,
+	}
+	manifestDesc, err := writeJSONBlob(layoutPath, specs.MediaTypeImageManifest, manifest)
+	if err != nil {
+		logger.Warnf("Fail to write manifest blob for %v", err)
+		return err
+	}
+	manifestDesc.Annotations = map[string]string{
+		specs.AnnotationRefName: image,
+	}
+	manifestDesc.Platform = &platform
+
+	// 4. index.json和oci-layout
+	index := specs.Index{
+		Versioned: imagespec.Versioned{SchemaVersion: 2},
+		Manifests: []specs.Descriptor{manifestDesc},
+	}
+	err = writeJSON(filepath.Join(layoutPath, "index.json"), index)
+	if err != nil {
+		logger.Warnf("Fail to write index.json for %v", err)
+		return err
+	}
+	err = writeJSON(filepath.Join(layoutPath, specs.ImageLayoutFile), specs.ImageLayout{Version: specs.ImageLayoutVersion})
+	if err != nil {
+		logger.Warnf("Fail to write oci-layout for %v", err)
+		return err
+	}
+
+	// 5. docker load使用的manifest.json
+	loadManifest := []archiveManifest{{
+		Config:   filepath.Join("blobs", configDesc.Digest.Algorithm().String(), configDesc.Digest.Hex()),
+		RepoTags: []string{image},
+	}}
+	for _, layer := range layers {
+		loadManifest[0].Layers = append(loadManifest[0].Layers, filepath.Join("blobs", layer.Digest.Algorithm().String(), layer.Digest.Hex()))
+	}
+	err = writeJSON(filepath.Join(layoutPath, "manifest.json"), loadManifest)
+	if err != nil {
+		logger.Warnf("Fail to write manifest.json for %v", err)
+		return err
+	}
+
+	return nil
+}
+
+// tarLayout tars the oci image layout dir into a tarball, which can also be
+// loaded by docker load
+func tarLayout(layoutPath, tarPath string) error {
+	rc, err := dockerArchive.Tar(layoutPath, dockerArchive.Uncompressed)
+	if err != nil {
+		return err
+	}
+	defer rc.Close()
+
+	f, err := os.Create(tarPath)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	_, err = io.Copy(f, rc)
+	if err != nil {
+		return err
+	}
+
+	return f.Close()
+}
+
+// loadGearImage loads image.tar into docker daemon
+func (b *Builder) loadGearImage() error {
+	imageTar, err := os.Open(filepath.Join(b.IrregularFilesPath, "image.tar"))
+	if err != nil {
+		logger.Warnf("Fail to open image.tar for %v", err)
+		return err
+	}
+	defer imageTar.Close()
+
+	resp, err := b.Client.ImageLoad(b.Ctx, imageTar, true)
+	if err != nil {
+		logger.WithField("err", err).Warn("Fail to load gear image...")
+		return err
+	}
+	defer resp.Body.Close()
+
+	decoder := json.NewDecoder(resp.Body)
+	for decoder.More() {
+		var m jsonmessage.JSONMessage
+		err := decoder.Decode(&m)
+		if err != nil {
+			logger.WithField("err", err).Warn("Fail decode load response...")
+			return err
+		}
+		if m.Error != nil {
+			return m.Error
+		}
+		fmt.Print(m.Stream)
+	}
+
+	return nil
+}
+
+// PushGearImage pushes the built gear image to the registry in its name
+// without docker daemon
+func (b *Builder) PushGearImage() error {
+	host, repo := registry.SplitImage(b.GImageName)
+	if host == "" {
+		return fmt.Errorf("No registry in image name: %s", b.GImageName)
+	}
+
+	fmt.Printf("Pushing %s:%s\n", b.GImageName, b.GImageTag)
+	err := registry.Init(host).PushOCILayout(b.layoutPath(), repo, b.GImageTag)
+	if err != nil {
+		logger.Warnf("Fail to push gear image for %v", err)
+		return err
+	}
+
+	return nil
+}
+
+// writeLayerBlob gzips the tar file into a blob of the oci layout and
+// returns its descriptor and diff id
+func writeLayerBlob(layoutPath, tarPath string) (specs.Descriptor, digest.Digest, error) {
+	src, err := os.Open(tarPath)
+	if err != nil {
+		return specs.Descriptor{}, "", err
+	}
+	defer src.Close()
+
+	tmp, err := ioutil.TempFile(filepath.Join(layoutPath, "blobs"), "layer-")
+	if err != nil {
+		return specs.Descriptor{}, "", err
+	}
+	defer os.Remove(tmp.Name())
+	defer tmp.Close()
+
+	// 同时计算压缩前和压缩后内容的摘要
+	compressed := digest.SHA256.Digester()
+	counter := &countWriter{}
+	gw := gzip.NewWriter(io.MultiWriter(tmp, compressed.Hash(), counter))
+
+	uncompressed := digest.SHA256.Digester()
+	_, err = io.Copy(io.MultiWriter(gw, uncompressed.Hash()), src)
+	if err != nil {
+		return specs.Descriptor{}, "", err
+	}
+	err = gw.Close()
+	if err != nil {
+		return specs.Descriptor{}, "", err
+	}
+	err = tmp.Close()
+	if err != nil {
+		return specs.Descriptor{}, "", err
+	}
+
+	desc := specs.Descriptor{
+		MediaType: specs.MediaTypeImageLayerGzip,
+		Digest:    compressed.Digest(),
+		Size:      counter.n,
+	}
+	err = os.Rename(tmp.Name(), registry.BlobPath(layoutPath, desc.Digest))
+	if err != nil {
+		return specs.Descriptor{}, "", err
+	}
+
+	return desc, uncompressed.Digest(), nil
+}
+
+func writeJSONBlob(layoutPath, mediaType string, v interface{}) (specs.Descriptor, error) {
+	data, err := json.Marshal(v)
+	if err != nil {
+		return specs.Descriptor{}, err
+	}
+
+	desc := specs.Descriptor{
+		MediaType: mediaType,
+		Digest:    digest.FromBytes(data),
+		Size:      int64(len(data)),
+	}
+	err = ioutil.WriteFile(registry.BlobPath(layoutPath, desc.Digest), data, 0644)
+	if err != nil {
+		return specs.Descriptor{}, err
+	}
+
+	return desc, nil
+}
+
+func writeJSON(path string, v interface{}) error {
+	data, err := json.Marshal(v)
+	if err != nil {
+		return err
+	}
+
+	return ioutil.WriteFile(path, data, 0644)
+}
+
+type countWriter struct {
+	n int64
+}
+
+func (c *countWriter) Write(p []byte) (int, error) {
+	c.n += int64(len(p))
+	return len(p), nil
+}
@@ -0,0 +1,56 @@
+package build
+
+import (
+	"os"
+	"fmt"
+	"strings"
+	"path/filepath"
+)
+
+// inlineFile reports whether the regular file keeps its content in the index
+// image instead of being stored as objects, which saves a round trip to the
+// storage for small files. Exclude globs win over include globs and the
+// threshold.
+func (b *Builder) inlineFile(name string, info os.FileInfo) bool {
+	if !info.Mode().IsRegular() {
+		return false
+	}
+
+	name = "/" + name
+	if matchGlobs(b.InlineExclude, name) {
+		return false
+	}
+	if matchGlobs(b.InlineInclude, name) {
+		return true
+	}
+
+	return info.Size() < b.InlineThreshold
+}
+
+// matchGlobs reports whether the path matches one of the patterns, patterns
+// without "/" are matched against the base name like in .gitignore
+func matchGlobs(patterns []string, name string) bool {
+	for _, pattern := range patterns {
+		target := name
+		if !strings.Contains(pattern, "/") {
+			target = filepath.Base(name)
+		}
+		if ok, _ := filepath.Match(pattern, target); ok {
+			return true
+		}
+	}
+
+	return false
+}
+
+// CheckGlobs returns an error for the first malformed pattern
+func CheckGlobs(patterns []string) error {
+	for _, pattern := range patterns {
+		_, err := filepath.Match(pattern, "")
+		if err != nil {
+			return fmt.Errorf("Invalid pattern %s: %v", pattern, err)
+		}
+	}
+
+	return nil
+}
@@ -0,0 +1,273 @@
+package build
+
+import (
+	"os"
+	"io"
+	"fmt"
+	"strings"
+	"strconv"
+	"io/ioutil"
+	"archive/tar"
+	"encoding/json"
+	"path/filepath"
+
+	dockerArchive "github.com/docker/docker/pkg/archive"
+	"github.com/seveirbian/gear/pkg"
+	"github.com/seveirbian/gear/types"
+)
+
+// ManifestPaths returns the paths of the copies of the manifest and of the
+// manifests of the index layers, the pusher reads them to find the objects
+// of the image
+func (b *Builder) ManifestPaths() []string {
+	paths := []string{b.ManifestPath()}
+	for i := range b.indexLayers {
+		paths = append(paths, b.layerManifestPath(i))
+	}
+
+	return paths
+}
+
+func (b *Builder) layerManifestPath(index int) string {
+	return filepath.Join(b.IrregularFilesPath, "gear-layer-"+strconv.Itoa(index)+".json")
+}
+
+// removeIndexLayers removes the index layers and their manifests left by
+// an earlier build
+func (b *Builder) removeIndexLayers() {
+	b.indexLayers = nil
+	for _, pattern := range []string{"layer-*.tar", "gear-layer-*.json"} {
+		paths, _ := filepath.Glob(filepath.Join(b.IrregularFilesPath, pattern))
+		for _, path := range paths {
+			os.Remove(path)
+		}
+	}
+}
+
+// writeIndex writes the files under rootfs into tw, regular files are stored
+// as objects, packs or chunks by workers and written in walk order. Regular
+// files of the source layer with the given cache are cached in it, a nil
+// cache means the cache of the top layer a file comes from. It returns the
+// manifest of the files.
+func (b *Builder) writeIndex(tw *tar.Writer, rootfs string, packOrder []string, cache *layerCache) ([]types.ManifestFile, error) {
+	packMembers, err := b.packFiles(rootfs, packOrder)
+	if err != nil {
+		logger.Warnf("Fail to pack small files for %v", err)
+		return nil, err
+	}
+
+	// walker按顺序遍历文件，worker并行存储普通文件，按遍历顺序写入tar
+	items := make(chan *buildItem, 1024)
+	jobs := make(chan *buildItem, b.jobs())
+	abort := make(chan struct{})
+
+	walkErr := make(chan error, 1)
+	go func() {
+		walkErr <- walkRootfs(rootfs, items, jobs, abort, func(item *buildItem) bool {
+			if !item.info.Mode().IsRegular() {
+				return false
+			}
+			// 索引层中的whiteout文件原样写入，由overlay2转换
+			if strings.HasPrefix(filepath.Base(item.name), dockerArchive.WhiteoutPrefix) {
+				return false
+			}
+			// 小文件和指定的文件直接保存在索引中
+			if b.inlineFile(item.name, item.info) {
+				item.inline = true
+				return false
+			}
+			// 小文件存储在pack中，索引中记录pack和偏移
+			if member, ok := packMembers[item.name]; ok {
+				item.entry, item.err = packEntry(member, item.info.Size())
+				return false
+			}
+			item.cache = cache
+			return true
+		})
+	}()
+
+	b.storeFiles(jobs, abort, b.storeFile)
+
+	manifestFiles := []types.ManifestFile{}
+	for item := range items {
+		<-item.done
+		if err != nil {
+			continue
+		}
+
+		err = item.err
+		if err == nil {
+			err = b.writeItem(tw, item)
+		}
+		if err != nil {
+			close(abort)
+			continue
+		}
+		manifestFiles = append(manifestFiles, manifestFile(item))
+	}
+	if e := <-walkErr; err == nil {
+		err = e
+	}
+
+	if err != nil {
+		logger.Warn("Fail to walk layers of image...")
+		return nil, err
+	}
+
+	return manifestFiles, nil
+}
+
+// writeIndexLayers writes an index layer for each source layer extracted
+// into b.layerDirs, whiteout files are kept so that overlay2 stacks the index
+// layers like the source layers. It returns the manifest of the merged
+// rootfs, whose regular files refer to the entries in the index layers.
+func (b *Builder) writeIndexLayers(mergedPath string) ([]types.ManifestFile, error) {
+	layerFiles := []map[string]types.ManifestFile{}
+
+	for i, dir := range b.layerDirs {
+		fmt.Println("Writing index layer", i)
+
+		var cache *layerCache
+		if i < len(b.layerCaches) {
+			cache = b.layerCaches[i]
+		}
+
+		files, err := b.writeIndexLayer(i, dir, cache)
+		if err != nil {
+			logger.Warnf("Fail to write index layer %d for %v", i, err)
+			return nil, err
+		}
+
+		byPath := map[string]types.ManifestFile{}
+		for _, file := range files {
+			byPath[file.Path] = file
+		}
+		layerFiles = append(layerFiles, byPath)
+	}
+
+	return b.mergedManifestFiles(mergedPath, layerFiles)
+}
+
+// writeIndexLayer writes the index-th index layer from the source layer
+// extracted into dir, with the manifest of its files at
+// pkg.LayerManifestPath
+func (b *Builder) writeIndexLayer(index int, dir string, cache *layerCache) ([]types.ManifestFile, error) {
+	path := filepath.Join(b.IrregularFilesPath, "layer-"+strconv.Itoa(index)+".tar")
+	f, err := os.Create(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	tw := tar.NewWriter(f)
+
+	files, err := b.writeIndex(tw, dir, nil, cache)
+	if err != nil {
+		return nil, err
+	}
+
+	// 索引层的清单不含镜像名，同一个源镜像层的索引层在各个gear镜像中相同
+	content, err := json.MarshalIndent(types.Manifest{
+		Version:     pkg.ManifestVersion,
+		Algorithm:   pkg.CIDAlgorithm.String(),
+		Compression: b.compression(),
+		Files:       files,
+	}, "", "  ")
+	if err != nil {
+		return nil, err
+	}
+	err = writeGearDir(tw)
+	if err != nil {
+		return nil, err
+	}
+	err = writeGearFile(tw, pkg.LayerManifestPath, content)
+	if err != nil {
+		return nil, err
+	}
+	err = ioutil.WriteFile(b.layerManifestPath(index), content, 0644)
+	if err != nil {
+		return nil, err
+	}
+
+	err = tw.Close()
+	if err != nil {
+		return nil, err
+	}
+	b.indexLayers = append(b.indexLayers, path)
+
+	return files, f.Close()
+}
+
+// mergedManifestFiles returns the manifest of the merged rootfs, the entry
+// of a regular file is taken from the top layer it comes from
+func (b *Builder) mergedManifestFiles(mergedPath string, layerFiles []map[string]types.ManifestFile) ([]types.ManifestFile, error) {
+	items := make(chan *buildItem, 1024)
+	jobs := make(chan *buildItem)
+	abort := make(chan struct{})
+
+	walkErr := make(chan error, 1)
+	go func() {
+		walkErr <- walkRootfs(mergedPath, items, jobs, abort, func(item *buildItem) bool {
+			return false
+		})
+	}()
+
+	var err error
+	manifestFiles := []types.ManifestFile{}
+	for item := range items {
+		if err != nil {
+			continue
+		}
+
+		file := manifestFile(item)
+		if item.info.Mode().IsRegular() && !item.hardlink {
+			err = copyLayerEntry(&file, layerFiles, b.layerOf[item.name])
+			if err != nil {
+				close(abort)
+				continue
+			}
+		}
+		manifestFiles = append(manifestFiles, file)
+	}
+	if e := <-walkErr; err == nil {
+		err = e
+	}
+
+	return manifestFiles, err
+}
+
+// copyLayerEntry copies where the content of the regular file is stored from
+// the manifest of the index-th index layer
+func copyLayerEntry(file *types.ManifestFile, layerFiles []map[string]types.ManifestFile, index int) error {
+	if index >= len(layerFiles) {
+		return fmt.Errorf("No index layer of %s", file.Path)
+	}
+
+	layerFile, ok := layerFiles[index][file.Path]
+	// 层中第一个文件名被上层删除的硬链接
+	if ok && layerFile.Link != "" {
+		layerFile, ok = layerFiles[index][layerFile.Link]
+	}
+	if !ok {
+		return fmt.Errorf("No entry of %s in index layer %d", file.Path, index)
+	}
+
+	file.Inline = layerFile.Inline
+	file.CID = layerFile.CID
+	file.Entry = layerFile.Entry
+
+	return nil
+}
+
+// extractLayer extracts the layer tar read from r into dir as is, whiteout
+// files are not applied, r is always read to the end
+func extractLayer(r io.Reader, dir string) error {
+	defer io.Copy(ioutil.Discard, r)
+
+	err := os.MkdirAll(dir, 0755)
+	if err != nil {
+		return err
+	}
+
+	return dockerArchive.Unpack(r, dir, &dockerArchive.TarOptions{})
+}
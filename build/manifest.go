@@ -0,0 +1,119 @@
+package build
+
+import (
+	"time"
+	"syscall"
+	"io/ioutil"
+	"archive/tar"
+	"encoding/json"
+	"path/filepath"
+
+	digest "github.com/opencontainers/go-digest"
+	"github.com/seveirbian/gear/pkg"
+	"github.com/seveirbian/gear/types"
+)
+
+// ManifestPath is where a copy of the manifest of the gear image is kept
+// after build, the pusher reads it to find the objects of the image
+func (b *Builder) ManifestPath() string {
+	return filepath.Join(b.IrregularFilesPath, "gear-manifest.json")
+}
+
+// manifestFile describes the item in the manifest
+func manifestFile(item *buildItem) types.ManifestFile {
+	file := types.ManifestFile{
+		Path: item.name,
+		Link: item.link,
+		Inline: item.inline,
+	}
+	// 目录和符号链接的大小没有意义，只记录普通文件的大小
+	if item.info.Mode().IsRegular() {
+		file.Size = item.info.Size()
+	}
+	if st, ok := item.info.Sys().(*syscall.Stat_t); ok {
+		file.Mode = st.Mode
+	}
+	if item.hardlink || item.inline || item.entry == nil {
+		return file
+	}
+
+	entry, ok, err := pkg.ParseIndexEntry(item.entry)
+	if err == nil && ok {
+		file.Entry = entry
+	} else {
+		file.CID = string(item.entry)
+	}
+
+	return file
+}
+
+// sourceDigest returns the digest of the source image, or "" if the image id
+// is not a digest
+func (b *Builder) sourceDigest() string {
+	id := b.DImageInfo.ID
+	if _, err := digest.Parse(id); err == nil {
+		return id
+	}
+	// docker-archive中的配置文件以不带算法的哈希命名
+	if d := digest.NewDigestFromHex(digest.SHA256.String(), id); d.Validate() == nil {
+		return d.String()
+	}
+
+	return ""
+}
+
+// writeManifest writes the manifest of the files into tmp.tar as
+// /.gear/manifest.json, and keeps a copy at b.ManifestPath()
+func (b *Builder) writeManifest(tw *tar.Writer, files []types.ManifestFile) error {
+	content, err := json.MarshalIndent(types.Manifest{
+		Version:     pkg.ManifestVersion,
+		Image:       b.GImageName + ":" + b.GImageTag,
+		Source:      b.sourceDigest(),
+		Platform:    PlatformString(b.platform()),
+		Algorithm:   pkg.CIDAlgorithm.String(),
+		Compression: b.compression(),
+		Layers:      len(b.indexLayers),
+		Files:       files,
+	}, "", "  ")
+	if err != nil {
+		return err
+	}
+
+	err = writeGearDir(tw)
+	if err != nil {
+		return err
+	}
+	err = writeGearFile(tw, pkg.ManifestPath, content)
+	if err != nil {
+		return err
+	}
+
+	return ioutil.WriteFile(b.ManifestPath(), content, 0644)
+}
+
+// writeGearDir writes the dir of the files generated by gear into tmp.tar
+func writeGearDir(tw *tar.Writer) error {
+	return tw.WriteHeader(&tar.Header{
+		Typeflag: tar.TypeDir,
+		Name:     pkg.ManifestDir + "/",
+		Mode:     0755,
+		ModTime:  time.Unix(0, 0),
+	})
+}
+
+// writeGearFile writes a file generated by gear into tmp.tar
+func writeGearFile(tw *tar.Writer, name string, content []byte) error {
+	err := tw.WriteHeader(&tar.Header{
+		Typeflag: tar.TypeReg,
+		Name:     name,
+		Mode:     0644,
+		Size:     int64(len(content)),
+		ModTime:  time.Unix(0, 0),
+	})
+	if err != nil {
+		return err
+	}
+	_, err = tw.Write(content)
+
+	return err
+}
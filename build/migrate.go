@@ -0,0 +1,149 @@
+package build
+
+import (
+	"os"
+	"io"
+	"fmt"
+	"errors"
+	"io/ioutil"
+	"archive/tar"
+	"encoding/json"
+	"path/filepath"
+
+	"github.com/seveirbian/gear/pkg"
+)
+
+// MigrateCIDs rewrites the legacy md5 CIDs in the gear index image of b into
+// new CIDs given by resolve, and writes the result as a new gear index image
+// like Build does. b is usually inited by InitBuilderFromRegistry with the
+// gear image itself and an empty suffix, so that PushGearImage replaces it.
+func (b *Builder) MigrateCIDs(resolve func(cid string) (string, error)) error {
+	if len(b.DLayers) != 1 {
+		return errors.New("A gear index image should have exactly one layer")
+	}
+
+	f, err := b.openLayer(b.DLayers[0])
+	if err != nil {
+		logger.Warnf("Fail to open layer for %v", err)
+		return err
+	}
+	defer f.Close()
+
+	rc, err := decompressStream(f)
+	if err != nil {
+		return err
+	}
+	defer rc.Close()
+
+	tmpFile, err := os.Create(filepath.Join(b.IrregularFilesPath, "tmp.tar"))
+	if err != nil {
+		logger.Warnf("Fail to create tmp.tar for %v", err)
+		return err
+	}
+	defer tmpFile.Close()
+
+	tw := tar.NewWriter(tmpFile)
+	tr := tar.NewReader(rc)
+	migrated := 0
+	for {
+		hd, err := tr.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return err
+		}
+
+		if hd.Typeflag != tar.TypeReg && hd.Typeflag != tar.TypeRegA {
+			err = tw.WriteHeader(hd)
+			if err != nil {
+				return err
+			}
+			_, err = io.Copy(tw, tr)
+			if err != nil {
+				return err
+			}
+			continue
+		}
+
+		// 普通文件的内容是cid或者分块列表
+		content, err := ioutil.ReadAll(tr)
+		if err != nil {
+			return err
+		}
+		content, changed, err := migrateIndexContent(content, resolve)
+		if err != nil {
+			logger.Warnf("Fail to migrate %s for %v", hd.Name, err)
+			return err
+		}
+		if changed {
+			migrated++
+		}
+
+		hd.Size = int64(len(content))
+		err = tw.WriteHeader(hd)
+		if err != nil {
+			return err
+		}
+		_, err = tw.Write(content)
+		if err != nil {
+			return err
+		}
+	}
+	err = tw.Close()
+	if err != nil {
+		return err
+	}
+	fmt.Printf("Migrated %d files\n", migrated)
+
+	err = b.createGearImage()
+	if err != nil {
+		logger.Warn("Fail to create gear index image...")
+		return err
+	}
+
+	fmt.Println("Gear image is written to", b.IrregularFilesPath)
+
+	return nil
+}
+
+// migrateIndexContent maps the legacy CIDs in the content of a regular file
+// in a gear index image
+func migrateIndexContent(content []byte, resolve func(cid string) (string, error)) ([]byte, bool, error) {
+	entry, chunked, err := pkg.ParseIndexEntry(content)
+	if err != nil {
+		return nil, false, err
+	}
+
+	if !chunked {
+		if !pkg.IsLegacyCID(string(content)) {
+			return content, false, nil
+		}
+		cid, err := resolve(string(content))
+		if err != nil {
+			return nil, false, err
+		}
+		return []byte(cid), true, nil
+	}
+
+	changed := false
+	for i, chunk := range entry.Chunks {
+		if !pkg.IsLegacyCID(chunk.CID) {
+			continue
+		}
+		cid, err := resolve(chunk.CID)
+		if err != nil {
+			return nil, false, err
+		}
+		entry.Chunks[i].CID = cid
+		changed = true
+	}
+	if !changed {
+		return content, false, nil
+	}
+	entry.Algorithm = pkg.CIDAlgorithm.String()
+
+	content, err = json.Marshal(entry)
+
+	return content, true, err
+}
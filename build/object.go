@@ -0,0 +1,95 @@
+package build
+
+import (
+	"io"
+	"os"
+	"bytes"
+	"bufio"
+	"io/ioutil"
+	"path/filepath"
+
+	"github.com/seveirbian/gear/pkg"
+)
+
+const (
+	// buffer used to stream a file into an object
+	streamBufferSize = 256 * 1024
+)
+
+func (b *Builder) compression() string {
+	if b.Compression == "" {
+		return pkg.DefaultCompression
+	}
+	return b.Compression
+}
+
+// writeObject stores content as the object cid in b.RegularFilesPath,
+// objects which already exist are skipped
+func (b *Builder) writeObject(cid string, content []byte, perm os.FileMode) error {
+	// 相同内容的对象只存一份
+	_, err := os.Lstat(filepath.Join(b.RegularFilesPath, cid))
+	if err == nil {
+		return nil
+	}
+
+	_, err = b.storeObject(bytes.NewReader(content), perm)
+
+	return err
+}
+
+// copyObject streams the file at path into an object in b.RegularFilesPath
+// and returns its CID
+func (b *Builder) copyObject(path string, perm os.FileMode) (string, error) {
+	src, err := os.Open(path)
+	if err != nil {
+		return "", err
+	}
+	defer src.Close()
+
+	return b.storeObject(src, perm)
+}
+
+// storeObject compresses the content of r into an object with b.Compression
+// while hashing it, and returns its CID. The content is never held in memory
+// as a whole.
+func (b *Builder) storeObject(r io.Reader, perm os.FileMode) (string, error) {
+	br := bufio.NewReaderSize(r, streamBufferSize)
+	sample, _ := br.Peek(pkg.AutoSampleSize)
+	compression := pkg.ChooseCompression(b.compression(), sample)
+
+	// 先写入临时文件，完成后再按cid重命名，避免留下不完整的对象
+	dst, err := ioutil.TempFile(b.RegularFilesPath, ".object-")
+	if err != nil {
+		return "", err
+	}
+	defer os.Remove(dst.Name())
+	defer dst.Close()
+
+	w, err := pkg.NewObjectWriter(dst, compression)
+	if err != nil {
+		return "", err
+	}
+	digester := pkg.CIDAlgorithm.Digester()
+	_, err = io.Copy(io.MultiWriter(w, digester.Hash()), br)
+	if err != nil {
+		return "", err
+	}
+	err = w.Close()
+	if err != nil {
+		return "", err
+	}
+
+	// 修改文件属性
+	err = dst.Chmod(perm)
+	if err != nil {
+		logger.Warnf("Fail to chmod for %v", err)
+	}
+
+	cid := digester.Digest().String()
+	_, err = os.Lstat(filepath.Join(b.RegularFilesPath, cid))
+	if err == nil {
+		return cid, nil
+	}
+
+	return cid, os.Rename(dst.Name(), filepath.Join(b.RegularFilesPath, cid))
+}
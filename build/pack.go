@@ -0,0 +1,148 @@
+package build
+
+import (
+	"os"
+	"strings"
+	"syscall"
+	"io/ioutil"
+	"encoding/json"
+	"path/filepath"
+
+	"github.com/seveirbian/gear/pkg"
+	"github.com/seveirbian/gear/types"
+)
+
+const (
+	// a pack object holds small files up to about maxPackSize bytes
+	maxPackSize = 1024 * 1024
+)
+
+// packFiles stores regular files smaller than b.PackThreshold and not larger
+// than maxPackSize under rootfs into pack objects and returns the pack member of each of them, keyed by
+// the relative path. Files are packed in walk order, so that files in the
+// same dir end up in the same pack, except that recorded files go first in
+// the order they were accessed.
+func (b *Builder) packFiles(rootfs string, recordedFileNames []string) (map[string]types.PackMember, error) {
+	members := map[string]types.PackMember{}
+	if b.PackThreshold <= 0 {
+		return members, nil
+	}
+
+	// 1. 找出所有需要打包的小文件
+	small := map[string]bool{}
+	paths := []string{}
+	inodes := map[inode]bool{}
+	err := filepath.Walk(rootfs, func(path string, f os.FileInfo, err error) error {
+		if f == nil {
+			return err
+		}
+		if !f.Mode().IsRegular() || f.Size() == 0 || f.Size() >= b.PackThreshold {
+			return nil
+		}
+		// 大于maxPackSize的文件不打包，pack不会超过maxPackSize
+		if f.Size() > maxPackSize {
+			return nil
+		}
+		if b.ChunkThreshold > 0 && f.Size() >= b.ChunkThreshold {
+			return nil
+		}
+		relativePath, err := filepath.Rel(rootfs, path)
+		if err != nil {
+			return err
+		}
+		if b.inlineFile(relativePath, f) {
+			return nil
+		}
+		// 硬链接只打包第一个文件名
+		if st, ok := f.Sys().(*syscall.Stat_t); ok && st.Nlink > 1 {
+			key := inode{dev: uint64(st.Dev), ino: st.Ino}
+			if inodes[key] {
+				return nil
+			}
+			inodes[key] = true
+		}
+
+		small[relativePath] = true
+		paths = append(paths, relativePath)
+
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	// 2. 被记录的文件按访问顺序排在最前面
+	ordered := []string{}
+	for _, name := range recordedFileNames {
+		name = strings.TrimPrefix(name, "/")
+		if small[name] {
+			ordered = append(ordered, name)
+			delete(small, name)
+		}
+	}
+	for _, path := range paths {
+		if small[path] {
+			ordered = append(ordered, path)
+		}
+	}
+
+	// 3. 依次写入pack
+	pack := []byte{}
+	packed := []string{}
+	flush := func() error {
+		if len(packed) == 0 {
+			return nil
+		}
+
+		cid := pkg.HashBytes(pack)
+		err := b.writeObject(cid, pack, 0644)
+		if err != nil {
+			return err
+		}
+		for _, path := range packed {
+			member := members[path]
+			member.Pack = cid
+			members[path] = member
+		}
+
+		pack = []byte{}
+		packed = []string{}
+
+		return nil
+	}
+	for _, path := range ordered {
+		content, err := ioutil.ReadFile(filepath.Join(rootfs, path))
+		if err != nil {
+			return nil, err
+		}
+
+		if len(pack) > 0 && len(pack)+len(content) > maxPackSize {
+			err := flush()
+			if err != nil {
+				return nil, err
+			}
+		}
+
+		members[path] = types.PackMember{
+			CID:    pkg.HashBytes(content),
+			Offset: int64(len(pack)),
+		}
+		pack = append(pack, content...)
+		packed = append(packed, path)
+	}
+	err = flush()
+	if err != nil {
+		return nil, err
+	}
+
+	return members, nil
+}
+
+// packEntry returns the index entry of a packed file
+func packEntry(member types.PackMember, size int64) ([]byte, error) {
+	return json.Marshal(types.IndexEntry{
+		Algorithm: pkg.CIDAlgorithm.String(),
+		Size:      size,
+		Pack:      &member,
+	})
+}
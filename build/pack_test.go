@@ -0,0 +1,92 @@
+package build
+
+import (
+	"os"
+	"bytes"
+	"testing"
+	"io/ioutil"
+	"path/filepath"
+
+	"github.com/seveirbian/gear/pkg"
+)
+
+func TestPackSize(t *testing.T) {
+	dir, err := ioutil.TempDir("", "gear-pack-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	rootfs := filepath.Join(dir, "rootfs")
+	objects := filepath.Join(dir, "objects")
+	for _, sub := range []string{rootfs, filepath.Join(rootfs, "a"), filepath.Join(rootfs, "b"), objects} {
+		err = os.Mkdir(sub, 0755)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// 各种大小的文件，包括恰好maxPackSize和更大的文件
+	files := map[string][]byte{}
+	sizes := []int{1, 100, 4 << 10, 100 << 10, 300 << 10, 700 << 10, maxPackSize - 1, maxPackSize, maxPackSize + 1, 3 << 20}
+	for i, size := range sizes {
+		for _, sub := range []string{"a", "b"} {
+			name := filepath.Join(sub, string(rune('a'+i)))
+			files[name] = randomContent(int64(i), size)
+			files[name][0] = sub[0]
+			err = ioutil.WriteFile(filepath.Join(rootfs, name), files[name], 0644)
+			if err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+
+	b := &Builder{RegularFilesPath: objects, PackThreshold: 8 << 20, Compression: pkg.CompressionSeekable}
+	members, err := b.packFiles(rootfs, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	packs := map[string][]byte{}
+	for name, content := range files {
+		member, ok := members[name]
+		if len(content) > maxPackSize {
+			if ok {
+				t.Fatalf("%s of %d bytes is packed", name, len(content))
+			}
+			continue
+		}
+		if !ok {
+			t.Fatalf("%s of %d bytes is not packed", name, len(content))
+		}
+
+		pack, ok := packs[member.Pack]
+		if !ok {
+			object, err := ioutil.ReadFile(filepath.Join(objects, member.Pack))
+			if err != nil {
+				t.Fatal(err)
+			}
+			r, err := pkg.NewObjectReader(bytes.NewReader(object))
+			if err != nil {
+				t.Fatal(err)
+			}
+			pack, err = ioutil.ReadAll(r)
+			r.Close()
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(pack) > maxPackSize {
+				t.Fatalf("Pack %s has %d bytes, more than %d", member.Pack, len(pack), maxPackSize)
+			}
+			packs[member.Pack] = pack
+		}
+
+		// 成员在pack中的内容与其cid一致
+		end := member.Offset + int64(len(content))
+		if end > int64(len(pack)) || !bytes.Equal(pack[member.Offset:end], content) || member.CID != pkg.HashBytes(content) {
+			t.Fatalf("%s is not at %d of pack %s", name, member.Offset, member.Pack)
+		}
+	}
+	if len(packs) < 2 {
+		t.Fatalf("%d packs are written", len(packs))
+	}
+}
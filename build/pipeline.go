@@ -0,0 +1,313 @@
+package build
+
+import (
+	"os"
+	"io"
+	"sync"
+	"errors"
+	"syscall"
+	"runtime"
+	"archive/tar"
+	"path/filepath"
+
+	"github.com/seveirbian/gear/pkg"
+)
+
+const (
+	// DefaultMemoryLimit bounds the memory used by the workers of a build
+	DefaultMemoryLimit = 512 * 1024 * 1024
+
+	// memory a worker is expected to use to compress one object
+	objectWriterMemory = 8 * 1024 * 1024
+)
+
+var errBuildAborted = errors.New("Build aborted")
+
+// buildItem is a file of the rootfs, items are written into tmp.tar in walk
+// order after their regular files are stored by workers
+type buildItem struct {
+	path string
+	name string
+	info os.FileInfo
+	// target of a symlink, or the first name of a hardlinked regular file
+	link     string
+	hardlink bool
+	xattrs   map[string][]byte
+	// inline regular files are written into tmp.tar with their content
+	inline bool
+	// cache of the source layer the file is stored for, nil means the cache
+	// of the top layer it comes from
+	cache *layerCache
+
+	// content of the regular file in tmp.tar, a CID or an index entry
+	entry []byte
+	err   error
+	done  chan struct{}
+}
+
+type inode struct {
+	dev uint64
+	ino uint64
+}
+
+// memoryLimiter is a semaphore of bytes
+type memoryLimiter struct {
+	mu    sync.Mutex
+	cond  *sync.Cond
+	limit int64
+	free  int64
+}
+
+func newMemoryLimiter(limit int64) *memoryLimiter {
+	m := &memoryLimiter{limit: limit, free: limit}
+	m.cond = sync.NewCond(&m.mu)
+	return m
+}
+
+// acquire blocks until n bytes are free, n is capped by the limit so that a
+// single big job can still run alone
+func (m *memoryLimiter) acquire(n int64) int64 {
+	if n > m.limit {
+		n = m.limit
+	}
+
+	m.mu.Lock()
+	for m.free < n {
+		m.cond.Wait()
+	}
+	m.free -= n
+	m.mu.Unlock()
+
+	return n
+}
+
+func (m *memoryLimiter) release(n int64) {
+	m.mu.Lock()
+	m.free += n
+	m.mu.Unlock()
+	m.cond.Broadcast()
+}
+
+func (b *Builder) jobs() int {
+	if b.Jobs <= 0 {
+		return runtime.NumCPU()
+	}
+	return b.Jobs
+}
+
+func (b *Builder) memoryLimit() int64 {
+	if b.MemoryLimit <= 0 {
+		return DefaultMemoryLimit
+	}
+	return b.MemoryLimit
+}
+
+// walkRootfs sends every file under rootfs to items in walk order, regular
+// files which need to be stored are also sent to jobs. It stops when abort
+// is closed.
+func walkRootfs(rootfs string, items chan<- *buildItem, jobs chan<- *buildItem, abort <-chan struct{}, needStore func(*buildItem) bool) error {
+	defer close(items)
+	defer close(jobs)
+
+	// 硬链接的普通文件只存储第一个文件名，其余的作为链接写入tmp.tar
+	inodes := map[inode]string{}
+
+	return filepath.Walk(rootfs, func(path string, f os.FileInfo, err error) error {
+		// fail to get file info
+		if f == nil {
+			return err
+		}
+
+		select {
+		case <-abort:
+			return errBuildAborted
+		default:
+		}
+
+		// get file's relative path
+		name, err := filepath.Rel(rootfs, path)
+		if err != nil {
+			return err
+		}
+		if name == "." {
+			return nil
+		}
+		// 由gear生成的清单不属于镜像内容
+		if name == pkg.ManifestDir {
+			if f.IsDir() {
+				return filepath.SkipDir
+			}
+			return nil
+		}
+
+		item := &buildItem{
+			path: path,
+			name: name,
+			info: f,
+			done: make(chan struct{}),
+		}
+
+		// current file is a symlink
+		if f.Mode()&os.ModeSymlink != 0 {
+			item.link, err = os.Readlink(path)
+			if err != nil {
+				logger.Warn("Fail to read symlink target...")
+				return err
+			}
+		}
+
+		item.xattrs, err = pkg.ListXattrs(path)
+		if err != nil {
+			logger.Warnf("Fail to list xattrs of %s for %v", name, err)
+			return err
+		}
+
+		if f.Mode().IsRegular() {
+			if st, ok := f.Sys().(*syscall.Stat_t); ok && st.Nlink > 1 {
+				key := inode{dev: uint64(st.Dev), ino: st.Ino}
+				if first, ok := inodes[key]; ok {
+					item.link = first
+					item.hardlink = true
+				} else {
+					inodes[key] = name
+				}
+			}
+		}
+
+		if !item.hardlink && needStore(item) {
+			jobs <- item
+		} else {
+			close(item.done)
+		}
+		items <- item
+
+		return nil
+	})
+}
+
+// storeFiles runs b.jobs() workers which store regular files by store, the
+// memory they use is bounded by b.memoryLimit()
+func (b *Builder) storeFiles(jobs <-chan *buildItem, abort <-chan struct{}, store func(*buildItem) ([]byte, error)) {
+	limiter := newMemoryLimiter(b.memoryLimit())
+
+	for i := 0; i < b.jobs(); i++ {
+		go func() {
+			for item := range jobs {
+				select {
+				case <-abort:
+					item.err = errBuildAborted
+					close(item.done)
+					continue
+				default:
+				}
+
+				cost := limiter.acquire(b.jobMemory(item.info))
+				item.entry, item.err = store(item)
+				limiter.release(cost)
+
+				close(item.done)
+			}
+		}()
+	}
+}
+
+// storeFile stores a regular file as an object or chunks and returns its
+// entry in tmp.tar, files of unchanged layers are taken from layer caches
+func (b *Builder) storeFile(item *buildItem) ([]byte, error) {
+	entry, ok := b.cachedEntry(item)
+	if ok {
+		return entry, nil
+	}
+
+	if b.ChunkThreshold > 0 && item.info.Size() >= b.ChunkThreshold {
+		// 大文件按内容切块存储，索引中记录块列表
+		entry, err := b.chunkAndCopy(item.path)
+		if err != nil {
+			logger.Warnf("Fail to chunk file for %v", err)
+			return nil, err
+		}
+		b.recordEntry(item, entry)
+		return entry, nil
+	}
+
+	// 普通文件边压缩边计算哈希，内容替换成哈希值
+	cid, err := b.copyObject(item.path, item.info.Mode().Perm())
+	if err != nil {
+		logger.Warnf("Fail to write object for %v", err)
+		return nil, err
+	}
+	b.recordEntry(item, []byte(cid))
+
+	return []byte(cid), nil
+}
+
+// jobMemory estimates the memory needed to store a regular file
+func (b *Builder) jobMemory(f os.FileInfo) int64 {
+	if b.ChunkThreshold > 0 && f.Size() >= b.ChunkThreshold {
+		return 2*maxChunkSize + objectWriterMemory
+	}
+	return streamBufferSize + objectWriterMemory
+}
+
+// writeItem writes the item into tmp.tar
+func (b *Builder) writeItem(tw *tar.Writer, item *buildItem) error {
+	hd, err := tar.FileInfoHeader(item.info, item.link)
+	if err != nil {
+		logger.Warn("Fail to get file head...")
+		return err
+	}
+
+	hd.Name = item.name
+
+	if item.hardlink {
+		hd.Typeflag = tar.TypeLink
+		hd.Linkname = item.link
+		hd.Size = 0
+	} else if item.entry != nil {
+		hd.Size = int64(len(item.entry))
+	}
+
+	// xattrs, including file capabilities and acls
+	for name, value := range item.xattrs {
+		if !pkg.IsImageXattr(name) {
+			continue
+		}
+		if hd.PAXRecords == nil {
+			hd.PAXRecords = map[string]string{}
+		}
+		hd.PAXRecords["SCHILY.xattr."+name] = string(value)
+	}
+	b.normalizeHeader(hd)
+
+	// write file header info
+	err = tw.WriteHeader(hd)
+	if err != nil {
+		logger.WithField("err", err).Warn("Fail to write header info")
+		return err
+	}
+
+	if !item.hardlink && item.entry != nil {
+		_, err = tw.Write(item.entry)
+		if err != nil {
+			logger.WithField("err", err).Warn("Fail to write content...")
+			return err
+		}
+	}
+
+	if !item.hardlink && item.inline {
+		f, err := os.Open(item.path)
+		if err != nil {
+			logger.Warnf("Fail to open inline file for %v", err)
+			return err
+		}
+		defer f.Close()
+
+		_, err = io.CopyN(tw, f, hd.Size)
+		if err != nil {
+			logger.WithField("err", err).Warn("Fail to write content...")
+			return err
+		}
+	}
+
+	return nil
+}
@@ -0,0 +1,217 @@
+package build
+
+import (
+	"fmt"
+	"runtime"
+	"strings"
+	"encoding/json"
+
+	imagespec "github.com/opencontainers/image-spec/specs-go"
+	specs "github.com/opencontainers/image-spec/specs-go/v1"
+	"github.com/seveirbian/gear/registry"
+)
+
+// ociIndex is specs.Index with the mediaType field, which some registries
+// require
+type ociIndex struct {
+	specs.Index
+	MediaType string `json:"mediaType,omitempty"`
+}
+
+// platform returns the platform the builder builds for
+func (b *Builder) platform() specs.Platform {
+	if b.Platform != nil {
+		return *b.Platform
+	}
+	if b.config != nil && b.config.Os != "" {
+		return specs.Platform{OS: b.config.Os, Architecture: b.config.Architecture, Variant: b.config.Variant, OSVersion: b.config.OsVersion}
+	}
+	if b.DImageInfo.Os != "" {
+		return specs.Platform{OS: b.DImageInfo.Os, Architecture: b.DImageInfo.Architecture}
+	}
+
+	return hostPlatform()
+}
+
+// hostPlatform is the platform of this machine
+func hostPlatform() specs.Platform {
+	return specs.Platform{OS: runtime.GOOS, Architecture: runtime.GOARCH}
+}
+
+// PlatformString formats the platform like linux/arm64/v8
+func PlatformString(p specs.Platform) string {
+	s := p.OS + "/" + p.Architecture
+	if p.Variant != "" {
+		s += "/" + p.Variant
+	}
+	return s
+}
+
+// platformDir is the name of the build dir of the platform, like linux-arm64-v8
+func platformDir(p specs.Platform) string {
+	return strings.Replace(PlatformString(p), "/", "-", -1)
+}
+
+// matchPlatform reports whether p is the platform want, the variant is only
+// compared if want has one
+func matchPlatform(p *specs.Platform, want specs.Platform) bool {
+	if p == nil || p.OS != want.OS || p.Architecture != want.Architecture {
+		return false
+	}
+	return want.Variant == "" || p.Variant == want.Variant
+}
+
+// listPlatforms returns the platforms of the image index desc points to, or
+// nil if desc is a single image. Entries without a real platform, like the
+// attestation manifests of buildkit, are skipped.
+func listPlatforms(desc specs.Descriptor, fetch func(specs.Descriptor) ([]byte, error)) ([]specs.Platform, error) {
+	if desc.MediaType != specs.MediaTypeImageIndex && desc.MediaType != mediaTypeDockerManifestList {
+		return nil, nil
+	}
+
+	data, err := fetch(desc)
+	if err != nil {
+		return nil, err
+	}
+	var index specs.Index
+	err = json.Unmarshal(data, &index)
+	if err != nil {
+		return nil, err
+	}
+
+	platforms := []specs.Platform{}
+	for _, m := range index.Manifests {
+		if m.Platform == nil || m.Platform.OS == "" || m.Platform.OS == "unknown" {
+			continue
+		}
+		platforms = append(platforms, specs.Platform{
+			OS:           m.Platform.OS,
+			Architecture: m.Platform.Architecture,
+			Variant:      m.Platform.Variant,
+		})
+	}
+	if len(platforms) == 0 {
+		return nil, fmt.Errorf("No platform in image index %s", desc.Digest)
+	}
+
+	return platforms, nil
+}
+
+// InitBuildersFromRegistry inits a builder for every platform of the image in
+// its registry, like InitBuilderFromRegistry. An image which is not a
+// manifest list gets one builder for its own platform.
+func InitBuildersFromRegistry(image, suffix string) ([]*Builder, error) {
+	dImageName, dImageTag := parseImage(image)
+	host, repo := registry.SplitImage(dImageName)
+	if host == "" {
+		return nil, fmt.Errorf("No registry in image name: %s", dImageName)
+	}
+	reg := registry.Init(host)
+
+	desc, _, err := reg.GetManifest(repo, dImageTag)
+	if err != nil {
+		logger.Warnf("Fail to get manifest of %s for %v", image, err)
+		return nil, err
+	}
+	platforms, err := listPlatforms(desc, registryFetcher(reg, repo))
+	if err != nil {
+		logger.Warnf("Fail to list platforms of %s for %v", image, err)
+		return nil, err
+	}
+
+	return initPlatformBuilders(platforms, func(platform *specs.Platform) (*Builder, error) {
+		return initBuilderFromRegistry(image, suffix, platform)
+	})
+}
+
+// InitBuildersFromOCILayout inits a builder for every platform of the image
+// in the oci image layout dir, like InitBuilderFromOCILayout
+func InitBuildersFromOCILayout(layoutPath, image, suffix string) ([]*Builder, error) {
+	desc, _, err := ociLayoutImage(layoutPath, image)
+	if err != nil {
+		return nil, err
+	}
+	platforms, err := listPlatforms(desc, ociLayoutFetcher(layoutPath))
+	if err != nil {
+		logger.Warnf("Fail to list platforms of %s for %v", layoutPath, err)
+		return nil, err
+	}
+
+	return initPlatformBuilders(platforms, func(platform *specs.Platform) (*Builder, error) {
+		return initBuilderFromOCILayout(layoutPath, image, suffix, platform)
+	})
+}
+
+func initPlatformBuilders(platforms []specs.Platform, init func(*specs.Platform) (*Builder, error)) ([]*Builder, error) {
+	if platforms == nil {
+		b, err := init(nil)
+		if err != nil {
+			return nil, err
+		}
+		return []*Builder{b}, nil
+	}
+
+	builders := []*Builder{}
+	for i := range platforms {
+		b, err := init(&platforms[i])
+		if err != nil {
+			logger.Warnf("Fail to init builder for %s for %v", PlatformString(platforms[i]), err)
+			return nil, err
+		}
+		builders = append(builders, b)
+	}
+
+	return builders, nil
+}
+
+// PushGearImages pushes the gear images built by builders, which are the
+// platforms of one multi-arch image, as a manifest list to the registry in
+// their name. A single builder without platform is pushed by PushGearImage.
+func PushGearImages(builders []*Builder) error {
+	if len(builders) == 0 {
+		return fmt.Errorf("No gear image to push")
+	}
+	if len(builders) == 1 && builders[0].Platform == nil {
+		return builders[0].PushGearImage()
+	}
+
+	gImageName, gImageTag := builders[0].GImageName, builders[0].GImageTag
+	host, repo := registry.SplitImage(gImageName)
+	if host == "" {
+		return fmt.Errorf("No registry in image name: %s", gImageName)
+	}
+	reg := registry.Init(host)
+
+	// 1. 按digest上传每个平台的镜像
+	index := ociIndex{
+		Index: specs.Index{
+			Versioned: imagespec.Versioned{SchemaVersion: 2},
+		},
+		MediaType: specs.MediaTypeImageIndex,
+	}
+	for _, b := range builders {
+		fmt.Printf("Pushing %s:%s for %s\n", b.GImageName, b.GImageTag, PlatformString(b.platform()))
+		desc, err := reg.PushOCILayoutManifest(b.layoutPath(), repo, b.GImageTag)
+		if err != nil {
+			logger.Warnf("Fail to push gear image for %v", err)
+			return err
+		}
+		desc.Annotations = nil
+		platform := b.platform()
+		desc.Platform = &platform
+		index.Manifests = append(index.Manifests, desc)
+	}
+
+	// 2. 上传manifest list
+	data, err := json.Marshal(index)
+	if err != nil {
+		return err
+	}
+	err = reg.PushManifest(repo, gImageTag, specs.MediaTypeImageIndex, data)
+	if err != nil {
+		logger.Warnf("Fail to push manifest list for %v", err)
+		return err
+	}
+
+	return nil
+}
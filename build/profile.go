@@ -0,0 +1,116 @@
+package build
+
+import (
+	"io"
+	"fmt"
+	"strings"
+	"syscall"
+	"io/ioutil"
+	"archive/tar"
+	"path/filepath"
+
+	"github.com/seveirbian/gear/pkg"
+	"github.com/seveirbian/gear/registry"
+	"github.com/seveirbian/gear/types"
+)
+
+// recordedCIDs looks up the objects of the recorded files in the manifest
+// files of this build, for the files recorded by name only, like the ones
+// of gear build --profile. Chunked files get a line for each chunk, files
+// which are not regular files of the image are dropped.
+func recordedCIDs(names []string, files []types.ManifestFile) ([]string, []string) {
+	byPath := map[string]types.ManifestFile{}
+	for _, file := range files {
+		byPath[file.Path] = file
+	}
+
+	recordedFiles, recordedFileNames := []string{}, []string{}
+	for _, name := range names {
+		file, ok := byPath[strings.TrimPrefix(filepath.Clean("/"+name), "/")]
+		if !ok || file.Mode&syscall.S_IFMT != syscall.S_IFREG {
+			continue
+		}
+		// 硬链接使用第一个文件名的对象
+		if file.Link != "" {
+			file = byPath[file.Link]
+		}
+
+		cids := []string{}
+		switch {
+		case file.CID != "":
+			cids = append(cids, file.CID)
+		case file.Entry != nil && file.Entry.Pack != nil:
+			cids = append(cids, file.Entry.Pack.Pack)
+		case file.Entry != nil:
+			for _, chunk := range file.Entry.Chunks {
+				cids = append(cids, chunk.CID)
+			}
+		}
+		for _, cid := range cids {
+			recordedFiles = append(recordedFiles, cid)
+			recordedFileNames = append(recordedFileNames, name)
+		}
+	}
+
+	return recordedFiles, recordedFileNames
+}
+
+// ExportProfile reads RecordFiles of the gear image in its registry, like
+// 202.114.10.146:9999/tomcat-gearmd:8, and returns it as a profile
+func ExportProfile(image string) (*types.Profile, error) {
+	imageName, imageTag := parseImage(image)
+	host, repo := registry.SplitImage(imageName)
+	if host == "" {
+		return nil, fmt.Errorf("No registry in image name: %s", imageName)
+	}
+	reg := registry.Init(host)
+
+	desc, _, err := reg.GetManifest(repo, imageTag)
+	if err != nil {
+		return nil, err
+	}
+	manifest, err := resolveManifest(desc, hostPlatform(), registryFetcher(reg, repo))
+	if err != nil {
+		return nil, err
+	}
+	if len(manifest.Layers) == 0 {
+		return nil, fmt.Errorf("No layer in %s", image)
+	}
+
+	// gear镜像只有一层
+	blob, err := reg.GetBlob(repo, manifest.Layers[len(manifest.Layers)-1].Digest)
+	if err != nil {
+		return nil, err
+	}
+	defer blob.Close()
+	rc, err := decompressStream(blob)
+	if err != nil {
+		return nil, err
+	}
+	defer rc.Close()
+
+	tr := tar.NewReader(rc)
+	for {
+		hd, err := tr.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, err
+		}
+		if strings.TrimPrefix(filepath.Clean("/"+hd.Name), "/") != pkg.RecordFilesName {
+			continue
+		}
+
+		content, err := ioutil.ReadAll(tr)
+		if err != nil {
+			return nil, err
+		}
+		profile := pkg.ParseRecordFiles(content)
+		profile.Image = image
+
+		return profile, nil
+	}
+
+	return nil, fmt.Errorf("No %s in %s, only -gearmd images have a profile", pkg.RecordFilesName, image)
+}
@@ -0,0 +1,103 @@
+package build
+
+import (
+	"fmt"
+	"errors"
+	"io/ioutil"
+
+	specs "github.com/opencontainers/image-spec/specs-go/v1"
+	"github.com/seveirbian/gear/registry"
+	"golang.org/x/net/context"
+)
+
+// InitBuilderFromRegistry inits a builder which pulls the image, like
+// 202.114.10.146:9999/tomcat:8, from its registry using the distribution v2
+// api instead of docker daemon. Layers are streamed and applied one by one
+// while building, and the gear image can be pushed back by PushGearImage.
+func InitBuilderFromRegistry(image, suffix string) (*Builder, error) {
+	return initBuilderFromRegistry(image, suffix, nil)
+}
+
+func initBuilderFromRegistry(image, suffix string, platform *specs.Platform) (*Builder, error) {
+	dImageName, dImageTag := parseImage(image)
+
+	host, repo := registry.SplitImage(dImageName)
+	if host == "" {
+		return nil, errors.New("No registry in image name: " + dImageName)
+	}
+	reg := registry.Init(host)
+
+	b := &Builder{
+		DImageName: dImageName,
+		DImageTag:  dImageTag,
+		Source:     SourceRegistry,
+		SourcePath: image,
+		registry:   reg,
+		sourceRepo: repo,
+		Platform:   platform,
+		GImageName: dImageName + suffix,
+		GImageTag:  dImageTag,
+		Ctx:        context.Background(),
+	}
+
+	// 1. 获取manifest，多架构镜像选择目标平台
+	desc, _, err := reg.GetManifest(repo, dImageTag)
+	if err != nil {
+		logger.Warnf("Fail to get manifest of %s for %v", image, err)
+		return nil, err
+	}
+	manifest, err := resolveManifest(desc, b.platform(), registryFetcher(reg, repo))
+	if err != nil {
+		return nil, err
+	}
+
+	// 2. 获取镜像配置
+	config, err := pullImageConfig(reg, repo, manifest.Config)
+	if err != nil {
+		logger.Warnf("Fail to get config of %s for %v", image, err)
+		return nil, err
+	}
+
+	for _, layer := range manifest.Layers {
+		b.DLayers = append(b.DLayers, layer.Digest.String())
+	}
+	b.DImageInfo = config.imageInspect(manifest.Config.Digest.String(), image)
+	b.config = config
+
+	err = b.initPaths()
+	if err != nil {
+		return nil, err
+	}
+
+	return b, nil
+}
+
+// pullImageConfig gets the image config desc points to from repo
+func pullImageConfig(reg *registry.Registry, repo string, desc specs.Descriptor) (*imageConfig, error) {
+	rc, err := reg.GetBlob(repo, desc.Digest)
+	if err != nil {
+		return nil, err
+	}
+	defer rc.Close()
+
+	// 读完整个blob以校验digest
+	data, err := ioutil.ReadAll(rc)
+	if err != nil {
+		return nil, err
+	}
+
+	config, err := parseImageConfig(data)
+	if err != nil {
+		return nil, fmt.Errorf("Fail to parse image config: %v", err)
+	}
+
+	return config, nil
+}
+
+// registryFetcher gets manifests of repo by digest
+func registryFetcher(reg *registry.Registry, repo string) func(specs.Descriptor) ([]byte, error) {
+	return func(desc specs.Descriptor) ([]byte, error) {
+		_, data, err := reg.GetManifest(repo, desc.Digest.String())
+		return data, err
+	}
+}
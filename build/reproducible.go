@@ -0,0 +1,40 @@
+package build
+
+import (
+	"time"
+	"archive/tar"
+)
+
+// sourceDateEpoch returns the time mtimes are clamped to in reproducible
+// builds, which is b.SourceDateEpoch or the creation time of the source image
+func (b *Builder) sourceDateEpoch() time.Time {
+	if !b.SourceDateEpoch.IsZero() {
+		return b.SourceDateEpoch
+	}
+
+	created, err := time.Parse(time.RFC3339Nano, b.DImageInfo.Created)
+	if err != nil {
+		return time.Unix(0, 0)
+	}
+
+	return created
+}
+
+// normalizeHeader makes the header independent of the build host and time
+// in reproducible builds: mtimes are clamped to the source date epoch and
+// owners are only recorded by uid and gid
+func (b *Builder) normalizeHeader(hd *tar.Header) {
+	if !b.Reproducible {
+		return
+	}
+
+	if epoch := b.sourceDateEpoch(); hd.ModTime.After(epoch) {
+		hd.ModTime = epoch
+	}
+	hd.AccessTime = time.Time{}
+	hd.ChangeTime = time.Time{}
+
+	// 用户名和组名来自构建机器的/etc/passwd，只保留uid和gid
+	hd.Uname = ""
+	hd.Gname = ""
+}
@@ -0,0 +1,393 @@
+package build
+
+import (
+	"os"
+	"io"
+	"bufio"
+	"strings"
+	"io/ioutil"
+	"debug/elf"
+	"path/filepath"
+)
+
+const (
+	// PATH of containers whose image does not set one
+	defaultPath = "/usr/local/sbin:/usr/local/bin:/usr/sbin:/usr/bin:/sbin:/bin"
+
+	// symlinks followed at most when resolving a path, like the kernel
+	maxSymlinks = 40
+)
+
+var (
+	// DefaultStartupConfigFiles are read by most programs at startup, they are
+	// added to the startup files if the image has them
+	DefaultStartupConfigFiles = []string{
+		"/etc/ld.so.cache",
+		"/etc/ld.so.preload",
+		"/etc/nsswitch.conf",
+		"/etc/passwd",
+		"/etc/group",
+		"/etc/hosts",
+		"/etc/host.conf",
+		"/etc/resolv.conf",
+		"/etc/localtime",
+	}
+
+	// library dirs searched after the ones of ld.so.conf
+	defaultLibraryPaths = []string{"/lib64", "/usr/lib64", "/lib", "/usr/lib"}
+
+	shells = map[string]bool{"sh": true, "bash": true, "ash": true, "dash": true}
+)
+
+// startupAnalyzer finds the files a container of the image reads at startup
+// without running it: the command, the ELF interpreters and shared libraries
+// it loads and the interpreters of scripts
+type startupAnalyzer struct {
+	rootfs string
+
+	path         []string
+	workingDir   string
+	libraryPaths []string
+
+	// regular files in the order they are found, by their path in the image
+	files []string
+	seen  map[string]bool
+}
+
+// startupFiles returns the paths of the files a container of the image
+// reads at startup, found statically from ENTRYPOINT and CMD
+func (b *Builder) startupFiles(rootfs string) []string {
+	if b.NoStartupAnalysis {
+		return nil
+	}
+
+	a := &startupAnalyzer{
+		rootfs:     rootfs,
+		path:       filepath.SplitList(defaultPath),
+		workingDir: "/",
+		seen:       map[string]bool{},
+	}
+	a.libraryPaths = append(a.readLibraryPaths(), defaultLibraryPaths...)
+
+	var args []string
+	config := b.DImageInfo.Config
+	if config != nil {
+		for _, env := range config.Env {
+			if strings.HasPrefix(env, "PATH=") {
+				a.path = filepath.SplitList(strings.TrimPrefix(env, "PATH="))
+			}
+		}
+		if config.WorkingDir != "" {
+			a.workingDir = config.WorkingDir
+		}
+		args = append(append(args, config.Entrypoint...), config.Cmd...)
+	}
+
+	a.addCommand(args)
+
+	configFiles := b.StartupConfigFiles
+	if configFiles == nil {
+		configFiles = DefaultStartupConfigFiles
+	}
+	for _, file := range configFiles {
+		a.add(file)
+	}
+
+	return a.files
+}
+
+// addCommand adds the program of args, and the arguments which are files
+// of the image, like the script run by an interpreter
+func (a *startupAnalyzer) addCommand(args []string) {
+	if len(args) == 0 {
+		return
+	}
+
+	a.add(a.lookPath(args[0]))
+
+	// shell形式的命令，例如/bin/sh -c "exec nginx -g ..."
+	if shells[filepath.Base(args[0])] && len(args) > 2 && args[1] == "-c" {
+		a.addCommand(strings.Fields(args[2]))
+		return
+	}
+
+	for _, arg := range args[1:] {
+		if arg == "" || strings.HasPrefix(arg, "-") {
+			continue
+		}
+		if !filepath.IsAbs(arg) {
+			arg = filepath.Join(a.workingDir, arg)
+		}
+		a.add(arg)
+	}
+}
+
+// lookPath finds the command in PATH of the image like a shell
+func (a *startupAnalyzer) lookPath(command string) string {
+	if strings.Contains(command, "/") {
+		if !filepath.IsAbs(command) {
+			return filepath.Join(a.workingDir, command)
+		}
+		return command
+	}
+
+	for _, dir := range a.path {
+		name := filepath.Join("/", dir, command)
+		if info, ok := a.stat(name); ok && info.Mode().IsRegular() && info.Mode().Perm()&0111 != 0 {
+			return name
+		}
+	}
+
+	return ""
+}
+
+// add adds the regular file at name and the files it needs to be executed
+func (a *startupAnalyzer) add(name string) {
+	if name == "" {
+		return
+	}
+	name = a.resolve(name)
+	if name == "" || a.seen[name] {
+		return
+	}
+	info, err := os.Stat(filepath.Join(a.rootfs, name))
+	if err != nil || !info.Mode().IsRegular() {
+		return
+	}
+
+	a.seen[name] = true
+	a.files = append(a.files, name)
+
+	f, err := os.Open(filepath.Join(a.rootfs, name))
+	if err != nil {
+		return
+	}
+	defer f.Close()
+
+	magic := make([]byte, 4)
+	_, err = io.ReadFull(f, magic)
+	if err != nil {
+		return
+	}
+
+	switch {
+	case string(magic[:2]) == "#!":
+		a.addInterpreter(f)
+	case string(magic) == elf.ELFMAG:
+		a.addELF(f, name)
+	}
+}
+
+// addInterpreter adds the interpreter in the shebang line of the script
+func (a *startupAnalyzer) addInterpreter(f *os.File) {
+	_, err := f.Seek(2, io.SeekStart)
+	if err != nil {
+		return
+	}
+	line, _ := bufio.NewReader(io.LimitReader(f, 256)).ReadString('\n')
+	fields := strings.Fields(line)
+	if len(fields) == 0 {
+		return
+	}
+
+	a.add(fields[0])
+
+	// #!/usr/bin/env python3
+	if filepath.Base(fields[0]) == "env" {
+		for _, field := range fields[1:] {
+			if !strings.HasPrefix(field, "-") && !strings.Contains(field, "=") {
+				a.add(a.lookPath(field))
+				break
+			}
+		}
+	}
+}
+
+// addELF adds the program interpreter and the DT_NEEDED libraries of the
+// ELF file, recursively through the libraries
+func (a *startupAnalyzer) addELF(f *os.File, name string) {
+	ef, err := elf.NewFile(f)
+	if err != nil {
+		return
+	}
+	defer ef.Close()
+
+	for _, prog := range ef.Progs {
+		if prog.Type != elf.PT_INTERP {
+			continue
+		}
+		interp := make([]byte, prog.Filesz)
+		_, err := prog.ReadAt(interp, 0)
+		if err == nil {
+			a.add(strings.TrimRight(string(interp), "\x00"))
+		}
+	}
+
+	libs, err := ef.ImportedLibraries()
+	if err != nil {
+		return
+	}
+
+	// DT_RPATH和DT_RUNPATH中的目录先于系统目录搜索
+	dirs := []string{}
+	for _, tag := range []elf.DynTag{elf.DT_RPATH, elf.DT_RUNPATH} {
+		values, _ := ef.DynString(tag)
+		for _, value := range values {
+			for _, dir := range filepath.SplitList(value) {
+				dir = strings.Replace(dir, "$ORIGIN", filepath.Dir(name), -1)
+				dir = strings.Replace(dir, "${ORIGIN}", filepath.Dir(name), -1)
+				dirs = append(dirs, dir)
+			}
+		}
+	}
+	dirs = append(dirs, a.libraryPaths...)
+
+	for _, lib := range libs {
+		a.add(a.findLibrary(lib, dirs, ef.Class, ef.Machine))
+	}
+}
+
+// findLibrary finds the library in dirs like the dynamic linker, libraries
+// of another class or machine are skipped
+func (a *startupAnalyzer) findLibrary(lib string, dirs []string, class elf.Class, machine elf.Machine) string {
+	if strings.Contains(lib, "/") {
+		return lib
+	}
+
+	for _, dir := range dirs {
+		name := filepath.Join("/", dir, lib)
+		resolved := a.resolve(name)
+		if resolved == "" {
+			continue
+		}
+		ef, err := elf.Open(filepath.Join(a.rootfs, resolved))
+		if err != nil {
+			continue
+		}
+		match := ef.Class == class && ef.Machine == machine
+		ef.Close()
+		if match {
+			return name
+		}
+	}
+
+	return ""
+}
+
+// readLibraryPaths reads the library dirs of the dynamic linker of glibc
+// from /etc/ld.so.conf and of musl from /etc/ld-musl-*.path
+func (a *startupAnalyzer) readLibraryPaths() []string {
+	dirs := a.readLdSoConf("/etc/ld.so.conf", map[string]bool{})
+
+	paths, _ := filepath.Glob(filepath.Join(a.rootfs, "etc", "ld-musl-*.path"))
+	for _, path := range paths {
+		content, err := ioutil.ReadFile(path)
+		if err != nil {
+			continue
+		}
+		dirs = append(dirs, strings.FieldsFunc(string(content), func(r rune) bool {
+			return r == ':' || r == '\n'
+		})...)
+	}
+
+	return dirs
+}
+
+func (a *startupAnalyzer) readLdSoConf(name string, included map[string]bool) []string {
+	name = a.resolve(name)
+	if name == "" || included[name] {
+		return nil
+	}
+	included[name] = true
+
+	f, err := os.Open(filepath.Join(a.rootfs, name))
+	if err != nil {
+		return nil
+	}
+	defer f.Close()
+
+	dirs := []string{}
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		line := strings.TrimSpace(strings.SplitN(scanner.Text(), "#", 2)[0])
+		fields := strings.Fields(line)
+		switch {
+		case len(fields) == 0:
+		case fields[0] == "include":
+			for _, pattern := range fields[1:] {
+				if !filepath.IsAbs(pattern) {
+					pattern = filepath.Join(filepath.Dir(name), pattern)
+				}
+				matches, _ := filepath.Glob(filepath.Join(a.rootfs, pattern))
+				for _, match := range matches {
+					rel, err := filepath.Rel(a.rootfs, match)
+					if err == nil {
+						dirs = append(dirs, a.readLdSoConf("/"+rel, included)...)
+					}
+				}
+			}
+		default:
+			dirs = append(dirs, fields...)
+		}
+	}
+
+	return dirs
+}
+
+// stat stats the path of the image, following symlinks inside the image
+func (a *startupAnalyzer) stat(name string) (os.FileInfo, bool) {
+	name = a.resolve(name)
+	if name == "" {
+		return nil, false
+	}
+	info, err := os.Stat(filepath.Join(a.rootfs, name))
+
+	return info, err == nil
+}
+
+// resolve resolves the symlinks in the path of the image, absolute targets
+// are relative to the rootfs instead of the root of this machine. It returns
+// "" if the path does not exist.
+func (a *startupAnalyzer) resolve(name string) string {
+	resolved := "/"
+	rest := strings.Split(filepath.Clean("/"+name), "/")
+	links := 0
+
+	for len(rest) > 0 {
+		part := rest[0]
+		rest = rest[1:]
+
+		switch part {
+		case "", ".":
+			continue
+		case "..":
+			resolved = filepath.Dir(resolved)
+			continue
+		}
+
+		next := filepath.Join(resolved, part)
+		info, err := os.Lstat(filepath.Join(a.rootfs, next))
+		if err != nil {
+			return ""
+		}
+		if info.Mode()&os.ModeSymlink == 0 {
+			resolved = next
+			continue
+		}
+
+		links++
+		if links > maxSymlinks {
+			return ""
+		}
+		target, err := os.Readlink(filepath.Join(a.rootfs, next))
+		if err != nil {
+			return ""
+		}
+		if filepath.IsAbs(target) {
+			resolved = "/"
+		}
+		rest = append(strings.Split(target, "/"), rest...)
+	}
+
+	return resolved
+}
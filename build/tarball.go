@@ -0,0 +1,256 @@
+package build
+
+import (
+	"os"
+	"io"
+	"path"
+	"errors"
+	"strings"
+	"io/ioutil"
+	"archive/tar"
+	"path/filepath"
+)
+
+// archiveIndex is the files of a docker-archive tarball. Files of an
+// uncompressed tarball are read in place, a compressed tarball can not be
+// read at random, so the files used by the build are extracted into dir.
+type archiveIndex struct {
+	path       string
+	compressed bool
+	// 未压缩的tarball中普通文件的位置，链接指向其目标
+	entries map[string]archiveEntry
+	links   map[string]string
+	// manifest.json的内容
+	manifest []byte
+	// 压缩的tarball中被解压出来的文件
+	dir       string
+	extracted map[string]bool
+}
+
+// archiveEntry is where the content of a regular file is in the tarball
+type archiveEntry struct {
+	offset int64
+	size   int64
+}
+
+// archiveFile is a file read in place from an uncompressed tarball
+type archiveFile struct {
+	*io.SectionReader
+	f *os.File
+}
+
+func (a archiveFile) Close() error {
+	return a.f.Close()
+}
+
+// cleanArchiveName returns name of a tarball entry relative to its root, it
+// never escapes the root
+func cleanArchiveName(name string) string {
+	return path.Clean("/" + name)[1:]
+}
+
+// indexArchive reads the file list and manifest.json of the docker-archive
+// tarball at archivePath, nothing is extracted
+func indexArchive(archivePath string) (*archiveIndex, error) {
+	x := &archiveIndex{
+		path:    archivePath,
+		entries: map[string]archiveEntry{},
+		links:   map[string]string{},
+	}
+
+	f, err := os.Open(archivePath)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	magic := make([]byte, 4)
+	n, _ := f.ReadAt(magic, 0)
+	x.compressed = isGzip(magic[:n]) || isZstd(magic[:n])
+
+	// 未压缩的tarball直接从文件读取，tar跳过文件内容时使用Seek，并记录内容的位置
+	var r io.Reader = f
+	if x.compressed {
+		rc, err := decompressStream(f)
+		if err != nil {
+			return nil, err
+		}
+		defer rc.Close()
+		r = rc
+	}
+
+	tr := tar.NewReader(r)
+	for {
+		hd, err := tr.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, err
+		}
+
+		name := cleanArchiveName(hd.Name)
+		switch hd.Typeflag {
+		case tar.TypeReg, tar.TypeRegA:
+			if !x.compressed {
+				offset, err := f.Seek(0, io.SeekCurrent)
+				if err != nil {
+					return nil, err
+				}
+				x.entries[name] = archiveEntry{offset: offset, size: hd.Size}
+			}
+			if name == "manifest.json" {
+				x.manifest, err = ioutil.ReadAll(tr)
+				if err != nil {
+					return nil, err
+				}
+			}
+		case tar.TypeSymlink:
+			// docker save中重复的层是指向另一个层的符号链接
+			x.links[name] = cleanArchiveName(path.Join(path.Dir(name), hd.Linkname))
+		case tar.TypeLink:
+			x.links[name] = cleanArchiveName(hd.Linkname)
+		}
+	}
+
+	if x.manifest == nil {
+		return nil, errors.New("No manifest.json in archive...")
+	}
+
+	return x, nil
+}
+
+// resolve follows the links from name to the regular file
+func (x *archiveIndex) resolve(name string) string {
+	name = cleanArchiveName(name)
+	for i := 0; i < 16; i++ {
+		target, ok := x.links[name]
+		if !ok {
+			break
+		}
+		name = target
+	}
+	return name
+}
+
+// extract extracts the files names of a compressed tarball into x.dir, which
+// is created if it is not yet
+func (x *archiveIndex) extract(names []string) error {
+	if !x.compressed {
+		return nil
+	}
+	if x.dir == "" {
+		dir, err := ioutil.TempDir("", "gear-archive-")
+		if err != nil {
+			return err
+		}
+		x.dir = dir
+		x.extracted = map[string]bool{}
+	}
+
+	wanted := map[string]bool{}
+	for _, name := range names {
+		if name = x.resolve(name); !x.extracted[name] {
+			wanted[name] = true
+		}
+	}
+	if len(wanted) == 0 {
+		return nil
+	}
+
+	f, err := os.Open(x.path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	rc, err := decompressStream(f)
+	if err != nil {
+		return err
+	}
+	defer rc.Close()
+
+	tr := tar.NewReader(rc)
+	for len(wanted) > 0 {
+		hd, err := tr.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return err
+		}
+
+		name := cleanArchiveName(hd.Name)
+		if !wanted[name] || (hd.Typeflag != tar.TypeReg && hd.Typeflag != tar.TypeRegA) {
+			continue
+		}
+		err = extractArchiveFile(tr, filepath.Join(x.dir, filepath.FromSlash(name)))
+		if err != nil {
+			return err
+		}
+		delete(wanted, name)
+		x.extracted[name] = true
+	}
+
+	missing := []string{}
+	for name := range wanted {
+		missing = append(missing, name)
+	}
+	if len(missing) > 0 {
+		return errors.New("No " + strings.Join(missing, ", ") + " in archive")
+	}
+
+	return nil
+}
+
+func extractArchiveFile(r io.Reader, target string) error {
+	err := os.MkdirAll(filepath.Dir(target), 0755)
+	if err != nil {
+		return err
+	}
+	dst, err := os.Create(target)
+	if err != nil {
+		return err
+	}
+	defer dst.Close()
+
+	_, err = io.Copy(dst, r)
+	if err != nil {
+		return err
+	}
+
+	return dst.Close()
+}
+
+// open opens the file name of the tarball, files of a compressed tarball
+// must be extracted first
+func (x *archiveIndex) open(name string) (io.ReadCloser, error) {
+	name = x.resolve(name)
+	if x.compressed {
+		if !x.extracted[name] {
+			return nil, errors.New(name + " is not extracted from archive")
+		}
+		return os.Open(filepath.Join(x.dir, filepath.FromSlash(name)))
+	}
+
+	entry, ok := x.entries[name]
+	if !ok {
+		return nil, errors.New("No " + name + " in archive")
+	}
+	f, err := os.Open(x.path)
+	if err != nil {
+		return nil, err
+	}
+
+	return archiveFile{io.NewSectionReader(f, entry.offset, entry.size), f}, nil
+}
+
+// readFile reads the file name of the tarball
+func (x *archiveIndex) readFile(name string) ([]byte, error) {
+	rc, err := x.open(name)
+	if err != nil {
+		return nil, err
+	}
+	defer rc.Close()
+
+	return ioutil.ReadAll(rc)
+}
@@ -0,0 +1,107 @@
+package build
+
+import (
+	"os"
+	"bytes"
+	"testing"
+	"io/ioutil"
+	"archive/tar"
+	"compress/gzip"
+	"path/filepath"
+)
+
+// writeTestArchive writes a docker-archive tarball like docker save, whose
+// manifest.json is the last file and whose image reuses a layer by a
+// symlink, and returns the content of the files
+func writeTestArchive(t *testing.T, path string, compressed bool) map[string][]byte {
+	files := map[string][]byte{
+		"config.json":   []byte(`{"architecture":"amd64","os":"linux","rootfs":{"type":"layers","diff_ids":[]}}`),
+		"a/layer.tar":   bytes.Repeat([]byte("layer a"), 10000),
+		"b/layer.tar":   bytes.Repeat([]byte("layer b"), 1000),
+		"unused.tar":    bytes.Repeat([]byte("unused"), 1000),
+		"manifest.json": []byte(`[{"Config":"config.json","RepoTags":["foo:latest"],"Layers":["a/layer.tar","./c/layer.tar","b/layer.tar"]}]`),
+	}
+
+	var buf bytes.Buffer
+	tw := tar.NewWriter(&buf)
+	for _, name := range []string{"config.json", "a/layer.tar", "b/layer.tar", "unused.tar"} {
+		tw.WriteHeader(&tar.Header{Name: name, Typeflag: tar.TypeReg, Mode: 0644, Size: int64(len(files[name]))})
+		tw.Write(files[name])
+	}
+	tw.WriteHeader(&tar.Header{Name: "c/layer.tar", Typeflag: tar.TypeSymlink, Linkname: "../a/layer.tar"})
+	tw.WriteHeader(&tar.Header{Name: "manifest.json", Typeflag: tar.TypeReg, Mode: 0644, Size: int64(len(files["manifest.json"]))})
+	tw.Write(files["manifest.json"])
+	tw.Close()
+
+	data := buf.Bytes()
+	if compressed {
+		var gz bytes.Buffer
+		gw := gzip.NewWriter(&gz)
+		gw.Write(data)
+		gw.Close()
+		data = gz.Bytes()
+	}
+	err := ioutil.WriteFile(path, data, 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	files["c/layer.tar"] = files["a/layer.tar"]
+	return files
+}
+
+func TestReadArchive(t *testing.T) {
+	dir, err := ioutil.TempDir("", "gear-archive-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	for _, compressed := range []bool{false, true} {
+		path := filepath.Join(dir, "image.tar")
+		files := writeTestArchive(t, path, compressed)
+
+		x, err := indexArchive(path)
+		if err != nil {
+			t.Fatalf("compressed %v: %v", compressed, err)
+		}
+		if !bytes.Equal(x.manifest, files["manifest.json"]) {
+			t.Fatalf("compressed %v: read wrong manifest.json", compressed)
+		}
+
+		names := []string{"config.json", "a/layer.tar", "./c/layer.tar", "b/layer.tar"}
+		err = x.extract(names)
+		if err != nil {
+			t.Fatalf("compressed %v: %v", compressed, err)
+		}
+		// 未压缩的tarball不解压任何文件，压缩的只解压用到的文件
+		if !compressed && x.dir != "" {
+			t.Fatal("An uncompressed archive is extracted")
+		}
+		if compressed {
+			if len(x.extracted) != 3 {
+				t.Fatalf("%d files are extracted, want 3", len(x.extracted))
+			}
+			if _, err := os.Stat(filepath.Join(x.dir, "unused.tar")); err == nil {
+				t.Fatal("An unused file is extracted")
+			}
+		}
+
+		b := &Builder{Source: SourceArchive, archive: x}
+		for _, name := range names {
+			rc, err := b.openLayer(name)
+			if err != nil {
+				t.Fatalf("compressed %v: open %s: %v", compressed, name, err)
+			}
+			data, err := ioutil.ReadAll(rc)
+			rc.Close()
+			if err != nil || !bytes.Equal(data, files[cleanArchiveName(name)]) {
+				t.Fatalf("compressed %v: read wrong %s: %v", compressed, name, err)
+			}
+		}
+
+		if x.dir != "" {
+			os.RemoveAll(x.dir)
+		}
+	}
+}
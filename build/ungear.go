@@ -0,0 +1,520 @@
+package build
+
+import (
+	"os"
+	"io"
+	"fmt"
+	"errors"
+	"strings"
+	"net/url"
+	"net/http"
+	"io/ioutil"
+	"archive/tar"
+	"path/filepath"
+
+	specs "github.com/opencontainers/image-spec/specs-go/v1"
+	"github.com/seveirbian/gear/pkg"
+	"github.com/seveirbian/gear/registry"
+	gtypes "github.com/seveirbian/gear/types"
+)
+
+// Ungearer turns a gear image back into a plain image with the real content
+// of every file of the gear image, in one layer, or in a layer for each
+// index layer of gear images built with KeepLayers
+type Ungearer struct {
+	GImageName string
+	GImageTag  string
+
+	// where the gear image is read from, SourceRegistry or SourceOCILayout
+	Source     string
+	SourcePath string
+	registry   *registry.Registry
+	sourceRepo string
+
+	DImageName string
+	DImageTag  string
+
+	// objects are read from ObjectsPath, like a files dir of gear build or
+	// the storage of a manager, and pulled from the manager if they are not
+	// there
+	ObjectsPath string
+	ManagerIp   string
+	ManagerPort string
+
+	// LayoutPath is where the plain image is written as an oci image layout
+	LayoutPath string
+	workPath   string
+
+	manifest *specs.Manifest
+	config   *imageConfig
+	// verified content of pack objects in workPath, by cid
+	packs map[string]string
+}
+
+// InitUngearerFromRegistry inits an ungearer which pulls the gear image, like
+// 202.114.10.146:9999/tomcat-gear:8, from its registry. The plain image is
+// named image if it is not "", otherwise the gear image name without -gear.
+func InitUngearerFromRegistry(gImage, image string) (*Ungearer, error) {
+	u := newUngearer(gImage, image)
+
+	host, repo := registry.SplitImage(u.GImageName)
+	if host == "" {
+		return nil, errors.New("No registry in image name: " + u.GImageName)
+	}
+	u.Source = SourceRegistry
+	u.SourcePath = gImage
+	u.registry = registry.Init(host)
+	u.sourceRepo = repo
+
+	desc, _, err := u.registry.GetManifest(repo, u.GImageTag)
+	if err != nil {
+		logger.Warnf("Fail to get manifest of %s for %v", gImage, err)
+		return nil, err
+	}
+	u.manifest, err = resolveManifest(desc, hostPlatform(), registryFetcher(u.registry, repo))
+	if err != nil {
+		return nil, err
+	}
+
+	u.config, err = pullImageConfig(u.registry, repo, u.manifest.Config)
+	if err != nil {
+		logger.Warnf("Fail to get config of %s for %v", gImage, err)
+		return nil, err
+	}
+
+	return u, u.initPaths()
+}
+
+// InitUngearerFromOCILayout inits an ungearer which reads the gear image
+// from an oci image layout dir, like the oci dir of gear build, see
+// InitBuilderFromOCILayout and InitUngearerFromRegistry
+func InitUngearerFromOCILayout(layoutPath, gImage, image string) (*Ungearer, error) {
+	desc, gImage, err := ociLayoutImage(layoutPath, gImage)
+	if err != nil {
+		return nil, err
+	}
+
+	u := newUngearer(gImage, image)
+	u.Source = SourceOCILayout
+	u.SourcePath = layoutPath
+
+	u.manifest, err = resolveManifest(desc, hostPlatform(), ociLayoutFetcher(layoutPath))
+	if err != nil {
+		return nil, err
+	}
+	u.config, err = readImageConfig(registry.BlobPath(layoutPath, u.manifest.Config.Digest))
+	if err != nil {
+		return nil, err
+	}
+
+	return u, u.initPaths()
+}
+
+func newUngearer(gImage, image string) *Ungearer {
+	u := &Ungearer{packs: map[string]string{}}
+	u.GImageName, u.GImageTag = parseImage(gImage)
+
+	if image != "" {
+		u.DImageName, u.DImageTag = parseImage(image)
+	} else {
+		u.DImageName = strings.TrimSuffix(strings.TrimSuffix(u.GImageName, "-gearmd"), "-gear")
+		u.DImageTag = u.GImageTag
+	}
+
+	return u
+}
+
+// initPaths creates /var/lib/gear/ungear/imageName:imageTag, where the plain
+// image is written by default
+func (u *Ungearer) initPaths() error {
+	u.workPath = filepath.Join("/var/lib/gear/ungear", u.DImageName+":"+u.DImageTag)
+	err := os.MkdirAll(u.workPath, os.ModePerm)
+	if err != nil {
+		logger.Warn("Fail to create ungear path...")
+		return err
+	}
+	if u.LayoutPath == "" {
+		u.LayoutPath = filepath.Join(u.workPath, "oci")
+	}
+
+	return nil
+}
+
+// Ungear fetches every object of the gear image, checks it against its cid
+// and writes the plain image into u.LayoutPath
+func (u *Ungearer) Ungear() error {
+	if len(u.manifest.Layers) == 0 {
+		return fmt.Errorf("No layer in %s:%s", u.GImageName, u.GImageTag)
+	}
+	defer os.RemoveAll(filepath.Join(u.workPath, "packs"))
+
+	// 1. 获取gear镜像的索引层
+	fmt.Println("Reading index of gear image...")
+	gearTar := filepath.Join(u.workPath, "gear.tar")
+	defer os.Remove(gearTar)
+	err := u.saveLayer(u.manifest.Layers[len(u.manifest.Layers)-1], gearTar)
+	if err != nil {
+		logger.Warnf("Fail to read index of gear image for %v", err)
+		return err
+	}
+
+	// 2. 读取清单，只支持带清单的gear镜像
+	manifest, err := readTarManifest(gearTar, pkg.ManifestPath)
+	if err != nil {
+		logger.Warnf("Fail to read gear manifest for %v", err)
+		return err
+	}
+	if manifest.Layers >= len(u.manifest.Layers) {
+		return fmt.Errorf("Gear manifest has %d index layers, but the image has %d layers", manifest.Layers, len(u.manifest.Layers))
+	}
+
+	// 3. 将索引中的cid替换成文件内容，保留层的gear镜像每个索引层还原成一层
+	fmt.Println("Fetching files of gear image...")
+	tarPaths := []string{}
+	if manifest.Layers == 0 {
+		tmpTar := filepath.Join(u.workPath, "tmp.tar")
+		defer os.Remove(tmpTar)
+		err = u.restoreLayer(gearTar, tmpTar, manifest)
+		if err != nil {
+			logger.Warnf("Fail to restore files of gear image for %v", err)
+			return err
+		}
+		tarPaths = append(tarPaths, tmpTar)
+	}
+	indexLayers := u.manifest.Layers[len(u.manifest.Layers)-1-manifest.Layers : len(u.manifest.Layers)-1]
+	for i, layer := range indexLayers {
+		tmpTar := filepath.Join(u.workPath, fmt.Sprintf("tmp-%d.tar", i))
+		defer os.Remove(tmpTar)
+		err = u.restoreIndexLayer(layer, tmpTar)
+		if err != nil {
+			logger.Warnf("Fail to restore index layer %d for %v", i, err)
+			return err
+		}
+		tarPaths = append(tarPaths, tmpTar)
+	}
+
+	// 4. 写入oci image layout
+	platform := specs.Platform{OS: u.config.Os, Architecture: u.config.Architecture, Variant: u.config.Variant, OSVersion: u.config.OsVersion}
+	err = writeImageLayout(u.LayoutPath, tarPaths, *u.config, u.DImageName+":"+u.DImageTag, platform)
+	if err != nil {
+		return err
+	}
+	fmt.Printf("Image %s:%s is written to %s\n", u.DImageName, u.DImageTag, u.LayoutPath)
+
+	return nil
+}
+
+// WriteArchive writes the plain image as a tarball which can be loaded by
+// docker load
+func (u *Ungearer) WriteArchive(path string) error {
+	err := tarLayout(u.LayoutPath, path)
+	if err != nil {
+		logger.Warnf("Fail to write docker-archive for %v", err)
+		return err
+	}
+
+	return nil
+}
+
+// Push pushes the plain image to the registry in its name
+func (u *Ungearer) Push() error {
+	host, repo := registry.SplitImage(u.DImageName)
+	if host == "" {
+		return fmt.Errorf("No registry in image name: %s", u.DImageName)
+	}
+
+	fmt.Printf("Pushing %s:%s\n", u.DImageName, u.DImageTag)
+	err := registry.Init(host).PushOCILayout(u.LayoutPath, repo, u.DImageTag)
+	if err != nil {
+		logger.Warnf("Fail to push image for %v", err)
+		return err
+	}
+
+	return nil
+}
+
+// restoreIndexLayer restores an index layer of a gear image built with
+// KeepLayers into dst, by the manifest in the layer
+func (u *Ungearer) restoreIndexLayer(layer specs.Descriptor, dst string) error {
+	indexTar := dst + ".index"
+	defer os.Remove(indexTar)
+	err := u.saveLayer(layer, indexTar)
+	if err != nil {
+		return err
+	}
+
+	manifest, err := readTarManifest(indexTar, pkg.LayerManifestPath)
+	if err != nil {
+		return err
+	}
+
+	return u.restoreLayer(indexTar, dst, manifest)
+}
+
+// saveLayer decompresses the layer of the gear image into path
+func (u *Ungearer) saveLayer(layer specs.Descriptor, path string) error {
+	var blob io.ReadCloser
+	var err error
+	if u.Source == SourceRegistry {
+		blob, err = u.registry.GetBlob(u.sourceRepo, layer.Digest)
+	} else {
+		blob, err = os.Open(registry.BlobPath(u.SourcePath, layer.Digest))
+	}
+	if err != nil {
+		return err
+	}
+	defer blob.Close()
+
+	rc, err := decompressStream(blob)
+	if err != nil {
+		return err
+	}
+	defer rc.Close()
+
+	f, err := os.Create(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	_, err = io.Copy(f, rc)
+	if err != nil {
+		return err
+	}
+
+	return f.Close()
+}
+
+// readTarManifest reads the manifest at name, pkg.ManifestPath or
+// pkg.LayerManifestPath, in the index layer
+func readTarManifest(path, name string) (*gtypes.Manifest, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	tr := tar.NewReader(f)
+	for {
+		hd, err := tr.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, err
+		}
+		if strings.TrimPrefix(filepath.Clean("/"+hd.Name), "/") != name {
+			continue
+		}
+
+		data, err := ioutil.ReadAll(tr)
+		if err != nil {
+			return nil, err
+		}
+		return pkg.ParseManifest(data)
+	}
+
+	return nil, errors.New("No gear manifest in the image, images built by older gear are not supported")
+}
+
+// restoreLayer copies the index layer at src to dst, the content of regular
+// files is replaced by the content of their objects. Files gear adds to the
+// index image, which are not in the manifest, are dropped.
+func (u *Ungearer) restoreLayer(src, dst string, manifest *gtypes.Manifest) error {
+	files := map[string]gtypes.ManifestFile{}
+	for _, file := range manifest.Files {
+		files[file.Path] = file
+	}
+
+	in, err := os.Open(src)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+
+	out, err := os.Create(dst)
+	if err != nil {
+		return err
+	}
+	defer out.Close()
+
+	tr := tar.NewReader(in)
+	tw := tar.NewWriter(out)
+	for {
+		hd, err := tr.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return err
+		}
+
+		name := strings.TrimPrefix(filepath.Clean("/"+hd.Name), "/")
+		file, ok := files[name]
+		if !ok {
+			continue
+		}
+
+		if hd.Typeflag != tar.TypeReg && hd.Typeflag != tar.TypeRegA {
+			err = tw.WriteHeader(hd)
+			if err != nil {
+				return err
+			}
+			continue
+		}
+
+		entry, err := ioutil.ReadAll(tr)
+		if err != nil {
+			return err
+		}
+		hd.Size = file.Size
+		err = tw.WriteHeader(hd)
+		if err != nil {
+			return err
+		}
+
+		// 内联的文件已经是文件内容，whiteout文件没有内容
+		if file.Inline || (file.CID == "" && file.Entry == nil) {
+			_, err = tw.Write(entry)
+			if err != nil {
+				return err
+			}
+			continue
+		}
+
+		counter := &countWriter{}
+		err = u.copyContent(io.MultiWriter(tw, counter), entry)
+		if err != nil {
+			return fmt.Errorf("Fail to restore %s: %v", name, err)
+		}
+		if counter.n != file.Size {
+			return fmt.Errorf("Fail to restore %s: got %d bytes, want %d", name, counter.n, file.Size)
+		}
+	}
+
+	err = tw.Close()
+	if err != nil {
+		return err
+	}
+
+	return out.Close()
+}
+
+// copyContent writes the content of a regular file by its entry in the index
+// layer, a CID or an index entry
+func (u *Ungearer) copyContent(w io.Writer, entry []byte) error {
+	index, ok, err := pkg.ParseIndexEntry(entry)
+	if err != nil {
+		return err
+	}
+	if !ok {
+		return u.copyObject(w, string(entry))
+	}
+
+	if index.Pack != nil {
+		return u.copyPackMember(w, *index.Pack, index.Size)
+	}
+	for _, chunk := range index.Chunks {
+		err := u.copyObject(w, chunk.CID)
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// copyObject writes the content of the object and checks it against cid
+func (u *Ungearer) copyObject(w io.Writer, cid string) error {
+	rc, err := u.openObject(cid)
+	if err != nil {
+		return err
+	}
+	defer rc.Close()
+
+	return pkg.VerifyCID(cid, io.TeeReader(rc, w))
+}
+
+// copyPackMember writes the member of a pack object, the pack is saved into
+// workPath after it is verified, so that it is fetched only once
+func (u *Ungearer) copyPackMember(w io.Writer, member gtypes.PackMember, size int64) error {
+	path, ok := u.packs[member.Pack]
+	if !ok {
+		err := os.MkdirAll(filepath.Join(u.workPath, "packs"), os.ModePerm)
+		if err != nil {
+			return err
+		}
+		f, err := ioutil.TempFile(filepath.Join(u.workPath, "packs"), "pack-")
+		if err != nil {
+			return err
+		}
+		err = u.copyObject(f, member.Pack)
+		f.Close()
+		if err != nil {
+			os.Remove(f.Name())
+			return err
+		}
+		path = f.Name()
+		u.packs[member.Pack] = path
+	}
+
+	f, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	return pkg.VerifyCID(member.CID, io.TeeReader(io.NewSectionReader(f, member.Offset, size), w))
+}
+
+// openObject returns the decompressed content of the object, which is read
+// from u.ObjectsPath or pulled from the manager
+func (u *Ungearer) openObject(cid string) (io.ReadCloser, error) {
+	if !pkg.ValidCID(cid) {
+		return nil, fmt.Errorf("Invalid cid %s", cid)
+	}
+
+	var object io.ReadCloser
+	if u.ObjectsPath != "" {
+		f, err := os.Open(filepath.Join(u.ObjectsPath, cid))
+		if err == nil {
+			object = f
+		} else if !os.IsNotExist(err) {
+			return nil, err
+		}
+	}
+	if object == nil {
+		if u.ManagerIp == "" {
+			return nil, fmt.Errorf("Object %s is not in %s", cid, u.ObjectsPath)
+		}
+		resp, err := http.PostForm("http://"+u.ManagerIp+":"+u.ManagerPort+"/pull/"+cid, url.Values{})
+		if err != nil {
+			return nil, err
+		}
+		if resp.StatusCode != http.StatusOK {
+			resp.Body.Close()
+			return nil, fmt.Errorf("Fail to pull object %s: %s", cid, resp.Status)
+		}
+		object = resp.Body
+	}
+
+	rc, err := pkg.NewObjectReader(object)
+	if err != nil {
+		object.Close()
+		return nil, err
+	}
+
+	return &objectReadCloser{ReadCloser: rc, object: object}, nil
+}
+
+// objectReadCloser closes the object with its decompressor
+type objectReadCloser struct {
+	io.ReadCloser
+
+	object io.Closer
+}
+
+func (o *objectReadCloser) Close() error {
+	o.ReadCloser.Close()
+	return o.object.Close()
+}
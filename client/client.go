@@ -5,17 +5,17 @@ import (
 	"fmt"
 	"time"
 	"sync"
-	"net/url"
 	// "os/exec"
 	// "syscall"
-	"net/http"
 	// "os/signal"
 	"io/ioutil"
 	// "encoding/json"
+	"golang.org/x/net/context"
 	"github.com/labstack/echo"
 	"github.com/sirupsen/logrus"
 	"github.com/seveirbian/gear/types"
 	"github.com/seveirbian/gear/pkg"
+	"github.com/seveirbian/gear/remote"
 )
 
 var (
@@ -37,11 +37,16 @@ type Client struct {
 	Manager types.Node
 	Monitor types.Node
 
+	// Remote pulls objects from manager and the mirrors
+	Remote *remote.Client
+	// ManagerRemote talks to manager only, the mirrors only serve objects
+	ManagerRemote *remote.Client
+
 	NodesMu sync.RWMutex
 	Nodes map[uint64]types.Node
 }
 
-func Init(managerIP string, managerPort string, monitorIP string, monitorPort string, enbaleP2p bool) (*Client, error) {
+func Init(managerIP string, managerPort string, mirrors []string, monitorIP string, monitorPort string, enbaleP2p bool) (*Client, error) {
 	// 1. create new echo instance
 	e := echo.New()
 
@@ -73,6 +78,8 @@ func Init(managerIP string, managerPort string, monitorIP string, monitorPort st
 		IP: managerIP, 
 		Port: managerPort, 
 	}
+	cli.Remote = remote.NewClient(append([]string{remote.Addr(managerIP, managerPort)}, mirrors...)...)
+	cli.ManagerRemote = remote.NewClient(remote.Addr(managerIP, managerPort))
 
 	cli.Monitor = types.Node{
 		ID: pkg.CreateIdFromIP(monitorIP), 
@@ -122,17 +129,22 @@ func (c *Client) joinCluster() {
 }
 
 func (c *Client) join() error {
-	_, err := http.PostForm("http://"+c.Manager.IP+":"+c.Manager.Port+"/join/"+c.Self.IP+"/"+c.Self.Port, url.Values{})
+	resp, err := c.ManagerRemote.PostForm(context.Background(), "/join/"+c.Self.IP+"/"+c.Self.Port, nil, nil)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
 
-	return err
+	return nil
 }
 
 func (c *Client) getClusterNodes() ([]types.Node, error) {
-	resp, err := http.Get("http://"+c.Manager.IP+":"+c.Manager.Port+"/nodes")
+	resp, err := c.ManagerRemote.Get(context.Background(), "/nodes", nil)
 	if err != nil {
 		logger.Fatal("Fail to get the cluster info...")
 		return []types.Node{}, err
 	}
+	defer resp.Body.Close()
 
 	nodesInStirng, err := ioutil.ReadAll(resp.Body)
 	if err != nil {
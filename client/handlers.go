@@ -14,6 +14,7 @@ import (
 	"path/filepath"
 	"github.com/labstack/echo"
 	"github.com/seveirbian/gear/push"
+	"github.com/seveirbian/gear/remote"
 	// "github.com/seveirbian/gear/pkg"
 	// "github.com/seveirbian/gear/types"
 )
@@ -41,16 +42,13 @@ func handleDownload(c echo.Context) error {
 	// 不存在
 	if err != nil {
 		// 从manager节点下载cid文件
-		resp, err := http.PostForm("http://"+cli.Manager.IP+":"+cli.Manager.Port+"/pull/"+cid, url.Values{})
+		resp, err := cli.Remote.PostForm(c.Request().Context(), "/pull/"+cid, nil, nil)
 		if err != nil {
 			logger.Warnf("Fail to pull from manager for %v", err)
+			return c.NoContent(pullStatus(err))
 		}
 		defer resp.Body.Close()
 
-		if resp.StatusCode != http.StatusOK {
-			return c.NoContent(resp.StatusCode)
-		}
-
 		l.Lock()
 
 		dst, err := os.Create(filepath.Join("/var/lib/gear/public", cid))
@@ -113,16 +111,13 @@ func handleGet(c echo.Context) error {
 	}
 
 	// 从manager节点下载cid文件
-	resp, err := http.PostForm("http://"+cli.Manager.IP+":"+cli.Manager.Port+"/pull/"+cid, url.Values{})
+	resp, err := cli.Remote.PostForm(c.Request().Context(), "/pull/"+cid, nil, nil)
 	if err != nil {
 		logger.Warnf("Fail to pull from manager for %v", err)
+		return c.NoContent(pullStatus(err))
 	}
 	defer resp.Body.Close()
 
-	if resp.StatusCode != http.StatusOK {
-		return c.NoContent(resp.StatusCode)
-	}
-
 	f, err := os.Create(filepath.Join("/var/lib/gear/public", cid))
 	if err != nil {
 		logger.Fatalf("Fail to create file for %V", err)
@@ -159,11 +154,26 @@ func handleUpload(c echo.Context) error {
         logger.Fatal("Fail to init a pusher to push gear image...")
     }
 
-    pusher.Push()
+    err = pusher.Push()
+    if err != nil {
+        logger.Warnf("Fail to push gear files for %v", err)
+        return c.NoContent(http.StatusBadGateway)
+    }
 
     return c.NoContent(http.StatusOK)
 }
 
+// pullStatus is the status answered if pulling from manager failed, the
+// status of manager if it answered one, otherwise 502
+func pullStatus(err error) int {
+	if e, ok := err.(*remote.Error); ok {
+		if se, ok := e.Err.(*remote.StatusError); ok {
+			return se.StatusCode
+		}
+	}
+	return http.StatusBadGateway
+}
+
 func handleRecorded(c echo.Context) error {
 	image := c.Param("IMAGE")
 	if _, ok := recordedImages[image]; !ok {
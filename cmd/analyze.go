@@ -0,0 +1,137 @@
+package cmd
+
+import (
+	"os"
+	"encoding/json"
+	"path/filepath"
+
+	"github.com/seveirbian/gear/analyze"
+	"github.com/seveirbian/gear/build"
+	"github.com/sirupsen/logrus"
+	"github.com/spf13/cobra"
+)
+
+var analyzeUsage = `Usage:  gear analyze IMAGENAME:TAG [IMAGENAME:TAG...]
+
+Report the files of images or gear images, how well their content dedups
+within each image, against storage and against the other images, the size
+of their index images and, for -gearmd images, the bytes read at startup.
+
+Options:
+      --from-archive        Read the images from a docker-archive tarball instead of docker daemon
+      --from-oci-layout     Read the images from an oci image layout dir instead of docker daemon
+      --from-registry       Pull the images from their registry instead of docker daemon
+      --storage             Look up objects in this dir, like the storage dir of manager or the files dir of gear build
+  -m, --manager-ip          Look up objects in the storage of this manager
+  -p, --manager-port        Manager node's port(default 2019)
+      --json                Write the report as json
+  -o, --output              Write the report to this file instead of stdout
+      --insecure-registry   Talk to this registry over http instead of https, registries on localhost always are
+`
+
+var (
+	analyzeFromArchive   string
+	analyzeFromOCILayout string
+	analyzeFromRegistry  bool
+	analyzeStorage       string
+	analyzeManagerIP     string
+	analyzeManagerPort   string
+	analyzeJSON          bool
+	analyzeOutput        string
+)
+
+func init() {
+	rootCmd.AddCommand(analyzeCmd)
+	analyzeCmd.SetUsageTemplate(analyzeUsage)
+	analyzeCmd.Flags().StringVarP(&analyzeFromArchive, "from-archive", "", "", "Read the images from a docker-archive tarball")
+	analyzeCmd.Flags().StringVarP(&analyzeFromOCILayout, "from-oci-layout", "", "", "Read the images from an oci image layout dir")
+	analyzeCmd.Flags().BoolVarP(&analyzeFromRegistry, "from-registry", "", false, "Pull the images from their registry")
+	analyzeCmd.Flags().StringVarP(&analyzeStorage, "storage", "", "", "Look up objects in this dir")
+	analyzeCmd.Flags().StringVarP(&analyzeManagerIP, "manager-ip", "m", "", "Look up objects in the storage of this manager")
+	analyzeCmd.Flags().StringVarP(&analyzeManagerPort, "manager-port", "p", "2019", "Manager node's port")
+	analyzeCmd.Flags().BoolVarP(&analyzeJSON, "json", "", false, "Write the report as json")
+	analyzeCmd.Flags().StringVarP(&analyzeOutput, "output", "o", "", "Write the report to this file")
+}
+
+var analyzeCmd = &cobra.Command{
+	Use:   "analyze",
+	Short: "Report dedup and lazy loading of images or gear images",
+	Long:  `Report dedup and lazy loading of images or gear images`,
+	Run: func(cmd *cobra.Command, args []string) {
+		images := args
+		// docker-archive和oci layout中未指定镜像时使用第一个
+		if len(images) == 0 && (analyzeFromArchive != "" || analyzeFromOCILayout != "") {
+			images = []string{""}
+		}
+		if len(images) == 0 {
+			logrus.Fatal("No image provided...")
+		}
+
+		analyzer := &analyze.Analyzer{
+			StoragePath: analyzeStorage,
+			ManagerIp:   analyzeManagerIP,
+			ManagerPort: analyzeManagerPort,
+		}
+
+		// 拉取和解压镜像的进度输出到stderr，stdout中只有报告
+		stdout := os.Stdout
+		os.Stdout = os.Stderr
+
+		for _, image := range images {
+			var builder *build.Builder
+			var err error
+			switch {
+			case analyzeFromArchive != "":
+				builder, err = build.InitBuilderFromArchive(analyzeFromArchive, image, "-analyze")
+			case analyzeFromOCILayout != "":
+				builder, err = build.InitBuilderFromOCILayout(analyzeFromOCILayout, image, "-analyze")
+			case analyzeFromRegistry:
+				builder, err = build.InitBuilderFromRegistry(image, "-analyze")
+			default:
+				builder, err = build.InitBuilder(image, "-analyze")
+			}
+			if err != nil {
+				logrus.Fatalf("Fail to read image %s for %v", image, err)
+			}
+
+			name := builder.DImageName + ":" + builder.DImageTag
+			err = builder.WithRootfs(func(rootfs string) error {
+				return analyzer.AddRootfs(name, rootfs)
+			})
+			// 分析不需要构建目录
+			os.RemoveAll(filepath.Dir(builder.RegularFilesPath))
+			if err != nil {
+				logrus.Fatalf("Fail to analyze %s for %v", name, err)
+			}
+		}
+
+		report, err := analyzer.Report()
+		if err != nil {
+			logrus.Fatalf("Fail to report for %v", err)
+		}
+		os.Stdout = stdout
+
+		out := os.Stdout
+		if analyzeOutput != "" {
+			out, err = os.Create(analyzeOutput)
+			if err != nil {
+				logrus.Fatalf("Fail to create %s for %v", analyzeOutput, err)
+			}
+			defer out.Close()
+		}
+
+		if analyzeJSON {
+			var data []byte
+			data, err = json.MarshalIndent(report, "", "  ")
+			if err != nil {
+				logrus.Fatalf("Fail to marshal report for %v", err)
+			}
+			_, err = out.Write(append(data, '\n'))
+		} else {
+			err = report.WriteText(out)
+		}
+		if err != nil {
+			logrus.Fatalf("Fail to write report for %v", err)
+		}
+	},
+}
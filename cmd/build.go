@@ -1,32 +1,190 @@
 package cmd
 
 import (
+	"fmt"
+	"os"
+	"strconv"
+	"time"
+
 	"github.com/seveirbian/gear/build"
+	"github.com/seveirbian/gear/pkg"
 	"github.com/sirupsen/logrus"
 	"github.com/spf13/cobra"
 )
 
-var buildUsage = `Usage:  gear build IMAGENAME:TAG`
+var buildUsage = `Usage:  gear build IMAGENAME:TAG
+Options:
+      --from-archive        Read the image from a docker-archive tarball instead of docker daemon
+      --from-oci-layout     Read the image from an oci image layout dir instead of docker daemon
+      --from-registry       Pull the image from its registry instead of docker daemon
+      --all-platforms       Build every platform of a multi-arch image from registry or oci layout
+      --chunk-threshold     Store regular files not smaller than this size(bytes) as chunks(default 0, disabled)
+      --pack-threshold      Store regular files smaller than this size(bytes) in pack objects(default 0, disabled)
+      --compression         Compression of objects, zstd, seekable, gzip, none or auto(default zstd), seekable objects can be read by range
+  -j, --jobs                Number of files stored in parallel(default number of cpus)
+      --memory-limit        Memory the build may use to store files in bytes(default 512MiB)
+      --profile             Build a -gearmd image which prefetches the files in this profile, see gear profile export
+      --reproducible        Write the same gear image for the same source image on any host at any time
+      --source-date-epoch   Latest mtime in seconds of reproducible builds(default $SOURCE_DATE_EPOCH or creation time of the image)
+      --inline-threshold    Keep regular files smaller than this size(bytes) in the index image(default 0, disabled)
+      --inline-include      Keep regular files matching these globs in the index image, like /etc/* or *.conf
+      --inline-exclude      Never keep regular files matching these globs in the index image
+      --startup-config-files  Config files prefetched with the startup files found from the entrypoint(default /etc/passwd, /etc/resolv.conf...)
+      --no-startup-analysis   Do not find the startup files of the image from its entrypoint
+      --keep-layers         Write an index layer for each layer of the image, so that gear images of the same base image share its index layers
+      --push                Push the gear image to its registry without docker daemon
+      --insecure-registry   Talk to this registry over http instead of https, registries on localhost always are
+`
+
+var (
+	buildFromArchive     string
+	buildFromOCILayout   string
+	buildFromRegistry    bool
+	buildAllPlatforms    bool
+	buildPush            bool
+	buildChunkThreshold  int64
+	buildPackThreshold   int64
+	buildCompression     string
+	buildJobs            int
+	buildMemoryLimit     int64
+	buildProfile         string
+	buildReproducible    bool
+	buildSourceDateEpoch int64
+	buildInlineThreshold int64
+	buildInlineInclude   []string
+	buildInlineExclude   []string
+	buildStartupConfigs  []string
+	buildNoStartup       bool
+	buildKeepLayers      bool
+)
 
 func init() {
 	rootCmd.AddCommand(buildCmd)
 	buildCmd.SetUsageTemplate(buildUsage)
+	buildCmd.Flags().StringVarP(&buildFromArchive, "from-archive", "", "", "Read the image from a docker-archive tarball")
+	buildCmd.Flags().StringVarP(&buildFromOCILayout, "from-oci-layout", "", "", "Read the image from an oci image layout dir")
+	buildCmd.Flags().BoolVarP(&buildFromRegistry, "from-registry", "", false, "Pull the image from its registry")
+	buildCmd.Flags().BoolVarP(&buildAllPlatforms, "all-platforms", "", false, "Build every platform of a multi-arch image")
+	buildCmd.Flags().IntVarP(&buildJobs, "jobs", "j", 0, "Number of files stored in parallel")
+	buildCmd.Flags().Int64VarP(&buildMemoryLimit, "memory-limit", "", build.DefaultMemoryLimit, "Memory the build may use to store files in bytes")
+	buildCmd.Flags().StringVarP(&buildProfile, "profile", "", "", "Build a -gearmd image which prefetches the files in this profile")
+	buildCmd.Flags().BoolVarP(&buildReproducible, "reproducible", "", false, "Write the same gear image for the same source image")
+	buildCmd.Flags().Int64VarP(&buildSourceDateEpoch, "source-date-epoch", "", -1, "Latest mtime in seconds of reproducible builds")
+	buildCmd.Flags().Int64VarP(&buildInlineThreshold, "inline-threshold", "", 0, "Keep regular files smaller than this size in the index image")
+	buildCmd.Flags().StringSliceVarP(&buildInlineInclude, "inline-include", "", nil, "Keep regular files matching these globs in the index image")
+	buildCmd.Flags().StringSliceVarP(&buildInlineExclude, "inline-exclude", "", nil, "Never keep regular files matching these globs in the index image")
+	buildCmd.Flags().StringSliceVarP(&buildStartupConfigs, "startup-config-files", "", build.DefaultStartupConfigFiles, "Config files prefetched with the startup files")
+	buildCmd.Flags().BoolVarP(&buildNoStartup, "no-startup-analysis", "", false, "Do not find the startup files of the image from its entrypoint")
+	buildCmd.Flags().BoolVarP(&buildKeepLayers, "keep-layers", "", false, "Write an index layer for each layer of the image")
+	buildCmd.Flags().BoolVarP(&buildPush, "push", "", false, "Push the gear image to its registry")
+	buildCmd.Flags().Int64VarP(&buildChunkThreshold, "chunk-threshold", "", 0, "Store regular files not smaller than this size as chunks")
+	buildCmd.Flags().Int64VarP(&buildPackThreshold, "pack-threshold", "", 0, "Store regular files smaller than this size in pack objects")
+	buildCmd.Flags().StringVarP(&buildCompression, "compression", "", pkg.DefaultCompression, "Compression of objects, zstd, seekable, gzip, none or auto, zstd objects are written seekable and read by range")
 }
 
 var buildCmd = &cobra.Command{
 	Use:   "build",
 	Short: "Build a gear image from a docker image",
 	Long:  `Build a gear image from a docker image`,
-	Args:  cobra.ExactArgs(1),
+	Args:  cobra.RangeArgs(0, 1),
 	Run: func(cmd *cobra.Command, args []string) {
-		builder, err := build.InitBuilder(args[0], "-gear")
+		if !pkg.ValidCompression(buildCompression) {
+			logrus.Fatalf("Unsupported compression: %s", buildCompression)
+		}
+		err := build.CheckGlobs(append(append([]string{}, buildInlineInclude...), buildInlineExclude...))
 		if err != nil {
-			logrus.Fatal("Fail to init a builder to build gear image...")
+			logrus.Fatal(err)
+		}
+
+		// 与其他工具一致，未指定时从SOURCE_DATE_EPOCH环境变量读取，只有
+		// 可重现构建才会用到
+		sourceDateEpoch := time.Time{}
+		if env := os.Getenv("SOURCE_DATE_EPOCH"); buildReproducible && buildSourceDateEpoch < 0 && env != "" {
+			seconds, err := strconv.ParseInt(env, 10, 64)
+			if err != nil {
+				logrus.Fatalf("Invalid SOURCE_DATE_EPOCH: %s", env)
+			}
+			buildSourceDateEpoch = seconds
+		}
+		if buildSourceDateEpoch >= 0 {
+			sourceDateEpoch = time.Unix(buildSourceDateEpoch, 0)
+		}
+
+		// 按profile构建包含预取文件的-gearmd镜像，与monitor构建的相同
+		suffix := "-gear"
+		var recordedFileNames []string
+		if buildProfile != "" {
+			profile, err := pkg.ReadProfile(buildProfile)
+			if err != nil {
+				logrus.Fatalf("Fail to read profile for %v", err)
+			}
+			suffix = "-gearmd"
+			recordedFileNames = pkg.ProfilePaths(profile)
 		}
 
-		err = builder.Build(nil, nil)
+		image := ""
+		if len(args) == 1 {
+			image = args[0]
+		}
+
+		var builders []*build.Builder
+		switch {
+		case buildAllPlatforms && buildFromOCILayout != "":
+			builders, err = build.InitBuildersFromOCILayout(buildFromOCILayout, image, suffix)
+		case buildAllPlatforms && buildFromRegistry && image != "":
+			builders, err = build.InitBuildersFromRegistry(image, suffix)
+		case buildAllPlatforms:
+			logrus.Fatal("--all-platforms needs --from-registry or --from-oci-layout...")
+		default:
+			var builder *build.Builder
+			switch {
+			case buildFromArchive != "":
+				builder, err = build.InitBuilderFromArchive(buildFromArchive, image, suffix)
+			case buildFromOCILayout != "":
+				builder, err = build.InitBuilderFromOCILayout(buildFromOCILayout, image, suffix)
+			case buildFromRegistry && image != "":
+				builder, err = build.InitBuilderFromRegistry(image, suffix)
+			case image != "":
+				builder, err = build.InitBuilder(image, suffix)
+			default:
+				logrus.Fatal("No image provided...")
+			}
+			builders = []*build.Builder{builder}
+		}
 		if err != nil {
-			logrus.Fatal("Fail to build gear image...")
+			logrus.Fatal("Fail to init a builder to build gear image...")
+		}
+
+		for _, builder := range builders {
+			if builder.Platform != nil {
+				fmt.Printf("Building %s:%s for %s\n", builder.GImageName, builder.GImageTag, build.PlatformString(*builder.Platform))
+			}
+
+			builder.ChunkThreshold = buildChunkThreshold
+			builder.PackThreshold = buildPackThreshold
+			builder.Compression = buildCompression
+			builder.Jobs = buildJobs
+			builder.MemoryLimit = buildMemoryLimit
+			builder.Reproducible = buildReproducible
+			builder.SourceDateEpoch = sourceDateEpoch
+			builder.InlineThreshold = buildInlineThreshold
+			builder.InlineInclude = buildInlineInclude
+			builder.InlineExclude = buildInlineExclude
+			builder.StartupConfigFiles = buildStartupConfigs
+			builder.NoStartupAnalysis = buildNoStartup
+			builder.KeepLayers = buildKeepLayers
+
+			err = builder.Build(nil, recordedFileNames)
+			if err != nil {
+				logrus.Fatal("Fail to build gear image...")
+			}
+		}
+
+		if buildPush {
+			err = build.PushGearImages(builders)
+			if err != nil {
+				logrus.Fatal("Fail to push gear image...")
+			}
 		}
 	},
 }
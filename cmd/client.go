@@ -14,12 +14,15 @@ Options:
   -p, --manager-port        Manager node's port(default 2019)
   -t, --monitor-ip          Monitor node's ip address
       --monitor-port        Monitor node's port(default 2021)
+      --mirror              Mirror node serving the same objects as manager,
+                            in the form of ip:port, can be repeated
       --enable-p2p          Enable the clients to construct a p2p cluster
 `
 	managerIP string
 	managerPort string
 	clientMonitorIP string
 	clientMonitorPort string
+	clientMirrors []string
 	enableP2p bool
 )
 
@@ -32,6 +35,7 @@ func init() {
 	clientCmd.Flags().StringVarP(&clientMonitorIP, "monitor-ip", "t", "", "Monitor node's ip address")
 	clientCmd.MarkFlagRequired("monitor-ip")
 	clientCmd.Flags().StringVarP(&clientMonitorPort, "monitor-port", "", "2021", "Monitor node's port")
+	clientCmd.Flags().StringSliceVarP(&clientMirrors, "mirror", "", nil, "Mirror node serving the same objects as manager")
 	
 	clientCmd.Flags().BoolVarP(&enableP2p, "enable-p2p", "", false, "Enable p2p")
 }
@@ -42,7 +46,7 @@ var clientCmd = &cobra.Command{
 	Long:  `Start a p2p cluster client`,
 	Args:  cobra.NoArgs,
 	Run: func(cmd *cobra.Command, args []string) {
-		cli, err := client.Init(managerIP, managerPort, clientMonitorIP, clientMonitorPort, enableP2p)
+		cli, err := client.Init(managerIP, managerPort, clientMirrors, clientMonitorIP, clientMonitorPort, enableP2p)
 		if err != nil {
 		    logrus.Fatal("Fail to init a client...")
 		}
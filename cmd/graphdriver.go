@@ -14,6 +14,8 @@ Options:
   -p, --manager-port        Manager node's port(default 2019)
   -t, --monitor-ip          Monitor node's ip address
       --monitor-port        Monitor node's port(default 2021)
+      --mirror              Mirror node serving the same objects as manager,
+                            in the form of ip:port, can be repeated
   `
 
 var (
@@ -21,6 +23,7 @@ var (
 	driverManagerPort string
 	driverMonitorIp string
 	driverMonitorPort string
+	driverMirrors []string
 )
 
 func init() {
@@ -32,6 +35,7 @@ func init() {
 	graphdriverCmd.Flags().StringVarP(&driverMonitorIp, "monitor-ip", "t", "", "Monitor node's ip address")
 	graphdriverCmd.MarkFlagRequired("monitor-ip")
 	graphdriverCmd.Flags().StringVarP(&driverMonitorPort, "monitor-port", "", "2021", "Monitor node's port")
+	graphdriverCmd.Flags().StringSliceVarP(&driverMirrors, "mirror", "", nil, "Mirror node serving the same objects as manager")
 	
 }
 
@@ -46,6 +50,7 @@ var graphdriverCmd = &cobra.Command{
 			ManagerPort: driverManagerPort, 
 			MonitorIp: driverMonitorIp, 
 			MonitorPort: driverMonitorPort, 
+			Mirrors: driverMirrors, 
 		}
 		h := graphdriver.NewHandler(gearGraphDriver)
 
@@ -0,0 +1,83 @@
+package cmd
+
+import (
+	"github.com/seveirbian/gear/build"
+	"github.com/seveirbian/gear/manager"
+	"github.com/seveirbian/gear/push"
+	"github.com/sirupsen/logrus"
+	"github.com/spf13/cobra"
+)
+
+var migrateUsage = `Usage:  gear migrate-cids [GEARIMAGENAME:TAG]
+
+Migrate md5 CIDs to sha256 CIDs. With --storage, objects in manager's storage
+are linked to their new CIDs. With a gear image, its index image is rewritten
+and pushed back to its registry, objects are migrated through manager.
+
+Options:
+      --storage             Migrate objects in manager's storage, run on manager node
+      --remove-legacy       Remove md5 named objects after migrating storage
+  -m, --manager-ip          Manager node's ip address
+  -p, --manager-port        Manager node's port(default 2019)
+`
+
+var (
+	migrateStorage      bool
+	migrateRemoveLegacy bool
+	migrateManagerIP    string
+	migrateManagerPort  string
+)
+
+func init() {
+	rootCmd.AddCommand(migrateCmd)
+	migrateCmd.SetUsageTemplate(migrateUsage)
+	migrateCmd.Flags().BoolVarP(&migrateStorage, "storage", "", false, "Migrate objects in manager's storage")
+	migrateCmd.Flags().BoolVarP(&migrateRemoveLegacy, "remove-legacy", "", false, "Remove md5 named objects after migrating storage")
+	migrateCmd.Flags().StringVarP(&migrateManagerIP, "manager-ip", "m", "", "Manager node's ip address")
+	migrateCmd.Flags().StringVarP(&migrateManagerPort, "manager-port", "p", "2019", "Manager node's port")
+}
+
+var migrateCmd = &cobra.Command{
+	Use:   "migrate-cids",
+	Short: "Migrate md5 CIDs of storage and gear images to sha256 CIDs",
+	Long:  `Migrate md5 CIDs of storage and gear images to sha256 CIDs`,
+	Args:  cobra.RangeArgs(0, 1),
+	Run: func(cmd *cobra.Command, args []string) {
+		if migrateStorage {
+			_, err := manager.MigrateStorage(migrateRemoveLegacy)
+			if err != nil {
+				logrus.Fatalf("Fail to migrate storage for %v", err)
+			}
+		}
+
+		if len(args) == 0 {
+			if !migrateStorage {
+				logrus.Fatal("No gear image provided...")
+			}
+			return
+		}
+		if migrateManagerIP == "" {
+			logrus.Fatal("No manager ip provided...")
+		}
+
+		builder, err := build.InitBuilderFromRegistry(args[0], "")
+		if err != nil {
+			logrus.Fatal("Fail to init a builder to migrate gear image...")
+		}
+
+		pusher, err := push.InitPusher(builder.RegularFilesPath, migrateManagerIP, migrateManagerPort, true)
+		if err != nil {
+			logrus.Fatal("Fail to init a pusher to migrate objects...")
+		}
+
+		err = builder.MigrateCIDs(pusher.Migrate)
+		if err != nil {
+			logrus.Fatalf("Fail to migrate gear image for %v", err)
+		}
+
+		err = builder.PushGearImage()
+		if err != nil {
+			logrus.Fatal("Fail to push gear image...")
+		}
+	},
+}
@@ -0,0 +1,67 @@
+package cmd
+
+import (
+	"os"
+	"io/ioutil"
+	"encoding/json"
+
+	"github.com/seveirbian/gear/build"
+	"github.com/sirupsen/logrus"
+	"github.com/spf13/cobra"
+)
+
+var profileUsage = `Usage:  gear profile export GEARIMAGENAME:TAG
+
+Export the files recorded in a -gearmd image as a profile, which can be used
+by gear build --profile to build the -gearmd image of another tag.
+
+Options:
+  -o, --output              Write the profile to this file instead of stdout
+      --insecure-registry   Talk to this registry over http instead of https, registries on localhost always are
+`
+
+var (
+	profileOutput string
+)
+
+func init() {
+	rootCmd.AddCommand(profileCmd)
+	profileCmd.AddCommand(profileExportCmd)
+	profileCmd.SetUsageTemplate(profileUsage)
+	profileExportCmd.SetUsageTemplate(profileUsage)
+	profileExportCmd.Flags().StringVarP(&profileOutput, "output", "o", "", "Write the profile to this file")
+}
+
+var profileCmd = &cobra.Command{
+	Use:   "profile",
+	Short: "Manage startup access profiles of gear images",
+	Long:  `Manage startup access profiles of gear images`,
+}
+
+var profileExportCmd = &cobra.Command{
+	Use:   "export",
+	Short: "Export the files recorded in a -gearmd image as a profile",
+	Long:  `Export the files recorded in a -gearmd image as a profile`,
+	Args:  cobra.ExactArgs(1),
+	Run: func(cmd *cobra.Command, args []string) {
+		profile, err := build.ExportProfile(args[0])
+		if err != nil {
+			logrus.Fatalf("Fail to export profile for %v", err)
+		}
+
+		data, err := json.MarshalIndent(profile, "", "  ")
+		if err != nil {
+			logrus.Fatalf("Fail to marshal profile for %v", err)
+		}
+		data = append(data, '\n')
+
+		if profileOutput == "" {
+			os.Stdout.Write(data)
+			return
+		}
+		err = ioutil.WriteFile(profileOutput, data, 0644)
+		if err != nil {
+			logrus.Fatalf("Fail to write profile for %v", err)
+		}
+	},
+}
@@ -44,6 +44,18 @@ var pushCmd = &cobra.Command{
             logrus.Fatal("Fail to init a pusher to push gear image...")
         }
 
-        pusher.Push()
+        // 多架构镜像的每个平台都有一个清单
+        buildPath := filepath.Join(GearBuildPath, gImageName+":"+gImageTag, "build")
+        platformManifests, _ := filepath.Glob(filepath.Join(buildPath, "*", "gear-manifest.json"))
+        pusher.Manifests = append([]string{filepath.Join(buildPath, "gear-manifest.json")}, platformManifests...)
+        // 保留层构建的镜像，每个索引层还有一个清单
+        layerManifests, _ := filepath.Glob(filepath.Join(buildPath, "gear-layer-*.json"))
+        platformLayerManifests, _ := filepath.Glob(filepath.Join(buildPath, "*", "gear-layer-*.json"))
+        pusher.Manifests = append(append(pusher.Manifests, layerManifests...), platformLayerManifests...)
+
+        err = pusher.Push()
+        if err != nil {
+            logrus.Fatalf("Fail to push gear files for %v", err)
+        }
     },
 }
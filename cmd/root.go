@@ -3,6 +3,7 @@ package cmd
 import (
 	"github.com/sirupsen/logrus"
 	"github.com/spf13/cobra"
+	"github.com/seveirbian/gear/registry"
 	"os"
 )
 
@@ -13,6 +14,10 @@ var rootCmd = &cobra.Command{
 Complete documentation is available at https://github.com/seveirbian/gear`,
 }
 
+func init() {
+	rootCmd.PersistentFlags().StringSliceVarP(&registry.InsecureRegistries, "insecure-registry", "", nil, "Talk to this registry over http instead of https")
+}
+
 func Execute() {
 	if err := rootCmd.Execute(); err != nil {
 		logrus.WithFields(logrus.Fields{
@@ -0,0 +1,104 @@
+package cmd
+
+import (
+	"github.com/seveirbian/gear/build"
+	"github.com/sirupsen/logrus"
+	"github.com/spf13/cobra"
+)
+
+var ungearUsage = `Usage:  gear ungear GEARIMAGENAME:TAG
+
+Turn a gear image back into a plain image with the content of every file,
+objects are checked against their cids.
+
+Options:
+      --from-oci-layout     Read the gear image from an oci image layout dir instead of its registry
+  -t, --tag                 Name of the plain image(default the gear image name without -gear)
+      --objects             Read objects from this dir, like the files dir of gear build, before pulling them from manager
+  -m, --manager-ip          Manager node's ip address
+  -p, --manager-port        Manager node's port(default 2019)
+      --oci-layout          Write the plain image into this oci image layout dir(default /var/lib/gear/ungear/IMAGE/oci)
+      --docker-archive      Write the plain image into this tarball, which can be loaded by docker load
+      --push                Push the plain image to its registry
+      --insecure-registry   Talk to this registry over http instead of https, registries on localhost always are
+`
+
+var (
+	ungearFromOCILayout string
+	ungearTag           string
+	ungearObjects       string
+	ungearManagerIP     string
+	ungearManagerPort   string
+	ungearOCILayout     string
+	ungearArchive       string
+	ungearPush          bool
+)
+
+func init() {
+	rootCmd.AddCommand(ungearCmd)
+	ungearCmd.SetUsageTemplate(ungearUsage)
+	ungearCmd.Flags().StringVarP(&ungearFromOCILayout, "from-oci-layout", "", "", "Read the gear image from an oci image layout dir")
+	ungearCmd.Flags().StringVarP(&ungearTag, "tag", "t", "", "Name of the plain image")
+	ungearCmd.Flags().StringVarP(&ungearObjects, "objects", "", "", "Read objects from this dir before pulling them from manager")
+	ungearCmd.Flags().StringVarP(&ungearManagerIP, "manager-ip", "m", "", "Manager node's ip address")
+	ungearCmd.Flags().StringVarP(&ungearManagerPort, "manager-port", "p", "2019", "Manager node's port")
+	ungearCmd.Flags().StringVarP(&ungearOCILayout, "oci-layout", "", "", "Write the plain image into this oci image layout dir")
+	ungearCmd.Flags().StringVarP(&ungearArchive, "docker-archive", "", "", "Write the plain image into this tarball")
+	ungearCmd.Flags().BoolVarP(&ungearPush, "push", "", false, "Push the plain image to its registry")
+}
+
+var ungearCmd = &cobra.Command{
+	Use:   "ungear",
+	Short: "Turn a gear image back into a plain image",
+	Long:  `Turn a gear image back into a plain image`,
+	Args:  cobra.RangeArgs(0, 1),
+	Run: func(cmd *cobra.Command, args []string) {
+		if ungearObjects == "" && ungearManagerIP == "" {
+			logrus.Fatal("Objects need --objects or --manager-ip...")
+		}
+
+		image := ""
+		if len(args) == 1 {
+			image = args[0]
+		}
+
+		var ungearer *build.Ungearer
+		var err error
+		switch {
+		case ungearFromOCILayout != "":
+			ungearer, err = build.InitUngearerFromOCILayout(ungearFromOCILayout, image, ungearTag)
+		case image != "":
+			ungearer, err = build.InitUngearerFromRegistry(image, ungearTag)
+		default:
+			logrus.Fatal("No image provided...")
+		}
+		if err != nil {
+			logrus.Fatalf("Fail to init an ungearer for %v", err)
+		}
+
+		ungearer.ObjectsPath = ungearObjects
+		ungearer.ManagerIp = ungearManagerIP
+		ungearer.ManagerPort = ungearManagerPort
+		if ungearOCILayout != "" {
+			ungearer.LayoutPath = ungearOCILayout
+		}
+
+		err = ungearer.Ungear()
+		if err != nil {
+			logrus.Fatalf("Fail to ungear image for %v", err)
+		}
+
+		if ungearArchive != "" {
+			err = ungearer.WriteArchive(ungearArchive)
+			if err != nil {
+				logrus.Fatal("Fail to write docker-archive...")
+			}
+		}
+		if ungearPush {
+			err = ungearer.Push()
+			if err != nil {
+				logrus.Fatal("Fail to push image...")
+			}
+		}
+	},
+}
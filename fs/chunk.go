@@ -0,0 +1,115 @@
+package fs
+
+import (
+	"os"
+	"io"
+	"sort"
+	"syscall"
+	"path/filepath"
+
+	"bazil.org/fuse"
+	"golang.org/x/net/context"
+	"github.com/seveirbian/gear/types"
+)
+
+// ChunkedFileHandler serves a file stored as chunks, only the chunks covering
+// the requested range are fetched from manager
+type ChunkedFileHandler struct {
+	relativePath string
+
+	entry *types.IndexEntry
+}
+
+// externalAttr fills attr of an external regular file of size bytes, which
+// is recorded in the index or the manifest, without fetching its content
+func (f *File) externalAttr(size int64, attr *fuse.Attr) error {
+	IndexFileInfo, err := os.Lstat(filepath.Join(f.indexImagePath, f.relativePath))
+	if err != nil {
+		logger.Warnf("Fail to get index file info for %v", err)
+		return fuse.ENOENT
+	}
+
+	attr.Valid = ValidTime
+	attr.Inode = IndexFileInfo.Sys().(*syscall.Stat_t).Ino
+	attr.Size = uint64(size)
+	attr.Blocks = (uint64(size) + 511) / 512
+	attr.Mtime = IndexFileInfo.ModTime()
+	attr.Mode = IndexFileInfo.Mode()
+	attr.Nlink = uint32(IndexFileInfo.Sys().(*syscall.Stat_t).Nlink)
+	attr.Uid = IndexFileInfo.Sys().(*syscall.Stat_t).Uid
+	attr.Gid = IndexFileInfo.Sys().(*syscall.Stat_t).Gid
+	attr.BlockSize = uint32(IndexFileInfo.Sys().(*syscall.Stat_t).Blksize)
+
+	return nil
+}
+
+func (fh *ChunkedFileHandler) Read(ctx context.Context, req *fuse.ReadRequest, resp *fuse.ReadResponse) error {
+	start := req.Offset
+	end := req.Offset + int64(req.Size)
+	if end > fh.entry.Size {
+		end = fh.entry.Size
+	}
+	if start >= end {
+		resp.Data = resp.Data[:0]
+		return nil
+	}
+
+	data := make([]byte, end-start)
+
+	// 找到第一个包含start的块
+	chunks := fh.entry.Chunks
+	i := sort.Search(len(chunks), func(i int) bool {
+		return chunks[i].Offset+chunks[i].Size > start
+	})
+	for ; i < len(chunks) && chunks[i].Offset < end; i++ {
+		chunk := chunks[i]
+
+		path, err := fetchObject(ctx, chunk.CID, fh.relativePath)
+		if err != nil {
+			logger.Warnf("Fail to fetch chunk %s for %v", chunk.CID, err)
+			return fuse.EIO
+		}
+
+		from := start
+		if chunk.Offset > from {
+			from = chunk.Offset
+		}
+		to := end
+		if chunk.Offset+chunk.Size < to {
+			to = chunk.Offset + chunk.Size
+		}
+
+		err = readFileAt(path, data[from-start:to-start], from-chunk.Offset)
+		if err != nil {
+			logger.Warnf("Fail to read chunk %s for %v", chunk.CID, err)
+			return fuse.EIO
+		}
+	}
+
+	resp.Data = data
+
+	return nil
+}
+
+func (fh *ChunkedFileHandler) Release(ctx context.Context, req *fuse.ReleaseRequest) error {
+	return nil
+}
+
+func (fh *ChunkedFileHandler) Flush(ctx context.Context, req *fuse.FlushRequest) error {
+	return nil
+}
+
+func readFileAt(path string, p []byte, off int64) error {
+	f, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	_, err = f.ReadAt(p, off)
+	if err == io.EOF {
+		return nil
+	}
+
+	return err
+}
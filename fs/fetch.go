@@ -0,0 +1,481 @@
+package fs
+
+import (
+	"os"
+	"io"
+	"fmt"
+	"bufio"
+	"errors"
+	"strconv"
+	"strings"
+	"syscall"
+	"sync"
+	"time"
+	"net/http"
+	"io/ioutil"
+	"path/filepath"
+
+	"golang.org/x/net/context"
+	"github.com/sirupsen/logrus"
+	"github.com/seveirbian/gear/pkg"
+	"github.com/seveirbian/gear/types"
+	"github.com/seveirbian/gear/remote"
+)
+
+var (
+	// errRangeUnsupported is returned by fetchRange if manager returned the
+	// whole object instead of the range
+	errRangeUnsupported = errors.New("Range requests are not supported")
+
+	// errRangeUnverifiable is returned by range reads of raw objects, whose
+	// ranges can not be checked against the cid
+	errRangeUnverifiable = errors.New("Ranges of raw objects can not be checked")
+
+	// GearQuarantinePath keeps the objects which do not match their cid
+	GearQuarantinePath = filepath.Join(GearPath, "quarantine")
+
+	// FetchRetries is how many times a fetch of an object is retried if the
+	// download broke or the object did not match its cid, the n-th retry
+	// waits n*FetchRetryDelay. Failed requests are retried by Remote.
+	FetchRetries = 3
+	FetchRetryDelay = 500 * time.Millisecond
+
+	// FetchTimeout bounds a fetch of an object with its retries, the fetch is
+	// shared by the callers waiting for it and goes on after their requests
+	// are done
+	FetchTimeout = 10 * time.Minute
+
+	objectFetcher = &fetcher{calls: map[string]*fetchCall{}, verified: map[string]bool{}, downloads: map[string]*download{}}
+)
+
+// fetcher runs one fetch of a key at a time, callers asking for a key which
+// is being fetched wait for the fetch and share its result. The fetch does
+// not belong to any caller, a caller whose context is done stops waiting
+// while the others still get the result, the fetch is bounded by
+// FetchTimeout instead. It also records the objects in
+// public cache which were checked against their cid, and the downloads of
+// the objects being fetched.
+type fetcher struct {
+	mu        sync.Mutex
+	calls     map[string]*fetchCall
+	verified  map[string]bool
+	downloads map[string]*download
+}
+
+type fetchCall struct {
+	done chan struct{}
+	path string
+	err  error
+}
+
+func (f *fetcher) do(ctx context.Context, key string, fetch func(ctx context.Context) (string, error)) (string, error) {
+	f.mu.Lock()
+	call, ok := f.calls[key]
+	if !ok {
+		call = &fetchCall{done: make(chan struct{})}
+		f.calls[key] = call
+		go func() {
+			fetchCtx, cancel := detachedContext()
+			call.path, call.err = fetch(fetchCtx)
+			cancel()
+
+			f.mu.Lock()
+			delete(f.calls, key)
+			f.mu.Unlock()
+			close(call.done)
+		}()
+	}
+	f.mu.Unlock()
+
+	select {
+	case <-call.done:
+		return call.path, call.err
+	case <-ctx.Done():
+		return "", ctx.Err()
+	}
+}
+
+// detachedContext returns the context of the work which goes on after the
+// request starting it is done, it is bounded by FetchTimeout
+func detachedContext() (context.Context, context.CancelFunc) {
+	return context.WithTimeout(context.Background(), FetchTimeout)
+}
+
+func (f *fetcher) isVerified(cid string) bool {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return f.verified[cid]
+}
+
+func (f *fetcher) setVerified(cid string) {
+	f.mu.Lock()
+	f.verified[cid] = true
+	f.mu.Unlock()
+}
+
+// download returns the download of the object cid, a new one if it is not
+// being downloaded
+func (f *fetcher) download(cid string) *download {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	d, ok := f.downloads[cid]
+	if !ok {
+		d = newDownload(cid)
+		f.downloads[cid] = d
+	}
+
+	return d
+}
+
+// finish ends the download d of the object cid with err
+func (f *fetcher) finish(cid string, d *download, err error) {
+	f.mu.Lock()
+	if f.downloads[cid] == d {
+		delete(f.downloads, cid)
+	}
+	f.mu.Unlock()
+
+	d.finish(err)
+}
+
+// fetch makes sure the whole object of the external file is in public cache
+// and linked into the private cache of the image, and returns its path there
+func (f *File) fetch(ctx context.Context) (string, error) {
+	public, err := fetchObject(ctx, f.privateCacheName, f.relativePath)
+	if err != nil {
+		return "", err
+	}
+
+	// 私有缓存中的文件可能是已经被隔离的损坏对象
+	target := filepath.Join(f.privateCachePath, f.privateCacheName)
+	privateInfo, err := os.Lstat(target)
+	if err == nil {
+		publicInfo, err := os.Lstat(public)
+		if err == nil && os.SameFile(privateInfo, publicInfo) {
+			return target, nil
+		}
+		os.Remove(target)
+	}
+
+	// 创建硬连接到镜像私有缓存目录下
+	err = os.Link(public, target)
+	if err != nil && !os.IsExist(err) {
+		return "", err
+	}
+
+	// 修改文件的权限
+	IndexFileInfo, err := os.Lstat(filepath.Join(f.indexImagePath, f.relativePath))
+	if err != nil {
+		logger.Warnf("Fail to get index file info for %v", err)
+		return target, nil
+	}
+	err = os.Chmod(target, IndexFileInfo.Mode())
+	if err != nil {
+		logger.Warnf("Fail to chmod for %v", err)
+	}
+	err = os.Chown(target, int(IndexFileInfo.Sys().(*syscall.Stat_t).Uid), int(IndexFileInfo.Sys().(*syscall.Stat_t).Gid))
+	if err != nil {
+		logger.Warnf("Fail to chown for %v", err)
+	}
+
+	return target, nil
+}
+
+// fetchObject makes sure the object cid, a whole file or a chunk of a file,
+// is in public cache and returns its path. Concurrent fetches of the same
+// object are coalesced into one download, which is retried if it fails.
+func fetchObject(ctx context.Context, cid, relativePath string) (string, error) {
+	target := filepath.Join(GearPublicCachePath, cid)
+	if objectFetcher.isVerified(cid) && exists(target) {
+		return target, nil
+	}
+
+	return objectFetcher.do(ctx, cid, func(ctx context.Context) (string, error) {
+		d := objectFetcher.download(cid)
+
+		// 等待的过程中对象可能已经被下载，缓存中已有的对象使用前先校验
+		err := verifyCached(cid, target)
+		if err == nil {
+			objectFetcher.finish(cid, d, nil)
+			return target, nil
+		}
+
+		err = retryFetch(ctx, cid, relativePath, func() error {
+			return pullObject(ctx, cid, target, d)
+		})
+		if err == nil {
+			objectFetcher.setVerified(cid)
+		}
+		objectFetcher.finish(cid, d, err)
+		if err != nil {
+			return "", err
+		}
+
+		if monitorFlag {
+			go func() {
+				RecordChan <- types.MonitorFile {
+					Hash: cid,
+					RelativePath: relativePath,
+				}
+			}()
+		}
+
+		return target, nil
+	})
+}
+
+// cachedObject reports whether the object cid is in public cache and matches
+// its cid
+func cachedObject(ctx context.Context, cid string) bool {
+	target := filepath.Join(GearPublicCachePath, cid)
+	if !exists(target) {
+		return false
+	}
+	if objectFetcher.isVerified(cid) {
+		return true
+	}
+
+	// 与fetchObject使用不同的key，否则等待校验结果的fetch会得到校验的错误
+	_, err := objectFetcher.do(ctx, "verify:"+cid, func(ctx context.Context) (string, error) {
+		return target, verifyCached(cid, target)
+	})
+
+	return err == nil
+}
+
+// verifyCached checks the object cid in public cache against its cid the
+// first time it is used, objects which do not match are quarantined
+func verifyCached(cid, target string) error {
+	if objectFetcher.isVerified(cid) && exists(target) {
+		return nil
+	}
+
+	f, err := os.Open(target)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	err = pkg.VerifyCID(cid, f)
+	if _, ok := err.(*pkg.MismatchError); ok && sameFile(f, target) {
+		quarantine(target, cid)
+	}
+	if err != nil {
+		return err
+	}
+	objectFetcher.setVerified(cid)
+
+	return nil
+}
+
+// retryFetch calls pull until it succeeds, FetchRetries retries failed or
+// ctx is done
+func retryFetch(ctx context.Context, cid, relativePath string, pull func() error) error {
+	var err error
+	for attempt := 0; attempt <= FetchRetries; attempt++ {
+		if attempt > 0 {
+			select {
+			case <-time.After(time.Duration(attempt) * FetchRetryDelay):
+			case <-ctx.Done():
+				return ctx.Err()
+			}
+		}
+
+		err = pull()
+		if err == nil {
+			return nil
+		}
+		// Remote已经在各个节点上重试过请求
+		if _, ok := err.(*remote.Error); ok || ctx.Err() != nil {
+			break
+		}
+		logger.Warnf("Fail to fetch %s, attempt %d, for %v", cid, attempt+1, err)
+	}
+
+	logger.WithFields(logrus.Fields{"cid": cid, "path": relativePath}).Errorf("Give up fetching object for %v", err)
+
+	return err
+}
+
+// quarantine moves the corrupted object at path into GearQuarantinePath,
+// where it is kept for inspection instead of being served
+func quarantine(path, cid string) {
+	logger.WithFields(logrus.Fields{"cid": cid}).Error("Object does not match its cid, quarantined")
+
+	err := os.MkdirAll(GearQuarantinePath, 0700)
+	if err == nil {
+		err = os.Rename(path, filepath.Join(GearQuarantinePath, cid+"-"+strconv.FormatInt(time.Now().UnixNano(), 10)))
+	}
+	if err != nil {
+		logger.Warnf("Fail to quarantine %s for %v", cid, err)
+		os.Remove(path)
+	}
+}
+
+// sameFile reports whether f is still the file at path, which may have been
+// replaced by a fetch while f was checked
+func sameFile(f *os.File, path string) bool {
+	fi, err := f.Stat()
+	if err != nil {
+		return false
+	}
+	pi, err := os.Stat(path)
+	if err != nil {
+		return false
+	}
+	return os.SameFile(fi, pi)
+}
+
+func exists(path string) bool {
+	_, err := os.Lstat(path)
+	return err == nil
+}
+
+// pullObject downloads the object cid from manager or a mirror, decompresses
+// and checks it against cid into target. The download is shared by all the
+// callers waiting for it, so it is bounded by ctx of the fetch instead of
+// their requests. The content is written through d, seekable objects are
+// read while they are downloaded.
+func pullObject(ctx context.Context, cid, target string, d *download) error {
+	resp, err := Remote.PostForm(ctx, "/pull/"+cid, nil, nil)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	return storeObject(cid, target, resp.Body, d)
+}
+
+// StoreObject decompresses the object cid read from r into public cache and
+// checks it against cid, objects which do not match are quarantined. It is
+// used to store the objects prefetched before gear fs is mounted.
+func StoreObject(cid string, r io.Reader) error {
+	if !pkg.ValidCID(cid) {
+		return fmt.Errorf("Invalid cid %s", cid)
+	}
+	target := filepath.Join(GearPublicCachePath, cid)
+
+	// r只能由一个fetch读取，等待其结束后才能返回
+	_, err := objectFetcher.do(context.Background(), cid, func(ctx context.Context) (string, error) {
+		d := objectFetcher.download(cid)
+		err := storeObject(cid, target, r, d)
+		if err == nil {
+			objectFetcher.setVerified(cid)
+		}
+		objectFetcher.finish(cid, d, err)
+		if err != nil {
+			return "", err
+		}
+		return target, nil
+	})
+
+	return err
+}
+
+// storeObject decompresses the object cid read from r into target. Only the
+// content of seekable objects is written through d, frame by frame after
+// their checksums are checked, other objects are read through d after they
+// are checked against cid.
+func storeObject(cid, target string, r io.Reader, d *download) error {
+	br := bufio.NewReader(r)
+	header, _ := br.Peek(pkg.ObjectHeaderSize)
+	compression, err := pkg.ObjectCompression(header)
+	if err != nil {
+		return err
+	}
+
+	if compression != pkg.CompressionSeekable {
+		rc, err := pkg.NewObjectReader(br)
+		if err != nil {
+			return err
+		}
+		defer rc.Close()
+
+		return writeCacheFile(target, func(f *os.File) error {
+			return pkg.VerifyCID(cid, io.TeeReader(rc, f))
+		})
+	}
+
+	rc, err := pkg.NewFrameReader(br)
+	if err != nil {
+		return err
+	}
+	defer rc.Close()
+
+	return writeCacheFile(target, func(f *os.File) error {
+		d.start(f)
+		defer d.stop()
+		return pkg.VerifyCID(cid, io.TeeReader(rc, d.writer(f)))
+	})
+}
+
+// writeCacheFile writes a file of the cache with write, the content is
+// written into a temp file which is synced and renamed to target, so that
+// readers see either no file or the whole file
+func writeCacheFile(target string, write func(f *os.File) error) error {
+	tmp, err := ioutil.TempFile(filepath.Dir(target), "."+filepath.Base(target))
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+	defer tmp.Close()
+
+	err = write(tmp)
+	if _, ok := err.(*pkg.MismatchError); ok {
+		quarantine(tmp.Name(), filepath.Base(target))
+	}
+	if err != nil {
+		return err
+	}
+	err = tmp.Sync()
+	if err != nil {
+		return err
+	}
+	err = tmp.Close()
+	if err != nil {
+		return err
+	}
+
+	return os.Rename(tmp.Name(), target)
+}
+
+// fetchRange reads bytes [start, end) of the object cid, which is compressed,
+// with a HTTP Range request. A negative start reads the last -start bytes.
+// It returns the bytes and the size of the object. The request is cancelled
+// with ctx, which is the context of the FUSE request.
+func fetchRange(ctx context.Context, cid string, start, end int64) ([]byte, int64, error) {
+	header := http.Header{}
+	if start < 0 {
+		header.Set("Range", fmt.Sprintf("bytes=%d", start))
+	} else {
+		header.Set("Range", fmt.Sprintf("bytes=%d-%d", start, end-1))
+	}
+
+	resp, err := Remote.PostForm(ctx, "/pull/"+cid, nil, header)
+	if err != nil {
+		return nil, 0, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusPartialContent {
+		return nil, 0, errRangeUnsupported
+	}
+
+	// Content-Range: bytes <first>-<last>/<size>
+	contentRange := resp.Header.Get("Content-Range")
+	size, err := strconv.ParseInt(contentRange[strings.LastIndex(contentRange, "/")+1:], 10, 64)
+	if err != nil {
+		return nil, 0, fmt.Errorf("Invalid Content-Range %q", contentRange)
+	}
+
+	data, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return nil, 0, err
+	}
+	if start >= 0 && int64(len(data)) != end-start {
+		return nil, 0, io.ErrUnexpectedEOF
+	}
+
+	return data, size, nil
+}
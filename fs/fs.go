@@ -5,16 +5,12 @@ import (
 	"io"
 	"fmt"
 	"path"
-	"bytes"
 	// "archive/tar"
-	gzip "github.com/klauspost/pgzip"
 	"time"
 	// "errors"
 	// "reflect"
 	"strings"
 	"syscall"
-	"net/url"
-	"net/http"
 	"os/signal"
 	"io/ioutil"
 	"path/filepath"
@@ -26,6 +22,7 @@ import (
 	"github.com/sirupsen/logrus"
 	"github.com/seveirbian/gear/types"
 	"github.com/seveirbian/gear/pkg"
+	"github.com/seveirbian/gear/remote"
 )
 
 var (
@@ -38,6 +35,10 @@ var (
 	ManagerIp   string
 	ManagerPort string
 
+	// Remote fetches objects from manager node and the mirrors
+	Remote = remote.NewClient()
+	remoteAddrs []string
+
 	RecordChan chan types.MonitorFile
 
 	NeedMonitor bool
@@ -54,6 +55,9 @@ type GearFS struct {
 
 	ManagerIp string
 	ManagerPort string
+	// Mirrors are host:port of nodes serving the same objects as manager,
+	// objects are fetched from them if manager is down
+	Mirrors []string
 
 	RecordChan chan types.MonitorFile
 
@@ -80,6 +84,11 @@ func (g * GearFS) Start() {
 	if err != nil {
 		logrus.Fatalf("mountPoint: %s is not valid...", g.MountPoint)
 	}
+	// 检测index image的清单版本是否支持
+	manifest, err := pkg.ReadManifest(indexImagePath)
+	if err != nil {
+		logrus.Fatalf("indexImagePath: %s is not a supported gear image: %v", g.IndexImagePath, err)
+	}
 
 	// 2. 在挂载点创建fuse连接
 	c, err := fuse.Mount(mountPoint, fuse.AllowOther())
@@ -103,7 +112,9 @@ func (g * GearFS) Start() {
 	}(c)
 
 	// 4. 初始化fuse文件系统
-	filesys := Init(indexImagePath, privateCachePath, upperPath, g.InitLayerPath, g.ManagerIp, g.ManagerPort, g.RecordChan, g.NeedMonitor)
+	filesys := Init(indexImagePath, privateCachePath, upperPath, g.InitLayerPath, g.ManagerIp, g.ManagerPort, g.Mirrors, g.RecordChan, g.NeedMonitor)
+	filesys.Inline = pkg.InlineFiles(manifest)
+	filesys.Sizes = pkg.FileSizes(manifest)
 
 	// 5. 使用fuse文件系统服务挂载点的fuse连接
 	if err := fuseFS.Serve(c, filesys); err != nil {
@@ -137,6 +148,11 @@ func (g * GearFS) StartAndNotify(notify chan int, monitor bool) {
 	if err != nil {
 		logrus.Fatalf("mountPoint: %s is not valid...", g.MountPoint)
 	}
+	// 检测index image的清单版本是否支持
+	manifest, err := pkg.ReadManifest(indexImagePath)
+	if err != nil {
+		logrus.Fatalf("indexImagePath: %s is not a supported gear image: %v", g.IndexImagePath, err)
+	}
 
 	// 2. 在挂载点创建fuse连接
 	c, err := fuse.Mount(mountPoint, fuse.AllowOther())
@@ -160,7 +176,9 @@ func (g * GearFS) StartAndNotify(notify chan int, monitor bool) {
 	}(c)
 
 	// 4. 初始化fuse文件系统
-	filesys := Init(indexImagePath, privateCachePath, upperPath, g.InitLayerPath, g.ManagerIp, g.ManagerPort, g.RecordChan, g.NeedMonitor)
+	filesys := Init(indexImagePath, privateCachePath, upperPath, g.InitLayerPath, g.ManagerIp, g.ManagerPort, g.Mirrors, g.RecordChan, g.NeedMonitor)
+	filesys.Inline = pkg.InlineFiles(manifest)
+	filesys.Sizes = pkg.FileSizes(manifest)
 
 	// 5. 使用fuse文件系统服务挂载点的fuse连接
 	notify <- 1
@@ -174,9 +192,16 @@ func (g * GearFS) StartAndNotify(notify chan int, monitor bool) {
 	}
 }
 
-func Init(indexImagePath, privateCachePath, upperPath, initLayerPath, managerIp, managerPort string, rChan chan types.MonitorFile, needMonitor bool) *FS {
+func Init(indexImagePath, privateCachePath, upperPath, initLayerPath, managerIp, managerPort string, mirrors []string, rChan chan types.MonitorFile, needMonitor bool) *FS {
 	ManagerIp = managerIp
 	ManagerPort = managerPort
+
+	// 所有gear fs共享同一个Remote，节点不变时保留节点的健康状态
+	addrs := append([]string{remote.Addr(managerIp, managerPort)}, mirrors...)
+	if strings.Join(addrs, ",") != strings.Join(remoteAddrs, ",") {
+		Remote = remote.NewClient(addrs...)
+		remoteAddrs = addrs
+	}
 	RecordChan = rChan
 	NeedMonitor = needMonitor
 
@@ -194,6 +219,11 @@ type FS struct {
 	UpperPath string
 
 	InitLayerPath string
+
+	// 内容直接保存在index image中的普通文件，由清单记录
+	Inline map[string]bool
+	// 保存为对象的普通文件的大小，由清单记录，旧镜像没有
+	Sizes map[string]int64
 }
 
 func (f *FS) Root() (fs.Node, error) {
@@ -205,6 +235,8 @@ func (f *FS) Root() (fs.Node, error) {
 
 		relativePath: "/", 
 		initLayerPath: f.InitLayerPath, 
+		inline: f.Inline, 
+		sizes: f.Sizes, 
 	}
 
 	return n, nil
@@ -218,6 +250,9 @@ type Dir struct {
 	relativePath string
 
 	initLayerPath string
+
+	inline map[string]bool
+	sizes map[string]int64
 }
 
 // TODO: 实际获取每个目录的属性
@@ -257,6 +292,9 @@ func (d *Dir) ReadDirAll(ctx context.Context) ([]fuse.Dirent, error) {
 	}
 
 	for _, file := range files {
+		if isManifestDir(d.relativePath, file.Name()) {
+			continue
+		}
 		var de fuse.Dirent
 		de.Name = file.Name()
 		switch mode := file.Mode(); {
@@ -264,8 +302,8 @@ func (d *Dir) ReadDirAll(ctx context.Context) ([]fuse.Dirent, error) {
 		case mode&os.ModeSymlink != 0: de.Type = fuse.DT_Link
 		case mode&os.ModeNamedPipe != 0: de.Type = fuse.DT_FIFO
 		case mode&os.ModeSocket != 0: de.Type = fuse.DT_Socket
-		case mode&os.ModeDevice != 0: de.Type = fuse.DT_Block
 		case mode&os.ModeCharDevice != 0: de.Type = fuse.DT_Char
+		case mode&os.ModeDevice != 0: de.Type = fuse.DT_Block
 		// case os.ModeIrregular: de.Type = DT_Unknown
 		default: de.Type = fuse.DT_File
 		}
@@ -276,6 +314,11 @@ func (d *Dir) ReadDirAll(ctx context.Context) ([]fuse.Dirent, error) {
 }
 
 func (d *Dir) Lookup(ctx context.Context, req *fuse.LookupRequest, resp *fuse.LookupResponse) (fs.Node, error) {
+	// gear的清单不对容器可见
+	if isManifestDir(d.relativePath, req.Name) {
+		return nil, fuse.ENOENT
+	}
+
 	target := filepath.Join(d.indexImagePath, d.relativePath, req.Name)
 
 	fInfo, err := os.Lstat(target)
@@ -291,6 +334,8 @@ func (d *Dir) Lookup(ctx context.Context, req *fuse.LookupRequest, resp *fuse.Lo
 			upperPath: d.upperPath, 
 			relativePath: filepath.Join(d.relativePath, req.Name), 
 			initLayerPath: d.initLayerPath, 
+			inline: d.inline, 
+			sizes: d.sizes, 
 		}
 		resp.EntryValid = ValidTime
 		attr := fuse.Attr{}
@@ -298,37 +343,35 @@ func (d *Dir) Lookup(ctx context.Context, req *fuse.LookupRequest, resp *fuse.Lo
 		resp.Attr = attr
 		return child, nil
 	} else {
-		if fInfo.Mode().IsRegular() {
-			child := &File {
-				isRegular: true, 
-				indexImagePath: d.indexImagePath, 
-				privateCachePath: d.privateCachePath, 
-				upperPath: d.upperPath, 
-				relativePath: filepath.Join(d.relativePath, req.Name), 
-				initLayerPath: d.initLayerPath, 
-				buff: nil, 
-			}
-			resp.EntryValid = ValidTime
-			attr := fuse.Attr{}
-			child.Attr(ctx, &attr)
-			resp.Attr = attr
-			return child, nil
-		} else {
-			child := &File {
-				isRegular: false, 
-				indexImagePath: d.indexImagePath, 
-				privateCachePath: d.privateCachePath, 
-				upperPath: d.upperPath, 
-				relativePath: filepath.Join(d.relativePath, req.Name), 
-				initLayerPath: d.initLayerPath, 
-				buff: nil, 
-			}
-			resp.EntryValid = ValidTime
-			attr := fuse.Attr{}
-			child.Attr(ctx, &attr)
-			resp.Attr = attr
-			return child, nil
+		// 内联的普通文件与其他文件一样直接从index image中读取
+		relativePath := filepath.Join(d.relativePath, req.Name)
+		size, sized := d.sizes[relativePath]
+		external := fInfo.Mode().IsRegular() && !d.inline[relativePath]
+		if external && !sized {
+			// 旧镜像的清单中没有文件，gear写入的RecordFiles等文件的内容不是cid
+			name, err := ioutil.ReadFile(target)
+			_, chunked, _ := pkg.ParseIndexEntry(name)
+			external = err == nil && (chunked || pkg.ValidCID(string(name)))
+		}
+
+		child := &File {
+			external: external, 
+			indexImagePath: d.indexImagePath, 
+			privateCachePath: d.privateCachePath, 
+			upperPath: d.upperPath, 
+			relativePath: relativePath, 
+			initLayerPath: d.initLayerPath, 
+			size: size, 
+			sized: sized, 
 		}
+		resp.EntryValid = ValidTime
+		attr := fuse.Attr{}
+		err := child.Attr(ctx, &attr)
+		if err != nil {
+			return nil, err
+		}
+		resp.Attr = attr
+		return child, nil
 	}
 
 	return nil, fuse.ENOENT
@@ -339,7 +382,9 @@ func (d *Dir) Access(ctx context.Context, req *fuse.AccessRequest) error {
 }
 
 type File struct {
-	isRegular bool
+	// the index file of an external regular file holds the cid or the
+	// index entry of its content instead of the content
+	external bool
 
 	indexImagePath string
 	privateCachePath string
@@ -351,7 +396,9 @@ type File struct {
 
 	initLayerPath string
 
-	buff *bytes.Buffer
+	// size of the external regular file recorded in the manifest, if sized
+	size int64
+	sized bool
 }
 
 func (f *File) Attr(ctx context.Context, attr *fuse.Attr) error {
@@ -379,146 +426,37 @@ func (f *File) Attr(ctx context.Context, attr *fuse.Attr) error {
 	}
 
 	// 否则，再判断是否是普通文件，是否需要下载等等
-	if f.isRegular {
+	if f.external {
 		// 获取文件的cid
 		name, err := ioutil.ReadFile(filepath.Join(f.indexImagePath, f.relativePath))
 		if err != nil {
-			logger.Warnf("Fail to read filename")
+			logger.Warnf("Fail to read filename for %v", err)
+			return fuse.ENOENT
 		}
 		f.privateCacheName = string(name)
 
-		// 检测private cache中是否存在该文件
-		_, err = os.Lstat(filepath.Join(f.privateCachePath, f.privateCacheName))
-		if err != nil {
-			// 检测public cache中是否存在该文件
-			_, err := os.Lstat(filepath.Join("/var/lib/gear/public", f.privateCacheName))
-			if err == nil {
-				// 跳过下载步骤
-				// 创建硬连接到镜像私有缓存目录下
-				_, err = os.Lstat(filepath.Join(f.privateCachePath, f.privateCacheName))
-				if err != nil {
-					_, err := os.Lstat(filepath.Join(f.privateCachePath, f.privateCacheName))
-					if err != nil {
-						err := os.Link(filepath.Join("/var/lib/gear/public", f.privateCacheName), filepath.Join(f.privateCachePath, f.privateCacheName))
-						if err != nil {
-							if !strings.Contains(err.Error(), "file exists") {
-								logger.Fatalf("Fail to create hard link for %v", err)
-							}
-						}
-					}
-				}
-			} else {
-				// 从manager节点下载cid文件
-				resp, err := http.PostForm("http://"+ManagerIp+":"+ManagerPort+"/pull/"+f.privateCacheName, url.Values{})
-				if err != nil {
-					logger.Warnf("Fail to pull from manager for %v", err)
-				}
-				defer resp.Body.Close()
-
-				if resp.StatusCode != http.StatusOK {
-					logger.Warnf("Fail to pull file")
-				}
-
-				tgt, err := os.Create(filepath.Join("/var/lib/gear/public", f.privateCacheName))
-				if err != nil {
-					logger.Fatalf("Fail to create file for %V", err)
-				}
-
-				// 先对内容进行解压
-				gr, err := gzip.NewReader(resp.Body)
-				if err != nil {
-					logger.Warnf("Fail to create gzip reader for %v", err)
-				}
-
-				// 现在内存中保留一份，加速后续的读取速度
-				b, err := ioutil.ReadAll(gr)
-				if err != nil {
-					logger.Warnf("Read gr err for %v", err)
-				}
-
-				f.buff = bytes.NewBuffer(b)
-				grCopy := bytes.NewReader(b)
-
-				_, err = io.Copy(tgt, grCopy)
-				if err != nil {
-					logger.Fatalf("Fail to copy for %v", err)
-				}
-
-				gr.Close()
-				tgt.Close()
-
-				// 4. 创建硬连接到镜像私有缓存目录下
-				_, err = os.Lstat(filepath.Join(f.privateCachePath, f.privateCacheName))
-				if err != nil {
-					err := os.Link(filepath.Join("/var/lib/gear/public", f.privateCacheName), filepath.Join(f.privateCachePath, f.privateCacheName))
-					if err != nil {
-						if !strings.Contains(err.Error(), "file exists") {
-							logger.Fatalf("Fail to create hard link for %v", err)
-						}
-					}
-				}
-			}
-
-			// 修改文件的权限
-			IndexFileInfo, err := os.Lstat(filepath.Join(f.indexImagePath, f.relativePath))
-			if err != nil {
-				logger.Warnf("Fail to get index file info for %v", err)
-			}
-			err = os.Chmod(filepath.Join(f.privateCachePath, f.privateCacheName), IndexFileInfo.Mode())
-			if err != nil {
-				logger.Warnf("Fail to chmod for %v", err)
-			}
-			err = os.Chown(filepath.Join(f.privateCachePath, f.privateCacheName), int(IndexFileInfo.Sys().(*syscall.Stat_t).Uid), int(IndexFileInfo.Sys().(*syscall.Stat_t).Gid))
-			if err != nil {
-				logger.Warnf("Fail to chown for %v", err)
-			}
+		// 分块或打包存储的文件，属性从索引中获取，不需要下载
+		if entry, chunked, _ := pkg.ParseIndexEntry(name); chunked {
+			return f.externalAttr(entry.Size, attr)
 		}
 
-		fInfo, err := os.Lstat(filepath.Join(f.privateCachePath, f.privateCacheName))
-		if err != nil {
-			logger.Warnf("Fail to lstat file for %v", err)
+		// 文件大小由清单记录，stat不下载文件内容
+		if f.sized {
+			return f.externalAttr(f.size, attr)
 		}
 
-		attr.Size = uint64(fInfo.Size())
-
-		IndexFileInfo, err := os.Lstat(filepath.Join(f.indexImagePath, f.relativePath))
+		// 旧镜像的清单没有记录大小，下载文件获取大小
+		cached, err := f.fetch(ctx)
 		if err != nil {
-			logger.Warnf("Fail to get index file info for %v", err)
+			logger.Warnf("Fail to fetch %s for %v", f.relativePath, err)
+			return fuse.EIO
 		}
-
-		attr.Valid = ValidTime
-		attr.Inode = IndexFileInfo.Sys().(*syscall.Stat_t).Ino
-		attr.Blocks = uint64(IndexFileInfo.Sys().(*syscall.Stat_t).Blocks)
-		attr.Mtime = IndexFileInfo.ModTime()
-		attr.Mode = IndexFileInfo.Mode()
-		attr.Nlink = uint32(IndexFileInfo.Sys().(*syscall.Stat_t).Nlink)
-		attr.Uid = IndexFileInfo.Sys().(*syscall.Stat_t).Uid
-		attr.Gid = IndexFileInfo.Sys().(*syscall.Stat_t).Gid
-		attr.BlockSize = uint32(IndexFileInfo.Sys().(*syscall.Stat_t).Blksize)
-
-		// 判断当前目录是否是镜像层还是gear-work目录
-		// 如果是镜像层，则将创建文件硬链接到gear-work目录
-		// 如果是gear-work目录，则啥都不做
-		if f.initLayerPath != "" {
-			// 将文件link到-init层目录
-			_, err = os.Lstat(filepath.Join(f.initLayerPath, f.relativePath))
-			if err != nil {
-				initDir := path.Dir(filepath.Join(f.initLayerPath, f.relativePath))
-				_, err = os.Lstat(initDir)
-				if err != nil {
-					err := os.MkdirAll(initDir, os.ModePerm)
-					if err != nil {
-						logger.Warnf("Fail to create initDir for %v", err)
-					}
-				}
-				err = os.Link(filepath.Join("/var/lib/gear/public", f.privateCacheName), filepath.Join(f.initLayerPath, f.relativePath))
-				if err != nil {
-					if !strings.Contains(err.Error(), "file exists") {
-						logger.Fatalf("Fail to create hard link for %v", err)
-					}
-				}
-			}
+		fInfo, err := os.Lstat(cached)
+		if err != nil {
+			logger.Warnf("Fail to lstat file for %v", err)
+			return fuse.EIO
 		}
+		return f.externalAttr(fInfo.Size(), attr)
 	} else {
 		IndexFileInfo, err := os.Lstat(filepath.Join(f.indexImagePath, f.relativePath))
 		if err != nil {
@@ -535,48 +473,8 @@ func (f *File) Attr(ctx context.Context, attr *fuse.Attr) error {
 		attr.Uid = IndexFileInfo.Sys().(*syscall.Stat_t).Uid
 		attr.Gid = IndexFileInfo.Sys().(*syscall.Stat_t).Gid
 		attr.BlockSize = uint32(IndexFileInfo.Sys().(*syscall.Stat_t).Blksize)
-	}
-
-	// fmt.Println("\nf.Attr")
-	// fmt.Println("f< ", f.relativePath, " >")
-	// fmt.Println("f.Attr< ", attr, " >")
-
-	if f.isRegular && (f.relativePath == "/prefetched" || f.relativePath == "/RecordFiles") {
-		// 创建硬链接到gear-work目录
-		indexPath := filepath.Join(f.indexImagePath, "..")
-		_, err = os.Lstat(filepath.Join(indexPath, "gear-work", f.relativePath))
-		if err != nil {
-			initDir := path.Dir(filepath.Join(indexPath, "gear-work", f.relativePath))
-			_, err := os.Lstat(initDir)
-			if err != nil {
-				// 复制路径
-				if pkg.CopyPath(f.indexImagePath, filepath.Join(indexPath, "gear-work"), f.relativePath) != true {
-					err := os.MkdirAll(initDir, os.ModePerm)
-					if err != nil {
-						logger.Warnf("Fail to create initDir for %v", err)
-					}
-				}
-			}
-			err = os.Link(filepath.Join(f.privateCachePath, f.privateCacheName), filepath.Join(indexPath, "gear-work", f.relativePath))
-			if err != nil {
-				if !strings.Contains(err.Error(), "file exists") {
-					logger.Fatalf("Fail to create hard link for %v", err)
-				}
-			}
-		}
-	}
-	
-	if monitorFlag {
-		go func() {
-			if f.privateCacheName != "" {
-				RecordChan <- types.MonitorFile {
-					Hash: f.privateCacheName, 
-					RelativePath: f.relativePath, 
-				}
-			} else {
-				// fmt.Println(filepath.Join(f.indexImagePath, f.relativePath))
-			}
-		}()
+		// 设备文件的设备号
+		attr.Rdev = uint32(IndexFileInfo.Sys().(*syscall.Stat_t).Rdev)
 	}
 
 	return nil
@@ -599,141 +497,84 @@ func (f *File) Open(ctx context.Context, req *fuse.OpenRequest, resp *fuse.OpenR
 		file, err := os.Open(filepath.Join(f.upperPath, f.relativePath))
 		if err != nil {
 			logger.Warnf("Fail to open file: %v", err)
+			return nil, fuse.EIO
 		}
 		fileHandler.f = file
+		fileHandler.filepath = filepath.Join(f.upperPath, f.relativePath)
 
 		resp.Flags |= fuse.OpenKeepCache
 		return &fileHandler, nil
 	}
 
 	// 否则，再判断是否是普通文件，是否需要下载等等
-	if f.isRegular {
+	if f.external {
 		name, err := ioutil.ReadFile(filepath.Join(f.indexImagePath, f.relativePath))
 		if err != nil {
-			logger.Warnf("Fail to read filename")
+			logger.Warnf("Fail to read filename for %v", err)
+			return nil, fuse.ENOENT
 		}
-		f.privateCacheName = string(name)
-		// 1. 检查该镜像的私有缓存中是否存在cid文件
-		_, err = os.Lstat(filepath.Join(f.privateCachePath, f.privateCacheName))
-		if err != nil {
-			// 检测public cache中是否存在该文件
-			_, err := os.Lstat(filepath.Join("/var/lib/gear/public", f.privateCacheName))
-			if err == nil {
-				// 跳过下载步骤
-				// 创建硬连接到镜像私有缓存目录下
-				_, err = os.Lstat(filepath.Join(f.privateCachePath, f.privateCacheName))
-				if err != nil {
-					_, err := os.Lstat(filepath.Join(f.privateCachePath, f.privateCacheName))
-					if err != nil {
-						err := os.Link(filepath.Join("/var/lib/gear/public", f.privateCacheName), filepath.Join(f.privateCachePath, f.privateCacheName))
-						if err != nil {
-							if !strings.Contains(err.Error(), "file exists") {
-								logger.Fatalf("Fail to create hard link for %v", err)
-							}
-						}
-					}
-				}
-			} else {
-				// 从manager节点下载cid文件
-				resp, err := http.PostForm("http://"+ManagerIp+":"+ManagerPort+"/pull/"+f.privateCacheName, url.Values{})
-				if err != nil {
-					logger.Warnf("Fail to pull from manager for %v", err)
-				}
-				defer resp.Body.Close()
 
-				if resp.StatusCode != http.StatusOK {
-					logger.Warnf("Fail to pull file")
-				}
-
-				tgt, err := os.Create(filepath.Join("/var/lib/gear/public", f.privateCacheName))
-				if err != nil {
-					logger.Fatalf("Fail to create file for %V", err)
-				}
-
-				// 先对内容进行解压
-				gr, err := gzip.NewReader(resp.Body)
-				if err != nil {
-					logger.Warnf("Fail to create gzip reader for %v", err)
-				}
+		// 分块存储的文件，读取时只下载需要的块，pack中的小文件只下载文件本身
+		if entry, chunked, _ := pkg.ParseIndexEntry(name); chunked {
+			resp.Flags |= fuse.OpenKeepCache
+			if entry.Pack != nil {
+				return &PackedFileHandler{relativePath: f.relativePath, entry: entry}, nil
+			}
+			return &ChunkedFileHandler{relativePath: f.relativePath, entry: entry}, nil
+		}
 
-				// 现在内存中保留一份，加速后续的读取速度
-				b, err := ioutil.ReadAll(gr)
-				if err != nil {
-					logger.Warnf("Read gr err for %v", err)
+		f.privateCacheName = string(name)
+		if monitorFlag {
+			go func() {
+				RecordChan <- types.MonitorFile {
+					Hash: f.privateCacheName, 
+					RelativePath: f.relativePath, 
 				}
+			}()
+		}
 
-				f.buff = bytes.NewBuffer(b)
-				grCopy := bytes.NewReader(b)
+		// 没有缓存的大文件按范围读取，只下载读到的部分
+		cached := cachedObject(ctx, f.privateCacheName)
+		if !cached && f.sized && f.size >= RangeReadThreshold {
+			resp.Flags |= fuse.OpenKeepCache
+			return &RangeFileHandler{relativePath: f.relativePath, cid: f.privateCacheName, size: f.size}, nil
+		}
 
-				_, err = io.Copy(tgt, grCopy)
+		// 没有缓存的其他文件边下载边读取，下载完成后再链接到私有缓存和-init层
+		if !cached && f.sized {
+			download := streamObject(f.privateCacheName, f.relativePath)
+			go func() {
+				ctx, cancel := detachedContext()
+				defer cancel()
+				_, err := f.fetch(ctx)
 				if err != nil {
-					logger.Fatalf("Fail to copy for %v", err)
+					logger.Warnf("Fail to fetch %s for %v", f.relativePath, err)
+					return
 				}
+				f.linkInitLayer()
+			}()
 
-				gr.Close()
-				tgt.Close()
-
-				// 4. 创建硬连接到镜像私有缓存目录下
-				_, err = os.Lstat(filepath.Join(f.privateCachePath, f.privateCacheName))
-				if err != nil {
-					err := os.Link(filepath.Join("/var/lib/gear/public", f.privateCacheName), filepath.Join(f.privateCachePath, f.privateCacheName))
-					if err != nil {
-						if !strings.Contains(err.Error(), "file exists") {
-							logger.Fatalf("Fail to create hard link for %v", err)
-						}
-					}
-				}
-			}
+			resp.Flags |= fuse.OpenKeepCache
+			return &StreamFileHandler{relativePath: f.relativePath, cid: f.privateCacheName, size: f.size, download: download}, nil
+		}
 
-			// 修改文件的权限
-			IndexFileInfo, err := os.Lstat(filepath.Join(f.indexImagePath, f.relativePath))
-			if err != nil {
-				logger.Warnf("Fail to get index file info for %v", err)
-			}
-			err = os.Chmod(filepath.Join(f.privateCachePath, f.privateCacheName), IndexFileInfo.Mode())
-			if err != nil {
-				logger.Warnf("Fail to chmod for %v", err)
-			}
-			err = os.Chown(filepath.Join(f.privateCachePath, f.privateCacheName), int(IndexFileInfo.Sys().(*syscall.Stat_t).Uid), int(IndexFileInfo.Sys().(*syscall.Stat_t).Gid))
-			if err != nil {
-				logger.Warnf("Fail to chown for %v", err)
-			}
+		// 1. 下载cid文件到缓存中
+		target, err := f.fetch(ctx)
+		if err != nil {
+			logger.Warnf("Fail to fetch %s for %v", f.relativePath, err)
+			return nil, fuse.EIO
 		}
 
 		// 2. 打开私有缓存中的文件
-		file, err := os.Open(filepath.Join(f.privateCachePath, f.privateCacheName))
+		file, err := os.Open(target)
 		if err != nil {
 			logger.Warnf("Fail to open file: %v", err)
+			return nil, fuse.EIO
 		}
 		fileHandler.f = file
-		fileHandler.filepath = filepath.Join(f.privateCachePath, f.privateCacheName)
-		if f.buff != nil {
-			fileHandler.buff = f.buff
-		}
+		fileHandler.filepath = target
 
-		// 判断当前目录是否是镜像层还是-init层
-		// 如果是镜像层，则将创建文件硬链接到-init层
-		// 如果是-init层，则啥都不做
-		if f.initLayerPath != "" {
-			// 将文件link到-init层目录
-			_, err = os.Lstat(filepath.Join(f.initLayerPath, f.relativePath))
-			if err != nil {
-				initDir := path.Dir(filepath.Join(f.initLayerPath, f.relativePath))
-				_, err = os.Lstat(initDir)
-				if err != nil {
-					err := os.MkdirAll(initDir, os.ModePerm)
-					if err != nil {
-						logger.Warnf("Fail to create initDir for %v", err)
-					}
-				}
-				err = os.Link(filepath.Join("/var/lib/gear/public", f.privateCacheName), filepath.Join(f.initLayerPath, f.relativePath))
-				if err != nil {
-					if !strings.Contains(err.Error(), "file exists") {
-						logger.Fatalf("Fail to create hard link for %v", err)
-					}
-				}
-			}
-		}
+		f.linkInitLayer()
 
 		resp.Flags |= fuse.OpenKeepCache
 		return &fileHandler, nil
@@ -742,38 +583,10 @@ func (f *File) Open(ctx context.Context, req *fuse.OpenRequest, resp *fuse.OpenR
 	file, err := os.Open(filepath.Join(f.indexImagePath, f.relativePath))
 	if err != nil {
 		logger.Warnf("Fail to open file: %v", err)
+		return nil, fuse.EIO
 	}
 	fileHandler.f = file
 	fileHandler.filepath = filepath.Join(f.indexImagePath, f.relativePath)
-	if f.buff != nil {
-		fileHandler.buff = f.buff
-	}
-
-	// 创建硬链接到上层
-	if f.isRegular && (f.relativePath == "/prefetched" || f.relativePath == "/RecordFiles") {
-		// 创建硬链接到gear-work目录
-		indexPath := filepath.Join(f.indexImagePath, "..")
-		_, err = os.Lstat(filepath.Join(indexPath, "gear-work", f.relativePath))
-		if err != nil {
-			initDir := path.Dir(filepath.Join(indexPath, "gear-work", f.relativePath))
-			_, err := os.Lstat(initDir)
-			if err != nil {
-				// 复制路径
-				if pkg.CopyPath(f.indexImagePath, filepath.Join(indexPath, "gear-work"), f.relativePath) != true {
-					err := os.MkdirAll(initDir, os.ModePerm)
-					if err != nil {
-						logger.Warnf("Fail to create initDir for %v", err)
-					}
-				}
-			}
-			err = os.Link(filepath.Join("/var/lib/gear/public", f.privateCacheName), filepath.Join(indexPath, "gear-work", f.relativePath))
-			if err != nil {
-				if !strings.Contains(err.Error(), "file exists") {
-					logger.Fatalf("Fail to create hard link for %v", err)
-				}
-			}
-		}
-	}
 
 	if monitorFlag {
 		go func() {
@@ -792,6 +605,33 @@ func (f *File) Open(ctx context.Context, req *fuse.OpenRequest, resp *fuse.OpenR
 	return &fileHandler, nil
 }
 
+// linkInitLayer links the object of the external file into the -init layer
+// if the file is in an image layer, files of the -init layer are not linked
+func (f *File) linkInitLayer() {
+	if f.initLayerPath == "" {
+		return
+	}
+
+	_, err := os.Lstat(filepath.Join(f.initLayerPath, f.relativePath))
+	if err == nil {
+		return
+	}
+	initDir := path.Dir(filepath.Join(f.initLayerPath, f.relativePath))
+	_, err = os.Lstat(initDir)
+	if err != nil {
+		err := os.MkdirAll(initDir, os.ModePerm)
+		if err != nil {
+			logger.Warnf("Fail to create initDir for %v", err)
+		}
+	}
+	err = os.Link(filepath.Join("/var/lib/gear/public", f.privateCacheName), filepath.Join(f.initLayerPath, f.relativePath))
+	if err != nil {
+		if !strings.Contains(err.Error(), "file exists") {
+			logger.Warnf("Fail to create hard link for %v", err)
+		}
+	}
+}
+
 func (f *File) Readlink(ctx context.Context, req *fuse.ReadlinkRequest) (string, error) {
 	// fmt.Println("Readlink()!")
 	// fmt.Println(f)
@@ -818,7 +658,7 @@ func (f *File) Readlink(ctx context.Context, req *fuse.ReadlinkRequest) (string,
 			err = os.Symlink(target, filepath.Join(indexPath, "gear-work", f.relativePath))
 			if err != nil {
 				if !strings.Contains(err.Error(), "file exists") {
-					logger.Fatalf("Fail to create symlink for %v", err)
+					logger.Warnf("Fail to create symlink for %v", err)
 				}
 			}
 		}
@@ -827,53 +667,33 @@ func (f *File) Readlink(ctx context.Context, req *fuse.ReadlinkRequest) (string,
 	return target, err
 }
 
+// FileHandler reads a file of the upper dir, the cache or the index image.
+// Reads are positional, concurrent FUSE requests on the same handle, like
+// page faults of mmap, do not share a file offset.
 type FileHandler struct {
 	filepath string
 
 	f *os.File
-
-	buff *bytes.Buffer
 }
 
 func (fh *FileHandler) Release(ctx context.Context, req *fuse.ReleaseRequest) error {
+	if fh.f == nil {
+		return nil
+	}
 
 	return fh.f.Close()
 }
 
 func (fh *FileHandler) Read(ctx context.Context, req *fuse.ReadRequest, resp *fuse.ReadResponse) error {
-	// fmt.Println("fh.Read()!")
-	var err error
-	if fh.buff != nil {
-		_, err = fh.buff.Read(resp.Data)
-	} else {
-		buf := make([]byte, req.Size)
-		n, er := fh.f.Read(buf)
-		err = er
-		resp.Data = buf[:n]
-	}
-	
-	return err
-}
-
-func (fh *FileHandler) ReadAll(ctx context.Context) ([]byte, error) {
-	// fmt.Println("ReadAll()!")
-	// fmt.Println(fh)
-
-	var data []byte
-	var err error
-
-	if fh.buff != nil {
-		data = fh.buff.Bytes()
-		err = nil
-	} else if fh.filepath != "" {
-		// fmt.Println("Filepath: ", fh.filepath)
-		data, err = ioutil.ReadFile(fh.filepath)
-	} else {
-		// fmt.Println("No filepath")
-		data, err = ioutil.ReadAll(fh.f)
+	buf := make([]byte, req.Size)
+	n, err := fh.f.ReadAt(buf, req.Offset)
+	if err != nil && err != io.EOF {
+		logger.Warnf("Fail to read %s for %v", fh.filepath, err)
+		return fuse.EIO
 	}
+	resp.Data = buf[:n]
 
-	return data, err
+	return nil
 }
 
 func (fh *FileHandler) Flush(ctx context.Context, req *fuse.FlushRequest) error {
@@ -0,0 +1,675 @@
+package fs
+
+import (
+	"os"
+	"bytes"
+	"sync"
+	"strings"
+	"strconv"
+	"syscall"
+	"testing"
+	"time"
+	"os/exec"
+	"net/http"
+	"io/ioutil"
+	"math/rand"
+	"path/filepath"
+	"net/http/httptest"
+
+	"bazil.org/fuse"
+	fuseFS "bazil.org/fuse/fs"
+	"golang.org/x/net/context"
+	"github.com/seveirbian/gear/pkg"
+	"github.com/seveirbian/gear/types"
+	"github.com/seveirbian/gear/remote"
+	"github.com/klauspost/compress/zstd"
+)
+
+// testFile is a regular file of the test image, stored as an object written
+// with compression
+type testFile struct {
+	content     []byte
+	compression string
+}
+
+// legacyZstd is the compression of test objects of the zstd codec, which are
+// no longer written by gear but still read
+const legacyZstd = "legacy-zstd"
+
+// testObject returns the object of content written with compression
+func testObject(t *testing.T, content []byte, compression string) []byte {
+	var buf bytes.Buffer
+	if compression == legacyZstd {
+		buf.Write([]byte("\x89GEAR\x02"))
+		zw, err := zstd.NewWriter(&buf)
+		if err != nil {
+			t.Fatal(err)
+		}
+		zw.Write(content)
+		zw.Close()
+		return buf.Bytes()
+	}
+
+	w, err := pkg.NewObjectWriter(&buf, compression)
+	if err != nil {
+		t.Fatal(err)
+	}
+	w.Write(content)
+	err = w.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+	return buf.Bytes()
+}
+
+// mountTestFS mounts a gear fs of an index image holding files, whose
+// objects are served by an in-process manager, and returns the mount point
+// and the function unmounting it. The test is skipped if FUSE can not be
+// mounted.
+func mountTestFS(t *testing.T, files map[string]testFile) (string, func()) {
+	dir, err := ioutil.TempDir("", "gear-fs-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, sub := range []string{"index", "private", "upper", "public", "quarantine", "mnt"} {
+		err = os.Mkdir(filepath.Join(dir, sub), 0755)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	GearPublicCachePath = filepath.Join(dir, "public")
+	GearQuarantinePath = filepath.Join(dir, "quarantine")
+	objectFetcher = &fetcher{calls: map[string]*fetchCall{}, verified: map[string]bool{}, downloads: map[string]*download{}}
+
+	objects := map[string][]byte{}
+	sizes := map[string]int64{}
+	for name, file := range files {
+		cid := pkg.HashBytes(file.content)
+		objects[cid] = testObject(t, file.content, file.compression)
+		sizes["/"+name] = int64(len(file.content))
+		err = ioutil.WriteFile(filepath.Join(dir, "index", name), []byte(cid), 0644)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	srv := httptest.NewServer(serveObjects(objects))
+
+	host := strings.Split(strings.TrimPrefix(srv.URL, "http://"), ":")
+	filesys := Init(filepath.Join(dir, "index"), filepath.Join(dir, "private"), filepath.Join(dir, "upper"), "", host[0], host[1], nil, nil, false)
+	filesys.Inline = map[string]bool{}
+	filesys.Sizes = sizes
+
+	mountPoint := filepath.Join(dir, "mnt")
+	c, err := fuse.Mount(mountPoint)
+	if err != nil {
+		srv.Close()
+		os.RemoveAll(dir)
+		t.Skipf("FUSE is not available: %v", err)
+	}
+	go fuseFS.Serve(c, filesys)
+	<-c.Ready
+	if c.MountError != nil {
+		t.Fatal(c.MountError)
+	}
+
+	return mountPoint, func() {
+		fuse.Unmount(mountPoint)
+		c.Close()
+		srv.Close()
+		os.RemoveAll(dir)
+	}
+}
+
+// testContent returns size bytes of which the first half is random, so that
+// the content is compressed but not too much
+func testContent(size int) []byte {
+	content := make([]byte, size)
+	rand.Read(content[:size/2])
+	for i := size / 2; i < size; i++ {
+		content[i] = byte(i % 251)
+	}
+	return content
+}
+
+func TestMmapAndPread(t *testing.T) {
+	files := map[string]testFile{
+		// 大文件按范围读取，原始对象先完整下载
+		"seekable": {testContent(3 << 20), pkg.CompressionSeekable},
+		"raw":      {testContent(2 << 20), pkg.CompressionNone},
+		"zstd":     {testContent(2 << 20), pkg.CompressionZstd},
+		"legacy":   {testContent(2 << 20), legacyZstd},
+		// 小文件边下载边读取
+		"small":        {testContent(300 << 10), pkg.CompressionSeekable},
+		"small-zstd":   {testContent(100 << 10), pkg.CompressionZstd},
+		"small-legacy": {testContent(100 << 10), legacyZstd},
+		"small-gzip": {testContent(100 << 10), pkg.CompressionGzip},
+	}
+	mountPoint, unmount := mountTestFS(t, files)
+	defer unmount()
+
+	dir, err := ioutil.TempDir("", "gear-fs-test-want")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	// 挂载gear fs的进程不能读取其中的文件，否则缺页或runtime的poll等待gear fs
+	// 时会阻塞垃圾回收，gear fs也随之停止，所以由子进程读取
+	for name, file := range files {
+		want := filepath.Join(dir, name)
+		err = ioutil.WriteFile(want, file.content, 0644)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		cmd := exec.Command(os.Args[0], "-test.run=^TestReadMounted$", "-test.v")
+		cmd.Env = append(os.Environ(), "GEAR_FS_TEST_READ="+filepath.Join(mountPoint, name), "GEAR_FS_TEST_WANT="+want)
+		output, err := cmd.CombinedOutput()
+		if err != nil {
+			t.Errorf("Fail to read %s: %v\n%s", name, err, output)
+		}
+	}
+}
+
+// TestReadMounted is run by TestMmapAndPread in a child process, it reads the
+// file $GEAR_FS_TEST_READ by concurrent preads on one handle and by mmap, and
+// compares it with $GEAR_FS_TEST_WANT
+func TestReadMounted(t *testing.T) {
+	path := os.Getenv("GEAR_FS_TEST_READ")
+	if path == "" {
+		t.Skip("Only run by TestMmapAndPread")
+	}
+	want, err := ioutil.ReadFile(os.Getenv("GEAR_FS_TEST_WANT"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	f, err := os.Open(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+
+	// 同一句柄上的并发读取不共享偏移
+	var wg sync.WaitGroup
+	for g := 0; g < 8; g++ {
+		wg.Add(1)
+		go func(seed int64) {
+			defer wg.Done()
+			r := rand.New(rand.NewSource(seed))
+			for i := 0; i < 16; i++ {
+				off := r.Int63n(int64(len(want)))
+				p := make([]byte, 1+r.Intn(64<<10))
+				n, err := f.ReadAt(p, off)
+				if err != nil && off+int64(len(p)) <= int64(len(want)) {
+					t.Errorf("ReadAt %d: %v", off, err)
+					return
+				}
+				if !bytes.Equal(p[:n], want[off:off+int64(n)]) {
+					t.Errorf("ReadAt %d read wrong content", off)
+					return
+				}
+			}
+		}(int64(g))
+	}
+	wg.Wait()
+
+	data, err := syscall.Mmap(int(f.Fd()), 0, len(want), syscall.PROT_READ, syscall.MAP_SHARED)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer syscall.Munmap(data)
+	if !bytes.Equal(data, want) {
+		t.Error("Mmap read wrong content")
+	}
+}
+
+func TestSharedLibrary(t *testing.T) {
+	var lib []byte
+	for _, path := range []string{"/usr/lib/x86_64-linux-gnu/libsqlite3.so.0", "/usr/lib/x86_64-linux-gnu/libz.so.1", "/lib/x86_64-linux-gnu/libz.so.1", "/usr/lib/libz.so.1"} {
+		content, err := ioutil.ReadFile(path)
+		if err == nil {
+			lib = content
+			break
+		}
+	}
+	if lib == nil {
+		t.Skip("No shared library to load")
+	}
+
+	mountPoint, unmount := mountTestFS(t, map[string]testFile{
+		"lib.so": {lib, pkg.CompressionSeekable},
+	})
+	defer unmount()
+
+	// 动态链接器用mmap加载preload的库，失败时只输出错误
+	cmd := exec.Command("/bin/true")
+	cmd.Env = append(os.Environ(), "LD_PRELOAD="+filepath.Join(mountPoint, "lib.so"))
+	output, err := cmd.CombinedOutput()
+	if err != nil || len(output) > 0 {
+		t.Fatalf("Fail to load the shared library: %v %s", err, output)
+	}
+}
+
+func TestSQLite(t *testing.T) {
+	sqlite, err := exec.LookPath("sqlite3")
+	if err != nil {
+		t.Skip("No sqlite3")
+	}
+
+	dir, err := ioutil.TempDir("", "gear-fs-test-db")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	db := filepath.Join(dir, "test.db")
+	output, err := exec.Command(sqlite, db, `CREATE TABLE t(k INTEGER PRIMARY KEY, v TEXT);
+		WITH RECURSIVE n(i) AS (SELECT 1 UNION ALL SELECT i+1 FROM n WHERE i < 20000)
+		INSERT INTO t SELECT i, hex(randomblob(64)) FROM n;`).CombinedOutput()
+	if err != nil {
+		t.Fatalf("Fail to create the database: %v %s", err, output)
+	}
+	content, err := ioutil.ReadFile(db)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	mountPoint, unmount := mountTestFS(t, map[string]testFile{
+		"test.db": {content, pkg.CompressionSeekable},
+	})
+	defer unmount()
+
+	// 分别用mmap和pread读取数据库
+	for _, mmapSize := range []string{"0", "268435456"} {
+		query := "PRAGMA mmap_size=" + mmapSize + "; PRAGMA integrity_check; SELECT count(*), sum(length(v)), max(v) FROM t;"
+		want, err := exec.Command(sqlite, "-readonly", db, query).CombinedOutput()
+		if err != nil {
+			t.Fatalf("Fail to query the database: %v %s", err, want)
+		}
+		got, err := exec.Command(sqlite, "-readonly", filepath.Join(mountPoint, "test.db"), query).CombinedOutput()
+		if err != nil || !bytes.Equal(got, want) {
+			t.Fatalf("Query with mmap_size %s = %s, %v, want %s", mmapSize, got, err, want)
+		}
+	}
+}
+
+func TestStreamDefaultObject(t *testing.T) {
+	content := testContent(2 << 20)
+	cid := pkg.HashBytes(content)
+	object := testObject(t, content, pkg.DefaultCompression)
+
+	// 先发送对象的前一半，直到release被关闭才发送其余部分
+	release := make(chan struct{})
+	cleanup := testFetchEnv(t, func(w http.ResponseWriter, r *http.Request) {
+		w.Write(object[:len(object)/2])
+		w.(http.Flusher).Flush()
+		select {
+		case <-release:
+		case <-r.Context().Done():
+			return
+		}
+		w.Write(object[len(object)/2:])
+	})
+	defer cleanup()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	d := streamObject(cid, "default")
+	p := make([]byte, 4096)
+	err := d.ReadAt(ctx, p, 100)
+	if err != nil {
+		t.Fatalf("Read before the download finishes: %v", err)
+	}
+	if !bytes.Equal(p, content[100:100+len(p)]) {
+		t.Fatal("Read wrong content before the download finishes")
+	}
+
+	close(release)
+	err = d.ReadAt(ctx, p, int64(len(content)-len(p)))
+	if err != nil || !bytes.Equal(p, content[len(content)-len(p):]) {
+		t.Fatalf("Read the end of the object: %v", err)
+	}
+}
+
+func TestRangeDefaultObject(t *testing.T) {
+	content := testContent(4 << 20)
+	cid := pkg.HashBytes(content)
+	object := testObject(t, content, pkg.DefaultCompression)
+
+	// 记录完整下载的请求和按范围读取的字节数
+	var mu sync.Mutex
+	var whole int
+	var served int64
+	serve := serveObjects(map[string][]byte{cid: object})
+	cleanup := testFetchEnv(t, func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		if r.Header.Get("Range") == "" {
+			whole++
+		}
+		mu.Unlock()
+		cw := &countingWriter{ResponseWriter: w}
+		serve(cw, r)
+		mu.Lock()
+		served += cw.n
+		mu.Unlock()
+	})
+	defer cleanup()
+
+	fh := &RangeFileHandler{relativePath: "default", cid: cid, size: int64(len(content))}
+	for _, off := range []int64{3 << 20, 100, int64(len(content)) - 1000} {
+		req := &fuse.ReadRequest{Offset: off, Size: 64 << 10}
+		resp := &fuse.ReadResponse{}
+		err := fh.Read(context.Background(), req, resp)
+		if err != nil {
+			t.Fatalf("Read %d: %v", off, err)
+		}
+		end := off + int64(req.Size)
+		if end > int64(len(content)) {
+			end = int64(len(content))
+		}
+		if !bytes.Equal(resp.Data, content[off:end]) {
+			t.Fatalf("Read %d read wrong content", off)
+		}
+	}
+
+	mu.Lock()
+	defer mu.Unlock()
+	if whole > 0 {
+		t.Fatalf("The whole object is fetched %d times", whole)
+	}
+	if served >= int64(len(object))/2 {
+		t.Fatalf("%d bytes of the object of %d bytes are fetched", served, len(object))
+	}
+}
+
+// countingWriter counts the bytes of the response body
+type countingWriter struct {
+	http.ResponseWriter
+	n int64
+}
+
+func (w *countingWriter) Write(p []byte) (int, error) {
+	n, err := w.ResponseWriter.Write(p)
+	w.n += int64(n)
+	return n, err
+}
+
+func TestConcurrentFetchOfCorruptedObject(t *testing.T) {
+	content := testContent(1 << 20)
+	cid := pkg.HashBytes(content)
+	object := testObject(t, content, pkg.DefaultCompression)
+
+	var mu sync.Mutex
+	pulls := 0
+	cleanup := testFetchEnv(t, func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		pulls++
+		mu.Unlock()
+		// 下载较慢，所有读者都在下载结束前开始
+		time.Sleep(100 * time.Millisecond)
+		w.Write(object)
+	})
+	defer cleanup()
+
+	// 缓存中的对象已经损坏，而且足够大，校验需要一段时间
+	target := filepath.Join(GearPublicCachePath, cid)
+	err := ioutil.WriteFile(target, nil, 0644)
+	if err == nil {
+		err = os.Truncate(target, 256<<20)
+	}
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// 一个读者只检查缓存，校验开始后其余读者获取对象
+	var wg sync.WaitGroup
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		cachedObject(context.Background(), cid)
+	}()
+	for {
+		objectFetcher.mu.Lock()
+		verifying := len(objectFetcher.calls) > 0
+		objectFetcher.mu.Unlock()
+		if verifying {
+			break
+		}
+		time.Sleep(time.Millisecond)
+	}
+	for i := 0; i < 16; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			path, err := fetchObject(context.Background(), cid, "corrupted")
+			if err != nil {
+				t.Errorf("Fail to fetch the object: %v", err)
+				return
+			}
+			got, err := ioutil.ReadFile(path)
+			if err != nil || !bytes.Equal(got, content) {
+				t.Errorf("Fetch wrong content: %v", err)
+			}
+		}()
+	}
+	wg.Wait()
+
+	if pulls != 1 {
+		t.Fatalf("The object is downloaded %d times, want 1", pulls)
+	}
+	if !cachedObject(context.Background(), cid) {
+		t.Fatal("The fetched object is not cached")
+	}
+}
+
+// testFetchEnv sets up public cache and quarantine in a temp dir and a manager
+// answering with handler, it returns the function cleaning them up
+func testFetchEnv(t *testing.T, handler http.HandlerFunc) func() {
+	dir, err := ioutil.TempDir("", "gear-fs-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	GearPublicCachePath = filepath.Join(dir, "public")
+	GearQuarantinePath = filepath.Join(dir, "quarantine")
+	os.Mkdir(GearPublicCachePath, 0755)
+	objectFetcher = &fetcher{calls: map[string]*fetchCall{}, verified: map[string]bool{}, downloads: map[string]*download{}}
+
+	srv := httptest.NewServer(handler)
+	Remote = remote.NewClient(strings.TrimPrefix(srv.URL, "http://"))
+
+	return func() {
+		srv.Close()
+		os.RemoveAll(dir)
+	}
+}
+
+// serveObjects answers /pull/<cid> with objects like manager, Range requests
+// are supported
+func serveObjects(objects map[string][]byte) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		object, ok := objects[strings.TrimPrefix(r.URL.Path, "/pull/")]
+		if !ok {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		http.ServeContent(w, r, "", time.Time{}, bytes.NewReader(object))
+	}
+}
+
+func TestCorruptedCacheIsRefetched(t *testing.T) {
+	content := testContent(1 << 20)
+	cid := pkg.HashBytes(content)
+	cleanup := testFetchEnv(t, serveObjects(map[string][]byte{cid: testObject(t, content, pkg.DefaultCompression)}))
+	defer cleanup()
+
+	corrupted := append([]byte{}, content...)
+	corrupted[100] ^= 0xff
+	target := filepath.Join(GearPublicCachePath, cid)
+	err := ioutil.WriteFile(target, corrupted, 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if cachedObject(context.Background(), cid) {
+		t.Fatal("The corrupted object is used")
+	}
+	path, err := fetchObject(context.Background(), cid, "corrupted")
+	if err != nil {
+		t.Fatalf("Fail to refetch the object: %v", err)
+	}
+	got, err := ioutil.ReadFile(path)
+	if err != nil || !bytes.Equal(got, content) {
+		t.Fatalf("Refetch wrong content: %v", err)
+	}
+
+	// 损坏的对象被移入quarantine
+	files, err := ioutil.ReadDir(GearQuarantinePath)
+	if err != nil || len(files) != 1 {
+		t.Fatalf("Quarantine has %d files, want 1: %v", len(files), err)
+	}
+	quarantined, err := ioutil.ReadFile(filepath.Join(GearQuarantinePath, files[0].Name()))
+	if err != nil || !bytes.Equal(quarantined, corrupted) {
+		t.Fatalf("The corrupted object is not quarantined: %v", err)
+	}
+}
+
+func TestMismatchedDownloadIsNotCached(t *testing.T) {
+	defer func(delay time.Duration, retries int) {
+		FetchRetryDelay, FetchRetries = delay, retries
+	}(FetchRetryDelay, FetchRetries)
+	FetchRetryDelay, FetchRetries = 0, 1
+	content := testContent(1 << 20)
+	cid := pkg.HashBytes(content)
+	corrupted := append([]byte{}, content...)
+	corrupted[len(corrupted)-1] ^= 0xff
+
+	for _, compression := range []string{pkg.DefaultCompression, pkg.CompressionGzip, pkg.CompressionNone} {
+		cleanup := testFetchEnv(t, serveObjects(map[string][]byte{cid: testObject(t, corrupted, compression)}))
+
+		_, err := fetchObject(context.Background(), cid, "mismatched")
+		if _, ok := err.(*pkg.MismatchError); !ok {
+			cleanup()
+			t.Fatalf("%s: fetch err = %v, want a mismatch", compression, err)
+		}
+		// public cache中既没有对象也没有临时文件
+		files, err := ioutil.ReadDir(GearPublicCachePath)
+		if err != nil || len(files) != 0 {
+			cleanup()
+			t.Fatalf("%s: public cache has %d files: %v", compression, len(files), err)
+		}
+		files, err = ioutil.ReadDir(GearQuarantinePath)
+		if err != nil || len(files) == 0 {
+			cleanup()
+			t.Fatalf("%s: the mismatched download is not quarantined: %v", compression, err)
+		}
+		cleanup()
+	}
+}
+
+func TestChunkedRead(t *testing.T) {
+	content := testContent(3 << 20)
+	entry := &types.IndexEntry{Size: int64(len(content))}
+	objects := map[string][]byte{}
+	// 块的大小不同，最后一个块是其余的内容
+	offset := int64(0)
+	for _, size := range []int64{700 << 10, 1 << 20, 300 << 10, -1} {
+		if size < 0 {
+			size = entry.Size - offset
+		}
+		chunk := content[offset : offset+size]
+		cid := pkg.HashBytes(chunk)
+		objects[cid] = testObject(t, chunk, pkg.DefaultCompression)
+		entry.Chunks = append(entry.Chunks, types.Chunk{CID: cid, Offset: offset, Size: size})
+		offset += size
+	}
+	cleanup := testFetchEnv(t, serveObjects(objects))
+	defer cleanup()
+
+	fh := &ChunkedFileHandler{relativePath: "chunked", entry: entry}
+	boundary := entry.Chunks[1].Offset
+	tests := []struct {
+		name   string
+		offset int64
+		size   int
+	}{
+		{"first chunk", 0, 4096},
+		{"inside a chunk", boundary + 100, 4096},
+		{"ends at a boundary", boundary - 4096, 4096},
+		{"starts at a boundary", boundary, 4096},
+		{"across a boundary", boundary - 100, 4096},
+		{"across three chunks", boundary - 100, 1<<20 + 200},
+		{"whole file", 0, len(content)},
+		{"past the end", int64(len(content)) - 100, 4096},
+		{"after the end", int64(len(content)), 4096},
+	}
+	for _, test := range tests {
+		req := &fuse.ReadRequest{Offset: test.offset, Size: test.size}
+		resp := &fuse.ReadResponse{}
+		err := fh.Read(context.Background(), req, resp)
+		if err != nil {
+			t.Fatalf("%s: %v", test.name, err)
+		}
+		end := test.offset + int64(test.size)
+		if end > int64(len(content)) {
+			end = int64(len(content))
+		}
+		if !bytes.Equal(resp.Data, content[test.offset:end]) {
+			t.Fatalf("%s: read wrong content", test.name)
+		}
+	}
+}
+
+func TestPackedRead(t *testing.T) {
+	pack := testContent(1 << 20)
+	packCID := pkg.HashBytes(pack)
+	entry := &types.IndexEntry{Size: 1000, Pack: &types.PackMember{Pack: packCID, Offset: 300 << 10}}
+	content := pack[entry.Pack.Offset : entry.Pack.Offset+entry.Size]
+	entry.Pack.CID = pkg.HashBytes(content)
+
+	// 与manager的/range相同返回pack中的一段，corrupt时返回错误的内容
+	corrupt := false
+	cleanup := testFetchEnv(t, func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/range/"+packCID {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		offset, _ := strconv.ParseInt(r.FormValue("offset"), 10, 64)
+		length, _ := strconv.ParseInt(r.FormValue("length"), 10, 64)
+		data := append([]byte{}, pack[offset:offset+length]...)
+		if corrupt {
+			data[0] ^= 0xff
+		}
+		w.Write(data)
+	})
+	defer cleanup()
+
+	defer func(delay time.Duration, retries int) {
+		FetchRetryDelay, FetchRetries = delay, retries
+	}(FetchRetryDelay, FetchRetries)
+	FetchRetryDelay, FetchRetries = 0, 1
+
+	fh := &PackedFileHandler{relativePath: "packed", entry: entry}
+	target := filepath.Join(GearPublicCachePath, entry.Pack.CID)
+
+	// 与cid不一致的内容不被读取也不被缓存
+	corrupt = true
+	err := fh.Read(context.Background(), &fuse.ReadRequest{Offset: 0, Size: 4096}, &fuse.ReadResponse{})
+	if err != fuse.EIO {
+		t.Fatalf("Read a corrupted member: %v", err)
+	}
+	if exists(target) {
+		t.Fatal("The corrupted member is cached")
+	}
+
+	corrupt = false
+	resp := &fuse.ReadResponse{}
+	err = fh.Read(context.Background(), &fuse.ReadRequest{Offset: 10, Size: 4096}, resp)
+	if err != nil || !bytes.Equal(resp.Data, content[10:]) {
+		t.Fatalf("Read the member: %v", err)
+	}
+	if !cachedObject(context.Background(), entry.Pack.CID) {
+		t.Fatal("The member is not cached")
+	}
+}
@@ -0,0 +1,129 @@
+package fs
+
+import (
+	"os"
+	"io"
+	"strconv"
+	"net/url"
+	"path/filepath"
+
+	"bazil.org/fuse"
+	"golang.org/x/net/context"
+	"github.com/seveirbian/gear/pkg"
+	"github.com/seveirbian/gear/types"
+)
+
+// PackedFileHandler serves a small file stored in a pack object, only the
+// file itself is fetched from manager unless the whole pack is prefetched
+type PackedFileHandler struct {
+	relativePath string
+
+	entry *types.IndexEntry
+}
+
+func (fh *PackedFileHandler) Read(ctx context.Context, req *fuse.ReadRequest, resp *fuse.ReadResponse) error {
+	start := req.Offset
+	end := req.Offset + int64(req.Size)
+	if end > fh.entry.Size {
+		end = fh.entry.Size
+	}
+	if start >= end {
+		resp.Data = resp.Data[:0]
+		return nil
+	}
+
+	path, offset, err := fetchPackMember(ctx, fh.entry, fh.relativePath)
+	if err != nil {
+		logger.Warnf("Fail to fetch %s from pack %s for %v", fh.relativePath, fh.entry.Pack.Pack, err)
+		return fuse.EIO
+	}
+
+	data := make([]byte, end-start)
+	err = readFileAt(path, data, offset+start)
+	if err != nil {
+		logger.Warnf("Fail to read %s for %v", fh.relativePath, err)
+		return fuse.EIO
+	}
+
+	resp.Data = data
+
+	return nil
+}
+
+func (fh *PackedFileHandler) Release(ctx context.Context, req *fuse.ReleaseRequest) error {
+	return nil
+}
+
+func (fh *PackedFileHandler) Flush(ctx context.Context, req *fuse.FlushRequest) error {
+	return nil
+}
+
+// fetchPackMember returns the file holding the content of a packed file and
+// the offset of the content in it
+func fetchPackMember(ctx context.Context, entry *types.IndexEntry, relativePath string) (string, int64, error) {
+	member := entry.Pack
+
+	// 整个pack已经预取到public cache中
+	packPath := filepath.Join(GearPublicCachePath, member.Pack)
+	if cachedObject(ctx, member.Pack) {
+		return packPath, member.Offset, nil
+	}
+
+	target := filepath.Join(GearPublicCachePath, member.CID)
+	if cachedObject(ctx, member.CID) {
+		return target, 0, nil
+	}
+
+	// 从manager节点读取pack中的一段，校验后写入public cache
+	_, err := objectFetcher.do(ctx, member.CID, func(ctx context.Context) (string, error) {
+		err := verifyCached(member.CID, target)
+		if err == nil {
+			return target, nil
+		}
+
+		err = retryFetch(ctx, member.CID, relativePath, func() error {
+			return pullPackMember(ctx, entry, target)
+		})
+		if err != nil {
+			return "", err
+		}
+		objectFetcher.setVerified(member.CID)
+
+		return target, nil
+	})
+	if err != nil {
+		return "", 0, err
+	}
+
+	// 记录pack的cid，预取时下载整个pack
+	if monitorFlag {
+		go func() {
+			RecordChan <- types.MonitorFile {
+				Hash: member.Pack,
+				RelativePath: relativePath,
+			}
+		}()
+	}
+
+	return target, 0, nil
+}
+
+// pullPackMember reads the content of a packed file from its pack object on
+// manager, checks it against its cid and writes it into target
+func pullPackMember(ctx context.Context, entry *types.IndexEntry, target string) error {
+	member := entry.Pack
+
+	v := url.Values{
+		"offset": []string{strconv.FormatInt(member.Offset, 10)},
+		"length": []string{strconv.FormatInt(entry.Size, 10)},
+	}
+	resp, err := Remote.PostForm(ctx, "/range/"+member.Pack, v, nil)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	return writeCacheFile(target, func(f *os.File) error {
+		return pkg.VerifyCID(member.CID, io.TeeReader(resp.Body, f))
+	})
+}
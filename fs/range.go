@@ -0,0 +1,262 @@
+package fs
+
+import (
+	"fmt"
+	"sync"
+	"path/filepath"
+
+	"bazil.org/fuse"
+	"golang.org/x/net/context"
+	"github.com/seveirbian/gear/pkg"
+)
+
+var (
+	// RangeReadThreshold is the size from which regular files which are not
+	// cached are read by range instead of fetching the whole object on open
+	RangeReadThreshold int64 = 1 << 20
+
+	// seek tables are read from the end of objects, most fit in this tail
+	seekTableTailSize int64 = 64 * 1024
+)
+
+// RangeFileHandler serves a large file stored as an object which is not in
+// public cache, each read only fetches the bytes of the object covering it
+// with HTTP Range requests. Seekable objects are read by their frames, which
+// are checked by their zstd checksums, other objects are read while they are
+// downloaded as a whole. Ranges of raw objects can not be checked, so they
+// are downloaded and checked against the cid before they are read.
+type RangeFileHandler struct {
+	relativePath string
+	cid string
+	size int64
+
+	// mu只保护下面的状态，请求manager时不持有锁，同一句柄上的读取可以并发
+	mu sync.Mutex
+	compression string
+	table *pkg.SeekTable
+	// 最近解压的帧，顺序读取时一个帧会被多次读取
+	frame int
+	frameData []byte
+
+	// 不能按范围读取的对象边下载边读取，下载失败后置为nil
+	download *download
+}
+
+func (fh *RangeFileHandler) Read(ctx context.Context, req *fuse.ReadRequest, resp *fuse.ReadResponse) error {
+	start := req.Offset
+	end := req.Offset + int64(req.Size)
+	if end > fh.size {
+		end = fh.size
+	}
+	if start >= end {
+		resp.Data = resp.Data[:0]
+		return nil
+	}
+
+	data := make([]byte, end-start)
+
+	// 对象已经被完整下载到public cache中
+	target := filepath.Join(GearPublicCachePath, fh.cid)
+	if cachedObject(ctx, fh.cid) {
+		err := readFileAt(target, data, start)
+		if err != nil {
+			logger.Warnf("Fail to read %s for %v", fh.relativePath, err)
+			return fuse.EIO
+		}
+		resp.Data = data
+		return nil
+	}
+
+	fh.mu.Lock()
+	download := fh.download
+	fh.mu.Unlock()
+
+	var err error
+	if download == nil {
+		err = fh.readRange(ctx, data, start)
+		if err == errRangeUnverifiable {
+			_, err = fetchObject(ctx, fh.cid, fh.relativePath)
+			if err == nil {
+				err = readFileAt(target, data, start)
+			}
+		}
+		if err == errRangeUnsupported {
+			// 对象不能按范围读取，在后台下载整个对象
+			fh.mu.Lock()
+			if fh.download == nil {
+				fh.download = streamObject(fh.cid, fh.relativePath)
+			}
+			download = fh.download
+			fh.mu.Unlock()
+		}
+	}
+
+	if download != nil {
+		err = download.ReadAt(ctx, data, start)
+		if err != nil && ctx.Err() == nil {
+			fh.mu.Lock()
+			if fh.download == download {
+				fh.download = nil
+			}
+			fh.mu.Unlock()
+		}
+	}
+	if err != nil && ctx.Err() != nil {
+		return fuse.EINTR
+	}
+	if err != nil {
+		logger.Warnf("Fail to read %s from %s for %v", fh.relativePath, fh.cid, err)
+		return fuse.EIO
+	}
+
+	resp.Data = data
+
+	return nil
+}
+
+// readRange reads the content at start into data from the object
+func (fh *RangeFileHandler) readRange(ctx context.Context, data []byte, start int64) error {
+	compression, table, err := fh.objectInfo(ctx)
+	if err != nil {
+		return err
+	}
+
+	switch compression {
+	case pkg.CompressionNone:
+		return errRangeUnverifiable
+	case pkg.CompressionSeekable:
+		return fh.readFrames(ctx, table, data, start)
+	}
+
+	return errRangeUnsupported
+}
+
+// objectInfo returns the compression of the object and the seek table of
+// seekable objects, they are fetched by the first reads and kept in fh
+func (fh *RangeFileHandler) objectInfo(ctx context.Context) (string, *pkg.SeekTable, error) {
+	fh.mu.Lock()
+	compression, table := fh.compression, fh.table
+	fh.mu.Unlock()
+
+	// 并发的首次读取可能都会请求，结果相同
+	if compression == "" {
+		header, _, err := fetchRange(ctx, fh.cid, 0, pkg.ObjectHeaderSize)
+		if err != nil {
+			return "", nil, err
+		}
+		compression, err = pkg.ObjectCompression(header)
+		if err != nil {
+			return "", nil, err
+		}
+	}
+	if compression == pkg.CompressionSeekable && table == nil {
+		var err error
+		table, err = fh.readSeekTable(ctx)
+		if err != nil {
+			return "", nil, err
+		}
+	}
+
+	fh.mu.Lock()
+	fh.compression, fh.table = compression, table
+	fh.mu.Unlock()
+
+	return compression, table, nil
+}
+
+// readFrames reads the content at start into data from the frames of the
+// seekable object covering it
+func (fh *RangeFileHandler) readFrames(ctx context.Context, table *pkg.SeekTable, data []byte, start int64) error {
+	end := start + int64(len(data))
+	first, last := table.FramesOf(start, end)
+	if first == last {
+		return fmt.Errorf("No frame of [%d, %d)", start, end)
+	}
+
+	fh.mu.Lock()
+	cached, cachedData := fh.frame, fh.frameData
+	fh.mu.Unlock()
+	if cachedData == nil {
+		cached = -1
+	}
+
+	// 一次请求读取所有需要的帧
+	var compressed []byte
+	if first != cached || last-first > 1 {
+		from := table.Frames[first].Offset
+		to := table.Frames[last-1].Offset + table.Frames[last-1].CompressedSize
+		var err error
+		compressed, _, err = fetchRange(ctx, fh.cid, from, to)
+		if err != nil {
+			return err
+		}
+	}
+
+	for i := first; i < last; i++ {
+		frame := table.Frames[i]
+		content := cachedData
+		if i != cached {
+			from := frame.Offset - table.Frames[first].Offset
+			var err error
+			content, err = pkg.DecodeFrame(compressed[from : from+frame.CompressedSize])
+			if err != nil {
+				return err
+			}
+			if int64(len(content)) != frame.Size {
+				return fmt.Errorf("Frame %d has %d bytes instead of %d", i, len(content), frame.Size)
+			}
+			fh.mu.Lock()
+			fh.frame, fh.frameData = i, content
+			fh.mu.Unlock()
+		}
+
+		from := start
+		if frame.ContentOffset > from {
+			from = frame.ContentOffset
+		}
+		to := end
+		if frame.ContentOffset+frame.Size < to {
+			to = frame.ContentOffset + frame.Size
+		}
+		copy(data[from-start:to-start], content[from-frame.ContentOffset:to-frame.ContentOffset])
+	}
+
+	return nil
+}
+
+// readSeekTable reads the seek table from the end of the object
+func (fh *RangeFileHandler) readSeekTable(ctx context.Context) (*pkg.SeekTable, error) {
+	tail, objectSize, err := fetchRange(ctx, fh.cid, -seekTableTailSize, 0)
+	if err != nil {
+		return nil, err
+	}
+
+	size, err := pkg.SeekTableSize(tail)
+	if err != nil {
+		return nil, err
+	}
+	if size > int64(len(tail)) {
+		tail, objectSize, err = fetchRange(ctx, fh.cid, -size, 0)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	table, err := pkg.ParseSeekTable(tail, objectSize)
+	if err != nil {
+		return nil, err
+	}
+	if table.Size != fh.size {
+		return nil, fmt.Errorf("Object has %d bytes instead of %d", table.Size, fh.size)
+	}
+
+	return table, nil
+}
+
+func (fh *RangeFileHandler) Release(ctx context.Context, req *fuse.ReleaseRequest) error {
+	return nil
+}
+
+func (fh *RangeFileHandler) Flush(ctx context.Context, req *fuse.FlushRequest) error {
+	return nil
+}
@@ -0,0 +1,195 @@
+package fs
+
+import (
+	"os"
+	"io"
+	"sync"
+	"path/filepath"
+
+	"bazil.org/fuse"
+	"golang.org/x/net/context"
+)
+
+// download is an object being downloaded into public cache. It records how
+// much of the content is written into the temp file, so that readers get the
+// bytes as soon as they arrive instead of waiting for the whole object. Only
+// seekable objects, which zstd objects are written as, are read before the
+// download finishes, by frames which are checked by their zstd checksums, the
+// other objects are read after they are checked against their cid. The object is committed to the cache only
+// if it matches its cid.
+type download struct {
+	target string
+
+	// 读者持有读锁读取临时文件，写者在关闭临时文件前获取写锁
+	mu      sync.RWMutex
+	file    *os.File
+	written int64
+	// changed is closed and replaced whenever written grows or the download
+	// finishes
+	changed  chan struct{}
+	finished bool
+	err      error
+}
+
+func newDownload(cid string) *download {
+	return &download{
+		target:  filepath.Join(GearPublicCachePath, cid),
+		changed: make(chan struct{}),
+	}
+}
+
+// start begins an attempt writing the content into file
+func (d *download) start(file *os.File) {
+	d.mu.Lock()
+	d.file = file
+	d.written = 0
+	d.mu.Unlock()
+}
+
+// stop ends the attempt, readers do not read the temp file after it
+func (d *download) stop() {
+	d.mu.Lock()
+	d.file = nil
+	d.mu.Unlock()
+}
+
+// finish ends the download, the object is in public cache if err is nil.
+// Only the first call counts.
+func (d *download) finish(err error) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	if d.finished {
+		return
+	}
+	d.file = nil
+	d.finished = true
+	d.err = err
+	close(d.changed)
+}
+
+// writer returns the writer of the attempt writing into file
+func (d *download) writer(file *os.File) io.Writer {
+	return &downloadWriter{d: d, file: file}
+}
+
+type downloadWriter struct {
+	d    *download
+	file *os.File
+}
+
+func (w *downloadWriter) Write(p []byte) (int, error) {
+	n, err := w.file.Write(p)
+
+	w.d.mu.Lock()
+	if w.d.file == w.file {
+		w.d.written += int64(n)
+		close(w.d.changed)
+		w.d.changed = make(chan struct{})
+	}
+	w.d.mu.Unlock()
+
+	return n, err
+}
+
+// ReadAt reads len(p) bytes of the content at off, waiting until they are
+// downloaded or ctx is done
+func (d *download) ReadAt(ctx context.Context, p []byte, off int64) error {
+	end := off + int64(len(p))
+	for {
+		d.mu.RLock()
+		if d.file != nil && d.written >= end {
+			_, err := d.file.ReadAt(p, off)
+			d.mu.RUnlock()
+			return err
+		}
+		if d.finished {
+			err := d.err
+			d.mu.RUnlock()
+			if err != nil {
+				return err
+			}
+			return readFileAt(d.target, p, off)
+		}
+		changed := d.changed
+		d.mu.RUnlock()
+
+		select {
+		case <-changed:
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+}
+
+// streamObject fetches the object cid into public cache in background and
+// returns its download, seekable objects are read while the fetch goes on
+func streamObject(cid, relativePath string) *download {
+	d := objectFetcher.download(cid)
+	go func() {
+		ctx, cancel := detachedContext()
+		defer cancel()
+		_, err := fetchObject(ctx, cid, relativePath)
+		objectFetcher.finish(cid, d, err)
+	}()
+
+	return d
+}
+
+// StreamFileHandler serves a file whose object is being downloaded, reads
+// return as soon as the frames they need are downloaded and checked, or the
+// whole object is checked against the cid if it is not seekable
+type StreamFileHandler struct {
+	relativePath string
+	cid string
+	size int64
+
+	// 下载失败后置为nil，下次读取时重新下载
+	mu sync.Mutex
+	download *download
+}
+
+func (fh *StreamFileHandler) Read(ctx context.Context, req *fuse.ReadRequest, resp *fuse.ReadResponse) error {
+	start := req.Offset
+	end := req.Offset + int64(req.Size)
+	if end > fh.size {
+		end = fh.size
+	}
+	if start >= end {
+		resp.Data = resp.Data[:0]
+		return nil
+	}
+
+	fh.mu.Lock()
+	if fh.download == nil {
+		fh.download = streamObject(fh.cid, fh.relativePath)
+	}
+	download := fh.download
+	fh.mu.Unlock()
+
+	data := make([]byte, end-start)
+	err := download.ReadAt(ctx, data, start)
+	if err != nil && ctx.Err() != nil {
+		return fuse.EINTR
+	}
+	if err != nil {
+		logger.Warnf("Fail to read %s for %v", fh.relativePath, err)
+		fh.mu.Lock()
+		if fh.download == download {
+			fh.download = nil
+		}
+		fh.mu.Unlock()
+		return fuse.EIO
+	}
+	resp.Data = data
+
+	return nil
+}
+
+func (fh *StreamFileHandler) Release(ctx context.Context, req *fuse.ReleaseRequest) error {
+	return nil
+}
+
+func (fh *StreamFileHandler) Flush(ctx context.Context, req *fuse.FlushRequest) error {
+	return nil
+}
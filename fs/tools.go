@@ -4,6 +4,8 @@ import (
 	"errors"
 	"strings"
 	"path/filepath"
+
+	"github.com/seveirbian/gear/pkg"
 )
 
 var (
@@ -20,4 +22,9 @@ func ValidatePath(path string) (string, error) {
 	}
 
 	return path, nil
-}
\ No newline at end of file
+}
+// isManifestDir reports whether name under the dir is the dir of the gear
+// manifest, which is only in the root of an index image
+func isManifestDir(dir, name string) bool {
+	return dir == "/" && name == pkg.ManifestDir
+}
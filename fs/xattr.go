@@ -0,0 +1,78 @@
+package fs
+
+import (
+	"os"
+	"sort"
+	"path/filepath"
+
+	"bazil.org/fuse"
+	"golang.org/x/net/context"
+	"golang.org/x/sys/unix"
+	"github.com/seveirbian/gear/pkg"
+)
+
+// xattrPath returns the file whose xattrs are served for relativePath, which
+// is the copy in upper dir if there is one, or the file in index image. The
+// index image keeps the xattrs of the original image.
+func xattrPath(indexImagePath, upperPath, relativePath string) string {
+	_, err := os.Lstat(filepath.Join(upperPath, relativePath))
+	if err == nil {
+		return filepath.Join(upperPath, relativePath)
+	}
+
+	return filepath.Join(indexImagePath, relativePath)
+}
+
+func getxattr(path string, req *fuse.GetxattrRequest, resp *fuse.GetxattrResponse) error {
+	if !pkg.IsImageXattr(req.Name) {
+		return fuse.ErrNoXattr
+	}
+
+	value, err := pkg.GetXattr(path, req.Name)
+	if err == unix.ENODATA || err == unix.ENOTSUP {
+		return fuse.ErrNoXattr
+	}
+	if err != nil {
+		logger.Warnf("Fail to get xattr %s of %s for %v", req.Name, path, err)
+		return fuse.EIO
+	}
+
+	resp.Xattr = value
+
+	return nil
+}
+
+func listxattr(path string, req *fuse.ListxattrRequest, resp *fuse.ListxattrResponse) error {
+	xattrs, err := pkg.ListXattrs(path)
+	if err != nil {
+		logger.Warnf("Fail to list xattrs of %s for %v", path, err)
+		return fuse.EIO
+	}
+
+	names := []string{}
+	for name := range xattrs {
+		if pkg.IsImageXattr(name) {
+			names = append(names, name)
+		}
+	}
+	sort.Strings(names)
+	resp.Append(names...)
+
+	return nil
+}
+
+func (d *Dir) Getxattr(ctx context.Context, req *fuse.GetxattrRequest, resp *fuse.GetxattrResponse) error {
+	return getxattr(xattrPath(d.indexImagePath, d.upperPath, d.relativePath), req, resp)
+}
+
+func (d *Dir) Listxattr(ctx context.Context, req *fuse.ListxattrRequest, resp *fuse.ListxattrResponse) error {
+	return listxattr(xattrPath(d.indexImagePath, d.upperPath, d.relativePath), req, resp)
+}
+
+func (f *File) Getxattr(ctx context.Context, req *fuse.GetxattrRequest, resp *fuse.GetxattrResponse) error {
+	return getxattr(xattrPath(f.indexImagePath, f.upperPath, f.relativePath), req, resp)
+}
+
+func (f *File) Listxattr(ctx context.Context, req *fuse.ListxattrRequest, resp *fuse.ListxattrResponse) error {
+	return listxattr(xattrPath(f.indexImagePath, f.upperPath, f.relativePath), req, resp)
+}
@@ -18,7 +18,6 @@ import (
 	"strings"
 	// "time"
 	"archive/tar"
-	gzip "github.com/klauspost/pgzip"
 	"io/ioutil"
 	// "strconv"
 	"github.com/docker/docker/pkg/ioutils"
@@ -40,6 +39,8 @@ import (
 	"github.com/seveirbian/gear/push"
 	"github.com/opencontainers/selinux/go-selinux/label"
 	"github.com/sirupsen/logrus"
+	"github.com/seveirbian/gear/remote"
+	"golang.org/x/net/context"
 )
 
 var (
@@ -51,6 +52,9 @@ var (
 	GearImagesPath       = filepath.Join(GearPath, "images")
 	GearContainersPath   = filepath.Join(GearPath, "containers")
 	GearPushPath         = filepath.Join(GearPath, "push")
+
+	// PrefetchTimeout bounds downloading the prefetched files of an image
+	PrefetchTimeout = 10 * time.Minute
 )
 
 var (
@@ -105,6 +109,10 @@ type Driver struct {
 	ManagerPort      string
 	MonitorIp        string
 	MonitorPort      string
+	// Mirrors are host:port of nodes serving the same objects as manager
+	Mirrors          []string
+
+	remote           *remote.Client
 }
 
 var (
@@ -136,6 +144,7 @@ func (d *Driver) Init(home string, options []string, uidMaps, gidMaps []idtools.
 		return err
 	}
 	d.dockerDriver = driver
+	d.remote = remote.NewClient(append([]string{remote.Addr(d.ManagerIp, d.ManagerPort)}, d.Mirrors...)...)
 	// d.naiveDiff = graphdriver.NewNaiveDiffDriver(d, uidMaps, gidMaps)
 
 	return nil
@@ -262,7 +271,13 @@ func (d *Driver) Remove(id string) error {
 	fmt.Printf("\nRemove func parameters: \n")
 	fmt.Printf("  id: %s\n", id)
 
-	err := d.dockerDriver.Remove(id)
+	// gear镜像层挂载的索引层
+	err := unmountIndexImage(filepath.Join(d.home, id))
+	if err != nil {
+		logger.Warnf("Fail to unmount index layers for %v", err)
+	}
+
+	err = d.dockerDriver.Remove(id)
 	return err
 }
 
@@ -296,13 +311,20 @@ func (d *Driver) Get(id, mountLabel string) (containerfs.ContainerFS, error) {
 			// 当前目录是gear容器目录，需要gear fs的挂载
 			// 2. 有，需要gear fs目录的挂载
 			gearDiffDir := filepath.Join(gearPath, "diff")
-			gearGearDir := filepath.Join(gearPath, "gear-diff")
+			// 保留层的gear镜像，索引层和gear-diff一起挂载成完整的索引
+			gearGearDir, err := indexImageDir(gearPath)
+			if err != nil {
+				logger.Warnf("Fail to mount index layers for %v", err)
+				return nil, err
+			}
 
-			// 3. 查找gear-diff目录下，gear-image软链接的镜像名和tag
-			gearImage, err := os.Readlink(filepath.Join(gearGearDir, "gear-image"))
+			// 3. 从gear-diff目录下的清单中读取镜像名和tag
+			manifest, err := pkg.ReadManifest(gearGearDir)
 			if err != nil {
-				logger.Warnf("Fail to read gear-image symlink for %v", err)
+				logger.Warnf("Fail to read gear manifest for %v", err)
+				return nil, err
 			}
+			gearImage := manifest.Image
 
 			// 4. 获取镜像自己的私有cache
 			gearImagePrivateCache := filepath.Join(GearPrivateCachePath, gearImage)
@@ -334,8 +356,12 @@ func (d *Driver) Get(id, mountLabel string) (containerfs.ContainerFS, error) {
 			// 	fmt.Println(initLayerPath)
 			// }
 
-			_, err = os.Lstat(filepath.Join(gearPath, "gear-diff", "RecordFiles"))
+			prefetchList := filepath.Join(gearPath, "gear-diff", pkg.RecordFilesName)
+			_, err = os.Lstat(prefetchList)
 			if err != nil {
+				// 没有访问记录时，先预取构建时静态分析出的启动文件
+				prefetchList = filepath.Join(gearPath, "gear-diff", pkg.StartupFilesPath)
+
 				// 需要监控该镜像
 				logger.Warnf("Monitoring...")
 				needMonitor = true
@@ -366,8 +392,9 @@ func (d *Driver) Get(id, mountLabel string) (containerfs.ContainerFS, error) {
 					for {
 						select {
 						case file := <- recordChan:
-							if _, ok := dupFiles[file.RelativePath]; !ok {
-								dupFiles[file.RelativePath] = true
+							// 分块存储的文件会记录多个块，按路径和cid去重
+							if _, ok := dupFiles[file.RelativePath+" "+file.Hash]; !ok {
+								dupFiles[file.RelativePath+" "+file.Hash] = true
 								recordFiles = append(recordFiles, file.Hash)
 								recordFileNames = append(recordFileNames, file.RelativePath)
 							}
@@ -440,7 +467,8 @@ func (d *Driver) Get(id, mountLabel string) (containerfs.ContainerFS, error) {
 						}
 					}
 				}(id)
-			} else {
+			}
+			if _, e := os.Lstat(prefetchList); e == nil {
 				// 判断是否存在prefetched文件
 				_, err = os.Lstat(filepath.Join(gearPath, "gear-diff", "prefetched"))
 				if err != nil {
@@ -449,7 +477,7 @@ func (d *Driver) Get(id, mountLabel string) (containerfs.ContainerFS, error) {
 					tamplate := map[string]string{}
 					dedup := map[string]bool{}
 
-					b, err := ioutil.ReadFile(filepath.Join(gearPath, "gear-diff", "RecordFiles"))
+					b, err := ioutil.ReadFile(prefetchList)
 					if err != nil {
 						logger.Warnf("Fail to read file for %v", err)
 					}
@@ -460,7 +488,7 @@ func (d *Driver) Get(id, mountLabel string) (containerfs.ContainerFS, error) {
 
 					for _, nameAndFile := range nameAndFiles {
 						c := strings.Split(nameAndFile, " ")
-						if c[1] != "" {
+						if len(c) == 2 && c[1] != "" {
 							if _, ok := dedup[c[1]]; !ok {
 								dedup[c[1]] = true
 								tmp = append(tmp, c[1])
@@ -486,50 +514,49 @@ func (d *Driver) Get(id, mountLabel string) (containerfs.ContainerFS, error) {
 
 					v := url.Values{"files": needToDownloadFiles, "image": []string{gearImage}}
 
-					resp, err := http.PostForm("http://"+d.ManagerIp+":"+d.ManagerPort+"/prefetch", v)
+					ctx, cancel := context.WithTimeout(context.Background(), PrefetchTimeout)
+					defer cancel()
+					resp, err := d.remote.PostForm(ctx, "/prefetch", v, nil)
 					if err != nil {
 						logger.Warnf("Fail to prefetch for %v", err)
-					}
-					defer resp.Body.Close()
+					} else {
+						defer resp.Body.Close()
 
-					tr := tar.NewReader(resp.Body)
-
-					for {
-						th, err := tr.Next()
-						if err == io.EOF {
-							break;
-						}
+						tr := tar.NewReader(resp.Body)
 
-						tgt, err := os.Create(filepath.Join(GearPublicCachePath, th.Name))
-						if err != nil {
-							logger.Warnf("Fail to create tgt file for %v", err)
-						}
-
-						gr, err := gzip.NewReader(tr)
-
-						_, err = io.Copy(tgt, gr)
-						if err != nil {
-							logger.Fatalf("Fail to copy for %v", err)
-						}
+						for {
+							th, err := tr.Next()
+							if err == io.EOF {
+								break;
+							}
+							if err != nil {
+								logger.Warnf("Fail to read prefetched files for %v", err)
+								break
+							}
 
-						gr.Close()
-						tgt.Close()
+							// 与cid不符的对象不会进入缓存，由gear fs按需重新下载
+							err = fs.StoreObject(th.Name, tr)
+							if err != nil {
+								logger.Warnf("Fail to store prefetched file %s for %v", th.Name, err)
+								continue
+							}
 
-						err = os.Link(filepath.Join(GearPublicCachePath, th.Name), filepath.Join(gearImagePrivateCache, th.Name))
-						if err != nil {
-							if !strings.Contains(err.Error(), "file exists") {
-								logger.Fatalf("Fail to create hard link for %v", err)
+							err = os.Link(filepath.Join(GearPublicCachePath, th.Name), filepath.Join(gearImagePrivateCache, th.Name))
+							if err != nil {
+								if !strings.Contains(err.Error(), "file exists") {
+									logger.Warnf("Fail to create hard link for %v", err)
+								}
 							}
-						}
 
-						// 设置文件权限
-						err = os.Chmod(filepath.Join(gearImagePrivateCache, th.Name), 0777)
-						if err != nil {
-							logger.Warnf("Fail to chmod file for %v", err)
+							// 设置文件权限
+							err = os.Chmod(filepath.Join(gearImagePrivateCache, th.Name), 0777)
+							if err != nil {
+								logger.Warnf("Fail to chmod file for %v", err)
+							}
 						}
 					}
 
-					_, err = os.Create(filepath.Join(gearGearDir, "prefetched"))
+					_, err = os.Create(filepath.Join(gearPath, "gear-diff", "prefetched"))
 					if err != nil {
 						logger.Warnf("Fail to create file for %v", err)
 					}
@@ -541,7 +568,18 @@ func (d *Driver) Get(id, mountLabel string) (containerfs.ContainerFS, error) {
 					fmt.Println(lt)
 					if initLayerPath != "" {
 						// 将文件link到gear-work层目录
+						inline := pkg.InlineFiles(manifest)
 						for relativePath, file := range tamplate {
+							// 内联的文件不是对象，由gear fs从索引中读取
+							if inline[relativePath] {
+								continue
+							}
+							// 分块或打包存储的文件由gear fs读取，不能直接link
+							content, err := ioutil.ReadFile(filepath.Join(gearGearDir, relativePath))
+							if _, chunked, _ := pkg.ParseIndexEntry(content); err == nil && chunked {
+								continue
+							}
+
 							_, err = os.Lstat(filepath.Join(initLayerPath, relativePath))
 							if err != nil {
 								initDir := goPath.Dir(filepath.Join(initLayerPath, relativePath))
@@ -585,6 +623,7 @@ func (d *Driver) Get(id, mountLabel string) (containerfs.ContainerFS, error) {
 
 				ManagerIp: d.ManagerIp, 
 				ManagerPort: d.ManagerPort, 
+				Mirrors: d.Mirrors, 
 
 				RecordChan: recordChan, 
 
@@ -715,6 +754,20 @@ func (d *Driver) Cleanup() error {
 	return mount.Unmount(d.home)
 }
 
+// failedDiff is the diff of a layer which can not be committed, reading it
+// returns err
+type failedDiff struct {
+	err error
+}
+
+func (f failedDiff) Read(p []byte) (int, error) {
+	return 0, f.err
+}
+
+func (f failedDiff) Close() error {
+	return nil
+}
+
 // Diff produces an archive of the changes between the specified
 // layer and its parent layer which may be ""
 func (d *Driver) Diff(id, parent string) io.ReadCloser {
@@ -759,19 +812,28 @@ func (d *Driver) Diff(id, parent string) io.ReadCloser {
 	        logger.Fatal("Fail to init a pusher to push gear image...")
 	    }
 
-	    pusher.Push()
+	    pushErr := pusher.Push()
 
 		err = os.RemoveAll(pushDir)
 		if err != nil {
 			logger.Warnf("Fail to remove push dir for %v", err)
 		}
 
+		// 对象没有全部上传时层不能被提交
+		if pushErr != nil {
+			logger.Warnf("Fail to push gear files for %v", pushErr)
+			return failedDiff{pushErr}
+		}
+
 		// 2. 联合挂载，对上下层目录树做Diff
 		parent, err := os.Readlink(filepath.Join(d.home, id, "gear-lower"))
 		if err != nil {
 			logger.Warnf("Fail to readlink for %v", err)
 		}
-		parentDir := filepath.Join(parent, "gear-diff")
+		parentDir, err := indexImageDir(parent)
+		if err != nil {
+			logger.Fatalf("Fail to mount index layers for %v", err)
+		}
 		opts := "lowerdir=" + parentDir + ",upperdir=" + currentDir + ",workdir=" + filepath.Join(d.home, id, "work")
 		mountData := label.FormatMountLabel(opts, "")
 		mount := unix.Mount
@@ -856,15 +918,22 @@ func (d *Driver) ApplyDiff(id, parent string, diff io.Reader) (int64, error) {
 	// 1. 直接将数据解压到diff文件中
 	size, err := d.dockerDriver.ApplyDiff(id, parent, diff)
 
-	// 4. 检测当前镜像是否是gear镜像
-	path := filepath.Join(d.home, id, "diff", "gear-image")
-	_, err = os.Lstat(path)
+	if err != nil {
+		return size, err
+	}
+
+	// 4. 根据/.gear/manifest.json检测当前镜像是否是gear镜像
+	manifest, err := pkg.ReadManifest(filepath.Join(d.home, id, "diff"))
 
 	// 判断gear镜像
-	if err != nil {
+	if err == pkg.ErrNotGearImage {
 		// 不是gear镜像
 		// 直接返回
 		return size, nil
+	} else if err != nil {
+		// 不支持的清单版本
+		logger.Warnf("Fail to read gear manifest for %v", err)
+		return size, err
 	} else {
 		// 是gear镜像，将diff文件夹重命名为gear-diff
 		err := os.Rename(filepath.Join(d.home, id, "diff"), filepath.Join(d.home, id, "gear-diff"))
@@ -879,7 +948,14 @@ func (d *Driver) ApplyDiff(id, parent string, diff io.Reader) (int64, error) {
 			logger.Warnf("Fail to create gear link for %v", err)
 		}
 
-		// 3. 删除overlay driver创建的lower文件
+		// 3. 保留层的gear镜像记录下面的索引层，删除overlay driver创建的lower文件
+		if manifest.Layers > 0 {
+			err = saveIndexLower(d.home, filepath.Join(d.home, id), manifest.Layers)
+			if err != nil {
+				logger.Warnf("Fail to save index layers for %v", err)
+				return size, err
+			}
+		}
 		_, err = os.Lstat(filepath.Join(d.home, id, "lower"))
 		if err == nil {
 			err := os.Remove(filepath.Join(d.home, id, "lower"))
@@ -1,12 +1,16 @@
 package graphdriver
 
 import (
+    "fmt"
     "path/filepath"
     "os"
     "strings"
     "io/ioutil"
     "io"
     "github.com/seveirbian/gear/pkg"
+    "github.com/docker/docker/pkg/mount"
+    "github.com/opencontainers/selinux/go-selinux/label"
+    "golang.org/x/sys/unix"
 )
 
 var (
@@ -26,7 +30,7 @@ func extractAndSaveRegularFiles(source string, target string) (err error) {
 			}
 
 			if f.Mode().IsRegular() {
-				hashValue := []byte(pkg.HashAFileInMD5(path))
+				hashValue := []byte(pkg.HashAFile(path))
 
 				src, err := os.Open(path)
 				if err != nil {
@@ -64,4 +68,76 @@ func extractAndSaveRegularFiles(source string, target string) (err error) {
 		})
 
 	return 
-}
\ No newline at end of file
+}
+
+const (
+	// gearIndexLowerFile lists the diff dirs of the index layers below a
+	// gear image layer built with keep-layers, gearIndexDir is where they
+	// are mounted with gear-diff on top
+	gearIndexLowerFile = "gear-index-lower"
+	gearIndexDir       = "gear-index"
+)
+
+// saveIndexLower saves the diff dirs of the first n layers in the lower file
+// of the layer at layerPath, which are the index layers of its gear image
+func saveIndexLower(home, layerPath string, n int) error {
+	data, err := ioutil.ReadFile(filepath.Join(layerPath, lowerFile))
+	if err != nil {
+		return err
+	}
+
+	lowers := strings.Split(string(data), ":")
+	if len(lowers) < n {
+		return fmt.Errorf("%d index layers but %d lower layers", n, len(lowers))
+	}
+
+	dirs := []string{}
+	for _, lower := range lowers[:n] {
+		dirs = append(dirs, filepath.Join(home, lower))
+	}
+
+	return ioutil.WriteFile(filepath.Join(layerPath, gearIndexLowerFile), []byte(strings.Join(dirs, ":")), 0644)
+}
+
+// indexImageDir returns the dir of the whole index image of the gear image
+// layer at gearPath, gear-diff if the image has no index layers, otherwise
+// a read-only overlay of gear-diff and the index layers, which overlay2
+// stacks like the layers of the source image
+func indexImageDir(gearPath string) (string, error) {
+	data, err := ioutil.ReadFile(filepath.Join(gearPath, gearIndexLowerFile))
+	if os.IsNotExist(err) {
+		return filepath.Join(gearPath, "gear-diff"), nil
+	}
+	if err != nil {
+		return "", err
+	}
+
+	target := filepath.Join(gearPath, gearIndexDir)
+	mounted, err := mount.Mounted(target)
+	if err != nil || mounted {
+		return target, err
+	}
+
+	err = os.MkdirAll(target, 0700)
+	if err != nil {
+		return "", err
+	}
+	opts := "lowerdir=" + filepath.Join(gearPath, "gear-diff") + ":" + string(data)
+	err = unix.Mount("overlay", target, "overlay", unix.MS_RDONLY, label.FormatMountLabel(opts, ""))
+	if err != nil {
+		return "", err
+	}
+
+	return target, nil
+}
+
+// unmountIndexImage unmounts the index image mounted by indexImageDir
+func unmountIndexImage(gearPath string) error {
+	target := filepath.Join(gearPath, gearIndexDir)
+	mounted, err := mount.Mounted(target)
+	if err != nil || !mounted {
+		return err
+	}
+
+	return unix.Unmount(target, unix.MNT_DETACH)
+}
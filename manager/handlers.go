@@ -70,6 +70,9 @@ func handleJoin(c echo.Context) error {
 
 func handlePull(c echo.Context) error {
 	cid := c.Param("CID")
+	if !pkg.ValidCID(cid) {
+		return c.NoContent(http.StatusBadRequest)
+	}
 
 	// fmt.Println(filepath.Join(GearStoragePath, cid))
 
@@ -89,6 +92,7 @@ func handlePull(c echo.Context) error {
 	// if err != nil {
 	// 	logger.Fatal("Fail to lock file in a sharing way...")
 	// }
+	// http.ServeContent支持Range请求，gear fs按范围读取大文件
 	err = c.Attachment(filepath.Join(GearStoragePath, cid), cid)
 	if err != nil {
 		logger.Fatal("Fail to return file...")
@@ -102,11 +106,57 @@ func handlePull(c echo.Context) error {
 	return nil
 }
 
+// handleRange returns length bytes at offset of the decompressed content of
+// the object, which is used to read a member of a pack object. Only objects
+// which are not seekable are decompressed from the start.
+func handleRange(c echo.Context) error {
+	cid := c.Param("CID")
+	if !pkg.ValidCID(cid) {
+		return c.NoContent(http.StatusBadRequest)
+	}
+
+	offset, err := strconv.ParseInt(c.FormValue("offset"), 10, 64)
+	if err != nil || offset < 0 {
+		return c.NoContent(http.StatusBadRequest)
+	}
+	length, err := strconv.ParseInt(c.FormValue("length"), 10, 64)
+	if err != nil || length < 0 {
+		return c.NoContent(http.StatusBadRequest)
+	}
+
+	f, err := os.Open(filepath.Join(GearStoragePath, cid))
+	if err != nil {
+		logger.Warnf("Fail to open file for %v", err)
+		return c.NoContent(http.StatusNotFound)
+	}
+	defer f.Close()
+
+	info, err := f.Stat()
+	if err != nil {
+		logger.Warnf("Fail to stat file for %v", err)
+		return c.NoContent(http.StatusInternalServerError)
+	}
+
+	// seekable对象从覆盖offset的帧开始解压
+	rc, err := pkg.NewObjectReaderAt(f, info.Size(), offset)
+	if err != nil {
+		logger.Warnf("Fail to read %s from %d for %v", cid, offset, err)
+		return c.NoContent(http.StatusRequestedRangeNotSatisfiable)
+	}
+	defer rc.Close()
+
+	return c.Stream(http.StatusOK, echo.MIMEOctetStream, io.LimitReader(rc, length))
+}
+
 func handleQuery(c echo.Context) error {
 	cid := c.Param("CID")
 
 	fmt.Printf("Querying %s\n", cid)
 
+	if !pkg.ValidCID(cid) {
+		return c.NoContent(http.StatusBadRequest)
+	}
+
 	_, err := os.Lstat(filepath.Join(GearStoragePath, cid))
 	if err != nil {
 		return c.NoContent(http.StatusNotFound)
@@ -117,9 +167,15 @@ func handleQuery(c echo.Context) error {
 
 func handlePush(c echo.Context) error {
 	cid := c.Param("CID")
+	if !pkg.ValidCID(cid) {
+		logger.Warnf("Invalid cid %s", cid)
+		return c.NoContent(http.StatusBadRequest)
+	}
+
 	file, err := c.FormFile("file")
 	if err != nil {
 		logger.Warnf("Fail to get formfile for %v", err)
+		return c.NoContent(http.StatusBadRequest)
 	}
 
 	// 检测是否已经存在cid文件
@@ -133,16 +189,30 @@ func handlePush(c echo.Context) error {
 		}
 		defer src.Close()
 
-		dst, err := os.Create(filepath.Join(GearStoragePath, cid))
+		// 先写入临时文件，校验内容与cid一致后再重命名
+		dst, err := ioutil.TempFile(GearStoragePath, ".push-")
 		if err != nil {
 			logger.Warnf("Fail to create file for %v", err)
 			return c.NoContent(http.StatusInternalServerError)
 		}
+		defer os.Remove(dst.Name())
 		defer dst.Close()
 
 		_, err = io.Copy(dst, src)
 		if err != nil {
-			logger.Warnf("Fail to copy for %V", err)
+			logger.Warnf("Fail to copy for %v", err)
+			return c.NoContent(http.StatusInternalServerError)
+		}
+
+		err = verifyObject(cid, dst.Name())
+		if err != nil {
+			logger.Warnf("Fail to verify %s for %v", cid, err)
+			return c.NoContent(http.StatusBadRequest)
+		}
+
+		err = os.Rename(dst.Name(), filepath.Join(GearStoragePath, cid))
+		if err != nil {
+			logger.Warnf("Fail to rename for %v", err)
 			return c.NoContent(http.StatusInternalServerError)
 		}
 	}
@@ -176,6 +246,11 @@ func handlePreFetch(c echo.Context) error {
 	tw := tar.NewWriter(tmpFile)
 
 	for _, file := range files {
+		if !pkg.ValidCID(file) {
+			logger.Warnf("Invalid cid %s", file)
+			continue
+		}
+
 		f, err := os.Stat(filepath.Join(GearStoragePath, file))
 		if err != nil {
 			logger.Warnf("Fail to stat file for %v", err)
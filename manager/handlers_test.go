@@ -0,0 +1,162 @@
+package manager
+
+import (
+	"os"
+	"bytes"
+	"strings"
+	"strconv"
+	"testing"
+	"net/url"
+	"net/http"
+	"io/ioutil"
+	"path/filepath"
+	"mime/multipart"
+	"net/http/httptest"
+
+	"github.com/labstack/echo"
+	"github.com/seveirbian/gear/pkg"
+)
+
+// pushObject posts object as the object cid to handlePush and returns the
+// status
+func pushObject(t *testing.T, cid string, object []byte) int {
+	body := new(bytes.Buffer)
+	writer := multipart.NewWriter(body)
+	formFile, err := writer.CreateFormFile("file", cid)
+	if err != nil {
+		t.Fatal(err)
+	}
+	formFile.Write(object)
+	writer.Close()
+
+	req := httptest.NewRequest(http.MethodPost, "/push/"+cid, body)
+	req.Header.Set(echo.HeaderContentType, writer.FormDataContentType())
+	rec := httptest.NewRecorder()
+	c := echo.New().NewContext(req, rec)
+	c.SetParamNames("CID")
+	c.SetParamValues(cid)
+
+	err = handlePush(c)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return rec.Code
+}
+
+func TestHandlePush(t *testing.T) {
+	dir, err := ioutil.TempDir("", "gear-manager-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	GearStoragePath = dir
+
+	content := []byte("content of the object")
+	var buf bytes.Buffer
+	w, err := pkg.NewObjectWriter(&buf, pkg.DefaultCompression)
+	if err != nil {
+		t.Fatal(err)
+	}
+	w.Write(content)
+	w.Close()
+	object := buf.Bytes()
+	cid := pkg.HashBytes(content)
+	other := pkg.HashBytes([]byte("other content"))
+
+	tests := []struct {
+		name   string
+		cid    string
+		object []byte
+		status int
+		stored bool
+	}{
+		{"invalid cid", "foo", object, http.StatusBadRequest, false},
+		{"mismatched content", other, object, http.StatusBadRequest, false},
+		{"truncated object", cid, object[:len(object)/2], http.StatusBadRequest, false},
+		{"matched content", cid, object, http.StatusOK, true},
+	}
+	for _, test := range tests {
+		status := pushObject(t, test.cid, test.object)
+		if status != test.status {
+			t.Fatalf("%s: status = %d, want %d", test.name, status, test.status)
+		}
+		stored, err := ioutil.ReadFile(filepath.Join(dir, test.cid))
+		if test.stored && (err != nil || !bytes.Equal(stored, test.object)) {
+			t.Fatalf("%s: object is not stored: %v", test.name, err)
+		}
+		if !test.stored && err == nil {
+			t.Fatalf("%s: object is stored", test.name)
+		}
+	}
+
+	// 被拒绝的对象的临时文件也被删除
+	files, err := ioutil.ReadDir(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(files) != 1 {
+		t.Fatalf("%d files are in storage, want 1", len(files))
+	}
+}
+
+func TestHandleRange(t *testing.T) {
+	dir, err := ioutil.TempDir("", "gear-manager-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	GearStoragePath = dir
+
+	// pack中的成员跨过seekable对象的帧
+	pack := make([]byte, 3*pkg.SeekableFrameSize)
+	for i := range pack {
+		pack[i] = byte(i * 7 % 253)
+	}
+	members := []struct {
+		offset int64
+		length int64
+	}{
+		{0, 100},
+		{pkg.SeekableFrameSize - 10, 20},
+		{pkg.SeekableFrameSize + 5, pkg.SeekableFrameSize},
+		{int64(len(pack)) - 1, 1},
+	}
+
+	for _, compression := range []string{pkg.DefaultCompression, pkg.CompressionGzip, pkg.CompressionNone} {
+		var buf bytes.Buffer
+		w, err := pkg.NewObjectWriter(&buf, compression)
+		if err != nil {
+			t.Fatal(err)
+		}
+		w.Write(pack)
+		w.Close()
+		cid := pkg.HashBytes(pack)
+		err = ioutil.WriteFile(filepath.Join(dir, cid), buf.Bytes(), 0644)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		for _, member := range members {
+			form := url.Values{
+				"offset": []string{strconv.FormatInt(member.offset, 10)},
+				"length": []string{strconv.FormatInt(member.length, 10)},
+			}
+			req := httptest.NewRequest(http.MethodPost, "/range/"+cid, strings.NewReader(form.Encode()))
+			req.Header.Set(echo.HeaderContentType, echo.MIMEApplicationForm)
+			rec := httptest.NewRecorder()
+			c := echo.New().NewContext(req, rec)
+			c.SetParamNames("CID")
+			c.SetParamValues(cid)
+
+			err = handleRange(c)
+			if err != nil || rec.Code != http.StatusOK {
+				t.Fatalf("%s: range %d+%d = %d, %v", compression, member.offset, member.length, rec.Code, err)
+			}
+			// 返回的内容与成员的cid一致
+			want := pack[member.offset : member.offset+member.length]
+			if pkg.VerifyCID(pkg.HashBytes(want), rec.Body) != nil {
+				t.Fatalf("%s: range %d+%d does not match the member cid", compression, member.offset, member.length)
+			}
+		}
+	}
+}
@@ -48,6 +48,7 @@ func Init() (*Manager, error) {
     e.GET("/nodes", handleNodes)
     e.POST("/join/:IP/:Port", handleJoin)
     e.POST("/pull/:CID", handlePull)
+    e.POST("/range/:CID", handleRange)
     e.POST("/query/:CID", handleQuery)
     e.POST("/push/:CID", handlePush)
 
@@ -0,0 +1,99 @@
+package manager
+
+import (
+	"os"
+	"fmt"
+	"io/ioutil"
+	"path/filepath"
+
+	"github.com/seveirbian/gear/pkg"
+)
+
+// verifyObject checks the decompressed content of the object at path
+// against cid
+func verifyObject(cid, path string) error {
+	f, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	gr, err := pkg.NewObjectReader(f)
+	if err != nil {
+		return err
+	}
+	defer gr.Close()
+
+	return pkg.VerifyCID(cid, gr)
+}
+
+// hashObject returns the CID of the decompressed content of the object at
+// path
+func hashObject(path string) (string, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+
+	gr, err := pkg.NewObjectReader(f)
+	if err != nil {
+		return "", err
+	}
+	defer gr.Close()
+
+	d, err := pkg.CIDAlgorithm.FromReader(gr)
+	if err != nil {
+		return "", err
+	}
+
+	return d.String(), nil
+}
+
+// MigrateStorage links every object named by a legacy md5 CID in storage to
+// its new CID, the legacy names are removed when removeLegacy is set.
+// It returns the map from legacy CIDs to new CIDs.
+func MigrateStorage(removeLegacy bool) (map[string]string, error) {
+	cids := map[string]string{}
+
+	files, err := ioutil.ReadDir(GearStoragePath)
+	if err != nil {
+		return nil, err
+	}
+
+	for _, file := range files {
+		if !file.Mode().IsRegular() || !pkg.IsLegacyCID(file.Name()) {
+			continue
+		}
+
+		legacyPath := filepath.Join(GearStoragePath, file.Name())
+
+		err := verifyObject(file.Name(), legacyPath)
+		if err != nil {
+			logger.Warnf("Skip corrupted object %s for %v", file.Name(), err)
+			continue
+		}
+
+		cid, err := hashObject(legacyPath)
+		if err != nil {
+			return nil, err
+		}
+
+		err = os.Link(legacyPath, filepath.Join(GearStoragePath, cid))
+		if err != nil && !os.IsExist(err) {
+			return nil, err
+		}
+
+		if removeLegacy {
+			err = os.Remove(legacyPath)
+			if err != nil {
+				return nil, err
+			}
+		}
+
+		cids[file.Name()] = cid
+		fmt.Printf("%s -> %s\n", file.Name(), cid)
+	}
+
+	return cids, nil
+}
@@ -5,7 +5,6 @@ import (
 	"fmt"
 	"time"
 	// "path"
-	"os/exec"
 	"strings"
 	"net/http"
 	"strconv"
@@ -48,25 +47,23 @@ func handleEvent(c echo.Context) error {
 	// 3. 检查是否已经构建过
 	if !check(strings.TrimSuffix(imageRepo, "-gear") + "-gearmd", imageTag) {
 		// 3. 构建包含预取文件的新gear镜像
-		builder, err := build.InitBuilder(image, "-gearmd")
+		builder, err := build.InitBuilderFromRegistry(image, "-gearmd")
 		if err != nil {
-			logger.Fatal("Fail to init a builder to build gear image for %v", err)
+			logger.Warnf("Fail to init a builder to build gear image for %v", err)
+			return nil
 		}
 		err = builder.Build(files, names)
 		if err != nil {
-			logger.Fatal("Fail to build gear image for %v", err)
+			logger.Warnf("Fail to build gear image for %v", err)
+			return nil
 		}
 
 		// 4. push -gearmd镜像
-		mdImage := strings.TrimSuffix(imageRepo, "-gear") + "-gearmd" + ":" + imageTag
-	    cName := "docker"
-	    cArgs := []string{"push", mdImage}
-	    cCmd := exec.Command(cName, cArgs...)
-	    if err := cCmd.Run(); err != nil {
-	        fmt.Fprintln(os.Stderr, err)
-	        os.Exit(1)
-	    }
-	    fmt.Println("push", mdImage, "done!")
+		err = builder.PushGearImage()
+		if err != nil {
+			logger.Warnf("Fail to push gear image for %v", err)
+			return nil
+		}
 
 		fmt.Println("Push ok!")
 	} else {
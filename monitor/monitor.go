@@ -2,7 +2,6 @@ package monitor
 
 import (
 	"os"
-	"os/exec"
 	"io/ioutil"
 	"fmt"
 	"sync"
@@ -12,13 +11,9 @@ import (
 	"net/http"
 	"encoding/json"
 
-	"golang.org/x/net/context"
 	"github.com/sirupsen/logrus"
 	"github.com/seveirbian/gear/build"
-	"github.com/docker/docker/client"
 	gearTypes "github.com/seveirbian/gear/types"
-	"github.com/docker/docker/api/types"
-	"github.com/docker/docker/pkg/jsonmessage"
 	"github.com/seveirbian/gear/push"
 	"github.com/labstack/echo"
 	"github.com/seveirbian/gear/pkg"
@@ -54,9 +49,6 @@ type Monitor struct {
 
 	Server *echo.Echo
 
-	Ctx    context.Context
-	Client *client.Client
-
 	HMutex sync.Mutex
 	HaveBeenBuild map[string][]string
 
@@ -69,14 +61,6 @@ type Monitor struct {
 func InitMonitor(registry string, managerIp, managerPort string, noCleanUp bool) (*Monitor, error) {
 	ip, port := parseRegistry(registry)
 
-	// 创建cli用来和dockerd交互
-	ctx := context.Background()
-	cli, err := client.NewClientWithOpts(client.WithVersion("1.38"))
-	if err != nil {
-		logger.Warn("Fail to create docker client...")
-		return nil, err
-	}
-
 	// 创建服务器
 	e := echo.New()
 	e.POST("/event", handleEvent)
@@ -92,8 +76,6 @@ func InitMonitor(registry string, managerIp, managerPort string, noCleanUp bool)
 	mnt.Server = e
 	mnt.ManagerIp = managerIp
 	mnt.ManagerPort = managerPort
-	mnt.Ctx = ctx
-	mnt.Client = cli
 	mnt.NoCleanUp = noCleanUp
 
 	return &mnt, nil
@@ -240,53 +222,49 @@ func (m *Monitor) build() {
 }
 
 func (m *Monitor) do_build(image gearTypes.Image) error {
-	// 1. 下载待处理镜像
-	fmt.Printf("Pulling %s:%s/%s:%s\n", m.RegistryIp, m.RegistryPort, image.Repository, image.Tag)
-	out, err := m.Client.ImagePull(m.Ctx, m.RegistryIp+":"+m.RegistryPort+"/"+image.Repository+":"+image.Tag, types.ImagePullOptions{})
+	// 1. 从镜像仓库直接拉取待处理镜像，构建gear镜像
+	source := m.RegistryIp+":"+m.RegistryPort+"/"+image.Repository+":"+image.Tag
+	fmt.Printf("Building %s\n", source)
+	// 多架构镜像的每个平台分别构建，相同内容的文件共用cid
+	builders, err := build.InitBuildersFromRegistry(source, "-gear")
 	if err != nil {
-		logger.Warnf("Fail to pull the image")
+		logger.Warnf("Fail to init a builder to build gear image for %v", err)
+		return err
 	}
-	defer out.Close()
-	decoder := json.NewDecoder(out)
-	for decoder.More() {
-		var retMessage jsonmessage.JSONMessage
-		err := decoder.Decode(&retMessage)
+
+	manifests := []string{}
+	for _, builder := range builders {
+		// 同一个源镜像重复构建时gear镜像的digest不变，节点不需要重新拉取
+		builder.Reproducible = true
+		err = builder.Build(nil, nil)
 		if err != nil {
-			logger.Warnf("Fail decode pull response...")
+			logger.Warnf("Fail to build gear image for %v", err)
 			return err
 		}
-		// fmt.Printf("%s: %s\r\n", retMessage.Status, retMessage.Progress)
+		manifests = append(manifests, builder.ManifestPaths()...)
 	}
-	fmt.Println("Pull OK!")
 
-	// 2. 调用build命令，构建gear镜像
-	builder, err := build.InitBuilder(m.RegistryIp+":"+m.RegistryPort+"/"+image.Repository+":"+image.Tag, "-gear")
+	// 2. 将备用文件存储到存储中
+	pusher, err := push.InitPusher(builders[0].RegularFilesPath, m.ManagerIp, m.ManagerPort, m.NoCleanUp)
 	if err != nil {
-		logrus.Fatal("Fail to init a builder to build gear image...")
+		logger.Warnf("Fail to init a pusher to push gear image for %v", err)
+		return err
 	}
-
-	err = builder.Build(nil, nil)
+	pusher.Manifests = manifests
+	// 对象没有全部上传时不能push gear镜像
+	err = pusher.Push()
 	if err != nil {
-		logrus.Fatal("Fail to build gear image...")
+		logger.Warnf("Fail to push gear files for %v", err)
+		return err
 	}
 
-	// 3. 将gear镜像push到镜像仓库，并将备用文件存储到存储中
-	fmt.Printf("Pushing %s:%s/%s:%s\n", m.RegistryIp, m.RegistryPort, image.Repository+"-gear", image.Tag)
-    gFIlesDir := filepath.Join(GearBuildPath, m.RegistryIp+":"+m.RegistryPort+"/"+image.Repository+"-gear"+":"+image.Tag, "files")
-    pusher, err := push.InitPusher(gFIlesDir, m.ManagerIp, m.ManagerPort, m.NoCleanUp)
-    if err != nil {
-        logrus.Fatal("Fail to init a pusher to push gear image...")
-    }
-    pusher.Push()
-
-    cName := "docker"
-    cArgs := []string{"push", m.RegistryIp+":"+m.RegistryPort+"/"+image.Repository+"-gear"+":"+image.Tag}
-    cCmd := exec.Command(cName, cArgs...)
-    if err := cCmd.Run(); err != nil {
-        fmt.Fprintln(os.Stderr, err)
-        os.Exit(1)
-    }
-    fmt.Println("done!")
+	// 3. 将gear镜像push到镜像仓库，多架构镜像push为manifest list
+	err = build.PushGearImages(builders)
+	if err != nil {
+		logger.Warnf("Fail to push gear image for %v", err)
+		return err
+	}
+	fmt.Println("done!")
 
 	return nil
 }
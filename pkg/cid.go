@@ -0,0 +1,101 @@
+package pkg
+
+import (
+	"io"
+	"os"
+	"fmt"
+	"regexp"
+	"crypto/md5"
+	_ "crypto/sha256"
+
+	digest "github.com/opencontainers/go-digest"
+	"github.com/sirupsen/logrus"
+)
+
+var (
+	// CIDAlgorithm is the digest algorithm of new CIDs, which are in the form
+	// of sha256:<hex>
+	CIDAlgorithm = digest.SHA256
+
+	// legacy CIDs are the md5 hex of the content without algorithm prefix,
+	// they are still accepted during migration
+	legacyCIDRegexp = regexp.MustCompile(`^[a-f0-9]{32}$`)
+)
+
+// HashAFile returns the CID of the file at path
+func HashAFile(path string) string {
+	f, err := os.Open(path)
+	if err != nil {
+		logrus.Fatal("Fail to open the file needs to be hashed...")
+	}
+	defer f.Close()
+
+	d, err := CIDAlgorithm.FromReader(f)
+	if err != nil {
+		logrus.Fatal("Fail to copy file to hash...")
+	}
+
+	return d.String()
+}
+
+// HashBytes returns the CID of content
+func HashBytes(content []byte) string {
+	return CIDAlgorithm.FromBytes(content).String()
+}
+
+// IsLegacyCID reports whether cid is an md5 CID
+func IsLegacyCID(cid string) bool {
+	return legacyCIDRegexp.MatchString(cid)
+}
+
+// ValidCID reports whether cid is a digest CID or a legacy md5 CID, which
+// also makes it safe to be used as a file name
+func ValidCID(cid string) bool {
+	if IsLegacyCID(cid) {
+		return true
+	}
+
+	d, err := digest.Parse(cid)
+	return err == nil && d.Algorithm() == CIDAlgorithm
+}
+
+// MismatchError is returned by VerifyCID if the content does not hash to
+// the cid
+type MismatchError struct {
+	CID string
+}
+
+func (e *MismatchError) Error() string {
+	return "Content does not match cid " + e.CID
+}
+
+// VerifyCID reads content to the end and checks it against cid
+func VerifyCID(cid string, content io.Reader) error {
+	if IsLegacyCID(cid) {
+		h := md5.New()
+		_, err := io.Copy(h, content)
+		if err != nil {
+			return err
+		}
+		if fmt.Sprintf("%x", h.Sum(nil)) != cid {
+			return &MismatchError{CID: cid}
+		}
+		return nil
+	}
+
+	d, err := digest.Parse(cid)
+	if err != nil {
+		return fmt.Errorf("Invalid cid %s", cid)
+	}
+
+	verifier := d.Verifier()
+	_, err = io.Copy(verifier, content)
+	if err != nil {
+		return err
+	}
+	if !verifier.Verified() {
+		return &MismatchError{CID: cid}
+	}
+
+	return nil
+}
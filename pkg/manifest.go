@@ -0,0 +1,129 @@
+package pkg
+
+import (
+	"os"
+	"fmt"
+	"errors"
+	"syscall"
+	"io/ioutil"
+	"encoding/json"
+	"path/filepath"
+
+	"github.com/seveirbian/gear/types"
+)
+
+const (
+	// ManifestVersion is the manifest format written by this version of gear,
+	// manifests of newer versions are rejected. Version 2 adds inline files,
+	// version 3 adds index layers.
+	ManifestVersion = 3
+
+	// ManifestDir and ManifestPath are relative to the root of an index image
+	ManifestDir  = ".gear"
+	ManifestPath = ".gear/manifest.json"
+	// LayerManifestPath is the manifest of the files of an index layer
+	LayerManifestPath = ".gear/layer.json"
+
+	// images built before the manifest only have this symlink to name:tag
+	legacyImageLink = "gear-image"
+)
+
+// ErrNotGearImage is returned by ReadManifest for dirs which are not gear
+// index images
+var ErrNotGearImage = errors.New("Not a gear image")
+
+// ParseManifest parses the manifest and checks its version
+func ParseManifest(data []byte) (*types.Manifest, error) {
+	manifest := &types.Manifest{}
+	err := json.Unmarshal(data, manifest)
+	if err != nil {
+		return nil, fmt.Errorf("Invalid gear manifest: %v", err)
+	}
+
+	if manifest.Version < 1 || manifest.Version > ManifestVersion {
+		return nil, fmt.Errorf("Unsupported gear manifest version %d, this gear supports up to version %d", manifest.Version, ManifestVersion)
+	}
+
+	return manifest, nil
+}
+
+// ReadManifestFile reads and parses the manifest at path
+func ReadManifestFile(path string) (*types.Manifest, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	return ParseManifest(data)
+}
+
+// ReadManifest reads the manifest of the index image at root. Images built
+// before the manifest get a version 0 manifest with only the image name,
+// ErrNotGearImage is returned for other dirs.
+func ReadManifest(root string) (*types.Manifest, error) {
+	manifest, err := ReadManifestFile(filepath.Join(root, ManifestPath))
+	if err == nil || !os.IsNotExist(err) {
+		return manifest, err
+	}
+
+	image, err := os.Readlink(filepath.Join(root, legacyImageLink))
+	if err != nil {
+		return nil, ErrNotGearImage
+	}
+
+	return &types.Manifest{Image: image}, nil
+}
+
+// InlineFiles returns the paths of the inline regular files of the manifest
+// with a leading "/", their content is in the index image instead of objects
+func InlineFiles(manifest *types.Manifest) map[string]bool {
+	inline := map[string]bool{}
+	for _, file := range manifest.Files {
+		if file.Inline {
+			inline["/"+file.Path] = true
+		}
+	}
+
+	return inline
+}
+
+// FileSizes returns the sizes of the regular files of the manifest which are
+// stored as objects, by path with a leading "/", so that they are stat'ed
+// without fetching their content
+func FileSizes(manifest *types.Manifest) map[string]int64 {
+	sizes := map[string]int64{}
+	for _, file := range manifest.Files {
+		if file.Mode&syscall.S_IFMT == syscall.S_IFREG && !file.Inline {
+			sizes["/"+file.Path] = file.Size
+		}
+	}
+
+	return sizes
+}
+
+// ManifestCIDs returns the CIDs of all objects the manifest refers to
+func ManifestCIDs(manifest *types.Manifest) []string {
+	cids := []string{}
+	seen := map[string]bool{}
+	add := func(cid string) {
+		if cid != "" && !seen[cid] {
+			seen[cid] = true
+			cids = append(cids, cid)
+		}
+	}
+
+	for _, file := range manifest.Files {
+		add(file.CID)
+		if file.Entry == nil {
+			continue
+		}
+		for _, chunk := range file.Entry.Chunks {
+			add(chunk.CID)
+		}
+		if file.Entry.Pack != nil {
+			add(file.Entry.Pack.Pack)
+		}
+	}
+
+	return cids
+}
@@ -0,0 +1,153 @@
+package pkg
+
+import (
+	"io"
+	"bytes"
+	"bufio"
+	"errors"
+	"io/ioutil"
+
+	gzip "github.com/klauspost/pgzip"
+	"github.com/klauspost/compress/zstd"
+)
+
+const (
+	CompressionNone = "none"
+	CompressionGzip = "gzip"
+	// CompressionZstd objects are written as CompressionSeekable, which is
+	// still a zstd stream, so that they can be read while downloaded and by
+	// range. Objects of the zstd codec written before are still read.
+	CompressionZstd = "zstd"
+	// CompressionSeekable is zstd in independent frames with a seek table,
+	// ranges of the content can be read without the whole object
+	CompressionSeekable = "seekable"
+	// CompressionAuto stores incompressible content raw and others zstd
+	CompressionAuto = "auto"
+
+	DefaultCompression = CompressionZstd
+
+	// AutoSampleSize bytes at the start of a file are used to decide whether
+	// it is compressible in auto mode
+	AutoSampleSize = 64 * 1024
+)
+
+var (
+	// every object written by gear starts with objectMagic and one byte
+	// which is the index of its codec in codecs, objects without the header
+	// are legacy gzip objects
+	objectMagic = []byte{0x89, 'G', 'E', 'A', 'R'}
+	codecs      = []string{CompressionNone, CompressionGzip, CompressionZstd, CompressionSeekable}
+
+	autoEncoder, _ = zstd.NewWriter(nil, zstd.WithEncoderLevel(zstd.SpeedFastest))
+)
+
+// ValidCompression reports whether compression can be used to write objects
+func ValidCompression(compression string) bool {
+	return compression == CompressionAuto || codecIndex(compression) >= 0
+}
+
+func codecIndex(compression string) int {
+	for i, codec := range codecs {
+		if codec == compression {
+			return i
+		}
+	}
+	return -1
+}
+
+// ChooseCompression resolves CompressionAuto by the sample of the content,
+// which is stored raw if zstd can not make it at least 10% smaller
+func ChooseCompression(compression string, sample []byte) string {
+	if compression != CompressionAuto {
+		return compression
+	}
+
+	if len(sample) > AutoSampleSize {
+		sample = sample[:AutoSampleSize]
+	}
+	compressed := autoEncoder.EncodeAll(sample, nil)
+	if len(compressed)*10 >= len(sample)*9 {
+		return CompressionNone
+	}
+
+	return CompressionZstd
+}
+
+// NewObjectWriter writes the object header to w and returns a writer which
+// compresses content into w, the writer must be closed to flush the object
+func NewObjectWriter(w io.Writer, compression string) (io.WriteCloser, error) {
+	if compression == CompressionZstd {
+		compression = CompressionSeekable
+	}
+	i := codecIndex(compression)
+	if i < 0 {
+		return nil, errors.New("Unsupported compression: " + compression)
+	}
+
+	_, err := w.Write(append(append([]byte{}, objectMagic...), byte(i)))
+	if err != nil {
+		return nil, err
+	}
+
+	// 多个对象由builder并行压缩，每个writer只使用少量的并发和内存
+	switch compression {
+	case CompressionGzip:
+		gw := gzip.NewWriter(w)
+		err = gw.SetConcurrency(256*1024, 4)
+		if err != nil {
+			return nil, err
+		}
+		return gw, nil
+	case CompressionSeekable:
+		return newSeekableWriter(w), nil
+	}
+
+	return nopWriteCloser{w}, nil
+}
+
+// NewObjectReader returns a reader of the decompressed content of the object
+// in r, the codec is read from the object header
+func NewObjectReader(r io.Reader) (io.ReadCloser, error) {
+	br := bufio.NewReader(r)
+	header, _ := br.Peek(len(objectMagic) + 1)
+
+	compression := CompressionGzip
+	if len(header) == len(objectMagic)+1 && bytes.Equal(header[:len(objectMagic)], objectMagic) {
+		if int(header[len(objectMagic)]) >= len(codecs) {
+			return nil, errors.New("Unknown codec of object")
+		}
+		compression = codecs[header[len(objectMagic)]]
+		br.Discard(len(header))
+	}
+
+	switch compression {
+	case CompressionGzip:
+		return gzip.NewReader(br)
+	// 可寻址对象的seek table是zstd的跳过帧，解压时被忽略
+	case CompressionZstd, CompressionSeekable:
+		zr, err := zstd.NewReader(br)
+		if err != nil {
+			return nil, err
+		}
+		return zstdReadCloser{zr}, nil
+	}
+
+	return ioutil.NopCloser(br), nil
+}
+
+type nopWriteCloser struct {
+	io.Writer
+}
+
+func (nopWriteCloser) Close() error {
+	return nil
+}
+
+type zstdReadCloser struct {
+	*zstd.Decoder
+}
+
+func (z zstdReadCloser) Close() error {
+	z.Decoder.Close()
+	return nil
+}
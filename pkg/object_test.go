@@ -0,0 +1,140 @@
+package pkg
+
+import (
+	"bytes"
+	"testing"
+	"io/ioutil"
+	"math/rand"
+	"compress/gzip"
+
+	"github.com/klauspost/compress/zstd"
+)
+
+// writeObject returns the object of content written with compression
+func writeObject(t *testing.T, content []byte, compression string) []byte {
+	var buf bytes.Buffer
+	w, err := NewObjectWriter(&buf, compression)
+	if err != nil {
+		t.Fatalf("%s: %v", compression, err)
+	}
+	_, err = w.Write(content)
+	if err != nil {
+		t.Fatalf("%s: %v", compression, err)
+	}
+	err = w.Close()
+	if err != nil {
+		t.Fatalf("%s: %v", compression, err)
+	}
+	return buf.Bytes()
+}
+
+// readObject returns the content of object
+func readObject(t *testing.T, object []byte) []byte {
+	r, err := NewObjectReader(bytes.NewReader(object))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer r.Close()
+	content, err := ioutil.ReadAll(r)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return content
+}
+
+func randomBytes(size int) []byte {
+	content := make([]byte, size)
+	rand.New(rand.NewSource(int64(size))).Read(content)
+	return content
+}
+
+func TestObjectRoundTrip(t *testing.T) {
+	text := bytes.Repeat([]byte("content of a regular file\n"), 40000)
+	contents := map[string][]byte{
+		"empty":  {},
+		"small":  []byte("x"),
+		"text":   text,
+		"random": randomBytes(3*SeekableFrameSize + 1),
+	}
+	tests := []struct {
+		compression string
+		// zstd对象写为seekable
+		codec string
+	}{
+		{CompressionNone, CompressionNone},
+		{CompressionGzip, CompressionGzip},
+		{CompressionZstd, CompressionSeekable},
+		{CompressionSeekable, CompressionSeekable},
+	}
+
+	for _, test := range tests {
+		for name, content := range contents {
+			object := writeObject(t, content, test.compression)
+			codec, err := ObjectCompression(object[:ObjectHeaderSize])
+			if err != nil || codec != test.codec {
+				t.Fatalf("%s %s: codec = %s, %v, want %s", test.compression, name, codec, err, test.codec)
+			}
+			if !bytes.Equal(readObject(t, object), content) {
+				t.Fatalf("%s %s: read wrong content", test.compression, name)
+			}
+		}
+	}
+
+	// 之前写入的zstd对象仍然可以读取
+	var buf bytes.Buffer
+	buf.Write(append(append([]byte{}, objectMagic...), byte(codecIndex(CompressionZstd))))
+	zw, err := zstd.NewWriter(&buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	zw.Write(text)
+	zw.Close()
+	if !bytes.Equal(readObject(t, buf.Bytes()), text) {
+		t.Fatal("Read wrong content of a zstd object")
+	}
+}
+
+func TestChooseCompression(t *testing.T) {
+	text := bytes.Repeat([]byte("content of a regular file\n"), 10000)
+	tests := []struct {
+		compression string
+		sample      []byte
+		want        string
+	}{
+		{CompressionAuto, randomBytes(AutoSampleSize), CompressionNone},
+		{CompressionAuto, randomBytes(100), CompressionNone},
+		{CompressionAuto, text, CompressionZstd},
+		// 只有auto由内容决定
+		{CompressionGzip, randomBytes(AutoSampleSize), CompressionGzip},
+		{CompressionSeekable, text, CompressionSeekable},
+	}
+
+	for _, test := range tests {
+		got := ChooseCompression(test.compression, test.sample)
+		if got != test.want {
+			t.Fatalf("ChooseCompression(%s, %d bytes) = %s, want %s", test.compression, len(test.sample), got, test.want)
+		}
+	}
+}
+
+func TestHeaderlessObjectIsGzip(t *testing.T) {
+	content := bytes.Repeat([]byte("legacy object\n"), 1000)
+	var buf bytes.Buffer
+	gw := gzip.NewWriter(&buf)
+	gw.Write(content)
+	gw.Close()
+
+	codec, err := ObjectCompression(buf.Bytes()[:ObjectHeaderSize])
+	if err != nil || codec != CompressionGzip {
+		t.Fatalf("codec = %s, %v, want gzip", codec, err)
+	}
+	if !bytes.Equal(readObject(t, buf.Bytes()), content) {
+		t.Fatal("Read wrong content of a headerless object")
+	}
+
+	// 头部有未知的codec时返回错误
+	_, err = NewObjectReader(bytes.NewReader(append(append([]byte{}, objectMagic...), 0xff)))
+	if err == nil {
+		t.Fatal("Read an object of unknown codec")
+	}
+}
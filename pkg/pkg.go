@@ -11,6 +11,7 @@ import (
 	"strconv"
 	"hash/fnv"
 	"crypto/md5"
+	"encoding/json"
 	"github.com/sirupsen/logrus"
 	"github.com/seveirbian/gear/types"
 )
@@ -118,10 +119,19 @@ func CopyPath(srcPath string, targetPath string, relativePath string) bool {
 	return true
 }
 
+// ParseIndexEntry parses the content of a regular file in a gear index
+// image, which is either a json IndexEntry for chunked or packed files or a
+// CID
+func ParseIndexEntry(content []byte) (*types.IndexEntry, bool, error) {
+	if len(content) == 0 || content[0] != '{' {
+		return nil, false, nil
+	}
 
+	var entry types.IndexEntry
+	err := json.Unmarshal(content, &entry)
+	if err != nil {
+		return nil, false, err
+	}
 
-
-
-
-
-
+	return &entry, true, nil
+}
@@ -0,0 +1,86 @@
+package pkg
+
+import (
+	"fmt"
+	"strings"
+	"io/ioutil"
+	"encoding/json"
+
+	"github.com/seveirbian/gear/types"
+)
+
+const (
+	// ProfileVersion is the profile format written by this version of gear
+	ProfileVersion = 1
+
+	// RecordFilesName is the file in the root of a -gearmd index image which
+	// lists the recorded files, a "path cid" line for each of them
+	RecordFilesName = "RecordFiles"
+
+	// StartupFilesPath lists the files found by the static analysis of the
+	// entrypoint at build time, in the format of RecordFiles. It is
+	// prefetched when the image has no RecordFiles.
+	StartupFilesPath = ManifestDir + "/startup"
+)
+
+// ReadProfile reads the profile at path and checks its version
+func ReadProfile(path string) (*types.Profile, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	profile := &types.Profile{}
+	err = json.Unmarshal(data, profile)
+	if err != nil {
+		return nil, fmt.Errorf("Invalid profile: %v", err)
+	}
+	if profile.Version < 1 || profile.Version > ProfileVersion {
+		return nil, fmt.Errorf("Unsupported profile version %d, this gear supports up to version %d", profile.Version, ProfileVersion)
+	}
+
+	return profile, nil
+}
+
+// ParseRecordFiles converts the content of RecordFiles into a profile
+func ParseRecordFiles(content []byte) *types.Profile {
+	profile := &types.Profile{
+		Version: ProfileVersion,
+		Files:   []types.ProfileFile{},
+	}
+
+	for _, line := range strings.Split(string(content), "\n") {
+		fields := strings.SplitN(line, " ", 2)
+		if len(fields) != 2 || fields[0] == "" {
+			continue
+		}
+		profile.Files = append(profile.Files, types.ProfileFile{Path: fields[0], CID: fields[1]})
+	}
+
+	return profile
+}
+
+// FormatRecordFiles returns the content of RecordFiles of the files
+func FormatRecordFiles(names, cids []string) string {
+	lines := []string{}
+	for i := range names {
+		lines = append(lines, names[i]+" "+cids[i])
+	}
+
+	return strings.Join(lines, "\n")
+}
+
+// ProfilePaths returns the paths of the profile in access order, each path
+// only once
+func ProfilePaths(profile *types.Profile) []string {
+	paths := []string{}
+	seen := map[string]bool{}
+	for _, file := range profile.Files {
+		if !seen[file.Path] {
+			seen[file.Path] = true
+			paths = append(paths, file.Path)
+		}
+	}
+
+	return paths
+}
@@ -0,0 +1,498 @@
+package pkg
+
+import (
+	"io"
+	"bufio"
+	"errors"
+	"io/ioutil"
+	"encoding/binary"
+
+	"github.com/klauspost/compress/zstd"
+)
+
+const (
+	// SeekableFrameSize is the content of each independently compressed
+	// frame of a seekable object, a range read decompresses whole frames
+	SeekableFrameSize = 256 * 1024
+
+	// SeekTableFooterSize is the size of the end of a seekable object which
+	// holds the number of frames
+	SeekTableFooterSize = 9
+
+	// ObjectHeaderSize is the size of the header of an object
+	ObjectHeaderSize = 6
+
+	// 跳过帧和可寻址格式的魔数，与zstd的seekable format相同
+	seekTableMagic    = 0x184D2A5E
+	seekableMagic     = 0x8F92EAB1
+	seekTableEntrySize = 8
+	zstdMagic          = 0xFD2FB528
+	zstdMaxBlockSize   = 128 * 1024
+)
+
+var (
+	seekableEncoder, _ = zstd.NewWriter(nil)
+	seekableDecoder, _ = zstd.NewReader(nil)
+)
+
+// SeekTable is the frames of a seekable object
+type SeekTable struct {
+	Frames []SeekFrame
+	// Size of the content
+	Size int64
+}
+
+// SeekFrame is a frame of a seekable object, Offset is where the compressed
+// frame starts in the object and ContentOffset where its content starts
+type SeekFrame struct {
+	Offset         int64
+	CompressedSize int64
+	ContentOffset  int64
+	Size           int64
+}
+
+// seekableWriter compresses every SeekableFrameSize bytes into a zstd frame
+// and writes the seek table as a skippable frame when closed, so that the
+// object is still a valid zstd stream
+type seekableWriter struct {
+	w      io.Writer
+	buf    []byte
+	frames [][2]uint32
+	err    error
+}
+
+func newSeekableWriter(w io.Writer) *seekableWriter {
+	return &seekableWriter{w: w, buf: make([]byte, 0, SeekableFrameSize)}
+}
+
+func (s *seekableWriter) Write(p []byte) (int, error) {
+	n := 0
+	for len(p) > 0 && s.err == nil {
+		m := SeekableFrameSize - len(s.buf)
+		if m > len(p) {
+			m = len(p)
+		}
+		s.buf = append(s.buf, p[:m]...)
+		p = p[m:]
+		n += m
+
+		if len(s.buf) == SeekableFrameSize {
+			s.flush()
+		}
+	}
+
+	return n, s.err
+}
+
+func (s *seekableWriter) flush() {
+	frame := seekableEncoder.EncodeAll(s.buf, nil)
+	_, s.err = s.w.Write(frame)
+	s.frames = append(s.frames, [2]uint32{uint32(len(frame)), uint32(len(s.buf))})
+	s.buf = s.buf[:0]
+}
+
+func (s *seekableWriter) Close() error {
+	if len(s.buf) > 0 && s.err == nil {
+		s.flush()
+	}
+	if s.err != nil {
+		return s.err
+	}
+
+	tableSize := len(s.frames)*seekTableEntrySize + SeekTableFooterSize
+	table := make([]byte, 8, 8+tableSize)
+	binary.LittleEndian.PutUint32(table[0:], seekTableMagic)
+	binary.LittleEndian.PutUint32(table[4:], uint32(tableSize))
+	for _, frame := range s.frames {
+		table = appendUint32(table, frame[0])
+		table = appendUint32(table, frame[1])
+	}
+	table = appendUint32(table, uint32(len(s.frames)))
+	// 描述符为0，帧没有校验和
+	table = append(table, 0)
+	table = appendUint32(table, seekableMagic)
+
+	_, s.err = s.w.Write(table)
+
+	return s.err
+}
+
+func appendUint32(b []byte, v uint32) []byte {
+	var buf [4]byte
+	binary.LittleEndian.PutUint32(buf[:], v)
+	return append(b, buf[:]...)
+}
+
+// ObjectCompression returns the codec of the object from its first
+// ObjectHeaderSize bytes, objects without a header are legacy gzip objects
+func ObjectCompression(header []byte) (string, error) {
+	if len(header) < ObjectHeaderSize || string(header[:len(objectMagic)]) != string(objectMagic) {
+		return CompressionGzip, nil
+	}
+	if int(header[len(objectMagic)]) >= len(codecs) {
+		return "", errors.New("Unknown codec of object")
+	}
+
+	return codecs[header[len(objectMagic)]], nil
+}
+
+// SeekTableSize returns the size of the seek table of a seekable object from
+// its last SeekTableFooterSize bytes
+func SeekTableSize(footer []byte) (int64, error) {
+	if len(footer) < SeekTableFooterSize {
+		return 0, errors.New("Short seek table footer")
+	}
+	footer = footer[len(footer)-SeekTableFooterSize:]
+	if binary.LittleEndian.Uint32(footer[5:]) != seekableMagic {
+		return 0, errors.New("Not a seekable object")
+	}
+
+	frames := int64(binary.LittleEndian.Uint32(footer))
+	return 8 + frames*seekTableEntrySize + SeekTableFooterSize, nil
+}
+
+// ParseSeekTable parses the seek table at the end of tail, which is the end
+// of a seekable object of objectSize bytes
+func ParseSeekTable(tail []byte, objectSize int64) (*SeekTable, error) {
+	size, err := SeekTableSize(tail)
+	if err != nil {
+		return nil, err
+	}
+	if int64(len(tail)) < size || objectSize < size+ObjectHeaderSize {
+		return nil, errors.New("Short seek table")
+	}
+	table := tail[int64(len(tail))-size:]
+	if binary.LittleEndian.Uint32(table) != seekTableMagic {
+		return nil, errors.New("Invalid seek table")
+	}
+
+	t := &SeekTable{}
+	offset := int64(ObjectHeaderSize)
+	entries := table[8 : size-SeekTableFooterSize]
+	for i := 0; i+seekTableEntrySize <= len(entries); i += seekTableEntrySize {
+		frame := SeekFrame{
+			Offset:         offset,
+			CompressedSize: int64(binary.LittleEndian.Uint32(entries[i:])),
+			ContentOffset:  t.Size,
+			Size:           int64(binary.LittleEndian.Uint32(entries[i+4:])),
+		}
+		offset += frame.CompressedSize
+		t.Size += frame.Size
+		t.Frames = append(t.Frames, frame)
+	}
+	if offset != objectSize-size {
+		return nil, errors.New("Seek table does not match the object")
+	}
+
+	return t, nil
+}
+
+// FramesOf returns the frames [first, last) covering content [start, end)
+func (t *SeekTable) FramesOf(start, end int64) (int, int) {
+	first := 0
+	for first < len(t.Frames) && t.Frames[first].ContentOffset+t.Frames[first].Size <= start {
+		first++
+	}
+	last := first
+	for last < len(t.Frames) && t.Frames[last].ContentOffset < end {
+		last++
+	}
+
+	return first, last
+}
+
+// DecodeFrame decompresses a frame of a seekable object
+func DecodeFrame(frame []byte) ([]byte, error) {
+	return seekableDecoder.DecodeAll(frame, nil)
+}
+
+// NewObjectReaderAt returns a reader of the decompressed content of the
+// object of size bytes in r from offset. Seekable objects are decompressed
+// from the frame covering offset and raw objects read at offset, other
+// objects are decompressed from the start.
+func NewObjectReaderAt(r io.ReaderAt, size, offset int64) (io.ReadCloser, error) {
+	header := make([]byte, ObjectHeaderSize)
+	n, err := r.ReadAt(header, 0)
+	if err != nil && err != io.EOF {
+		return nil, err
+	}
+	compression, err := ObjectCompression(header[:n])
+	if err != nil {
+		return nil, err
+	}
+
+	switch compression {
+	case CompressionNone:
+		if offset > size-ObjectHeaderSize {
+			return nil, errors.New("Offset is beyond the content")
+		}
+		return ioutil.NopCloser(io.NewSectionReader(r, ObjectHeaderSize+offset, size-ObjectHeaderSize-offset)), nil
+	case CompressionSeekable:
+		table, err := readSeekTable(r, size)
+		if err != nil {
+			return nil, err
+		}
+		if offset > table.Size {
+			return nil, errors.New("Offset is beyond the content")
+		}
+		first, _ := table.FramesOf(offset, table.Size)
+		return &frameReader{r: r, table: table, frame: first, skip: offset - frameOffset(table, first)}, nil
+	}
+
+	rc, err := NewObjectReader(io.NewSectionReader(r, 0, size))
+	if err != nil {
+		return nil, err
+	}
+	_, err = io.CopyN(ioutil.Discard, rc, offset)
+	if err != nil {
+		rc.Close()
+		return nil, err
+	}
+
+	return rc, nil
+}
+
+// readSeekTable reads the seek table at the end of the seekable object of
+// size bytes in r
+func readSeekTable(r io.ReaderAt, size int64) (*SeekTable, error) {
+	tail := make([]byte, SeekTableFooterSize)
+	if size < int64(len(tail)) {
+		return nil, errors.New("Short seek table footer")
+	}
+	_, err := r.ReadAt(tail, size-int64(len(tail)))
+	if err != nil {
+		return nil, err
+	}
+
+	tableSize, err := SeekTableSize(tail)
+	if err != nil {
+		return nil, err
+	}
+	if tableSize > size {
+		return nil, errors.New("Short seek table")
+	}
+	tail = make([]byte, tableSize)
+	_, err = r.ReadAt(tail, size-tableSize)
+	if err != nil {
+		return nil, err
+	}
+
+	return ParseSeekTable(tail, size)
+}
+
+// frameOffset is where the content of the frame starts, the end of the
+// content if there is no such frame
+func frameOffset(t *SeekTable, frame int) int64 {
+	if frame < len(t.Frames) {
+		return t.Frames[frame].ContentOffset
+	}
+	return t.Size
+}
+
+// frameReader decompresses the frames of a seekable object one by one from
+// frame, the first skip bytes are dropped
+type frameReader struct {
+	r     io.ReaderAt
+	table *SeekTable
+	frame int
+	skip  int64
+	buf   []byte
+}
+
+func (f *frameReader) Read(p []byte) (int, error) {
+	for len(f.buf) == 0 {
+		if f.frame >= len(f.table.Frames) {
+			return 0, io.EOF
+		}
+
+		frame := f.table.Frames[f.frame]
+		compressed := make([]byte, frame.CompressedSize)
+		_, err := f.r.ReadAt(compressed, frame.Offset)
+		if err != nil {
+			return 0, err
+		}
+		content, err := DecodeFrame(compressed)
+		if err != nil {
+			return 0, err
+		}
+		if int64(len(content)) != frame.Size {
+			return 0, errors.New("Frame does not match the seek table")
+		}
+
+		f.buf = content[f.skip:]
+		f.skip = 0
+		f.frame++
+	}
+
+	n := copy(p, f.buf)
+	f.buf = f.buf[n:]
+
+	return n, nil
+}
+
+func (f *frameReader) Close() error {
+	return nil
+}
+
+// NewFrameReader returns a reader of the content of the seekable object read
+// from r, which decompresses it frame by frame. A frame is returned only
+// after it is decompressed as a whole, so the content has been checked by
+// the zstd checksum of its frame.
+func NewFrameReader(r io.Reader) (io.ReadCloser, error) {
+	br := bufio.NewReader(r)
+	header := make([]byte, ObjectHeaderSize)
+	_, err := io.ReadFull(br, header)
+	if err != nil {
+		return nil, err
+	}
+	compression, err := ObjectCompression(header)
+	if err != nil {
+		return nil, err
+	}
+	if compression != CompressionSeekable {
+		return nil, errors.New("Not a seekable object")
+	}
+
+	return &streamFrameReader{r: br}, nil
+}
+
+// streamFrameReader decompresses the frames of a seekable object read from
+// the start, the seek table at the end is skipped
+type streamFrameReader struct {
+	r   *bufio.Reader
+	buf []byte
+	eof bool
+}
+
+func (f *streamFrameReader) Read(p []byte) (int, error) {
+	for len(f.buf) == 0 {
+		if f.eof {
+			return 0, io.EOF
+		}
+
+		frame, skippable, err := readZstdFrame(f.r)
+		if err != nil {
+			return 0, err
+		}
+		// seek table是最后一个帧
+		if skippable {
+			f.eof = true
+			continue
+		}
+		f.buf, err = DecodeFrame(frame)
+		if err != nil {
+			return 0, err
+		}
+	}
+
+	n := copy(p, f.buf)
+	f.buf = f.buf[n:]
+
+	return n, nil
+}
+
+func (f *streamFrameReader) Close() error {
+	return nil
+}
+
+// readZstdFrame reads a whole zstd frame from r by its frame header and block
+// headers, skippable frames are reported but not returned
+func readZstdFrame(r *bufio.Reader) ([]byte, bool, error) {
+	magic := make([]byte, 4)
+	_, err := io.ReadFull(r, magic)
+	if err != nil {
+		return nil, false, err
+	}
+
+	if binary.LittleEndian.Uint32(magic)&0xFFFFFFF0 == 0x184D2A50 {
+		size := make([]byte, 4)
+		_, err = io.ReadFull(r, size)
+		if err != nil {
+			return nil, true, err
+		}
+		_, err = io.CopyN(ioutil.Discard, r, int64(binary.LittleEndian.Uint32(size)))
+		return nil, true, err
+	}
+	if binary.LittleEndian.Uint32(magic) != zstdMagic {
+		return nil, false, errors.New("Invalid zstd frame")
+	}
+
+	descriptor, err := r.ReadByte()
+	if err != nil {
+		return nil, false, err
+	}
+	frame := append(magic, descriptor)
+
+	// 帧头的长度由描述符决定：窗口描述符、字典ID和内容大小
+	singleSegment := descriptor&0x20 != 0
+	headerSize := []int{0, 1, 2, 4}[descriptor&3]
+	if !singleSegment {
+		headerSize++
+	}
+	switch descriptor >> 6 {
+	case 0:
+		if singleSegment {
+			headerSize++
+		}
+	case 1:
+		headerSize += 2
+	case 2:
+		headerSize += 4
+	case 3:
+		headerSize += 8
+	}
+	frame, err = readAppend(r, frame, headerSize)
+	if err != nil {
+		return nil, false, err
+	}
+
+	for {
+		frame, err = readAppend(r, frame, 3)
+		if err != nil {
+			return nil, false, err
+		}
+		block := frame[len(frame)-3:]
+		blockHeader := uint32(block[0]) | uint32(block[1])<<8 | uint32(block[2])<<16
+
+		size := int(blockHeader >> 3)
+		switch (blockHeader >> 1) & 3 {
+		case 1:
+			// RLE块只有一个字节
+			size = 1
+		case 3:
+			return nil, false, errors.New("Invalid zstd block")
+		}
+		if size > zstdMaxBlockSize {
+			return nil, false, errors.New("Invalid zstd block")
+		}
+		frame, err = readAppend(r, frame, size)
+		if err != nil {
+			return nil, false, err
+		}
+
+		if blockHeader&1 != 0 {
+			break
+		}
+	}
+
+	if descriptor&0x04 != 0 {
+		frame, err = readAppend(r, frame, 4)
+		if err != nil {
+			return nil, false, err
+		}
+	}
+
+	return frame, false, nil
+}
+
+// readAppend appends n bytes read from r to b
+func readAppend(r io.Reader, b []byte, n int) ([]byte, error) {
+	start := len(b)
+	b = append(b, make([]byte, n)...)
+	_, err := io.ReadFull(r, b[start:])
+	if err == io.EOF {
+		err = io.ErrUnexpectedEOF
+	}
+
+	return b, err
+}
@@ -0,0 +1,90 @@
+package pkg
+
+import (
+	"bytes"
+	"strings"
+
+	"golang.org/x/sys/unix"
+)
+
+// ListXattrs returns the extended attributes of the file at path without
+// following symlinks, filesystems without xattr support have none
+func ListXattrs(path string) (map[string][]byte, error) {
+	xattrs := map[string][]byte{}
+
+	names, err := listXattrNames(path)
+	if err != nil {
+		if err == unix.ENOTSUP {
+			return xattrs, nil
+		}
+		return nil, err
+	}
+
+	for _, name := range names {
+		value, err := GetXattr(path, name)
+		if err == unix.ENODATA {
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+		xattrs[name] = value
+	}
+
+	return xattrs, nil
+}
+
+// GetXattr returns the value of the extended attribute name of the file at
+// path without following symlinks
+func GetXattr(path, name string) ([]byte, error) {
+	for {
+		size, err := unix.Lgetxattr(path, name, nil)
+		if err != nil {
+			return nil, err
+		}
+		value := make([]byte, size)
+		n, err := unix.Lgetxattr(path, name, value)
+		if err == unix.ERANGE {
+			// 两次调用之间属性被修改了
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+		return value[:n], nil
+	}
+}
+
+func listXattrNames(path string) ([]string, error) {
+	for {
+		size, err := unix.Llistxattr(path, nil)
+		if err != nil {
+			return nil, err
+		}
+		if size == 0 {
+			return nil, nil
+		}
+		buf := make([]byte, size)
+		n, err := unix.Llistxattr(path, buf)
+		if err == unix.ERANGE {
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+
+		names := []string{}
+		for _, name := range bytes.Split(buf[:n], []byte{0}) {
+			if len(name) > 0 {
+				names = append(names, string(name))
+			}
+		}
+		return names, nil
+	}
+}
+
+// IsImageXattr reports whether the xattr belongs to the image content, the
+// ones used by overlayfs to implement layers do not
+func IsImageXattr(name string) bool {
+	return !strings.HasPrefix(name, "trusted.overlay.")
+}
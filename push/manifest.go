@@ -0,0 +1,33 @@
+package push
+
+import (
+	"os"
+
+	"github.com/seveirbian/gear/pkg"
+)
+
+// manifestCIDs returns the CIDs the manifests of the gear images refer to,
+// or nil if p.Manifests is not set or the images were built without a
+// manifest
+func (p *Pusher) manifestCIDs() (map[string]bool, error) {
+	var cids map[string]bool
+
+	for _, path := range p.Manifests {
+		manifest, err := pkg.ReadManifestFile(path)
+		if os.IsNotExist(err) {
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+
+		if cids == nil {
+			cids = map[string]bool{}
+		}
+		for _, cid := range pkg.ManifestCIDs(manifest) {
+			cids[cid] = true
+		}
+	}
+
+	return cids, nil
+}
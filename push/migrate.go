@@ -0,0 +1,103 @@
+package push
+
+import (
+	"os"
+	"io"
+	"fmt"
+	"bytes"
+	"net/url"
+	"net/http"
+	"io/ioutil"
+	"mime/multipart"
+
+	"github.com/seveirbian/gear/pkg"
+)
+
+// Migrate gets the object of the legacy cid from manager, and makes sure it
+// is stored under its new cid too. It returns the new cid.
+func (p *Pusher) Migrate(legacyCid string) (string, error) {
+	if cid, ok := p.migrated[legacyCid]; ok {
+		return cid, nil
+	}
+
+	// 1. 下载原有对象到临时文件
+	resp, err := http.PostForm("http://"+p.StorageIP+":"+p.StoragePort+"/pull/"+legacyCid, url.Values{})
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return "", fmt.Errorf("Fail to pull %s: %s", legacyCid, resp.Status)
+	}
+
+	tmp, err := ioutil.TempFile("", "gear-migrate-")
+	if err != nil {
+		return "", err
+	}
+	defer os.Remove(tmp.Name())
+	defer tmp.Close()
+
+	_, err = io.Copy(tmp, resp.Body)
+	if err != nil {
+		return "", err
+	}
+
+	// 2. 校验原有cid并计算新cid
+	_, err = tmp.Seek(0, io.SeekStart)
+	if err != nil {
+		return "", err
+	}
+	gr, err := pkg.NewObjectReader(tmp)
+	if err != nil {
+		return "", err
+	}
+	content, err := ioutil.ReadAll(gr)
+	gr.Close()
+	if err != nil {
+		return "", err
+	}
+	err = pkg.VerifyCID(legacyCid, bytes.NewReader(content))
+	if err != nil {
+		return "", err
+	}
+	cid := pkg.HashBytes(content)
+
+	// 3. manager中没有新cid的对象时上传
+	resp, err = http.PostForm("http://"+p.StorageIP+":"+p.StoragePort+"/query/"+cid, url.Values{})
+	if err != nil {
+		return "", err
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		_, err = tmp.Seek(0, io.SeekStart)
+		if err != nil {
+			return "", err
+		}
+
+		buf := new(bytes.Buffer)
+		writer := multipart.NewWriter(buf)
+		formFile, err := writer.CreateFormFile("file", cid)
+		if err != nil {
+			return "", err
+		}
+		_, err = io.Copy(formFile, tmp)
+		if err != nil {
+			return "", err
+		}
+		writer.Close()
+
+		resp, err = http.Post("http://"+p.StorageIP+":"+p.StoragePort+"/push/"+cid, writer.FormDataContentType(), buf)
+		if err != nil {
+			return "", err
+		}
+		resp.Body.Close()
+		if resp.StatusCode != http.StatusOK {
+			return "", fmt.Errorf("Fail to push %s: %s", cid, resp.Status)
+		}
+	}
+
+	p.migrated[legacyCid] = cid
+	fmt.Printf("%s -> %s\n", legacyCid, cid)
+
+	return cid, nil
+}
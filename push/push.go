@@ -5,8 +5,8 @@ import (
 	"io"
 	"os"
 	"bytes"
+	"time"
 	"strings"
-	"net/url"
 	"net/http"
 	"mime/multipart"
 	// "crypto/md5"
@@ -15,7 +15,7 @@ import (
 	"path/filepath"
 
 	// "github.com/docker/docker/api/types"
-	// "github.com/seveirbian/gear/pkg"
+	"github.com/seveirbian/gear/pkg"
 	// "github.com/docker/docker/client"
 	// "github.com/docker/docker/daemon/graphdriver/overlay2"
 	"github.com/sirupsen/logrus"
@@ -34,6 +34,14 @@ type Pusher struct {
 	FilesToSent map[string]string
 
 	DoNotClean bool
+
+	// Manifests are the paths of the manifests of the gear images whose
+	// objects are in GFilesDir, only objects they refer to are pushed. Empty
+	// pushes every object in GFilesDir.
+	Manifests []string
+
+	// legacy cids already migrated by Migrate
+	migrated map[string]string
 }
 
 func InitPusher(path, ip, port string, doNotClean bool) (*Pusher, error) {
@@ -48,10 +56,14 @@ func InitPusher(path, ip, port string, doNotClean bool) (*Pusher, error) {
 		GFilesDir: path, 
 		FilesToSent: map[string]string{}, 
 		DoNotClean: noClean, 
+		migrated: map[string]string{}, 
 	}, nil
 }
 
-func (p *Pusher) Push() {
+// Push uploads the objects in GFilesDir which are not in the storage of
+// manager. It returns an error if an object can not be uploaded, the gear
+// image must not be pushed then, since its objects are not all in storage.
+func (p *Pusher) Push() error {
 	// 遍历普通文件目录，将所有文件添加到待push的字典中
     err := filepath.Walk(p.GFilesDir, func(path string, f os.FileInfo, err error) error {
     	if f == nil {
@@ -64,60 +76,90 @@ func (p *Pusher) Push() {
 			return nil
 		}
 
+		// 只上传以cid命名的对象
+		if !pkg.ValidCID(f.Name()) {
+			return nil
+		}
+
     	p.FilesToSent[f.Name()] = path
 
     	return nil
     })
 
     if err != nil {
-    	logger.Warnf("Fail to walk dir for %v", err)
+    	return fmt.Errorf("Fail to walk %s for %v", p.GFilesDir, err)
+    }
+
+    // 有清单时只上传清单中引用的对象
+    manifestCIDs, err := p.manifestCIDs()
+    if err != nil {
+    	return fmt.Errorf("Fail to read gear manifest for %v", err)
+    }
+    if manifestCIDs != nil {
+    	for cid, _ := range p.FilesToSent {
+    		if !manifestCIDs[cid] {
+    			delete(p.FilesToSent, cid)
+    		}
+    	}
+    	for cid, _ := range manifestCIDs {
+    		if _, ok := p.FilesToSent[cid]; !ok {
+    			logger.Warnf("Object %s in the gear manifest is missing in %s", cid, p.GFilesDir)
+    		}
+    	}
+    }
+
+    // 已知存在于storage中的文件不再询问manager，先抽查其中一部分是否仍然存在
+    stored := p.loadStored()
+    known := []string{}
+    for cid, _ := range p.FilesToSent {
+    	if _, ok := stored[cid]; ok {
+    		known = append(known, cid)
+    	}
+    }
+    if !p.checkStored(known) {
+    	stored = map[string]time.Time{}
+    	known = nil
+    }
+    for _, cid := range known {
+    	delete(p.FilesToSent, cid)
     }
 
     // 将字典中所有文件都询问manager，如果该文件已经存在storage中，则将其从字典中删除
     fmt.Println("Querying...")
     toDelete := map[string]string{}
     for cid, path := range p.FilesToSent {
-    	resp, err := http.PostForm("http://"+p.StorageIP+":"+p.StoragePort+"/query/"+cid, url.Values{})
+    	ok, err := p.query(cid)
     	if err != nil {
     		logger.Warnf("Fail to query cid for %v", err)
+    		continue
     	}
 
-    	if resp.StatusCode == http.StatusOK {
+    	if ok {
     		toDelete[cid] = path
     	}
     }
 
     for cid, _ := range toDelete {
     	delete(p.FilesToSent, cid)
+    	stored[cid] = time.Now()
     }
 
     fmt.Println("Uploading...")
     for cid, path := range p.FilesToSent {
-    	// 创建表单文件
-	    // CreateFormFile 用来创建表单，第一个参数是字段名，第二个参数是文件名
-	    buf := new(bytes.Buffer)
-	    writer := multipart.NewWriter(buf)
-	   	formFile, err := writer.CreateFormFile("file", cid)
-	   	if err != nil {
-	        logger.Warnf("Fail to create form file failed: %v", err)
-	    }
-	    // 从文件读取数据，写入表单
-	    srcFile, err := os.Open(path)
-	    if err != nil {
-	        logger.Warnf("Fail to open source file for %v", err)
-	    }
-	    _, err = io.Copy(formFile, srcFile)
-	    if err != nil {
-	        logger.Warnf("Fail to write to form file for %v", err)
-	    }
-	    // 发送表单
-	    contentType := writer.FormDataContentType()
-	    writer.Close() // 发送之前必须调用Close()以写入结尾行
-	    _, err = http.Post("http://"+p.StorageIP+":"+p.StoragePort+"/push/"+cid, contentType, buf)
-	    if err != nil {
-	        logger.Fatalf("Post failed: %s\n", err)
-	    }
-	    srcFile.Close()
+    	err = p.upload(cid, path)
+    	if err != nil {
+    		// 已经上传的对象仍然记录下来，重试时不再上传
+    		if err := p.saveStored(stored); err != nil {
+    			logger.Warnf("Fail to save stored cids for %v", err)
+    		}
+    		return fmt.Errorf("Fail to upload %s for %v", cid, err)
+    	}
+    	stored[cid] = time.Now()
+    }
+
+    err = p.saveStored(stored)
+    if err != nil {
+    	logger.Warnf("Fail to save stored cids for %v", err)
     }
 
     fmt.Println("Push OK!")
@@ -131,6 +173,44 @@ func (p *Pusher) Push() {
 
     	fmt.Println("Clean up OK!")
     }
+
+    return nil
+}
+
+// upload posts the object cid at path to manager
+func (p *Pusher) upload(cid, path string) error {
+	// 创建表单文件
+    // CreateFormFile 用来创建表单，第一个参数是字段名，第二个参数是文件名
+    buf := new(bytes.Buffer)
+    writer := multipart.NewWriter(buf)
+   	formFile, err := writer.CreateFormFile("file", cid)
+   	if err != nil {
+        return err
+    }
+    // 从文件读取数据，写入表单
+    srcFile, err := os.Open(path)
+    if err != nil {
+        return err
+    }
+    defer srcFile.Close()
+    _, err = io.Copy(formFile, srcFile)
+    if err != nil {
+        return err
+    }
+    // 发送表单
+    contentType := writer.FormDataContentType()
+    writer.Close() // 发送之前必须调用Close()以写入结尾行
+    resp, err := http.Post("http://"+p.StorageIP+":"+p.StoragePort+"/push/"+cid, contentType, buf)
+    if err != nil {
+        return err
+    }
+    resp.Body.Close()
+
+    if resp.StatusCode < 200 || resp.StatusCode > 299 {
+    	return fmt.Errorf("Unexpected status %s", resp.Status)
+    }
+
+    return nil
 }
 
 func ParseImage(image string) (imageName string, imageTag string) {
@@ -0,0 +1,118 @@
+package push
+
+import (
+	"os"
+	"fmt"
+	"time"
+	"strings"
+	"strconv"
+	"net/url"
+	"net/http"
+	"math/rand"
+	"io/ioutil"
+	"path/filepath"
+)
+
+var (
+	// StoredCIDsPath keeps a file for each manager listing the CIDs known to
+	// be in its storage and when they were last seen there
+	StoredCIDsPath = "/var/lib/gear/build/stored"
+
+	// StoredCIDsExpiry is how long a CID is trusted to be in storage after it
+	// was last seen there
+	StoredCIDsExpiry = 7 * 24 * time.Hour
+
+	// StoredCIDsSample known CIDs are queried before the others are trusted,
+	// all of them are forgotten if one is missing, like after the storage of
+	// manager is reset
+	StoredCIDsSample = 16
+)
+
+func (p *Pusher) storedCIDsFile() string {
+	return filepath.Join(StoredCIDsPath, p.StorageIP+":"+p.StoragePort)
+}
+
+// loadStored returns the CIDs known to be in the storage of manager and when
+// they were last seen there, expired CIDs are left out
+func (p *Pusher) loadStored() map[string]time.Time {
+	stored := map[string]time.Time{}
+
+	content, err := ioutil.ReadFile(p.storedCIDsFile())
+	if err != nil {
+		return stored
+	}
+	for _, line := range strings.Split(string(content), "\n") {
+		// 每行是cid和最后确认的时间，没有时间的旧格式视为过期
+		fields := strings.Fields(line)
+		if len(fields) != 2 {
+			continue
+		}
+		seen, err := strconv.ParseInt(fields[1], 10, 64)
+		if err != nil || time.Since(time.Unix(seen, 0)) > StoredCIDsExpiry {
+			continue
+		}
+		stored[fields[0]] = time.Unix(seen, 0)
+	}
+
+	return stored
+}
+
+// checkStored queries a sample of cids, which are known to be in the storage
+// of manager, and reports whether all of them are still there
+func (p *Pusher) checkStored(cids []string) bool {
+	for n, i := range rand.Perm(len(cids)) {
+		if n >= StoredCIDsSample {
+			break
+		}
+		ok, err := p.query(cids[i])
+		if err != nil {
+			logger.Warnf("Fail to query cid for %v", err)
+			return false
+		}
+		if !ok {
+			logger.Warnf("Object %s is no longer in storage, forget the known objects", cids[i])
+			return false
+		}
+	}
+
+	return true
+}
+
+// saveStored rewrites the CIDs known to be in the storage of manager
+func (p *Pusher) saveStored(stored map[string]time.Time) error {
+	err := os.MkdirAll(StoredCIDsPath, os.ModePerm)
+	if err != nil {
+		return err
+	}
+
+	lines := []string{}
+	for cid, seen := range stored {
+		lines = append(lines, cid+" "+strconv.FormatInt(seen.Unix(), 10))
+	}
+
+	tmp := p.storedCIDsFile() + ".tmp"
+	err = ioutil.WriteFile(tmp, []byte(strings.Join(lines, "\n")+"\n"), 0644)
+	if err != nil {
+		return err
+	}
+
+	return os.Rename(tmp, p.storedCIDsFile())
+}
+
+// query asks manager whether the object cid is in its storage
+func (p *Pusher) query(cid string) (bool, error) {
+	resp, err := http.PostForm("http://"+p.StorageIP+":"+p.StoragePort+"/query/"+cid, url.Values{})
+	if err != nil {
+		return false, err
+	}
+	resp.Body.Close()
+
+	switch resp.StatusCode {
+	case http.StatusOK:
+		return true, nil
+	case http.StatusNotFound:
+		return false, nil
+	}
+
+	return false, fmt.Errorf("Unexpected status %s", resp.Status)
+}
@@ -0,0 +1,227 @@
+package registry
+
+import (
+	"os"
+	"fmt"
+	"strings"
+	"net/url"
+	"net/http"
+	"io/ioutil"
+	"encoding/json"
+	"path/filepath"
+	"encoding/base64"
+)
+
+// do sends req with the authorization got from the registry, if the
+// registry answers 401 it authenticates as its challenge asks and sends req
+// again
+func (r *Registry) do(req *http.Request) (*http.Response, error) {
+	r.authorize(req)
+	resp, err := r.Client.Do(req)
+	if err != nil || resp.StatusCode != http.StatusUnauthorized {
+		return resp, err
+	}
+	challenge := resp.Header.Get("WWW-Authenticate")
+	resp.Body.Close()
+
+	err = r.authenticate(challenge)
+	if err != nil {
+		logger.Warnf("Fail to authenticate to %s for %v", r.Host, err)
+		return nil, err
+	}
+
+	// 请求体只能读一次，不能重放的请求直接返回
+	if req.Body != nil {
+		if req.GetBody == nil {
+			return nil, fmt.Errorf("Fail to resend %s %s after authentication", req.Method, req.URL)
+		}
+		req.Body, err = req.GetBody()
+		if err != nil {
+			return nil, err
+		}
+	}
+	r.authorize(req)
+
+	return r.Client.Do(req)
+}
+
+func (r *Registry) authorize(req *http.Request) {
+	r.mu.Lock()
+	authorization := r.authorization
+	r.mu.Unlock()
+
+	if authorization != "" {
+		req.Header.Set("Authorization", authorization)
+	}
+}
+
+// authenticate gets the authorization asked by the WWW-Authenticate
+// challenge, a bearer token from the token server or basic auth
+func (r *Registry) authenticate(challenge string) error {
+	scheme, params := parseChallenge(challenge)
+
+	var authorization string
+	switch strings.ToLower(scheme) {
+	case "basic":
+		if r.Username == "" {
+			return fmt.Errorf("No credentials for %s", r.Host)
+		}
+		authorization = "Basic " + basicAuth(r.Username, r.Password)
+	case "bearer":
+		token, err := r.fetchToken(params)
+		if err != nil {
+			return err
+		}
+		authorization = "Bearer " + token
+	default:
+		return fmt.Errorf("Unsupported authentication %q", challenge)
+	}
+
+	r.mu.Lock()
+	r.authorization = authorization
+	r.mu.Unlock()
+
+	return nil
+}
+
+// fetchToken gets a bearer token for the service and scope of the challenge
+// from its realm
+func (r *Registry) fetchToken(params map[string]string) (string, error) {
+	realm, err := url.Parse(params["realm"])
+	if err != nil || params["realm"] == "" {
+		return "", fmt.Errorf("Invalid token realm %q", params["realm"])
+	}
+	q := realm.Query()
+	if service, ok := params["service"]; ok {
+		q.Set("service", service)
+	}
+	if scope, ok := params["scope"]; ok {
+		q.Set("scope", scope)
+	}
+	realm.RawQuery = q.Encode()
+
+	req, err := http.NewRequest(http.MethodGet, realm.String(), nil)
+	if err != nil {
+		return "", err
+	}
+	if r.Username != "" {
+		req.SetBasicAuth(r.Username, r.Password)
+	}
+
+	resp, err := r.Client.Do(req)
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return "", fmt.Errorf("Fail to get token from %s: %s", realm.Host, resp.Status)
+	}
+
+	var token struct {
+		Token       string `json:"token"`
+		AccessToken string `json:"access_token"`
+	}
+	err = json.NewDecoder(resp.Body).Decode(&token)
+	if err != nil {
+		return "", err
+	}
+	if token.Token == "" {
+		token.Token = token.AccessToken
+	}
+	if token.Token == "" {
+		return "", fmt.Errorf("No token from %s", realm.Host)
+	}
+
+	return token.Token, nil
+}
+
+// parseChallenge parses a WWW-Authenticate header like
+// Bearer realm="https://auth.example.com/token",service="registry"
+func parseChallenge(challenge string) (string, map[string]string) {
+	params := map[string]string{}
+
+	challenge = strings.TrimSpace(challenge)
+	i := strings.IndexByte(challenge, ' ')
+	if i < 0 {
+		return challenge, params
+	}
+	scheme, rest := challenge[:i], challenge[i+1:]
+
+	for {
+		rest = strings.TrimLeft(rest, " ,")
+		eq := strings.IndexByte(rest, '=')
+		if eq < 0 {
+			break
+		}
+		key := strings.ToLower(strings.TrimSpace(rest[:eq]))
+		rest = rest[eq+1:]
+
+		var value string
+		if strings.HasPrefix(rest, "\"") {
+			// 引号中的值可能含有逗号，如scope
+			end := strings.IndexByte(rest[1:], '"')
+			if end < 0 {
+				value, rest = rest[1:], ""
+			} else {
+				value, rest = rest[1:end+1], rest[end+2:]
+			}
+		} else {
+			end := strings.IndexByte(rest, ',')
+			if end < 0 {
+				value, rest = rest, ""
+			} else {
+				value, rest = rest[:end], rest[end:]
+			}
+		}
+		params[key] = value
+	}
+
+	return scheme, params
+}
+
+func basicAuth(username, password string) string {
+	return base64.StdEncoding.EncodeToString([]byte(username + ":" + password))
+}
+
+// dockerCredentials reads the username and password of host saved by
+// docker login in the docker config, $DOCKER_CONFIG/config.json or
+// ~/.docker/config.json
+func dockerCredentials(host string) (string, string) {
+	dir := os.Getenv("DOCKER_CONFIG")
+	if dir == "" {
+		dir = filepath.Join(os.Getenv("HOME"), ".docker")
+	}
+	data, err := ioutil.ReadFile(filepath.Join(dir, "config.json"))
+	if err != nil {
+		return "", ""
+	}
+
+	var config struct {
+		Auths map[string]struct {
+			Auth string `json:"auth"`
+		} `json:"auths"`
+	}
+	err = json.Unmarshal(data, &config)
+	if err != nil {
+		logger.Warnf("Fail to parse docker config for %v", err)
+		return "", ""
+	}
+
+	for _, key := range []string{host, "https://" + host, "http://" + host} {
+		auth, ok := config.Auths[key]
+		if !ok {
+			continue
+		}
+		decoded, err := base64.StdEncoding.DecodeString(auth.Auth)
+		if err != nil {
+			return "", ""
+		}
+		slices := strings.SplitN(string(decoded), ":", 2)
+		if len(slices) == 2 {
+			return slices[0], slices[1]
+		}
+	}
+
+	return "", ""
+}
@@ -0,0 +1,423 @@
+package registry
+
+import (
+	"os"
+	"io"
+	"fmt"
+	"bytes"
+	"strings"
+	"net"
+	"net/http"
+	"io/ioutil"
+	"sync"
+	"encoding/json"
+	"path/filepath"
+
+	digest "github.com/opencontainers/go-digest"
+	specs "github.com/opencontainers/image-spec/specs-go/v1"
+	"github.com/sirupsen/logrus"
+)
+
+var (
+	logger = logrus.WithField("gear", "registry")
+)
+
+// InsecureRegistries are the hosts talked to over plain http instead of
+// https, registries on the loopback interface are always insecure
+var InsecureRegistries []string
+
+// Registry talks to a docker registry using the distribution v2 api
+type Registry struct {
+	Host string
+	// Scheme is https, or http for insecure registries
+	Scheme string
+
+	// Username and Password are sent to the registry or its token server
+	// if it asks for authentication, they are read from the docker config
+	// by Init
+	Username string
+	Password string
+
+	Client *http.Client
+
+	// 认证后得到的Authorization头
+	mu            sync.Mutex
+	authorization string
+}
+
+func Init(host string) *Registry {
+	r := &Registry{
+		Host: host,
+		Scheme: "https",
+		Client: &http.Client{},
+	}
+	if insecure(host) {
+		r.Scheme = "http"
+	}
+	r.Username, r.Password = dockerCredentials(host)
+
+	return r
+}
+
+// insecure reports whether host is in InsecureRegistries or a loopback host
+func insecure(host string) bool {
+	for _, h := range InsecureRegistries {
+		if h == host {
+			return true
+		}
+	}
+
+	hostname := host
+	if h, _, err := net.SplitHostPort(host); err == nil {
+		hostname = h
+	}
+	if hostname == "localhost" {
+		return true
+	}
+	ip := net.ParseIP(hostname)
+
+	return ip != nil && ip.IsLoopback()
+}
+
+// SplitImage splits an image name like 202.114.10.146:9999/tomcat-gear or
+// localhost/tomcat-gear into registry host and repository
+func SplitImage(imageName string) (host string, repo string) {
+	slices := strings.SplitN(imageName, "/", 2)
+	if len(slices) == 2 && (strings.ContainsAny(slices[0], ".:") || slices[0] == "localhost") {
+		return slices[0], slices[1]
+	}
+
+	return "", imageName
+}
+
+func (r *Registry) url(format string, args ...interface{}) string {
+	return r.Scheme + "://" + r.Host + "/v2/" + fmt.Sprintf(format, args...)
+}
+
+// manifestAccept lists the manifest media types gear understands
+var manifestAccept = []string{
+	specs.MediaTypeImageManifest,
+	specs.MediaTypeImageIndex,
+	"application/vnd.docker.distribution.manifest.v2+json",
+	"application/vnd.docker.distribution.manifest.list.v2+json",
+}
+
+// Catalog lists all repositories in the registry
+func (r *Registry) Catalog() ([]string, error) {
+	var repos struct {
+		Repos []string `json:"repositories"`
+	}
+	err := r.getJSON(r.url("_catalog"), &repos)
+
+	return repos.Repos, err
+}
+
+// Tags lists all tags of repo
+func (r *Registry) Tags(repo string) ([]string, error) {
+	var tags struct {
+		Name string   `json:"name"`
+		Tags []string `json:"tags"`
+	}
+	err := r.getJSON(r.url("%s/tags/list", repo), &tags)
+
+	return tags.Tags, err
+}
+
+func (r *Registry) getJSON(url string, v interface{}) error {
+	req, err := http.NewRequest(http.MethodGet, url, nil)
+	if err != nil {
+		return err
+	}
+
+	resp, err := r.do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("Fail to get %s: %s", url, resp.Status)
+	}
+
+	return json.NewDecoder(resp.Body).Decode(v)
+}
+
+// GetManifest gets the manifest or image index of repo:ref, ref is a tag or
+// a digest
+func (r *Registry) GetManifest(repo, ref string) (specs.Descriptor, []byte, error) {
+	req, err := http.NewRequest(http.MethodGet, r.url("%s/manifests/%s", repo, ref), nil)
+	if err != nil {
+		return specs.Descriptor{}, nil, err
+	}
+	req.Header.Set("Accept", strings.Join(manifestAccept, ", "))
+
+	resp, err := r.do(req)
+	if err != nil {
+		return specs.Descriptor{}, nil, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return specs.Descriptor{}, nil, fmt.Errorf("Fail to get manifest %s:%s: %s", repo, ref, resp.Status)
+	}
+
+	data, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return specs.Descriptor{}, nil, err
+	}
+
+	desc := specs.Descriptor{
+		MediaType: strings.Split(resp.Header.Get("Content-Type"), ";")[0],
+		Digest:    digest.FromBytes(data),
+		Size:      int64(len(data)),
+	}
+
+	// 按digest获取时校验内容
+	if d, err := digest.Parse(ref); err == nil && d != desc.Digest {
+		return specs.Descriptor{}, nil, fmt.Errorf("Manifest %s:%s has digest %s", repo, ref, desc.Digest)
+	}
+
+	return desc, data, nil
+}
+
+// GetBlob streams blob d of repo, the content is verified against d when
+// the returned reader reaches EOF
+func (r *Registry) GetBlob(repo string, d digest.Digest) (io.ReadCloser, error) {
+	req, err := http.NewRequest(http.MethodGet, r.url("%s/blobs/%s", repo, d), nil)
+	if err != nil {
+		return nil, err
+	}
+
+	resp, err := r.do(req)
+	if err != nil {
+		return nil, err
+	}
+
+	if resp.StatusCode != http.StatusOK {
+		resp.Body.Close()
+		return nil, fmt.Errorf("Fail to get blob %s: %s", d, resp.Status)
+	}
+
+	return &verifiedReader{
+		ReadCloser: resp.Body,
+		digest:     d,
+		verifier:   d.Verifier(),
+	}, nil
+}
+
+// verifiedReader returns an error instead of io.EOF when the content read
+// does not match the digest
+type verifiedReader struct {
+	io.ReadCloser
+
+	digest   digest.Digest
+	verifier digest.Verifier
+}
+
+func (v *verifiedReader) Read(p []byte) (int, error) {
+	n, err := v.ReadCloser.Read(p)
+	v.verifier.Write(p[:n])
+	if err == io.EOF && !v.verifier.Verified() {
+		return n, fmt.Errorf("Content of blob %s does not match its digest", v.digest)
+	}
+
+	return n, err
+}
+
+// BlobExists checks whether repo already has the blob
+func (r *Registry) BlobExists(repo string, d digest.Digest) (bool, error) {
+	req, err := http.NewRequest(http.MethodHead, r.url("%s/blobs/%s", repo, d), nil)
+	if err != nil {
+		return false, err
+	}
+
+	resp, err := r.do(req)
+	if err != nil {
+		return false, err
+	}
+	resp.Body.Close()
+
+	switch resp.StatusCode {
+	case http.StatusOK:
+		return true, nil
+	case http.StatusNotFound:
+		return false, nil
+	}
+
+	return false, fmt.Errorf("Unexpected status %s when checking blob %s", resp.Status, d)
+}
+
+// PushBlob uploads content as blob d of repo in a single request
+func (r *Registry) PushBlob(repo string, d digest.Digest, size int64, content io.Reader) error {
+	// 1. 开始上传，需要认证时在这里获取push权限
+	req, err := http.NewRequest(http.MethodPost, r.url("%s/blobs/uploads/", repo), nil)
+	if err != nil {
+		return err
+	}
+
+	resp, err := r.do(req)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusAccepted {
+		return fmt.Errorf("Fail to start upload of blob %s: %s", d, resp.Status)
+	}
+
+	location, err := resp.Location()
+	if err != nil {
+		return err
+	}
+	q := location.Query()
+	q.Set("digest", d.String())
+	location.RawQuery = q.Encode()
+
+	// 2. 上传blob内容
+	req, err = http.NewRequest(http.MethodPut, location.String(), content)
+	if err != nil {
+		return err
+	}
+	req.ContentLength = size
+	req.Header.Set("Content-Type", "application/octet-stream")
+
+	resp, err = r.do(req)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusCreated {
+		return fmt.Errorf("Fail to upload blob %s: %s", d, resp.Status)
+	}
+
+	return nil
+}
+
+// PushManifest puts a manifest or an image index to repo:ref
+func (r *Registry) PushManifest(repo, ref, mediaType string, data []byte) error {
+	req, err := http.NewRequest(http.MethodPut, r.url("%s/manifests/%s", repo, ref), bytes.NewReader(data))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", mediaType)
+
+	resp, err := r.do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusCreated {
+		msg, _ := ioutil.ReadAll(resp.Body)
+		return fmt.Errorf("Fail to push manifest %s:%s: %s %s", repo, ref, resp.Status, msg)
+	}
+
+	return nil
+}
+
+// PushOCILayout pushes the image which ref name is repo:tag in an oci image
+// layout dir to the registry, blobs which already exist are skipped
+func (r *Registry) PushOCILayout(layoutPath, repo, tag string) error {
+	desc, err := taggedDescriptor(layoutPath, tag)
+	if err != nil {
+		return err
+	}
+
+	return r.pushDescriptor(layoutPath, repo, tag, desc)
+}
+
+// PushOCILayoutManifest pushes the image which ref name is repo:tag in an
+// oci image layout dir by its digest without tagging it, and returns its
+// descriptor, so that it can be referenced by an image index
+func (r *Registry) PushOCILayoutManifest(layoutPath, repo, tag string) (specs.Descriptor, error) {
+	desc, err := taggedDescriptor(layoutPath, tag)
+	if err != nil {
+		return specs.Descriptor{}, err
+	}
+
+	return desc, r.pushDescriptor(layoutPath, repo, desc.Digest.String(), desc)
+}
+
+// taggedDescriptor finds the image which ref name is repo:tag or tag in
+// index.json of an oci image layout dir
+func taggedDescriptor(layoutPath, tag string) (specs.Descriptor, error) {
+	var index specs.Index
+	data, err := ioutil.ReadFile(filepath.Join(layoutPath, "index.json"))
+	if err != nil {
+		return specs.Descriptor{}, err
+	}
+	err = json.Unmarshal(data, &index)
+	if err != nil {
+		return specs.Descriptor{}, err
+	}
+
+	for _, desc := range index.Manifests {
+		if ref, ok := desc.Annotations[specs.AnnotationRefName]; ok && !strings.HasSuffix(ref, ":"+tag) && ref != tag {
+			continue
+		}
+
+		return desc, nil
+	}
+
+	return specs.Descriptor{}, fmt.Errorf("No image with tag %s in %s", tag, layoutPath)
+}
+
+func (r *Registry) pushDescriptor(layoutPath, repo, ref string, desc specs.Descriptor) error {
+	data, err := ioutil.ReadFile(BlobPath(layoutPath, desc.Digest))
+	if err != nil {
+		return err
+	}
+
+	// 先上传manifest引用的所有blob，再上传manifest本身
+	var children struct {
+		Config    *specs.Descriptor  `json:"config"`
+		Layers    []specs.Descriptor `json:"layers"`
+		Manifests []specs.Descriptor `json:"manifests"`
+	}
+	err = json.Unmarshal(data, &children)
+	if err != nil {
+		return err
+	}
+
+	blobs := children.Layers
+	if children.Config != nil {
+		blobs = append(blobs, *children.Config)
+	}
+	for _, blob := range blobs {
+		err := r.pushBlobFile(repo, blob, BlobPath(layoutPath, blob.Digest))
+		if err != nil {
+			logger.Warnf("Fail to push blob %s for %v", blob.Digest, err)
+			return err
+		}
+	}
+	for _, manifest := range children.Manifests {
+		err := r.pushDescriptor(layoutPath, repo, manifest.Digest.String(), manifest)
+		if err != nil {
+			return err
+		}
+	}
+
+	return r.PushManifest(repo, ref, desc.MediaType, data)
+}
+
+func (r *Registry) pushBlobFile(repo string, desc specs.Descriptor, path string) error {
+	ok, err := r.BlobExists(repo, desc.Digest)
+	if err != nil {
+		return err
+	}
+	if ok {
+		return nil
+	}
+
+	f, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	return r.PushBlob(repo, desc.Digest, desc.Size, f)
+}
+
+// BlobPath returns where blob d is stored in an oci image layout dir
+func BlobPath(layoutPath string, d digest.Digest) string {
+	return filepath.Join(layoutPath, "blobs", d.Algorithm().String(), d.Hex())
+}
@@ -0,0 +1,259 @@
+package registry
+
+import (
+	"io"
+	"bytes"
+	"strings"
+	"testing"
+	"net/http"
+	"io/ioutil"
+	"sync"
+	"net/http/httptest"
+
+	digest "github.com/opencontainers/go-digest"
+	specs "github.com/opencontainers/image-spec/specs-go/v1"
+)
+
+// testRegistry is an in-memory registry of the distribution v2 api, which
+// asks for a bearer token from its /token endpoint
+type testRegistry struct {
+	username string
+	password string
+	token    string
+
+	mu        sync.Mutex
+	blobs     map[digest.Digest][]byte
+	manifests map[string][]byte
+	types     map[string]string
+}
+
+func newTestRegistry() *testRegistry {
+	return &testRegistry{
+		username:  "gear",
+		password:  "secret",
+		token:     "t0ken",
+		blobs:     map[digest.Digest][]byte{},
+		manifests: map[string][]byte{},
+		types:     map[string]string{},
+	}
+}
+
+func (t *testRegistry) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.URL.Path == "/token" {
+		username, password, ok := r.BasicAuth()
+		if !ok || username != t.username || password != t.password {
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+		if r.URL.Query().Get("service") != "test-registry" {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		w.Write([]byte(`{"token":"` + t.token + `"}`))
+		return
+	}
+
+	if r.Header.Get("Authorization") != "Bearer "+t.token {
+		scheme := "http"
+		if r.TLS != nil {
+			scheme = "https"
+		}
+		w.Header().Set("WWW-Authenticate", `Bearer realm="`+scheme+`://`+r.Host+`/token",service="test-registry",scope="repository:foo:pull,push"`)
+		w.WriteHeader(http.StatusUnauthorized)
+		return
+	}
+
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	path := strings.TrimPrefix(r.URL.Path, "/v2/")
+	switch {
+	case strings.HasSuffix(path, "/blobs/uploads/") && r.Method == http.MethodPost:
+		w.Header().Set("Location", "/v2/"+path+"1")
+		w.WriteHeader(http.StatusAccepted)
+	case strings.Contains(path, "/blobs/uploads/") && r.Method == http.MethodPut:
+		data, _ := ioutil.ReadAll(r.Body)
+		d := digest.Digest(r.URL.Query().Get("digest"))
+		if digest.FromBytes(data) != d {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		t.blobs[d] = data
+		w.WriteHeader(http.StatusCreated)
+	case strings.Contains(path, "/blobs/"):
+		data, ok := t.blobs[digest.Digest(path[strings.LastIndex(path, "/")+1:])]
+		if !ok {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		w.Write(data)
+	case strings.Contains(path, "/manifests/") && r.Method == http.MethodPut:
+		data, _ := ioutil.ReadAll(r.Body)
+		t.manifests[path] = data
+		t.types[path] = r.Header.Get("Content-Type")
+		w.WriteHeader(http.StatusCreated)
+	case strings.Contains(path, "/manifests/"):
+		data, ok := t.manifests[path]
+		if !ok {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		w.Header().Set("Content-Type", t.types[path])
+		w.Write(data)
+	default:
+		w.WriteHeader(http.StatusNotFound)
+	}
+}
+
+func TestPushAndPull(t *testing.T) {
+	for _, tls := range []bool{false, true} {
+		reg := newTestRegistry()
+		var srv *httptest.Server
+		if tls {
+			srv = httptest.NewTLSServer(reg)
+		} else {
+			srv = httptest.NewServer(reg)
+		}
+
+		r := Init(strings.TrimPrefix(strings.TrimPrefix(srv.URL, "http://"), "https://"))
+		if tls {
+			r.Scheme = "https"
+			r.Client = srv.Client()
+		}
+		r.Username, r.Password = reg.username, reg.password
+
+		blob := []byte("layer content")
+		d := digest.FromBytes(blob)
+		ok, err := r.BlobExists("foo", d)
+		if err != nil || ok {
+			t.Fatalf("BlobExists before push = %v, %v", ok, err)
+		}
+		err = r.PushBlob("foo", d, int64(len(blob)), bytes.NewReader(blob))
+		if err != nil {
+			t.Fatalf("PushBlob: %v", err)
+		}
+		ok, err = r.BlobExists("foo", d)
+		if err != nil || !ok {
+			t.Fatalf("BlobExists after push = %v, %v", ok, err)
+		}
+
+		rc, err := r.GetBlob("foo", d)
+		if err != nil {
+			t.Fatalf("GetBlob: %v", err)
+		}
+		data, err := ioutil.ReadAll(rc)
+		rc.Close()
+		if err != nil || !bytes.Equal(data, blob) {
+			t.Fatalf("GetBlob read %q, %v", data, err)
+		}
+
+		manifest := []byte(`{"schemaVersion":2}`)
+		err = r.PushManifest("foo", "latest", specs.MediaTypeImageManifest, manifest)
+		if err != nil {
+			t.Fatalf("PushManifest: %v", err)
+		}
+		desc, data, err := r.GetManifest("foo", "latest")
+		if err != nil || !bytes.Equal(data, manifest) {
+			t.Fatalf("GetManifest read %q, %v", data, err)
+		}
+		if desc.MediaType != specs.MediaTypeImageManifest || desc.Digest != digest.FromBytes(manifest) {
+			t.Fatalf("GetManifest returned %+v", desc)
+		}
+
+		srv.Close()
+	}
+}
+
+func TestCorruptedBlob(t *testing.T) {
+	reg := newTestRegistry()
+	srv := httptest.NewServer(reg)
+	defer srv.Close()
+
+	r := Init(strings.TrimPrefix(srv.URL, "http://"))
+	r.Username, r.Password = reg.username, reg.password
+
+	d := digest.FromBytes([]byte("layer content"))
+	reg.blobs[d] = []byte("other content")
+
+	rc, err := r.GetBlob("foo", d)
+	if err != nil {
+		t.Fatalf("GetBlob: %v", err)
+	}
+	defer rc.Close()
+	_, err = io.Copy(ioutil.Discard, rc)
+	if err == nil {
+		t.Fatal("GetBlob did not detect the corrupted blob")
+	}
+}
+
+func TestWrongCredentials(t *testing.T) {
+	reg := newTestRegistry()
+	srv := httptest.NewServer(reg)
+	defer srv.Close()
+
+	r := Init(strings.TrimPrefix(srv.URL, "http://"))
+	r.Username, r.Password = reg.username, "wrong"
+
+	_, _, err := r.GetManifest("foo", "latest")
+	if err == nil {
+		t.Fatal("GetManifest succeeded with wrong credentials")
+	}
+}
+
+func TestSplitImage(t *testing.T) {
+	tests := []struct {
+		image, host, repo string
+	}{
+		{"202.114.10.146:9999/tomcat-gear", "202.114.10.146:9999", "tomcat-gear"},
+		{"registry.example.com/library/nginx", "registry.example.com", "library/nginx"},
+		{"localhost/foo", "localhost", "foo"},
+		{"localhost:5000/foo/bar", "localhost:5000", "foo/bar"},
+		{"library/nginx", "", "library/nginx"},
+		{"nginx", "", "nginx"},
+	}
+	for _, test := range tests {
+		host, repo := SplitImage(test.image)
+		if host != test.host || repo != test.repo {
+			t.Errorf("SplitImage(%q) = %q, %q, want %q, %q", test.image, host, repo, test.host, test.repo)
+		}
+	}
+}
+
+func TestScheme(t *testing.T) {
+	InsecureRegistries = []string{"10.0.0.1:5000"}
+	defer func() { InsecureRegistries = nil }()
+
+	tests := []struct {
+		host, scheme string
+	}{
+		{"registry.example.com", "https"},
+		{"10.0.0.1:5000", "http"},
+		{"10.0.0.1:5001", "https"},
+		{"localhost", "http"},
+		{"localhost:5000", "http"},
+		{"127.0.0.1:5000", "http"},
+		{"[::1]:5000", "http"},
+	}
+	for _, test := range tests {
+		if scheme := Init(test.host).Scheme; scheme != test.scheme {
+			t.Errorf("Init(%q).Scheme = %q, want %q", test.host, scheme, test.scheme)
+		}
+	}
+}
+
+func TestParseChallenge(t *testing.T) {
+	scheme, params := parseChallenge(`Bearer realm="https://auth.example.com/token",service="registry.example.com",scope="repository:foo:pull,push"`)
+	if scheme != "Bearer" {
+		t.Errorf("scheme = %q", scheme)
+	}
+	want := map[string]string{
+		"realm":   "https://auth.example.com/token",
+		"service": "registry.example.com",
+		"scope":   "repository:foo:pull,push",
+	}
+	for key, value := range want {
+		if params[key] != value {
+			t.Errorf("params[%q] = %q, want %q", key, params[key], value)
+		}
+	}
+}
@@ -0,0 +1,373 @@
+package remote
+
+import (
+	"io"
+	"fmt"
+	"sync"
+	"time"
+	"errors"
+	"strings"
+	"net/url"
+	"net/http"
+	"math/rand"
+
+	"golang.org/x/net/context"
+	"github.com/sirupsen/logrus"
+)
+
+var (
+	logger = logrus.WithField("gear", "remote")
+
+	// ErrUnavailable is returned if the circuit of every endpoint is open
+	ErrUnavailable = errors.New("No endpoint is available")
+
+	// ErrIdle is returned by reads of a response body which received no
+	// data for IdleTimeout
+	ErrIdle = errors.New("No data received from endpoint")
+)
+
+const (
+	DefaultTimeout          = 60 * time.Second
+	DefaultIdleTimeout      = 30 * time.Second
+	DefaultRetries          = 3
+	DefaultBackoff          = 200 * time.Millisecond
+	DefaultMaxBackoff       = 5 * time.Second
+	DefaultFailureThreshold = 3
+	DefaultOpenDuration     = 30 * time.Second
+)
+
+// Client sends requests to a manager node and its mirrors, which serve the
+// same objects. Every attempt has a deadline for the response, whose body is
+// read as long as data keeps arriving, so large objects are not cut off on
+// slow links. Failed attempts are retried
+// with jittered backoff on the next endpoint, and an endpoint which failed
+// FailureThreshold times in a row is skipped for OpenDuration, after which a
+// single request probes whether it is back.
+type Client struct {
+	// Timeout is the deadline of each attempt until the response headers
+	// arrive, the deadline of the context of the request applies if it is
+	// earlier, so that an endpoint which does not answer is left for the
+	// next one even if the request may take long
+	Timeout time.Duration
+	// IdleTimeout is how long a read of the body waits for data before the
+	// request is cancelled
+	IdleTimeout time.Duration
+	// Retries is how many times a failed request is retried
+	Retries int
+	// the n-th retry waits a random duration up to Backoff*2^n, at most
+	// MaxBackoff
+	Backoff    time.Duration
+	MaxBackoff time.Duration
+
+	FailureThreshold int
+	OpenDuration     time.Duration
+
+	client *http.Client
+
+	mu        sync.Mutex
+	endpoints []*endpoint
+}
+
+// endpoint is a manager or mirror at host:port and its health
+type endpoint struct {
+	addr string
+
+	failures  int
+	openUntil time.Time
+	probing   bool
+}
+
+// Error is returned when a request failed on every attempt, Err is the
+// error of the last attempt
+type Error struct {
+	Path string
+	Err  error
+}
+
+func (e *Error) Error() string {
+	return fmt.Sprintf("Fail to request %s: %v", e.Path, e.Err)
+}
+
+// StatusError is the error of an attempt whose response has an unexpected
+// status
+type StatusError struct {
+	Status     string
+	StatusCode int
+}
+
+func (e *StatusError) Error() string {
+	return "Unexpected status " + e.Status
+}
+
+// NewClient returns a client of the endpoints in the form of host:port, the
+// first one is preferred while it is healthy
+func NewClient(addrs ...string) *Client {
+	c := &Client{
+		Timeout:          DefaultTimeout,
+		IdleTimeout:      DefaultIdleTimeout,
+		Retries:          DefaultRetries,
+		Backoff:          DefaultBackoff,
+		MaxBackoff:       DefaultMaxBackoff,
+		FailureThreshold: DefaultFailureThreshold,
+		OpenDuration:     DefaultOpenDuration,
+		client:           &http.Client{},
+	}
+	for _, addr := range addrs {
+		if addr != "" {
+			c.endpoints = append(c.endpoints, &endpoint{addr: addr})
+		}
+	}
+
+	return c
+}
+
+// Addr joins ip and port into an endpoint, the port is 2019 if it is empty
+func Addr(ip, port string) string {
+	if ip == "" {
+		return ""
+	}
+	if port == "" {
+		port = "2019"
+	}
+	return ip + ":" + port
+}
+
+// PostForm posts form to path on an endpoint, header is added to the
+// request. It returns the first response with a 2xx status, the body must be
+// closed. A 4xx status is not retried on the same endpoint but the request
+// goes on with the other endpoints, since a mirror may miss an object.
+func (c *Client) PostForm(ctx context.Context, path string, form url.Values, header http.Header) (*http.Response, error) {
+	return c.request(ctx, http.MethodPost, path, form, header)
+}
+
+// Get gets path from an endpoint like PostForm
+func (c *Client) Get(ctx context.Context, path string, header http.Header) (*http.Response, error) {
+	return c.request(ctx, http.MethodGet, path, nil, header)
+}
+
+func (c *Client) request(ctx context.Context, method, path string, form url.Values, header http.Header) (*http.Response, error) {
+	var err error
+	// 本次请求中返回4xx的节点不再重试，失败过的节点只在没有其他节点时重试
+	tried := map[*endpoint]bool{}
+	failed := map[*endpoint]bool{}
+
+	for attempt := 0; attempt <= c.Retries; attempt++ {
+		if len(failed) > 0 {
+			err := c.sleep(ctx, attempt)
+			if err != nil {
+				return nil, &Error{Path: path, Err: err}
+			}
+		}
+
+		e := c.pick(tried, failed)
+		if e == nil {
+			if err == nil {
+				err = ErrUnavailable
+			}
+			break
+		}
+
+		var resp *http.Response
+		resp, err = c.do(ctx, e, method, path, form, header)
+		if err == nil {
+			c.succeed(e)
+			return resp, nil
+		}
+		if ctx.Err() != nil {
+			c.release(e)
+			return nil, &Error{Path: path, Err: ctx.Err()}
+		}
+
+		// 4xx说明节点是健康的，只是不能处理这个请求
+		if se, ok := err.(*StatusError); ok && se.StatusCode < 500 {
+			c.release(e)
+			tried[e] = true
+			continue
+		}
+
+		logger.Warnf("Fail to request %s from %s for %v", path, e.addr, err)
+		c.fail(e)
+		failed[e] = true
+	}
+
+	return nil, &Error{Path: path, Err: err}
+}
+
+func (c *Client) do(ctx context.Context, e *endpoint, method, path string, form url.Values, header http.Header) (*http.Response, error) {
+	ctx, cancel := context.WithCancel(ctx)
+
+	// 只有等待响应头时有deadline，响应体在空闲超时前一直读取。ctx的
+	// deadline更早时先于计时器取消请求
+	var deadline *time.Timer
+	if c.Timeout > 0 {
+		deadline = time.AfterFunc(c.Timeout, cancel)
+	}
+
+	var reqBody io.Reader
+	if method == http.MethodPost {
+		reqBody = strings.NewReader(form.Encode())
+	}
+	req, err := http.NewRequest(method, "http://"+e.addr+path, reqBody)
+	if err != nil {
+		cancel()
+		return nil, err
+	}
+	req = req.WithContext(ctx)
+	for key, values := range header {
+		req.Header[key] = values
+	}
+	if method == http.MethodPost {
+		req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	}
+
+	resp, err := c.client.Do(req)
+	if deadline != nil && !deadline.Stop() {
+		if err == nil {
+			resp.Body.Close()
+		}
+		err = context.DeadlineExceeded
+	}
+	if err != nil {
+		cancel()
+		return nil, err
+	}
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		resp.Body.Close()
+		cancel()
+		return nil, &StatusError{Status: resp.Status, StatusCode: resp.StatusCode}
+	}
+
+	// 关闭响应体后才取消请求
+	body := &cancelBody{ReadCloser: resp.Body, cancel: cancel, timeout: c.IdleTimeout}
+	if c.IdleTimeout > 0 {
+		body.idle = time.AfterFunc(c.IdleTimeout, body.expire)
+	}
+	resp.Body = body
+
+	return resp, nil
+}
+
+// pick returns the first endpoint which is not tried and is healthy or whose
+// circuit was open long enough to be probed, preferring the ones which did not
+// fail in this request
+func (c *Client) pick(tried, failed map[*endpoint]bool) *endpoint {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	now := time.Now()
+	for _, retry := range []bool{false, true} {
+		for _, e := range c.endpoints {
+			if tried[e] || failed[e] != retry {
+				continue
+			}
+			if e.failures < c.FailureThreshold {
+				return e
+			}
+			// 按顺序探测恢复的节点，否则有其他健康节点时它不会再被使用
+			if !e.probing && now.After(e.openUntil) {
+				e.probing = true
+				return e
+			}
+		}
+	}
+
+	return nil
+}
+
+func (c *Client) succeed(e *endpoint) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if e.failures >= c.FailureThreshold {
+		logger.Infof("Endpoint %s is back", e.addr)
+	}
+	e.failures = 0
+	e.probing = false
+}
+
+func (c *Client) release(e *endpoint) {
+	c.mu.Lock()
+	e.probing = false
+	c.mu.Unlock()
+}
+
+func (c *Client) fail(e *endpoint) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	e.failures++
+	e.probing = false
+	if e.failures >= c.FailureThreshold {
+		if e.failures == c.FailureThreshold {
+			logger.Warnf("Endpoint %s failed %d times, skip it for %v", e.addr, e.failures, c.OpenDuration)
+		}
+		e.openUntil = time.Now().Add(c.OpenDuration)
+	}
+}
+
+// sleep waits the jittered backoff before the attempt-th retry
+func (c *Client) sleep(ctx context.Context, attempt int) error {
+	backoff := c.Backoff << uint(attempt-1)
+	if backoff > c.MaxBackoff || backoff <= 0 {
+		backoff = c.MaxBackoff
+	}
+	if backoff <= 0 {
+		return nil
+	}
+
+	t := time.NewTimer(time.Duration(rand.Int63n(int64(backoff)) + 1))
+	defer t.Stop()
+
+	select {
+	case <-t.C:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// cancelBody cancels the request when it is closed, or when no data is read
+// for timeout
+type cancelBody struct {
+	io.ReadCloser
+	cancel context.CancelFunc
+
+	timeout time.Duration
+	idle    *time.Timer
+	mu      sync.Mutex
+	expired bool
+}
+
+func (b *cancelBody) Read(p []byte) (int, error) {
+	n, err := b.ReadCloser.Read(p)
+	if b.idle == nil {
+		return n, err
+	}
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.expired {
+		return n, ErrIdle
+	}
+	if n > 0 {
+		b.idle.Reset(b.timeout)
+	}
+
+	return n, err
+}
+
+func (b *cancelBody) expire() {
+	b.mu.Lock()
+	b.expired = true
+	b.mu.Unlock()
+	b.cancel()
+}
+
+func (b *cancelBody) Close() error {
+	if b.idle != nil {
+		b.idle.Stop()
+	}
+	err := b.ReadCloser.Close()
+	b.cancel()
+	return err
+}
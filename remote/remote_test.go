@@ -0,0 +1,213 @@
+package remote
+
+import (
+	"sync"
+	"time"
+	"strings"
+	"testing"
+	"net/http"
+	"io/ioutil"
+	"sync/atomic"
+	"net/http/httptest"
+
+	"golang.org/x/net/context"
+)
+
+// testEndpoint is an endpoint which answers with handler and counts the
+// requests it got
+type testEndpoint struct {
+	srv  *httptest.Server
+	hits int32
+}
+
+func newTestEndpoint(handler func(w http.ResponseWriter, r *http.Request)) *testEndpoint {
+	e := &testEndpoint{}
+	e.srv = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&e.hits, 1)
+		handler(w, r)
+	}))
+	return e
+}
+
+func (e *testEndpoint) addr() string {
+	return strings.TrimPrefix(e.srv.URL, "http://")
+}
+
+func (e *testEndpoint) count() int {
+	return int(atomic.LoadInt32(&e.hits))
+}
+
+func ok(w http.ResponseWriter, r *http.Request) {
+	w.Write([]byte("ok"))
+}
+
+// hang answers nothing until the request is cancelled
+func hang(w http.ResponseWriter, r *http.Request) {
+	<-r.Context().Done()
+}
+
+func testClient(addrs ...string) *Client {
+	c := NewClient(addrs...)
+	c.Timeout = 200 * time.Millisecond
+	c.Backoff = time.Millisecond
+	c.MaxBackoff = 10 * time.Millisecond
+	return c
+}
+
+func readBody(t *testing.T, c *Client, ctx context.Context) string {
+	resp, err := c.PostForm(ctx, "/pull/foo", nil, nil)
+	if err != nil {
+		t.Fatalf("PostForm: %v", err)
+	}
+	defer resp.Body.Close()
+	data, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		t.Fatalf("Read body: %v", err)
+	}
+	return string(data)
+}
+
+func TestHangingEndpointFailover(t *testing.T) {
+	dead := newTestEndpoint(hang)
+	defer dead.srv.Close()
+	alive := newTestEndpoint(ok)
+	defer alive.srv.Close()
+
+	c := testClient(dead.addr(), alive.addr())
+
+	// fetch的ctx总有较长的deadline，不能让它代替每次尝试的超时
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Minute)
+	defer cancel()
+
+	start := time.Now()
+	if body := readBody(t, c, ctx); body != "ok" {
+		t.Fatalf("body = %q", body)
+	}
+	if elapsed := time.Since(start); elapsed > 2*time.Second {
+		t.Fatalf("Failover took %v", elapsed)
+	}
+	if dead.count() != 1 || alive.count() != 1 {
+		t.Fatalf("hits = %d, %d, want 1, 1", dead.count(), alive.count())
+	}
+}
+
+func TestClientErrorMovesOn(t *testing.T) {
+	missing := newTestEndpoint(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusNotFound)
+	})
+	defer missing.srv.Close()
+	alive := newTestEndpoint(ok)
+	defer alive.srv.Close()
+
+	c := testClient(missing.addr(), alive.addr())
+	c.FailureThreshold = 1
+
+	for i := 0; i < 3; i++ {
+		if body := readBody(t, c, context.Background()); body != "ok" {
+			t.Fatalf("body = %q", body)
+		}
+	}
+	// 4xx不计入失败，节点仍然被优先使用
+	if missing.count() != 3 || alive.count() != 3 {
+		t.Fatalf("hits = %d, %d, want 3, 3", missing.count(), alive.count())
+	}
+
+	// 所有节点都返回4xx时返回最后一个状态
+	c = testClient(missing.addr())
+	_, err := c.PostForm(context.Background(), "/pull/foo", nil, nil)
+	e, isError := err.(*Error)
+	if !isError {
+		t.Fatalf("err = %v", err)
+	}
+	if se, isStatus := e.Err.(*StatusError); !isStatus || se.StatusCode != http.StatusNotFound {
+		t.Fatalf("err = %v", err)
+	}
+}
+
+func TestCircuitBreaker(t *testing.T) {
+	var down int32 = 1
+	flaky := newTestEndpoint(func(w http.ResponseWriter, r *http.Request) {
+		// 探测请求较慢，并发的请求不会同时探测
+		time.Sleep(100 * time.Millisecond)
+		if atomic.LoadInt32(&down) == 1 {
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+		ok(w, r)
+	})
+	defer flaky.srv.Close()
+	alive := newTestEndpoint(ok)
+	defer alive.srv.Close()
+
+	c := testClient(flaky.addr(), alive.addr())
+	c.FailureThreshold = 2
+	c.OpenDuration = 300 * time.Millisecond
+
+	for i := 0; i < 4; i++ {
+		readBody(t, c, context.Background())
+	}
+	// 连续失败FailureThreshold次后不再请求该节点
+	if flaky.count() != 2 {
+		t.Fatalf("flaky hits = %d, want 2", flaky.count())
+	}
+
+	time.Sleep(c.OpenDuration)
+	atomic.StoreInt32(&down, 0)
+
+	// OpenDuration之后只有一个请求探测节点
+	var wg sync.WaitGroup
+	for i := 0; i < 4; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			readBody(t, c, context.Background())
+		}()
+	}
+	wg.Wait()
+	if flaky.count() != 3 {
+		t.Fatalf("flaky hits = %d, want 3", flaky.count())
+	}
+
+	// 探测成功后节点恢复为首选
+	readBody(t, c, context.Background())
+	if flaky.count() != 4 {
+		t.Fatalf("flaky hits = %d, want 4", flaky.count())
+	}
+}
+
+func TestIdleTimeout(t *testing.T) {
+	stall := newTestEndpoint(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("x"))
+		w.(http.Flusher).Flush()
+		<-r.Context().Done()
+	})
+	defer stall.srv.Close()
+	trickle := newTestEndpoint(func(w http.ResponseWriter, r *http.Request) {
+		for i := 0; i < 10; i++ {
+			w.Write([]byte("x"))
+			w.(http.Flusher).Flush()
+			time.Sleep(50 * time.Millisecond)
+		}
+	})
+	defer trickle.srv.Close()
+
+	// 响应体读取的总时间超过Timeout，但一直有数据到达
+	c := testClient(trickle.addr())
+	c.Timeout = 100 * time.Millisecond
+	c.IdleTimeout = 200 * time.Millisecond
+	if body := readBody(t, c, context.Background()); body != strings.Repeat("x", 10) {
+		t.Fatalf("body = %q", body)
+	}
+
+	c = testClient(stall.addr())
+	c.IdleTimeout = 200 * time.Millisecond
+	resp, err := c.PostForm(context.Background(), "/pull/foo", nil, nil)
+	if err != nil {
+		t.Fatalf("PostForm: %v", err)
+	}
+	defer resp.Body.Close()
+	_, err = ioutil.ReadAll(resp.Body)
+	if err != ErrIdle {
+		t.Fatalf("Read body err = %v, want ErrIdle", err)
+	}
+}
@@ -46,4 +46,87 @@ type Image struct {
 type MonitorFile struct {
 	Hash string
 	RelativePath string
-}
\ No newline at end of file
+}
+
+// IndexEntry is the content of a regular file in a gear index image whose
+// content is stored as chunks or in a pack, a plain CID is used for other
+// files
+type IndexEntry struct {
+	// Algorithm is the digest algorithm of the CIDs
+	Algorithm string      `json:"algorithm,omitempty"`
+	Size      int64       `json:"size"`
+	Chunks    []Chunk     `json:"chunks,omitempty"`
+	Pack      *PackMember `json:"pack,omitempty"`
+}
+
+// Chunk is a piece of a file stored as an object named by CID
+type Chunk struct {
+	CID    string `json:"cid"`
+	Offset int64  `json:"offset"`
+	Size   int64  `json:"size"`
+}
+
+// PackMember locates a small file stored in a pack object, which is the
+// concatenation of its members
+type PackMember struct {
+	// CID of the pack object
+	Pack   string `json:"pack"`
+	// CID of the file content
+	CID    string `json:"cid"`
+	Offset int64  `json:"offset"`
+}
+
+// Manifest is /.gear/manifest.json of a gear index image, it describes how
+// the image was built and where the content of each path is stored
+type Manifest struct {
+	// Version of the manifest format
+	Version     int    `json:"version"`
+	// Image is the name:tag of the gear image
+	Image       string `json:"image"`
+	// Source is the digest of the image the gear image is built from
+	Source      string `json:"source,omitempty"`
+	// Platform of the image, like linux/arm64/v8
+	Platform    string `json:"platform,omitempty"`
+	// Algorithm is the digest algorithm of the CIDs
+	Algorithm   string `json:"algorithm"`
+	// Compression objects are written with, objects record their own codec
+	Compression string `json:"compression"`
+	// Layers is the number of index layers below the layer of the manifest,
+	// one per layer of the source image, 0 means the index image is flat
+	Layers      int    `json:"layers,omitempty"`
+
+	Files []ManifestFile `json:"files"`
+}
+
+// ManifestFile is a path of a gear image, regular files have either a CID
+// or an index entry, unless they are inline
+type ManifestFile struct {
+	Path  string      `json:"path"`
+	// Mode is st_mode, including the file type bits
+	Mode  uint32      `json:"mode"`
+	// Size is 0 for the paths which are not regular files
+	Size  int64       `json:"size"`
+	// Link is the target of a symlink, or the path a hardlink links to
+	Link  string      `json:"link,omitempty"`
+	// Inline regular files keep their content in the index image
+	Inline bool       `json:"inline,omitempty"`
+	CID   string      `json:"cid,omitempty"`
+	Entry *IndexEntry `json:"entry,omitempty"`
+}
+
+// Profile is the files a container of an image accessed at startup in the
+// order they were accessed, a -gearmd image is built with it so that the
+// files are prefetched
+type Profile struct {
+	// Version of the profile format
+	Version int           `json:"version"`
+	// Image the profile was captured with
+	Image   string        `json:"image,omitempty"`
+	Files   []ProfileFile `json:"files"`
+}
+
+// ProfileFile is an accessed file, CID is the object it was read from
+type ProfileFile struct {
+	Path string `json:"path"`
+	CID  string `json:"cid,omitempty"`
+}